@@ -5,12 +5,33 @@
 // Package apitype contains types for the Tailscale local API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
 	Node        *tailcfg.Node
 	UserProfile *tailcfg.UserProfile
+
+	// Tags are the node's ACL tags, if any, from its
+	// Hostinfo.RequestTags. A tagged node is owned by its tags
+	// rather than by UserProfile.
+	Tags []string `json:",omitempty"`
+
+	// Caps are the node's capabilities, as in Node.Capabilities.
+	Caps []string `json:",omitempty"`
+
+	// Online is whether the node is connected to the coordination
+	// server. It is nil if unknown.
+	Online *bool `json:",omitempty"`
+
+	// AllowedDsts are the destinations on this node, as
+	// "ip/bits:ports" strings, that the local packet filter
+	// permits the node to connect to.
+	AllowedDsts []string `json:",omitempty"`
 }
 
 // FileTarget is a node to which files can be sent, and the PeerAPI
@@ -27,3 +48,57 @@ type WaitingFile struct {
 	Name string
 	Size int64
 }
+
+// DNSQueryLog is the JSON type returned by the LocalAPI's
+// /localapi/v0/dns-query-log handler.
+type DNSQueryLog struct {
+	// Enabled is whether the query log is recording queries.
+	Enabled bool
+
+	// Names is whether query names are being recorded.
+	Names bool
+
+	// Entries are the requested log entries, oldest first.
+	Entries []dnstype.QueryLogEntry
+}
+
+// DNSStatus is the JSON type returned by the LocalAPI's
+// /localapi/v0/dns-status handler. It describes the DNS configuration
+// tailscaled most recently applied.
+type DNSStatus struct {
+	// DefaultResolvers are the ip:ports of the nameservers used for
+	// names not matched by Routes.
+	DefaultResolvers []string `json:",omitempty"`
+
+	// Routes maps DNS suffixes to the ip:ports of the nameservers
+	// to use for names within them. A suffix with no nameservers is
+	// answered by tailscaled itself from Hosts.
+	Routes map[string][]string `json:",omitempty"`
+
+	// SearchDomains are the DNS suffixes tried when expanding
+	// single-label names.
+	SearchDomains []string `json:",omitempty"`
+
+	// Hosts are the records answered by tailscaled itself, sorted
+	// by name.
+	Hosts []DNSHost `json:",omitempty"`
+
+	// LocalHostsFile is the path of the local hosts file whose
+	// entries override records from the control plane, if any.
+	LocalHostsFile string `json:",omitempty"`
+
+	// LocalHostsError is the error from the last attempt to load
+	// LocalHostsFile, if it failed.
+	LocalHostsError string `json:",omitempty"`
+}
+
+// DNSHost is a DNS record answered by tailscaled itself.
+type DNSHost struct {
+	Name string
+	IPs  []netaddr.IP
+
+	// Source is where the record came from: "control" for
+	// MagicDNS names and extra records from the control plane, or
+	// "local" for entries in the local hosts file.
+	Source string
+}
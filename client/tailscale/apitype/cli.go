@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitype
+
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+// The types below are the JSON output of the tailscale CLI's --json
+// flags. They're a stable interface: fields may be added, but
+// existing fields are only removed or changed along with an increase
+// of CLIOutputSchema. The schemas are locked by golden files in
+// cmd/tailscale/cli/testdata, written by the CLI's own code.
+//
+// Durations, such as latencies, are time.Durations and so are
+// encoded as integer nanoseconds.
+
+// CLIOutputSchema is the version of the CLI's JSON output formats. It
+// is the value of the Schema field of each of them.
+const CLIOutputSchema = 1
+
+// IPOutput is the JSON output of "tailscale ip --json".
+type IPOutput struct {
+	Schema int
+
+	// IPs are the Tailscale IPs of this machine, or of the peer
+	// asked about.
+	IPs []netaddr.IP
+}
+
+// VersionOutput is the JSON output of "tailscale version --json".
+type VersionOutput struct {
+	Schema int
+
+	// Client is the version of the tailscale CLI.
+	Client string
+
+	// Daemon is the version of tailscaled, with --daemon.
+	Daemon string `json:",omitempty"`
+}
+
+// BugReportOutput is the JSON output of "tailscale bugreport --json".
+type BugReportOutput struct {
+	Schema int
+
+	// Marker is the identifier of the bug report in the logs.
+	Marker string
+}
+
+// PingOutput is the JSON output of "tailscale ping --json". It's
+// written once per ping, as a line of its own.
+type PingOutput struct {
+	Schema int
+
+	// IP is the Tailscale IP pinged.
+	IP netaddr.IP
+
+	// NodeName is the MagicDNS name of the node that replied.
+	NodeName string `json:",omitempty"`
+
+	// Timeout is whether no reply arrived in time. The fields
+	// below are then empty.
+	Timeout bool `json:",omitempty"`
+
+	// Err is the error the ping got, if any.
+	Err string `json:",omitempty"`
+
+	// Latency is the round trip time, in nanoseconds.
+	Latency time.Duration `json:",omitempty"`
+
+	// TSMP is whether the ping was a TSMP ping (--tsmp), which
+	// goes through WireGuard like other traffic and doesn't
+	// report the path it took. Endpoint, DERPRegionCode and
+	// PeerRelay are then empty.
+	TSMP bool `json:",omitempty"`
+
+	// Endpoint is the ip:port the reply came from when it came
+	// directly rather than through DERP.
+	Endpoint string `json:",omitempty"`
+
+	// DERPRegionCode is the DERP region the reply came through,
+	// if it didn't come directly.
+	DERPRegionCode string `json:",omitempty"`
+
+	// PeerRelay is the name of the tailnet node the reply was
+	// relayed through, if it came through a peer relay.
+	PeerRelay string `json:",omitempty"`
+
+	// PeerAPIPort is the port of the peer's peer API, if known.
+	PeerAPIPort uint16 `json:",omitempty"`
+}
+
+// PingSummaryOutput is the last line of JSON output of "tailscale
+// ping --continuous --json", written when it's interrupted.
+type PingSummaryOutput struct {
+	Schema int
+
+	// IP is the Tailscale IP pinged.
+	IP netaddr.IP
+
+	// Sent and Received are the numbers of pings sent and of
+	// replies received.
+	Sent     int
+	Received int
+
+	// Paths are the statistics of each path that replies came
+	// through, in the order they were first used.
+	Paths []PingPathStats
+}
+
+// PingPathStats are the statistics of the pings over one path in a
+// PingSummaryOutput.
+type PingPathStats struct {
+	// Endpoint, DERPRegionCode and PeerRelay identify the path,
+	// as in PingOutput. They're all empty for TSMP pings, and for
+	// pings lost before any reply.
+	Endpoint       string `json:",omitempty"`
+	DERPRegionCode string `json:",omitempty"`
+	PeerRelay      string `json:",omitempty"`
+
+	// Received is the number of replies through the path. Lost is
+	// the number of pings that got no reply while the path was the
+	// one the latest reply came through.
+	Received int
+	Lost     int
+
+	// Loss is Lost as a fraction of all pings counted for the
+	// path.
+	Loss float64
+
+	// The statistics of the round trip times of the replies, in
+	// nanoseconds.
+	MinLatency    time.Duration `json:",omitempty"`
+	AvgLatency    time.Duration `json:",omitempty"`
+	MaxLatency    time.Duration `json:",omitempty"`
+	StdDevLatency time.Duration `json:",omitempty"`
+
+	// Jitter is the mean difference between the round trip times
+	// of consecutive replies, in nanoseconds.
+	Jitter time.Duration `json:",omitempty"`
+}
+
+// NetcheckOutput is the JSON output of "tailscale netcheck --json".
+type NetcheckOutput struct {
+	Schema int
+
+	UDP  bool // whether UDP works
+	IPv4 bool // whether IPv4 works
+	IPv6 bool // whether IPv6 works
+
+	// GlobalV4 and GlobalV6 are this machine's public ip:ports as
+	// seen by STUN, if found.
+	GlobalV4 string `json:",omitempty"`
+	GlobalV6 string `json:",omitempty"`
+
+	// MappingVariesByDestIP and HairPinning are "true" or "false"
+	// for IPv4, or empty if unknown.
+	MappingVariesByDestIP string `json:",omitempty"`
+	HairPinning           string `json:",omitempty"`
+
+	// PortMapping are the port mapping protocols found on the LAN,
+	// of "UPnP", "NAT-PMP" and "PCP". It's nil if they weren't
+	// checked.
+	PortMapping []string
+
+	// PreferredDERP is the code of the nearest DERP region, or
+	// empty if unknown.
+	PreferredDERP string `json:",omitempty"`
+
+	// DERPLatency are the round trip times to the DERP regions
+	// that replied, in nanoseconds, keyed by region code.
+	DERPLatency map[string]time.Duration `json:",omitempty"`
+}
+
+// FileTargetsOutput is the JSON output of
+// "tailscale file cp --targets --json".
+type FileTargetsOutput struct {
+	Schema int
+
+	Targets []FileTargetInfo
+}
+
+// FileTargetInfo is a node that files can be sent to.
+type FileTargetInfo struct {
+	// Name is the node's MagicDNS name.
+	Name string
+
+	// ID is the node's stable ID.
+	ID tailcfg.StableNodeID
+
+	// IPs are the node's Tailscale IPs.
+	IPs []netaddr.IP
+
+	// Online is whether the node is connected, or nil if unknown.
+	Online *bool `json:",omitempty"`
+
+	// LastSeen is when the node was last online, if known.
+	LastSeen *time.Time `json:",omitempty"`
+}
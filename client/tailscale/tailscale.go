@@ -6,8 +6,10 @@
 package tailscale
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,12 +21,14 @@ import (
 	"strconv"
 	"strings"
 
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
 )
 
 // TailscaledSocket is the tailscaled Unix socket.
@@ -37,20 +41,25 @@ var tsClient = &http.Client{
 			if addr != "local-tailscaled.sock:80" {
 				return nil, fmt.Errorf("unexpected URL address %q", addr)
 			}
-			if TailscaledSocket == paths.DefaultTailscaledSocket() {
-				// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
-				// a TCP server on a random port, find the random port. For HTTP connections,
-				// we don't send the token. It gets added in an HTTP Basic-Auth header.
-				if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
-					var d net.Dialer
-					return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
-				}
-			}
-			return safesocket.Connect(TailscaledSocket, 41112)
+			return dialLocal(ctx)
 		},
 	},
 }
 
+// dialLocal connects to the local Tailscale daemon.
+func dialLocal(ctx context.Context) (net.Conn, error) {
+	if TailscaledSocket == paths.DefaultTailscaledSocket() {
+		// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
+		// a TCP server on a random port, find the random port. For HTTP connections,
+		// we don't send the token. It gets added in an HTTP Basic-Auth header.
+		if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
+		}
+	}
+	return safesocket.Connect(TailscaledSocket, 41112)
+}
+
 // DoLocalRequest makes an HTTP request to the local machine's Tailscale daemon.
 //
 // URLs are of the form http://local-tailscaled.sock/localapi/v0/whois?ip=1.2.3.4.
@@ -158,6 +167,20 @@ func status(ctx context.Context, queryString string) (*ipnstate.Status, error) {
 	return st, nil
 }
 
+// PathHistory returns the recent changes of the network path to the
+// peer handling ip, oldest first.
+func PathHistory(ctx context.Context, ip netaddr.IP) ([]ipnstate.PathChange, error) {
+	body, err := get200(ctx, "/localapi/v0/path-history?ip="+url.QueryEscape(ip.String()))
+	if err != nil {
+		return nil, err
+	}
+	var hist []ipnstate.PathChange
+	if err := json.Unmarshal(body, &hist); err != nil {
+		return nil, fmt.Errorf("invalid JSON from path-history: %w", err)
+	}
+	return hist, nil
+}
+
 func WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
 	body, err := get200(ctx, "/localapi/v0/files/")
 	if err != nil {
@@ -280,6 +303,76 @@ func SetDNS(ctx context.Context, name, value string) error {
 	return err
 }
 
+// DialTCP connects to port on host through the local Tailscale
+// daemon, which dials it over the tailnet. The host may be a MagicDNS
+// name. This works in userspace networking mode too, where the local
+// machine can't reach Tailscale IPs directly.
+func DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	conn, err := dialLocal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header = http.Header{
+		"Upgrade":    []string{"ts-dial"},
+		"Connection": []string{"upgrade"},
+		"Dial-Host":  []string{host},
+		"Dial-Port":  []string{strconv.Itoa(int(port))},
+	}
+	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+		req.SetBasicAuth("", token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(res.Body)
+		conn.Close()
+		return nil, bestError(fmt.Errorf("unexpected HTTP response: %s, %s", res.Status, bytes.TrimSpace(body)), body)
+	}
+	return &dialConn{Conn: conn, br: br}, nil
+}
+
+// dialConn is a connection from DialTCP. Reads go through br, which
+// may hold bytes buffered while reading the HTTP response.
+type dialConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *dialConn) Read(p []byte) (int, error) { return c.br.Read(p) }
+
+// CloseWrite shuts down the writing side of the connection, which
+// tailscaled passes on to the remote side.
+func (c *dialConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite not supported")
+}
+
+// ServeSigningKey returns the key that the reverse proxies configured
+// by Prefs.Serve sign proxied requests and their identity headers
+// with, for use with ipn.VerifyServeRequest.
+func ServeSigningKey(ctx context.Context) ([]byte, error) {
+	body, err := get200(ctx, "/localapi/v0/serve-signing-key")
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(body)))
+}
+
 // CurrentDERPMap returns the current DERPMap that is being used by the local tailscaled.
 // It is intended to be used with netcheck to see availability of DERPs.
 func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
@@ -293,3 +386,149 @@ func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
 	}
 	return &derpMap, nil
 }
+
+// DNSStatus returns the DNS configuration tailscaled most recently applied.
+func DNSStatus(ctx context.Context) (*apitype.DNSStatus, error) {
+	body, err := get200(ctx, "/localapi/v0/dns-status")
+	if err != nil {
+		return nil, err
+	}
+	st := new(apitype.DNSStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, fmt.Errorf("invalid JSON from dns-status: %w", err)
+	}
+	return st, nil
+}
+
+// DNSQuery asks tailscaled's internal resolver to resolve name for
+// records of type qtype (such as "A" or "AAAA"), and returns its
+// response along with how it arrived at it.
+func DNSQuery(ctx context.Context, name, qtype string) (*dnstype.QueryResult, error) {
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("type", qtype)
+	body, err := get200(ctx, "/localapi/v0/dns-query?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	res := new(dnstype.QueryResult)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, fmt.Errorf("invalid JSON from dns-query: %w", err)
+	}
+	return res, nil
+}
+
+// IPNBusWatcher is a subscription to tailscaled's IPN notification
+// bus, returned by WatchIPNBus.
+type IPNBusWatcher struct {
+	res *http.Response
+	dec *json.Decoder
+}
+
+// WatchIPNBus subscribes to the ipn.Notify messages of the kinds in
+// mask that tailscaled sends, until ctx is done or the returned
+// watcher is closed.
+func WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*IPNBusWatcher, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"http://local-tailscaled.sock/localapi/v0/watch-ipn-bus?mask="+strconv.FormatUint(uint64(mask), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	return &IPNBusWatcher{
+		res: res,
+		dec: json.NewDecoder(res.Body),
+	}, nil
+}
+
+// Next returns the next ipn.Notify message. It blocks until there is
+// one or the watch ends.
+func (w *IPNBusWatcher) Next() (ipn.Notify, error) {
+	var n ipn.Notify
+	if err := w.dec.Decode(&n); err != nil {
+		return ipn.Notify{}, err
+	}
+	return n, nil
+}
+
+// Close ends the watch.
+func (w *IPNBusWatcher) Close() error {
+	return w.res.Body.Close()
+}
+
+// LoginProfiles returns tailscaled's login profiles.
+func LoginProfiles(ctx context.Context) ([]ipn.LoginProfile, error) {
+	body, err := get200(ctx, "/localapi/v0/profiles")
+	if err != nil {
+		return nil, err
+	}
+	return decodeLoginProfiles(body)
+}
+
+// SwitchProfile switches tailscaled to the login profile named name,
+// creating it if it doesn't exist, and returns the login profiles.
+func SwitchProfile(ctx context.Context, name string) ([]ipn.LoginProfile, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/profiles?name="+url.QueryEscape(name), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLoginProfiles(body)
+}
+
+// DeleteProfile deletes tailscaled's login profile named name, which
+// must not be in use, and returns the remaining login profiles.
+func DeleteProfile(ctx context.Context, name string) ([]ipn.LoginProfile, error) {
+	body, err := send(ctx, "DELETE", "/localapi/v0/profiles?name="+url.QueryEscape(name), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLoginProfiles(body)
+}
+
+func decodeLoginProfiles(body []byte) ([]ipn.LoginProfile, error) {
+	var profiles []ipn.LoginProfile
+	if err := json.Unmarshal(body, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid JSON from profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+// DNSQueryLog returns the entries in tailscaled's DNS query log with a
+// Seq greater than since.
+func DNSQueryLog(ctx context.Context, since uint64) (*apitype.DNSQueryLog, error) {
+	body, err := get200(ctx, "/localapi/v0/dns-query-log?since="+strconv.FormatUint(since, 10))
+	if err != nil {
+		return nil, err
+	}
+	return decodeDNSQueryLog(body)
+}
+
+// SetDNSQueryLogging enables or disables tailscaled's DNS query log.
+// If names is false, the names being queried are not recorded.
+// Disabling the log discards its entries.
+func SetDNSQueryLogging(ctx context.Context, enable, names bool) (*apitype.DNSQueryLog, error) {
+	v := url.Values{}
+	v.Set("enable", strconv.FormatBool(enable))
+	v.Set("names", strconv.FormatBool(names))
+	body, err := send(ctx, "POST", "/localapi/v0/dns-query-log?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDNSQueryLog(body)
+}
+
+func decodeDNSQueryLog(body []byte) (*apitype.DNSQueryLog, error) {
+	ql := new(apitype.DNSQueryLog)
+	if err := json.Unmarshal(body, ql); err != nil {
+		return nil, fmt.Errorf("invalid JSON from dns-query-log: %w", err)
+	}
+	return ql, nil
+}
@@ -8,6 +8,7 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -98,6 +99,7 @@ change in the future.
 		Subcommands: []*ffcli.Command{
 			upCmd,
 			downCmd,
+			setCmd,
 			logoutCmd,
 			netcheckCmd,
 			ipCmd,
@@ -107,6 +109,14 @@ change in the future.
 			webCmd,
 			fileCmd,
 			bugReportCmd,
+			dnsCmd,
+			switchCmd,
+			exitNodeCmd,
+			whoisCmd,
+			serveCmd,
+			ncCmd,
+			portForwardCmd,
+			completionCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
@@ -120,6 +130,10 @@ change in the future.
 	if strSliceContains(args, "debug") {
 		rootCmd.Subcommands = append(rootCmd.Subcommands, debugCmd)
 	}
+	// Nor the command the shell completion scripts call.
+	if len(args) > 0 && args[0] == "__complete" {
+		rootCmd.Subcommands = append(rootCmd.Subcommands, newCompleteCmd(rootCmd))
+	}
 
 	if err := rootCmd.Parse(args); err != nil {
 		return err
@@ -197,6 +211,18 @@ func pump(ctx context.Context, bc *ipn.BackendClient, conn net.Conn) error {
 	return ctx.Err()
 }
 
+// printJSON writes v to stdout as indented JSON, for the --json flags
+// whose output types are in package apitype.
+func printJSON(v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+	_, err = os.Stdout.Write(j)
+	return err
+}
+
 func strSliceContains(ss []string, s string) bool {
 	for _, v := range ss {
 		if v == s {
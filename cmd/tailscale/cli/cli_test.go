@@ -6,17 +6,22 @@ package cli
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/peterbourgon/ff/v2/ffcli"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
 )
@@ -404,6 +409,21 @@ func TestCheckForAccidentalSettingReverts(t *testing.T) {
 			},
 			want: accidentalUpPrefix + " --hostname=foo --exit-node=100.64.5.7",
 		},
+		{
+			name:          "auto_exit_node_kept",
+			flags:         []string{"--hostname=foo"},
+			curExitNodeIP: netaddr.MustParseIP("100.64.5.7"),
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+
+				AutoExitNode: true,
+				ExitNodeID:   "auto_picked_id",
+			},
+			want: "", // not an error
+		},
 		{
 			name:  "ignore_login_server_synonym",
 			flags: []string{"--login-server=https://controlplane.tailscale.com"},
@@ -547,6 +567,48 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `tag: "foo": tags must start with 'tag:'`,
 		},
+		{
+			name: "qos",
+			args: upArgsFromOSArgs("linux", "--qos", "--qos-classes=ssh:22,voice:dscp46"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				QoS:              true,
+				QoSClasses: []preftype.QoSClass{
+					{Name: "ssh", Ports: []uint16{22}},
+					{Name: "voice", DSCP: []int{46}},
+				},
+			},
+		},
+		{
+			name: "forward_rate_limit",
+			args: upArgsFromOSArgs("linux", "--forward-rate-limit=20M"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				ForwardRateLimit: 20e6,
+			},
+		},
+		{
+			name: "error_qos_class_reserved",
+			args: upArgsT{
+				qosClasses: "bulk:22",
+			},
+			wantErr: `QoS class name "bulk" is reserved`,
+		},
+		{
+			name: "error_forward_rate_limit",
+			args: upArgsT{
+				forwardRateLimit: "20 Mbps",
+			},
+			wantErr: `invalid --forward-rate-limit: "20 Mbps" is not a valid rate`,
+		},
 		{
 			name: "error_long_hostname",
 			args: upArgsT{
@@ -650,6 +712,46 @@ func TestPrefsFromUpArgs(t *testing.T) {
 
 }
 
+func TestParseBitRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantFmt string // formatBitRate(want)
+		wantErr bool
+	}{
+		{in: "", want: 0, wantFmt: ""},
+		{in: "0", want: 0, wantFmt: ""},
+		{in: "8", want: 8, wantFmt: "8"},
+		{in: "7", wantErr: true},
+		{in: "1500", want: 1500, wantFmt: "1500"},
+		{in: "500k", want: 500e3, wantFmt: "500k"},
+		{in: "1000k", want: 1e6, wantFmt: "1M"},
+		{in: "20M", want: 20e6, wantFmt: "20M"},
+		{in: "2G", want: 2e9, wantFmt: "2G"},
+		{in: "1.5M", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "M", wantErr: true},
+		{in: "20Mbps", wantErr: true},
+		{in: "99999999999G", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBitRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBitRate(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBitRate(%q) = %d; want %d", tt.in, got, tt.want)
+		}
+		if f := formatBitRate(got); f != tt.wantFmt {
+			t.Errorf("formatBitRate(%d) = %q; want %q", got, f, tt.wantFmt)
+		}
+	}
+}
+
 func TestPrefFlagMapping(t *testing.T) {
 	prefHasFlag := map[string]bool{}
 	for _, pv := range prefsOfFlag {
@@ -672,6 +774,12 @@ func TestPrefFlagMapping(t *testing.T) {
 			// Only used by Android, which doesn't have a CLI mode anyway, so
 			// fine to not map.
 			continue
+		case "AutoExitNode":
+			// Set by "tailscale exit-node use auto", and kept by applyImplicitPrefs.
+			continue
+		case "Serve":
+			// Set by "tailscale serve", and kept by applyImplicitPrefs.
+			continue
 		case "NotepadURLs":
 			// TODO(bradfitz): https://github.com/tailscale/tailscale/issues/1830
 			continue
@@ -796,3 +904,296 @@ func TestUpdatePrefs(t *testing.T) {
 		})
 	}
 }
+
+func TestMaskedPrefsFromSetFlags(t *testing.T) {
+	subnet := netaddr.MustParseIPPrefix("10.0.0.0/16")
+	curPrefs := &ipn.Prefs{
+		ControlURL:       ipn.DefaultControlURL,
+		WantRunning:      true,
+		CorpDNS:          true,
+		AllowSingleHosts: true,
+		AdvertiseRoutes:  []netaddr.IPPrefix{subnet},
+		AdvertiseTags:    []string{"tag:foo"},
+		Hostname:         "host",
+		NetfilterMode:    preftype.NetfilterOn,
+	}
+	tests := []struct {
+		name         string
+		flags        []string
+		want         *ipn.MaskedPrefs
+		wantErrSubtr string
+	}{
+		{
+			name:  "shields_up",
+			flags: []string{"--shields-up"},
+			want: &ipn.MaskedPrefs{
+				ShieldsUpSet: true,
+				Prefs:        ipn.Prefs{ShieldsUp: true},
+			},
+		},
+		{
+			name:  "advertise_exit_node_keeps_routes",
+			flags: []string{"--advertise-exit-node"},
+			want: &ipn.MaskedPrefs{
+				AdvertiseRoutesSet: true,
+				Prefs: ipn.Prefs{AdvertiseRoutes: []netaddr.IPPrefix{
+					ipv4default,
+					ipv6default,
+					subnet,
+				}},
+			},
+		},
+		{
+			name:  "exit_node",
+			flags: []string{"--exit-node=100.64.1.2", "--exit-node-allow-lan-access"},
+			want: &ipn.MaskedPrefs{
+				ExitNodeIPSet:             true,
+				ExitNodeIDSet:             true,
+				ExitNodeAllowLANAccessSet: true,
+				Prefs: ipn.Prefs{
+					ExitNodeIP:             netaddr.MustParseIP("100.64.1.2"),
+					ExitNodeAllowLANAccess: true,
+				},
+			},
+		},
+		{
+			name:         "lan_access_without_exit_node",
+			flags:        []string{"--exit-node-allow-lan-access"},
+			wantErrSubtr: "can only be used with --exit-node",
+		},
+		{
+			name:         "bad_route",
+			flags:        []string{"--advertise-routes=10.0.0.1/16"},
+			wantErrSubtr: "non-address bits set",
+		},
+		{
+			name:         "own_exit_node",
+			flags:        []string{"--exit-node=100.64.0.1"},
+			wantErrSubtr: "local IP address",
+		},
+	}
+	st := &ipnstate.Status{
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args upArgsT
+			fs := newSetFlagSet("linux", &args)
+			if err := fs.Parse(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			got, err := maskedPrefsFromSetFlags(fs, curPrefs, st, "linux", t.Logf)
+			if tt.wantErrSubtr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrSubtr) {
+					t.Fatalf("err = %v; want containing %q", err, tt.wantErrSubtr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only compare the masked-in prefs.
+			var gotMasked ipn.MaskedPrefs
+			gotv, gotMaskedv := reflect.ValueOf(got).Elem(), reflect.ValueOf(&gotMasked).Elem()
+			for i := 0; i < gotv.NumField(); i++ {
+				f := gotv.Type().Field(i)
+				if f.Name == "Prefs" || !gotv.Field(i).Bool() {
+					continue
+				}
+				gotMaskedv.Field(i).SetBool(true)
+				pref := strings.TrimSuffix(f.Name, "Set")
+				gotMaskedv.FieldByName("Prefs").FieldByName(pref).Set(gotv.FieldByName("Prefs").FieldByName(pref))
+			}
+			if !reflect.DeepEqual(&gotMasked, tt.want) {
+				t.Errorf("got %v; want %v", gotMasked.Pretty(), tt.want.Pretty())
+			}
+		})
+	}
+}
+
+func TestSetFlagSet(t *testing.T) {
+	for _, goos := range geese {
+		var args upArgsT
+		newSetFlagSet(goos, &args).VisitAll(func(f *flag.Flag) {
+			mp := new(ipn.MaskedPrefs)
+			updateMaskedPrefsFromUpFlag(mp, f.Name)
+			if mp.Pretty() == "MaskedPrefs{}" {
+				t.Errorf("set flag %q on %s changes no prefs", f.Name, goos)
+			}
+			if mp.ControlURLSet {
+				t.Errorf("set flag %q on %s changes the control URL", f.Name, goos)
+			}
+		})
+	}
+}
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    portForward
+		wantErr bool
+	}{
+		{in: "8080:web:80", want: portForward{8080, "web", 80}},
+		{in: "2222:100.64.0.1:22", want: portForward{2222, "100.64.0.1", 22}},
+		{in: "2222:[fd7a:115c:a1e0::1]:22", want: portForward{2222, "fd7a:115c:a1e0::1", 22}},
+		{in: "8080:web", wantErr: true},
+		{in: "0:web:80", wantErr: true},
+		{in: "8080::80", wantErr: true},
+		{in: "8080:web:http", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePortForward(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePortForward(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parsePortForward(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	root := &ffcli.Command{
+		Name: "tailscale",
+		FlagSet: (func() *flag.FlagSet {
+			fs := flag.NewFlagSet("tailscale", flag.ContinueOnError)
+			fs.String("socket", "", "")
+			return fs
+		})(),
+		Subcommands: []*ffcli.Command{upCmd, pingCmd, exitNodeCmd, fileCmd, statusCmd},
+	}
+	st := &ipnstate.Status{
+		MagicDNSSuffix: "example.ts.net",
+		Peer: map[key.Public]*ipnstate.PeerStatus{
+			{1}: {
+				DNSName:      "web.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+			},
+			{2}: {
+				DNSName:        "exit.example.ts.net.",
+				TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				ExitNodeOption: true,
+			},
+		},
+	}
+	getStatus := func(context.Context) (*ipnstate.Status, error) { return st, nil }
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{""}, []string{"up", "ping", "exit-node", "file", "status"}},
+		{[]string{"--socket", "/tmp/s", "pi"}, []string{"ping"}},
+		{[]string{"exit-node", ""}, []string{"list", "use"}},
+		{[]string{"exit-node", "use", ""}, []string{"100.64.0.2", "exit", "auto", "none"}},
+		{[]string{"ping", "w"}, []string{"web"}},
+		{[]string{"ping", "--verbose", "100."}, []string{"100.64.0.1", "100.64.0.2"}},
+		{[]string{"ping", "web", ""}, nil},
+		{[]string{"file", "cp", "a.txt", "w"}, []string{"web:"}},
+		{[]string{"file", "cp", "w"}, nil},
+		{[]string{"up", "--exit-node", "e"}, []string{"exit"}},
+		{[]string{"up", "--exit-node=e"}, []string{"--exit-node=exit"}},
+		{[]string{"up", "--accept-r"}, []string{"--accept-routes"}},
+		{[]string{"status", "--peer", "w"}, []string{"web"}},
+		{[]string{"up", "-accept-r"}, []string{"-accept-routes"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, c := range completions(context.Background(), root, tt.args, getStatus) {
+			got = append(got, c.word)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("completions(%q) = %q; want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPingStats(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	var s pingStats
+	lost := func() {
+		s.sent++
+		s.noteLost()
+	}
+	reply := func(out apitype.PingOutput, latency time.Duration) {
+		s.sent++
+		out.Latency = latency
+		s.noteReply(out)
+	}
+	derp := apitype.PingOutput{DERPRegionCode: "nyc"}
+	direct := apitype.PingOutput{Endpoint: "203.0.113.7:41641"}
+
+	lost()
+	reply(derp, ms(70))
+	reply(derp, ms(80))
+	lost()
+	reply(direct, ms(11))
+	reply(direct, ms(13))
+	reply(direct, ms(11))
+	reply(direct, ms(13))
+
+	got := s.summary("100.101.102.103")
+	want := apitype.PingSummaryOutput{
+		Schema:   apitype.CLIOutputSchema,
+		IP:       netaddr.MustParseIP("100.101.102.103"),
+		Sent:     8,
+		Received: 6,
+		Paths: []apitype.PingPathStats{
+			{
+				Lost: 1,
+				Loss: 1,
+			},
+			{
+				DERPRegionCode: "nyc",
+				Received:       2,
+				Lost:           1,
+				Loss:           1.0 / 3,
+				MinLatency:     ms(70),
+				AvgLatency:     ms(75),
+				MaxLatency:     ms(80),
+				StdDevLatency:  ms(5),
+				Jitter:         ms(10),
+			},
+			{
+				Endpoint:      "203.0.113.7:41641",
+				Received:      4,
+				MinLatency:    ms(11),
+				AvgLatency:    ms(12),
+				MaxLatency:    ms(13),
+				StdDevLatency: ms(1),
+				Jitter:        ms(2),
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary:\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestApplyImplicitPrefsAutoExitNode(t *testing.T) {
+	curPrefs := &ipn.Prefs{
+		ControlURL:   ipn.DefaultControlURL,
+		AutoExitNode: true,
+		ExitNodeID:   "auto_picked_id",
+	}
+	newPrefs := func(flags ...string) *ipn.Prefs {
+		t.Helper()
+		prefs, err := prefsFromUpArgs(upArgsFromOSArgs("linux", flags...), t.Logf, new(ipnstate.Status), "linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyImplicitPrefs(prefs, curPrefs, "")
+		return prefs
+	}
+
+	p := newPrefs("--hostname=foo")
+	if !p.AutoExitNode || p.ExitNodeID != "auto_picked_id" {
+		t.Errorf("without --exit-node: AutoExitNode=%v ExitNodeID=%q; want true, auto_picked_id", p.AutoExitNode, p.ExitNodeID)
+	}
+
+	p = newPrefs("--exit-node=100.64.5.8")
+	if p.AutoExitNode || !p.ExitNodeID.IsZero() {
+		t.Errorf("with --exit-node: AutoExitNode=%v ExitNodeID=%q; want false, none", p.AutoExitNode, p.ExitNodeID)
+	}
+}
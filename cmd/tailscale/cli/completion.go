@@ -0,0 +1,314 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var completionCmd = &ffcli.Command{
+	Name:       "completion",
+	ShortUsage: "completion <bash|zsh|fish>",
+	ShortHelp:  "Print a shell completion script",
+	LongHelp: strings.TrimSpace(`
+'tailscale completion' prints a script that makes the given shell complete
+tailscale's subcommands, flags, and peer names and IPs.
+
+The script calls back into tailscale for completions, so it doesn't need
+to be regenerated when tailscale is upgraded. To use it:
+
+  bash: tailscale completion bash > /etc/bash_completion.d/tailscale
+  zsh:  tailscale completion zsh > "${fpath[1]}/_tailscale"
+  fish: tailscale completion fish > ~/.config/fish/completions/tailscale.fish
+`),
+	Exec: runCompletion,
+}
+
+func runCompletion(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: completion <bash|zsh|fish>")
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q; want bash, zsh or fish", args[0])
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completionScripts are the completion scripts of each shell, keyed
+// by shell name. They run "tailscale __complete -- <words...>" with
+// the words of the command line after "tailscale" up to the cursor,
+// which prints one completion per line, each optionally followed by
+// a tab and a description.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for tailscale; see "tailscale completion --help".
+
+_tailscale() {
+	local line="${COMP_LINE:0:COMP_POINT}"
+	local -a words
+	read -r -a words <<< "$line"
+	if [[ "$line" == *[[:space:]] ]]; then
+		words+=("")
+	fi
+	local cur="${words[${#words[@]}-1]}"
+	# Bash only replaces the part of the current word after the last
+	# "=" or ":", so drop it from the completions too.
+	local prefix="${cur%"${cur##*[=:]}"}"
+	local IFS=$'\n'
+	COMPREPLY=($(tailscale __complete -- "${words[@]:1}" 2>/dev/null | cut -f1))
+	COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+}
+complete -o default -F _tailscale tailscale
+`,
+	"zsh": `#compdef tailscale
+# zsh completion for tailscale; see "tailscale completion --help".
+
+_tailscale() {
+	local -a completions
+	local line word
+	for line in "${(@f)$(tailscale __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+		[[ -z "$line" ]] && continue
+		word="${line%%$'\t'*}"
+		word="${word//:/\\:}"
+		if [[ "$line" == *$'\t'* ]]; then
+			completions+=("$word:${line#*$'\t'}")
+		else
+			completions+=("$word")
+		fi
+	done
+	if (( ${#completions} )); then
+		_describe tailscale completions
+	else
+		_files
+	fi
+}
+
+compdef _tailscale tailscale
+`,
+	"fish": `# fish completion for tailscale; see "tailscale completion --help".
+
+function __tailscale_complete
+	set -l words (commandline -opc)[2..-1] (commandline -ct)
+	tailscale __complete -- $words 2>/dev/null
+end
+
+complete -c tailscale -a '(__tailscale_complete)'
+`,
+}
+
+// newCompleteCmd returns the hidden "__complete" command, which the
+// completion scripts call to complete the command line of root.
+func newCompleteCmd(root *ffcli.Command) *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "__complete",
+		ShortUsage: "__complete -- <words...>",
+		Exec: func(ctx context.Context, args []string) error {
+			for _, c := range completions(ctx, root, args, tailscale.Status) {
+				if c.desc == "" {
+					fmt.Println(c.word)
+				} else {
+					fmt.Printf("%s\t%s\n", c.word, c.desc)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// completion is a candidate completion of a word, with an optional
+// one-line description.
+type completion struct {
+	word, desc string
+}
+
+// completions returns the completions of the last of args, which are
+// the words of a tailscale command line after "tailscale", given the
+// command tree root. getStatus is how it gets the peers to complete
+// hostnames and IPs for.
+func completions(ctx context.Context, root *ffcli.Command, args []string, getStatus func(context.Context) (*ipnstate.Status, error)) []completion {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	words, partial := args[:len(args)-1], args[len(args)-1]
+
+	cmd := root
+	var path []string       // subcommand names, such as ["exit-node", "use"]
+	var positional []string // non-flag arguments of cmd
+	var valueFlag string    // flag whose value is the next word, if any
+	dashdash := false
+	for _, w := range words {
+		switch {
+		case valueFlag != "":
+			valueFlag = ""
+		case dashdash:
+			positional = append(positional, w)
+		case w == "--":
+			dashdash = true
+		case strings.HasPrefix(w, "-") && len(w) > 1:
+			name := strings.TrimLeft(w, "-")
+			if !strings.Contains(name, "=") && flagTakesValue(cmd, name) {
+				valueFlag = name
+			}
+		default:
+			if len(positional) == 0 {
+				if sub := findSubcommand(cmd, w); sub != nil {
+					cmd = sub
+					path = append(path, sub.Name)
+					continue
+				}
+			}
+			positional = append(positional, w)
+		}
+	}
+	cmdPath := strings.Join(path, " ")
+
+	var ret []completion
+	switch {
+	case valueFlag != "":
+		ret = flagValueCompletions(ctx, valueFlag, "", partial, getStatus)
+	case !dashdash && strings.HasPrefix(partial, "-"):
+		name := strings.TrimLeft(partial, "-")
+		if i := strings.Index(name, "="); i != -1 {
+			prefix := partial[:len(partial)-len(name)] + name[:i+1]
+			return flagValueCompletions(ctx, name[:i], prefix, name[i+1:], getStatus)
+		}
+		dashes := "--"
+		if len(partial) > 1 && !strings.HasPrefix(partial, "--") {
+			dashes = "-"
+		}
+		if cmd.FlagSet != nil {
+			cmd.FlagSet.VisitAll(func(f *flag.Flag) {
+				_, usage := flag.UnquoteUsage(f)
+				ret = append(ret, completion{dashes + f.Name, usage})
+			})
+		}
+	default:
+		if len(positional) == 0 {
+			for _, sub := range cmd.Subcommands {
+				if !strings.HasPrefix(sub.Name, "__") {
+					ret = append(ret, completion{sub.Name, sub.ShortHelp})
+				}
+			}
+		}
+		ret = append(ret, argCompletions(ctx, cmdPath, positional, partial, getStatus)...)
+	}
+	return filterCompletions(ret, partial)
+}
+
+func findSubcommand(cmd *ffcli.Command, name string) *ffcli.Command {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// flagTakesValue reports whether the flag name of cmd takes a value
+// as the next word, which is the case for all but boolean flags.
+func flagTakesValue(cmd *ffcli.Command, name string) bool {
+	if cmd.FlagSet == nil {
+		return false
+	}
+	f := cmd.FlagSet.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+// flagValueCompletions returns the completions of the value of the
+// flag name, each prefixed by prefix.
+func flagValueCompletions(ctx context.Context, name, prefix, partial string, getStatus func(context.Context) (*ipnstate.Status, error)) []completion {
+	var ret []completion
+	switch name {
+	case "exit-node":
+		ret = peerCompletions(ctx, getStatus, true, "")
+	case "peer":
+		ret = peerCompletions(ctx, getStatus, false, "")
+	}
+	for i := range ret {
+		ret[i].word = prefix + ret[i].word
+	}
+	return filterCompletions(ret, prefix+partial)
+}
+
+// argCompletions returns the completions of the non-flag argument
+// after positional of the subcommand cmdPath.
+func argCompletions(ctx context.Context, cmdPath string, positional []string, partial string, getStatus func(context.Context) (*ipnstate.Status, error)) []completion {
+	switch cmdPath {
+	case "ping", "whois", "nc":
+		if len(positional) == 0 {
+			return peerCompletions(ctx, getStatus, false, "")
+		}
+	case "exit-node use":
+		if len(positional) == 0 {
+			return append(peerCompletions(ctx, getStatus, true, ""),
+				completion{"auto", "pick the best exit node automatically"},
+				completion{"none", "stop using an exit node"})
+		}
+	case "file cp":
+		// The target comes after the files, which the shell
+		// completes itself.
+		if len(positional) > 0 && !strings.Contains(partial, "/") {
+			return peerCompletions(ctx, getStatus, false, ":")
+		}
+	}
+	return nil
+}
+
+// peerCompletions returns the names and Tailscale IPs of the peers,
+// each followed by suffix. If exitNodes, only peers that can be used
+// as exit nodes are included.
+func peerCompletions(ctx context.Context, getStatus func(context.Context) (*ipnstate.Status, error), exitNodes bool, suffix string) []completion {
+	st, err := getStatus(ctx)
+	if err != nil {
+		return nil
+	}
+	var ret []completion
+	for _, ps := range st.Peer {
+		if exitNodes && !ps.ExitNodeOption {
+			continue
+		}
+		var ip string
+		if len(ps.TailscaleIPs) > 0 {
+			ip = ps.TailscaleIPs[0].String()
+		}
+		name := dnsOrQuoteHostname(st, ps)
+		if !strings.HasPrefix(name, "(") {
+			ret = append(ret, completion{name + suffix, ip})
+		}
+		for _, a := range ps.TailscaleIPs {
+			ret = append(ret, completion{a.String() + suffix, name})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].word < ret[j].word })
+	return ret
+}
+
+// filterCompletions returns the completions in cs that start with
+// partial.
+func filterCompletions(cs []completion, partial string) []completion {
+	var ret []completion
+	for _, c := range cs {
+		if strings.HasPrefix(c.word, partial) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/dnstype"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <status|log|query> ...",
+	ShortHelp:  "Diagnose tailscaled's DNS resolver",
+	Subcommands: []*ffcli.Command{
+		dnsStatusCmd,
+		dnsLogCmd,
+		dnsQueryCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("dns subcommand required; run 'tailscale dns -h' for details")
+	},
+}
+
+var dnsStatusCmd = &ffcli.Command{
+	Name:       "status",
+	ShortUsage: "dns status",
+	ShortHelp:  "Show the DNS configuration tailscaled applied",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns status' command shows the DNS configuration tailscaled
+most recently applied: the upstream nameservers, the split DNS routes,
+the search domains, and the records answered by tailscaled itself, along
+with where each record came from.
+
+Records marked "local" come from the hosts file given to tailscaled with
+--dns-hosts-file. They take precedence over records for the same name
+from the control plane.
+`),
+	Exec: runDNSStatus,
+}
+
+func runDNSStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	st, err := tailscale.DNSStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if st.LocalHostsFile != "" {
+		fmt.Printf("Local hosts file: %s\n", st.LocalHostsFile)
+		if st.LocalHostsError != "" {
+			fmt.Printf("  error: %s\n", st.LocalHostsError)
+		}
+	}
+	if len(st.DefaultResolvers) > 0 {
+		fmt.Printf("Default resolvers: %s\n", strings.Join(st.DefaultResolvers, " "))
+	}
+	if len(st.SearchDomains) > 0 {
+		fmt.Printf("Search domains: %s\n", strings.Join(st.SearchDomains, " "))
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(st.Routes) > 0 {
+		fmt.Fprintln(tw, "\nROUTE\tRESOLVERS")
+		var suffixes []string
+		for suffix := range st.Routes {
+			suffixes = append(suffixes, suffix)
+		}
+		sort.Strings(suffixes)
+		for _, suffix := range suffixes {
+			rs := strings.Join(st.Routes[suffix], " ")
+			if rs == "" {
+				rs = "(answered by tailscaled)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", suffix, rs)
+		}
+		tw.Flush()
+	}
+	if len(st.Hosts) > 0 {
+		fmt.Fprintln(tw, "\nNAME\tIPS\tSOURCE")
+		for _, h := range st.Hosts {
+			ips := make([]string, len(h.IPs))
+			for i, ip := range h.IPs {
+				ips[i] = ip.String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", h.Name, strings.Join(ips, " "), h.Source)
+		}
+	}
+	return tw.Flush()
+}
+
+var dnsLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "dns log [--enable [--names] | --disable] [--follow]",
+	ShortHelp:  "Show recent queries handled by tailscaled's DNS resolver",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns log' command shows the most recent DNS queries handled
+by tailscaled's internal resolver (100.100.100.100): the name and type
+queried, the route chosen, the upstream nameserver that answered, the
+latency and the response code.
+
+The query log is kept only in memory and is off by default. Turn it on
+with --enable. Query names are recorded only if --names is also given.
+Turning the log off with --disable discards everything recorded.
+`),
+	Exec: runDNSLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("log", flag.ExitOnError)
+		fs.BoolVar(&dnsLogArgs.enable, "enable", false, "start recording queries")
+		fs.BoolVar(&dnsLogArgs.disable, "disable", false, "stop recording queries and discard the log")
+		fs.BoolVar(&dnsLogArgs.names, "names", false, "with --enable, also record the names being queried")
+		fs.BoolVar(&dnsLogArgs.follow, "follow", false, "keep printing new queries as they happen")
+		return fs
+	})(),
+}
+
+var dnsLogArgs struct {
+	enable  bool
+	disable bool
+	names   bool
+	follow  bool
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	if dnsLogArgs.enable && dnsLogArgs.disable {
+		return errors.New("--enable and --disable are mutually exclusive")
+	}
+	if dnsLogArgs.names && !dnsLogArgs.enable {
+		return errors.New("--names requires --enable")
+	}
+
+	var ql *apitype.DNSQueryLog
+	var err error
+	switch {
+	case dnsLogArgs.enable:
+		ql, err = tailscale.SetDNSQueryLogging(ctx, true, dnsLogArgs.names)
+	case dnsLogArgs.disable:
+		if _, err := tailscale.SetDNSQueryLogging(ctx, false, false); err != nil {
+			return err
+		}
+		fmt.Println("DNS query log disabled.")
+		return nil
+	default:
+		ql, err = tailscale.DNSQueryLog(ctx, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if !ql.Enabled {
+		return errors.New("the DNS query log is disabled; enable it with 'tailscale dns log --enable'")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNAME\tTYPE\tROUTE\tUPSTREAM\tLATENCY\tRCODE")
+	since := printDNSQueryLog(tw, ql.Entries, 0)
+	tw.Flush()
+	if !dnsLogArgs.follow {
+		return nil
+	}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		ql, err := tailscale.DNSQueryLog(ctx, since)
+		if err != nil {
+			return err
+		}
+		if !ql.Enabled {
+			return errors.New("the DNS query log was disabled")
+		}
+		since = printDNSQueryLog(tw, ql.Entries, since)
+		tw.Flush()
+	}
+}
+
+// printDNSQueryLog prints ents to tw and returns the Seq of the last
+// entry printed, or since if ents is empty.
+func printDNSQueryLog(tw *tabwriter.Writer, ents []dnstype.QueryLogEntry, since uint64) uint64 {
+	for _, e := range ents {
+		name := e.Name
+		if name == "" {
+			name = "-"
+		}
+		route := e.Route
+		if route == "" {
+			route = "-"
+		}
+		upstream := e.Upstream
+		if upstream == "" {
+			upstream = "-"
+		}
+		rcode := e.RCode
+		if e.Error != "" {
+			rcode = "error: " + e.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n",
+			e.Time.Local().Format("15:04:05.000"),
+			name, e.Type, route, upstream,
+			e.Latency.Round(time.Millisecond/10), rcode)
+		since = e.Seq
+	}
+	return since
+}
+
+var dnsQueryCmd = &ffcli.Command{
+	Name:       "query",
+	ShortUsage: "dns query <name> [type]",
+	ShortHelp:  "Resolve a name using tailscaled's DNS resolver and explain the answer",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale dns query' command asks tailscaled's internal resolver
+(100.100.100.100) to resolve a name, and prints the answer along with
+how the resolver arrived at it: whether it answered from MagicDNS
+records, which split DNS route it picked, and which upstream nameserver
+answered.
+
+The record type defaults to A.
+`),
+	Exec: runDNSQuery,
+}
+
+func runDNSQuery(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: dns query <name> [type]")
+	}
+	qtype := "A"
+	if len(args) == 2 {
+		qtype = args[1]
+	}
+	res, err := tailscale.DNSQuery(ctx, args[0], qtype)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Query: %s %s\n", res.Name, res.Type)
+	switch {
+	case res.Route == "local":
+		fmt.Println("Route: answered by tailscaled")
+	case res.Route != "":
+		fmt.Printf("Route: %s via %s\n", res.Route, res.Upstream)
+	}
+	if res.Error != "" {
+		fmt.Printf("Error: %s\n", res.Error)
+	} else {
+		fmt.Printf("Response: %s in %v\n", res.RCode, res.Latency.Round(time.Millisecond/10))
+	}
+	if len(res.Path) > 0 {
+		fmt.Println("\nResolution:")
+		for i, step := range res.Path {
+			fmt.Printf("  %d. %s\n", i+1, step)
+		}
+	}
+	if len(res.Answers) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "\nNAME\tTYPE\tTTL\tDATA")
+		for _, a := range res.Answers {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", a.Name, a.Type, a.TTL, a.Data)
+		}
+		return tw.Flush()
+	}
+	return nil
+}
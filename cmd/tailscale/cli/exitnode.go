@@ -0,0 +1,227 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+var exitNodeCmd = &ffcli.Command{
+	Name:       "exit-node",
+	ShortUsage: "exit-node <list|use> ...",
+	ShortHelp:  "List and choose exit nodes",
+	Subcommands: []*ffcli.Command{
+		exitNodeListCmd,
+		exitNodeUseCmd,
+	},
+	Exec: func(context.Context, []string) error {
+		return errors.New("exit-node subcommand required; run 'tailscale exit-node -h' for details")
+	},
+}
+
+var exitNodeListCmd = &ffcli.Command{
+	Name:       "list",
+	ShortUsage: "exit-node list",
+	ShortHelp:  "List the peers that can be used as exit nodes",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale exit-node list' command lists the peers offering to be an
+exit node, along with their owner, whether they're online, and the
+latency of the direct connection to them, if known. The exit node in use
+is marked with "*".
+`),
+	Exec: runExitNodeList,
+}
+
+var exitNodeUseCmd = &ffcli.Command{
+	Name:       "use",
+	ShortUsage: "exit-node use <name|IP|auto|none>",
+	ShortHelp:  "Choose the exit node for internet traffic",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale exit-node use' command routes internet traffic through the
+given exit node, named by its hostname, MagicDNS name or Tailscale IP.
+
+"auto" picks the online exit node with the lowest latency, and picks
+another whenever the chosen one goes offline. "none" stops using an exit
+node.
+`),
+	Exec: runExitNodeUse,
+}
+
+func runExitNodeList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	peers := exitNodePeers(st)
+	if len(peers) == 0 {
+		fmt.Println("No peers offer to be an exit node.")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTNAME\tIP\tOWNER\tSTATUS\tLATENCY")
+	for _, ps := range peers {
+		name := dnsOrQuoteHostname(st, ps)
+		if ps.ExitNode {
+			name += "*"
+		}
+		var ip string
+		if len(ps.TailscaleIPs) > 0 {
+			ip = ps.TailscaleIPs[0].String()
+		}
+		status := "offline"
+		if ps.Online {
+			status = "online"
+		}
+		latency := "-"
+		if ps.Latency > 0 {
+			latency = ps.Latency.Round(time.Millisecond / 10).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, ip, ownerLogin(st, ps), status, latency)
+	}
+	return tw.Flush()
+}
+
+// exitNodePeers returns the peers in st that can be used as exit
+// nodes, sorted by name.
+func exitNodePeers(st *ipnstate.Status) []*ipnstate.PeerStatus {
+	var peers []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		if ps.ExitNodeOption {
+			peers = append(peers, ps)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return dnsOrQuoteHostname(st, peers[i]) < dnsOrQuoteHostname(st, peers[j])
+	})
+	return peers
+}
+
+func runExitNodeUse(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale exit-node use <name|IP|auto|none>")
+	}
+	mp := new(ipn.MaskedPrefs)
+	var chosen string
+	switch arg := args[0]; arg {
+	case "auto":
+		mp.AutoExitNodeSet = true
+		mp.AutoExitNode = true
+	case "none":
+		mp.ExitNodeIDSet = true
+		mp.ExitNodeIPSet = true
+	default:
+		st, err := tailscale.Status(ctx)
+		if err != nil {
+			return fixTailscaledConnectError(err)
+		}
+		ps, err := findExitNode(st, arg)
+		if err != nil {
+			return err
+		}
+		mp.ExitNodeIDSet = true
+		mp.ExitNodeIPSet = true
+		mp.ExitNodeID = ps.ID
+		chosen = dnsOrQuoteHostname(st, ps)
+	}
+	prefs, err := tailscale.EditPrefs(ctx, mp)
+	if err != nil {
+		return err
+	}
+	switch {
+	case prefs.AutoExitNode && prefs.ExitNodeID.IsZero():
+		fmt.Println("Choosing the exit node automatically; no exit node is online yet.")
+	case prefs.AutoExitNode:
+		st, err := tailscale.Status(ctx)
+		if err != nil {
+			return fixTailscaledConnectError(err)
+		}
+		fmt.Printf("Choosing the exit node automatically; using %s.\n", exitNodeName(st, prefs.ExitNodeID))
+	case chosen != "":
+		fmt.Printf("Using exit node %s.\n", chosen)
+	default:
+		fmt.Println("Not using an exit node.")
+	}
+	return nil
+}
+
+// exitNodeName describes the peer in st with the given ID by its name
+// and Tailscale IP.
+func exitNodeName(st *ipnstate.Status, id tailcfg.StableNodeID) string {
+	for _, ps := range st.Peer {
+		if ps.ID != id {
+			continue
+		}
+		if len(ps.TailscaleIPs) == 0 {
+			return dnsOrQuoteHostname(st, ps)
+		}
+		return fmt.Sprintf("%s (%v)", dnsOrQuoteHostname(st, ps), ps.TailscaleIPs[0])
+	}
+	return "an exit node not in the netmap yet"
+}
+
+// findExitNode returns the peer in st named by arg, a hostname,
+// MagicDNS name or Tailscale IP, which must be able to be used as an
+// exit node.
+func findExitNode(st *ipnstate.Status, arg string) (*ipnstate.PeerStatus, error) {
+	ip, _ := netaddr.ParseIP(arg)
+	match := matchPeers(st, arg)
+	switch {
+	case len(match) == 0:
+		if !ip.IsZero() && ipsContain(st.TailscaleIPs, ip) {
+			return nil, fmt.Errorf("%v is this machine; it can't be its own exit node", ip)
+		}
+		return nil, fmt.Errorf("no peer named %q; see 'tailscale exit-node list'", arg)
+	case len(match) > 1:
+		return nil, fmt.Errorf("%q matches %d peers; use its MagicDNS name or Tailscale IP instead", arg, len(match))
+	case !match[0].ExitNodeOption:
+		return nil, fmt.Errorf("%s doesn't offer to be an exit node; see 'tailscale exit-node list'", dnsOrQuoteHostname(st, match[0]))
+	}
+	return match[0], nil
+}
+
+// matchPeers returns the peers in st named by arg, a hostname,
+// MagicDNS name or Tailscale IP.
+func matchPeers(st *ipnstate.Status, arg string) []*ipnstate.PeerStatus {
+	ip, _ := netaddr.ParseIP(arg)
+	name := strings.TrimSuffix(strings.ToLower(arg), ".")
+	var match []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		dnsName := strings.TrimSuffix(strings.ToLower(ps.DNSName), ".")
+		switch {
+		case !ip.IsZero() && ipsContain(ps.TailscaleIPs, ip),
+			name == strings.ToLower(ps.HostName),
+			name == dnsName,
+			dnsName != "" && name == strings.SplitN(dnsName, ".", 2)[0]:
+			match = append(match, ps)
+		}
+	}
+	return match
+}
+
+func ipsContain(ips []netaddr.IP, ip netaddr.IP) bool {
+	for _, v := range ips {
+		if v == ip {
+			return true
+		}
+	}
+	return false
+}
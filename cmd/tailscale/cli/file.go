@@ -59,6 +59,7 @@ var fileCpCmd = &ffcli.Command{
 		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
 		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
+		fs.BoolVar(&cpArgs.json, "json", false, "with --targets, output in JSON format")
 		return fs
 	})(),
 }
@@ -67,12 +68,16 @@ var cpArgs struct {
 	name    string
 	verbose bool
 	targets bool
+	json    bool
 }
 
 func runCp(ctx context.Context, args []string) error {
 	if cpArgs.targets {
 		return runCpTargets(ctx, args)
 	}
+	if cpArgs.json {
+		return errors.New("--json is only supported with --targets")
+	}
 	if len(args) < 2 {
 		return errors.New("usage: tailscale file cp <files...> <target>:")
 	}
@@ -276,6 +281,9 @@ func runCpTargets(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	if cpArgs.json {
+		return printJSON(fileTargetsOutput(fts))
+	}
 	for _, ft := range fts {
 		n := ft.Node
 		var detail string
@@ -434,3 +442,26 @@ func waitForFile(ctx context.Context) error {
 		return ctx.Err()
 	}
 }
+
+// fileTargetsOutput returns fts as the JSON output of
+// "tailscale file cp --targets".
+func fileTargetsOutput(fts []apitype.FileTarget) apitype.FileTargetsOutput {
+	out := apitype.FileTargetsOutput{
+		Schema:  apitype.CLIOutputSchema,
+		Targets: []apitype.FileTargetInfo{},
+	}
+	for _, ft := range fts {
+		n := ft.Node
+		ti := apitype.FileTargetInfo{
+			Name:     n.Name,
+			ID:       n.StableID,
+			Online:   n.Online,
+			LastSeen: n.LastSeen,
+		}
+		for _, a := range n.Addresses {
+			ti.IPs = append(ti.IPs, a.IP())
+		}
+		out.Targets = append(out.Targets, ti)
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestJSONOutputGolden locks the JSON schemas of the --json output,
+// as written by the funcs that build it from what tailscaled returns.
+// If it fails after an intended change, make sure the change is
+// compatible or bump apitype.CLIOutputSchema, then run the test with
+// -update.
+func TestJSONOutputGolden(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	pfx := netaddr.MustParseIPPrefix
+	ips := []netaddr.IP{
+		netaddr.MustParseIP("100.64.0.1"),
+		netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+	}
+
+	var stats pingStats
+	for _, r := range []struct {
+		out     apitype.PingOutput
+		latency time.Duration // or 0 for a timeout
+	}{
+		{apitype.PingOutput{}, 0},
+		{apitype.PingOutput{DERPRegionCode: "nyc"}, ms(70)},
+		{apitype.PingOutput{DERPRegionCode: "nyc"}, ms(80)},
+		{apitype.PingOutput{}, 0},
+		{apitype.PingOutput{Endpoint: "203.0.113.7:41641"}, ms(11)},
+		{apitype.PingOutput{Endpoint: "203.0.113.7:41641"}, ms(13)},
+		{apitype.PingOutput{Endpoint: "203.0.113.7:41641"}, ms(11)},
+		{apitype.PingOutput{Endpoint: "203.0.113.7:41641"}, ms(13)},
+	} {
+		stats.sent++
+		if r.latency == 0 {
+			stats.noteLost()
+			continue
+		}
+		r.out.Latency = r.latency
+		stats.noteReply(r.out)
+	}
+
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+			2: {RegionID: 2, RegionCode: "sfo"},
+		},
+	}
+	online := true
+	lastSeen := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		// The ip, version and bugreport commands fill in their
+		// output directly.
+		{"ip", apitype.IPOutput{
+			Schema: apitype.CLIOutputSchema,
+			IPs:    ips,
+		}},
+		{"version", apitype.VersionOutput{
+			Schema: apitype.CLIOutputSchema,
+			Client: "1.11.0-t0123456789a",
+			Daemon: "1.11.0-tba9876543210",
+		}},
+		{"bugreport", apitype.BugReportOutput{
+			Schema: apitype.CLIOutputSchema,
+			Marker: "BUG-0123456789abcdef-20210701120000Z-fedcba9876543210",
+		}},
+		{"ping", pingOutput(&ipnstate.PingResult{
+			IP:             "100.64.0.2",
+			NodeIP:         "100.64.0.2",
+			NodeName:       "peer.example.ts.net.",
+			LatencySeconds: 0.012,
+			Endpoint:       "203.0.113.7:41641",
+			PeerAPIPort:    45678,
+		}, false)},
+		{"ping-derp", pingOutput(&ipnstate.PingResult{
+			IP:             "100.64.0.2",
+			NodeIP:         "100.64.0.2",
+			NodeName:       "peer.example.ts.net.",
+			LatencySeconds: 0.08,
+			DERPRegionID:   1,
+			DERPRegionCode: "nyc",
+		}, false)},
+		{"ping-peer-relay", pingOutput(&ipnstate.PingResult{
+			IP:             "100.64.0.2",
+			NodeIP:         "100.64.0.2",
+			NodeName:       "peer.example.ts.net.",
+			LatencySeconds: 0.025,
+			PeerRelay:      "relay.example.ts.net.",
+		}, false)},
+		{"ping-tsmp", pingOutput(&ipnstate.PingResult{
+			IP:             "100.64.0.2",
+			NodeIP:         "100.64.0.2",
+			NodeName:       "peer.example.ts.net.",
+			LatencySeconds: 0.004,
+			PeerAPIPort:    45678,
+		}, true)},
+		{"ping-timeout", pingTimeoutOutput("100.64.0.2")},
+		{"ping-error", pingOutput(&ipnstate.PingResult{
+			IP:  "100.64.0.9",
+			Err: "no matching peer",
+		}, false)},
+		{"ping-summary", stats.summary("100.64.0.2")},
+		{"netcheck", netcheckOutput(dm, &netcheck.Report{
+			UDP:                   true,
+			IPv4:                  true,
+			IPv6:                  true,
+			GlobalV4:              "203.0.113.1:41641",
+			GlobalV6:              "[2001:db8::1]:41641",
+			MappingVariesByDestIP: "false",
+			HairPinning:           "true",
+			UPnP:                  "true",
+			PMP:                   "false",
+			PreferredDERP:         1,
+			RegionLatency: map[int]time.Duration{
+				1: ms(10),
+				2: ms(70),
+				3: ms(5), // not in the DERP map
+			},
+		})},
+		{"file-targets", fileTargetsOutput([]apitype.FileTarget{
+			{
+				Node: &tailcfg.Node{
+					Name:      "laptop.example.ts.net.",
+					StableID:  "nABCDEF1CNTRL",
+					Addresses: []netaddr.IPPrefix{pfx("100.64.0.1/32"), pfx("fd7a:115c:a1e0::1/128")},
+					Online:    &online,
+					LastSeen:  &lastSeen,
+				},
+				PeerAPIURL: "http://100.64.0.1:45678",
+			},
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.MarshalIndent(tt.v, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			path := filepath.Join("testdata", tt.name+".json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output of %T changed; got:\n%s\nwant:\n%s", tt.v, got, want)
+			}
+		})
+	}
+}
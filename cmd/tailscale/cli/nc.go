@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var ncCmd = &ffcli.Command{
+	Name:       "nc",
+	ShortUsage: "nc <hostname-or-IP> <port>",
+	ShortHelp:  "Connect to a port on a host, connected to stdin/stdout",
+	LongHelp: strings.TrimSpace(`
+'tailscale nc' connects to a TCP port on a tailnet host through
+tailscaled, and copies stdin to it and its output to stdout. It works
+in userspace networking mode too, so it can be used as an SSH
+ProxyCommand:
+
+  ssh -o ProxyCommand='tailscale nc %h %p' host
+`),
+	Exec: runNC,
+}
+
+func runNC(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: nc <hostname-or-IP> <port>")
+	}
+	host := args[0]
+	port, err := parsePort(args[1])
+	if err != nil {
+		return err
+	}
+	c, err := tailscale.DialTCP(ctx, host, port)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.Close()
+
+	go func() {
+		io.Copy(c, os.Stdin)
+		closeWrite(c)
+	}()
+	_, err = io.Copy(os.Stdout, c)
+	return err
+}
+
+// parsePort parses a non-zero TCP port number.
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+// closeWrite shuts down the writing side of c if it supports that,
+// and otherwise closes it.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
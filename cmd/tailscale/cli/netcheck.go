@@ -20,6 +20,7 @@ import (
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/portmapper"
@@ -29,12 +30,13 @@ import (
 
 var netcheckCmd = &ffcli.Command{
 	Name:       "netcheck",
-	ShortUsage: "netcheck",
+	ShortUsage: "netcheck [--json]",
 	ShortHelp:  "Print an analysis of local network conditions",
 	Exec:       runNetcheck,
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("netcheck", flag.ExitOnError)
-		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"`)
+		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), or "json" or "json-line" for the raw, unstable report`)
+		fs.BoolVar(&netcheckArgs.json, "json", false, "output in JSON format")
 		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency")
 		fs.BoolVar(&netcheckArgs.verbose, "verbose", false, "verbose logs")
 		return fs
@@ -43,6 +45,7 @@ var netcheckCmd = &ffcli.Command{
 
 var netcheckArgs struct {
 	format  string
+	json    bool
 	every   time.Duration
 	verbose bool
 }
@@ -91,6 +94,9 @@ func runNetcheck(ctx context.Context, args []string) error {
 }
 
 func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
+	if netcheckArgs.json {
+		return printJSON(netcheckOutput(dm, report))
+	}
 	var j []byte
 	var err error
 	switch netcheckArgs.format {
@@ -174,7 +180,16 @@ func portMapping(r *netcheck.Report) string {
 	if !r.AnyPortMappingChecked() {
 		return "not checked"
 	}
-	var got []string
+	return strings.Join(portMappingProtocols(r), ", ")
+}
+
+// portMappingProtocols returns the port mapping protocols that r
+// found, or nil if none were checked.
+func portMappingProtocols(r *netcheck.Report) []string {
+	if !r.AnyPortMappingChecked() {
+		return nil
+	}
+	got := []string{}
 	if r.UPnP.EqualBool(true) {
 		got = append(got, "UPnP")
 	}
@@ -184,7 +199,37 @@ func portMapping(r *netcheck.Report) string {
 	if r.PCP.EqualBool(true) {
 		got = append(got, "PCP")
 	}
-	return strings.Join(got, ", ")
+	return got
+}
+
+// netcheckOutput returns report as the JSON output of
+// "tailscale netcheck".
+func netcheckOutput(dm *tailcfg.DERPMap, report *netcheck.Report) apitype.NetcheckOutput {
+	out := apitype.NetcheckOutput{
+		Schema:                apitype.CLIOutputSchema,
+		UDP:                   report.UDP,
+		IPv4:                  report.IPv4,
+		IPv6:                  report.IPv6,
+		GlobalV4:              report.GlobalV4,
+		GlobalV6:              report.GlobalV6,
+		MappingVariesByDestIP: string(report.MappingVariesByDestIP),
+		HairPinning:           string(report.HairPinning),
+		PortMapping:           portMappingProtocols(report),
+	}
+	if r := dm.Regions[report.PreferredDERP]; r != nil {
+		out.PreferredDERP = r.RegionCode
+	}
+	for rid, d := range report.RegionLatency {
+		r := dm.Regions[rid]
+		if r == nil {
+			continue
+		}
+		if out.DERPLatency == nil {
+			out.DERPLatency = make(map[string]time.Duration)
+		}
+		out.DERPLatency[r.RegionCode] = d
+	}
+	return out
 }
 
 func prodDERPMap(ctx context.Context, httpc *http.Client) (*tailcfg.DERPMap, error) {
@@ -6,16 +6,20 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 )
@@ -36,7 +40,10 @@ side's operating system firewall is blocking packets; 'tailscale ping'
 does not inject packets into either side's TUN devices.
 
 By default, 'tailscale ping' stops after 10 pings or once a direct
-(non-DERP) path has been established, whichever comes first.
+(non-DERP) path has been established, whichever comes first. With
+--continuous, it instead pings until interrupted and then prints
+statistics of the loss and latency of each path the replies came
+through. Pings answered with an error count as lost.
 
 The provided hostname must resolve to or be a Tailscale IP
 (e.g. 100.x.y.z) or a subnet IP advertised by a Tailscale
@@ -51,6 +58,9 @@ relay node.
 		fs.BoolVar(&pingArgs.tsmp, "tsmp", false, "do a TSMP-level ping (through IP + wireguard, but not involving host OS stack)")
 		fs.IntVar(&pingArgs.num, "c", 10, "max number of pings to send")
 		fs.DurationVar(&pingArgs.timeout, "timeout", 5*time.Second, "timeout before giving up on a ping")
+		fs.BoolVar(&pingArgs.json, "json", false, "output each ping's result as a line of JSON")
+		fs.BoolVar(&pingArgs.continuous, "continuous", false, "ping until interrupted, then print statistics; ignores -c and --until-direct")
+		fs.DurationVar(&pingArgs.interval, "interval", time.Second, "time to wait after each reply before the next ping")
 		return fs
 	})(),
 }
@@ -61,6 +71,9 @@ var pingArgs struct {
 	verbose     bool
 	tsmp        bool
 	timeout     time.Duration
+	json        bool
+	continuous  bool
+	interval    time.Duration
 }
 
 func runPing(ctx context.Context, args []string) error {
@@ -93,49 +106,104 @@ func runPing(ctx context.Context, args []string) error {
 		log.Printf("lookup %q => %q", hostOrIP, ip)
 	}
 
+	var stats *pingStats
+	if pingArgs.continuous {
+		stats = new(pingStats)
+	}
+	// done is called when ctx is done. A continuous ping ends then,
+	// by the user interrupting it.
+	done := func() error {
+		if stats == nil || !gotSignal.Get() {
+			return ctx.Err()
+		}
+		sum := stats.summary(ip)
+		if pingArgs.json {
+			j, _ := json.Marshal(sum)
+			fmt.Printf("%s\n", j)
+		} else {
+			printPingSummary(sum)
+		}
+		return nil
+	}
+
 	n := 0
 	anyPong := false
 	for {
+		if ctx.Err() != nil {
+			return done()
+		}
 		n++
 		bc.Ping(ip, pingArgs.tsmp)
+		if stats != nil {
+			stats.sent++
+		}
 		timer := time.NewTimer(pingArgs.timeout)
 		select {
 		case <-timer.C:
-			fmt.Printf("timeout waiting for ping reply\n")
+			if stats != nil {
+				stats.noteLost()
+			}
+			if pingArgs.json {
+				printPingJSON(pingTimeoutOutput(ip))
+			} else {
+				fmt.Printf("timeout waiting for ping reply\n")
+			}
 		case err := <-pumpErr:
+			if gotSignal.Get() {
+				return done()
+			}
 			return err
 		case pr := <-prc:
 			timer.Stop()
-			if pr.Err != "" {
-				return errors.New(pr.Err)
+			out := pingOutput(pr, pingArgs.tsmp)
+			if pingArgs.json {
+				printPingJSON(out)
 			}
-			latency := time.Duration(pr.LatencySeconds * float64(time.Second)).Round(time.Millisecond)
-			via := pr.Endpoint
-			if pr.DERPRegionID != 0 {
-				via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
-			}
-			if pingArgs.tsmp {
-				// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
-				// For now just say it came via TSMP.
-				via = "TSMP"
+			if pr.Err != "" {
+				if stats == nil {
+					return errors.New(pr.Err)
+				}
+				// Like ping(8), count errors as lost pings
+				// and keep going.
+				stats.noteLost()
+				if !pingArgs.json {
+					fmt.Printf("error: %s\n", pr.Err)
+				}
+				select {
+				case <-time.After(pingArgs.interval):
+				case <-ctx.Done():
+				}
+				continue
 			}
 			anyPong = true
-			extra := ""
-			if pr.PeerAPIPort != 0 {
-				extra = fmt.Sprintf(", %d", pr.PeerAPIPort)
+			if stats != nil {
+				stats.noteReply(out)
+			}
+			if !pingArgs.json {
+				latency := time.Duration(pr.LatencySeconds * float64(time.Second)).Round(time.Millisecond)
+				via := pingVia(out.Endpoint, out.DERPRegionCode, out.PeerRelay)
+				extra := ""
+				if pr.PeerAPIPort != 0 {
+					extra = fmt.Sprintf(", %d", pr.PeerAPIPort)
+				}
+				fmt.Printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
 			}
-			fmt.Printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
-			if pingArgs.tsmp {
-				return nil
+			if !pingArgs.continuous {
+				if pingArgs.tsmp {
+					return nil
+				}
+				if pr.Endpoint != "" && pingArgs.untilDirect {
+					return nil
+				}
 			}
-			if pr.Endpoint != "" && pingArgs.untilDirect {
-				return nil
+			select {
+			case <-time.After(pingArgs.interval):
+			case <-ctx.Done():
 			}
-			time.Sleep(time.Second)
 		case <-ctx.Done():
-			return ctx.Err()
+			return done()
 		}
-		if n == pingArgs.num {
+		if n == pingArgs.num && !pingArgs.continuous {
 			if !anyPong {
 				return errors.New("no reply")
 			}
@@ -147,6 +215,67 @@ func runPing(ctx context.Context, args []string) error {
 	}
 }
 
+// pingVia describes the path a ping reply came through, as identified
+// by the fields of apitype.PingOutput, for the text output.
+func pingVia(endpoint, derpRegionCode, peerRelay string) string {
+	switch {
+	case pingArgs.tsmp:
+		// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
+		// For now just say it came via TSMP.
+		return "TSMP"
+	case derpRegionCode != "":
+		return fmt.Sprintf("DERP(%s)", derpRegionCode)
+	case peerRelay != "":
+		return fmt.Sprintf("peer relay(%s)", peerRelay)
+	case endpoint != "":
+		return endpoint
+	default:
+		return "unknown path"
+	}
+}
+
+// pingOutput returns pr as the JSON output of "tailscale ping". tsmp
+// is whether it's the result of a TSMP ping.
+func pingOutput(pr *ipnstate.PingResult, tsmp bool) apitype.PingOutput {
+	out := apitype.PingOutput{
+		Schema:      apitype.CLIOutputSchema,
+		NodeName:    pr.NodeName,
+		Err:         pr.Err,
+		Latency:     time.Duration(pr.LatencySeconds * float64(time.Second)),
+		TSMP:        tsmp,
+		PeerAPIPort: pr.PeerAPIPort,
+	}
+	out.IP, _ = netaddr.ParseIP(pr.IP)
+	if tsmp {
+		return out
+	}
+	if pr.DERPRegionID != 0 {
+		out.DERPRegionCode = pr.DERPRegionCode
+	} else if pr.PeerRelay != "" {
+		out.PeerRelay = pr.PeerRelay
+	} else {
+		out.Endpoint = pr.Endpoint
+	}
+	return out
+}
+
+// pingTimeoutOutput returns the JSON output of "tailscale ping" for a
+// ping to ipStr that got no reply.
+func pingTimeoutOutput(ipStr string) apitype.PingOutput {
+	out := apitype.PingOutput{
+		Schema:  apitype.CLIOutputSchema,
+		Timeout: true,
+	}
+	out.IP, _ = netaddr.ParseIP(ipStr)
+	return out
+}
+
+// printPingJSON prints out as a line of JSON.
+func printPingJSON(out apitype.PingOutput) {
+	j, _ := json.Marshal(out)
+	fmt.Printf("%s\n", j)
+}
+
 func tailscaleIPFromArg(ctx context.Context, hostOrIP string) (ip string, err error) {
 	// If the argument is an IP address, use it directly without any resolution.
 	if net.ParseIP(hostOrIP) != nil {
@@ -177,3 +306,116 @@ func tailscaleIPFromArg(ctx context.Context, hostOrIP string) (ip string, err er
 		return addrs[0], nil
 	}
 }
+
+// pingStats accumulates the statistics of "tailscale ping --continuous"
+// per path.
+type pingStats struct {
+	sent  int
+	paths []*pingPathStats // in the order first used
+	cur   *pingPathStats   // path of the latest reply; nil before any
+}
+
+type pingPathStats struct {
+	apitype.PingPathStats
+	latencies []time.Duration
+}
+
+// path returns the stats of the path identified by the fields of
+// apitype.PingOutput, adding it if it's new.
+func (s *pingStats) path(endpoint, derpRegionCode, peerRelay string) *pingPathStats {
+	for _, p := range s.paths {
+		if p.Endpoint == endpoint && p.DERPRegionCode == derpRegionCode && p.PeerRelay == peerRelay {
+			return p
+		}
+	}
+	p := &pingPathStats{}
+	p.Endpoint = endpoint
+	p.DERPRegionCode = derpRegionCode
+	p.PeerRelay = peerRelay
+	s.paths = append(s.paths, p)
+	return p
+}
+
+// noteReply records a reply.
+func (s *pingStats) noteReply(out apitype.PingOutput) {
+	p := s.path(out.Endpoint, out.DERPRegionCode, out.PeerRelay)
+	p.Received++
+	p.latencies = append(p.latencies, out.Latency)
+	s.cur = p
+}
+
+// noteLost records a ping that timed out. It's counted against the
+// path of the latest reply, which it most likely took.
+func (s *pingStats) noteLost() {
+	if s.cur == nil {
+		s.cur = s.path("", "", "")
+	}
+	s.cur.Lost++
+}
+
+// summary returns the statistics of the pings to ipStr so far.
+func (s *pingStats) summary(ipStr string) apitype.PingSummaryOutput {
+	sum := apitype.PingSummaryOutput{
+		Schema: apitype.CLIOutputSchema,
+		Sent:   s.sent,
+	}
+	sum.IP, _ = netaddr.ParseIP(ipStr)
+	for _, p := range s.paths {
+		ps := p.PingPathStats
+		sum.Received += ps.Received
+		if n := ps.Received + ps.Lost; n > 0 {
+			ps.Loss = float64(ps.Lost) / float64(n)
+		}
+		if n := len(p.latencies); n > 0 {
+			var total, jitter time.Duration
+			ps.MinLatency = p.latencies[0]
+			for i, d := range p.latencies {
+				total += d
+				if d < ps.MinLatency {
+					ps.MinLatency = d
+				}
+				if d > ps.MaxLatency {
+					ps.MaxLatency = d
+				}
+				if i > 0 {
+					diff := d - p.latencies[i-1]
+					if diff < 0 {
+						diff = -diff
+					}
+					jitter += diff
+				}
+			}
+			ps.AvgLatency = total / time.Duration(n)
+			var variance float64
+			for _, d := range p.latencies {
+				dev := float64(d - ps.AvgLatency)
+				variance += dev * dev
+			}
+			ps.StdDevLatency = time.Duration(math.Sqrt(variance / float64(n)))
+			if n > 1 {
+				ps.Jitter = jitter / time.Duration(n-1)
+			}
+		}
+		sum.Paths = append(sum.Paths, ps)
+	}
+	return sum
+}
+
+// printPingSummary prints sum in the style of ping(8).
+func printPingSummary(sum apitype.PingSummaryOutput) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	var loss float64
+	if sum.Sent > 0 {
+		loss = float64(sum.Sent-sum.Received) / float64(sum.Sent)
+	}
+	fmt.Printf("\n--- %v ping statistics ---\n", sum.IP)
+	fmt.Printf("%d pings sent, %d replies, %.1f%% loss\n", sum.Sent, sum.Received, loss*100)
+	for _, p := range sum.Paths {
+		fmt.Printf("via %s: %d replies, %.1f%% loss", pingVia(p.Endpoint, p.DERPRegionCode, p.PeerRelay), p.Received, p.Loss*100)
+		if p.Received > 0 {
+			fmt.Printf(", rtt min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms, jitter %.3f ms",
+				ms(p.MinLatency), ms(p.AvgLatency), ms(p.MaxLatency), ms(p.StdDevLatency), ms(p.Jitter))
+		}
+		fmt.Printf("\n")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var portForwardCmd = &ffcli.Command{
+	Name:       "portforward",
+	ShortUsage: "portforward [--bind=<addr>] <localport>:<host>:<port> [...]",
+	ShortHelp:  "Forward local ports to ports on tailnet hosts",
+	LongHelp: strings.TrimSpace(`
+'tailscale portforward' listens on local TCP ports and forwards each
+connection through tailscaled to a port on a tailnet host, until
+interrupted. It works in userspace networking mode too.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("portforward", flag.ExitOnError)
+		fs.StringVar(&portForwardArgs.bind, "bind", "127.0.0.1", "local address to listen on")
+		return fs
+	})(),
+	Exec: runPortForward,
+}
+
+var portForwardArgs struct {
+	bind string
+}
+
+// portForward is a parsed <localport>:<host>:<port> argument.
+type portForward struct {
+	localPort uint16
+	host      string
+	port      uint16
+}
+
+func parsePortForward(s string) (pf portForward, err error) {
+	i := strings.Index(s, ":")
+	j := strings.LastIndex(s, ":")
+	if i < 0 || i == j {
+		return pf, fmt.Errorf("invalid port forward %q; want <localport>:<host>:<port>", s)
+	}
+	if pf.localPort, err = parsePort(s[:i]); err != nil {
+		return pf, err
+	}
+	if pf.port, err = parsePort(s[j+1:]); err != nil {
+		return pf, err
+	}
+	pf.host = strings.TrimSuffix(strings.TrimPrefix(s[i+1:j], "["), "]")
+	if pf.host == "" {
+		return pf, fmt.Errorf("invalid port forward %q; missing host", s)
+	}
+	return pf, nil
+}
+
+func runPortForward(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: portforward <localport>:<host>:<port> [...]")
+	}
+	var pfs []portForward
+	for _, arg := range args {
+		pf, err := parsePortForward(arg)
+		if err != nil {
+			return err
+		}
+		pfs = append(pfs, pf)
+	}
+
+	errc := make(chan error, len(pfs))
+	for _, pf := range pfs {
+		ln, err := net.Listen("tcp", net.JoinHostPort(portForwardArgs.bind, strconv.Itoa(int(pf.localPort))))
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		log.Printf("forwarding %v to %s", ln.Addr(), net.JoinHostPort(pf.host, strconv.Itoa(int(pf.port))))
+		go func(ln net.Listener, pf portForward) {
+			errc <- servePortForward(ctx, ln, pf)
+		}(ln, pf)
+	}
+	return <-errc
+}
+
+func servePortForward(ctx context.Context, ln net.Listener, pf portForward) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			out, err := tailscale.DialTCP(ctx, pf.host, pf.port)
+			if err != nil {
+				log.Printf("dial %s:%d: %v", pf.host, pf.port, err)
+				return
+			}
+			defer out.Close()
+			go func() {
+				io.Copy(out, c)
+				closeWrite(out)
+			}()
+			io.Copy(c, out)
+		}()
+	}
+}
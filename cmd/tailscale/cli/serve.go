@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var serveCmd = &ffcli.Command{
+	Name:       "serve",
+	ShortUsage: "serve [--tls | --remove] [<port> [<target>]]",
+	ShortHelp:  "Serve a local web app to your tailnet with caller identity",
+	LongHelp: strings.TrimSpace(`
+'tailscale serve' makes tailscaled run a reverse proxy on this machine's
+Tailscale IPs that forwards HTTP requests received on <port> to <target>.
+
+The target is a local port (such as "3000"), an http:// or https:// URL
+on localhost, or "unix:" followed by the absolute path of a Unix socket.
+Unix sockets must be owned by the operator user (see 'tailscale up
+--operator'), or by tailscaled's user if there's no operator.
+
+Proxied requests carry the caller's identity in the Tailscale-User-Login
+and Tailscale-User-Name headers, which are removed if sent by the client.
+The Tailscale-User-Signature header signs them along with the request's
+method, host and path. Tagged machines have no user headers.
+
+With --tls, the proxy terminates TLS using this machine's certificate
+for its MagicDNS name, which tailscaled gets from Let's Encrypt. HTTPS
+certificates must be enabled for your tailnet.
+
+With no arguments, it lists the current proxies.
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		fs.BoolVar(&serveArgs.tls, "tls", false, "terminate TLS with this machine's certificate")
+		fs.BoolVar(&serveArgs.remove, "remove", false, "stop serving the given port")
+		return fs
+	})(),
+	Exec: runServe,
+}
+
+var serveArgs struct {
+	tls    bool
+	remove bool
+}
+
+func runServe(ctx context.Context, args []string) error {
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		if serveArgs.remove {
+			return errors.New("--remove requires a port")
+		}
+		return printServeHandlers(prefs.Serve)
+	}
+
+	port, err := parsePort(args[0])
+	if err != nil {
+		return err
+	}
+	var handlers []ipn.ServeHandler
+	for _, h := range prefs.Serve {
+		if h.Port != port {
+			handlers = append(handlers, h)
+		}
+	}
+	switch {
+	case serveArgs.remove:
+		if len(args) != 1 {
+			return errors.New("usage: serve --remove <port>")
+		}
+		if len(handlers) == len(prefs.Serve) {
+			return fmt.Errorf("not serving port %d", port)
+		}
+	case len(args) == 2:
+		handlers = append(handlers, ipn.ServeHandler{
+			Port:   port,
+			Target: expandServeTarget(args[1]),
+			TLS:    serveArgs.tls,
+		})
+		if err := ipn.CheckServeHandlers(handlers); err != nil {
+			return err
+		}
+	default:
+		return errors.New("usage: serve [--tls] <port> <target>")
+	}
+
+	prefs, err = tailscale.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:    ipn.Prefs{Serve: handlers},
+		ServeSet: true,
+	})
+	if err != nil {
+		return err
+	}
+	return printServeHandlers(prefs.Serve)
+}
+
+// expandServeTarget expands a bare port number to a localhost URL.
+func expandServeTarget(target string) string {
+	if _, err := parsePort(target); err == nil {
+		return "http://127.0.0.1:" + target
+	}
+	return target
+}
+
+func printServeHandlers(hs []ipn.ServeHandler) error {
+	if len(hs) == 0 {
+		fmt.Println("Not serving anything.")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tPROTO\tTARGET")
+	for _, h := range hs {
+		proto := "http"
+		if h.TLS {
+			proto = "https"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", h.Port, proto, h.Target)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/logger"
+	"tailscale.com/version/distro"
+)
+
+var setCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "set [flags]",
+	ShortHelp:  "Change specified preferences",
+
+	LongHelp: strings.TrimSpace(`
+"tailscale set" changes only the preferences given as flags, leaving all
+others as they are. Unlike "tailscale up", it never needs every
+non-default flag to be restated, and it doesn't log in or bring the
+network up or down.
+
+The flags are those of "tailscale up" that change preferences, with the
+same meaning and checks.
+`),
+	FlagSet: setFlagSet,
+	Exec:    runSet,
+}
+
+var setArgs upArgsT
+
+var setFlagSet = newSetFlagSet(effectiveGOOS(), &setArgs)
+
+// newSetFlagSet returns a FlagSet with the flags of newUpFlagSet that
+// can be changed without restarting the backend, storing their values
+// in args.
+func newSetFlagSet(goos string, args *upArgsT) *flag.FlagSet {
+	setf := flag.NewFlagSet("set", flag.ExitOnError)
+	newUpFlagSet(goos, args).VisitAll(func(f *flag.Flag) {
+		if preflessFlag(f.Name) || f.Name == "login-server" {
+			return
+		}
+		setf.Var(f.Value, f.Name, f.Usage)
+	})
+	return setf
+}
+
+func runSet(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		fatalf("too many non-flag arguments: %q", args)
+	}
+	if setFlagSet.NFlag() == 0 {
+		return errors.New("no preferences given; see 'tailscale set -h'")
+	}
+
+	if distro.Get() == distro.Synology {
+		notSupported := "not supported on Synology; see https://github.com/tailscale/tailscale/issues/1995"
+		if setArgs.acceptRoutes {
+			return errors.New("--accept-routes is " + notSupported)
+		}
+		if setArgs.exitNodeIP != "" {
+			return errors.New("--exit-node is " + notSupported)
+		}
+		if flagIsSet(setFlagSet, "netfilter-mode") && setArgs.netfilterMode != "off" {
+			return errors.New("--netfilter-mode values besides \"off\" " + notSupported)
+		}
+	}
+
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	curPrefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	mp, err := maskedPrefsFromSetFlags(setFlagSet, curPrefs, st, effectiveGOOS(), warnf)
+	if err != nil {
+		return err
+	}
+	if mp.AdvertiseRoutesSet && len(mp.AdvertiseRoutes) > 0 {
+		if err := tailscale.CheckIPForwarding(ctx); err != nil {
+			warnf("%v", err)
+		}
+	}
+	_, err = tailscale.EditPrefs(ctx, mp)
+	return err
+}
+
+// flagIsSet reports whether the flag named name was given in fs.
+func flagIsSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// maskedPrefsFromSetFlags returns the MaskedPrefs to send for the
+// flags given in setFlags, a FlagSet from newSetFlagSet.
+//
+// The flags are applied on top of curPrefs, as if "tailscale up" had
+// been run with all of curPrefs's settings plus setFlags, so that they
+// go through the same checks as prefsFromUpArgs and flags that share
+// a pref (such as --advertise-routes and --advertise-exit-node)
+// combine with its current value. Only the prefs of setFlags are
+// masked in.
+func maskedPrefsFromSetFlags(setFlags *flag.FlagSet, curPrefs *ipn.Prefs, st *ipnstate.Status, goos string, warnf logger.Logf) (*ipn.MaskedPrefs, error) {
+	env := upCheckEnv{
+		goos:          goos,
+		curExitNodeIP: exitNodeIP(curPrefs, st),
+	}
+	var args upArgsT
+	fs := newUpFlagSet(goos, &args)
+	for name, v := range prefsToFlags(env, curPrefs) {
+		if v == nil || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+			return nil, fmt.Errorf("current value of --%s: %w", name, err)
+		}
+	}
+	var err error
+	setFlags.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only warn about the netfilter mode if it's being changed.
+	if !flagIsSet(setFlags, "netfilter-mode") {
+		warnf = logger.Discard
+	}
+	prefs, err := prefsFromUpArgs(args, warnf, st, goos)
+	if err != nil {
+		return nil, err
+	}
+	mp := &ipn.MaskedPrefs{Prefs: *prefs}
+	setFlags.Visit(func(f *flag.Flag) {
+		updateMaskedPrefsFromUpFlag(mp, f.Name)
+	})
+	return mp, nil
+}
@@ -8,12 +8,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"github.com/toqueteos/webbrowser"
@@ -27,7 +30,7 @@ import (
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [--active] [--web] [--json]",
+	ShortUsage: "status [--active] [--web] [--json] [--peer=<name> [--verbose]]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	Exec:       runStatus,
 	FlagSet: (func() *flag.FlagSet {
@@ -37,6 +40,8 @@ var statusCmd = &ffcli.Command{
 		fs.BoolVar(&statusArgs.active, "active", false, "filter output to only peers with active sessions (not applicable to web mode)")
 		fs.BoolVar(&statusArgs.self, "self", true, "show status of local machine")
 		fs.BoolVar(&statusArgs.peers, "peers", true, "show status of peers")
+		fs.StringVar(&statusArgs.peer, "peer", "", "show status of only the peer with this hostname, MagicDNS name or Tailscale IP (not applicable to web mode)")
+		fs.BoolVar(&statusArgs.verbose, "verbose", false, "with --peer, also show the peer's endpoints and the history of its network paths")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address for web mode; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
 		return fs
@@ -51,13 +56,30 @@ var statusArgs struct {
 	active  bool   // in CLI mode, filter output to only peers with active sessions
 	self    bool   // in CLI mode, show status of local machine
 	peers   bool   // in CLI mode, show status of peer machines
+	peer    string // if non-empty, show status of only this peer
+	verbose bool   // in CLI mode with peer, show path history
 }
 
 func runStatus(ctx context.Context, args []string) error {
+	if statusArgs.verbose && statusArgs.peer == "" {
+		return errors.New("--verbose requires --peer")
+	}
 	st, err := tailscale.Status(ctx)
 	if err != nil {
 		return fixTailscaledConnectError(err)
 	}
+	var onlyPeer *ipnstate.PeerStatus
+	if statusArgs.peer != "" && !statusArgs.web {
+		onlyPeer, err = findPeer(st, statusArgs.peer)
+		if err != nil {
+			return err
+		}
+		for peer, ps := range st.Peer {
+			if ps != onlyPeer {
+				delete(st.Peer, peer)
+			}
+		}
+	}
 	if statusArgs.json {
 		if statusArgs.active {
 			for peer, ps := range st.Peer {
@@ -150,7 +172,9 @@ func runStatus(ctx context.Context, args []string) error {
 			if ps.ExitNode {
 				f("exit node; ")
 			}
-			if relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer relay %q", ps.PeerRelay)
+			} else if relay != "" && ps.CurAddr == "" {
 				f("relay %q", relay)
 			} else if ps.CurAddr != "" {
 				f("direct %s", ps.CurAddr)
@@ -162,14 +186,14 @@ func runStatus(ctx context.Context, args []string) error {
 		f("\n")
 	}
 
-	if statusArgs.self && st.Self != nil {
+	if statusArgs.self && st.Self != nil && onlyPeer == nil {
 		printPS(st.Self)
 	}
 	if statusArgs.peers {
 		var peers []*ipnstate.PeerStatus
 		for _, peer := range st.Peers() {
 			ps := st.Peer[peer]
-			if ps.ShareeNode {
+			if ps.ShareeNode && ps != onlyPeer {
 				continue
 			}
 			peers = append(peers, ps)
@@ -182,10 +206,74 @@ func runStatus(ctx context.Context, args []string) error {
 			printPS(ps)
 		}
 	}
+	if statusArgs.verbose && onlyPeer != nil {
+		if err := printPeerPaths(ctx, &buf, onlyPeer); err != nil {
+			return err
+		}
+	}
 	os.Stdout.Write(buf.Bytes())
 	return nil
 }
 
+// findPeer returns the peer in st named by arg, a hostname, MagicDNS
+// name or Tailscale IP.
+func findPeer(st *ipnstate.Status, arg string) (*ipnstate.PeerStatus, error) {
+	match := matchPeers(st, arg)
+	switch len(match) {
+	case 0:
+		return nil, fmt.Errorf("no peer named %q", arg)
+	case 1:
+		return match[0], nil
+	default:
+		return nil, fmt.Errorf("%q matches %d peers; use its MagicDNS name or Tailscale IP instead", arg, len(match))
+	}
+}
+
+// printPeerPaths writes the details of how ps is reached, for
+// "status --peer --verbose": its endpoints and path history.
+func printPeerPaths(ctx context.Context, w io.Writer, ps *ipnstate.PeerStatus) error {
+	if len(ps.TailscaleIPs) == 0 {
+		return errors.New("peer has no Tailscale IP")
+	}
+	hist, err := tailscale.PathHistory(ctx, ps.TailscaleIPs[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nendpoints: %s\n", strings.Join(ps.Addrs, " "))
+	if ps.Latency != 0 {
+		fmt.Fprintf(w, "latency: %v\n", ps.Latency.Round(time.Millisecond/10))
+	}
+	if ps.PathMTU != 0 {
+		fmt.Fprintf(w, "path MTU: %d\n", ps.PathMTU)
+	}
+	if ps.ForwardedBytes != 0 || ps.ForwardDropped != 0 {
+		fmt.Fprintf(w, "forwarded: %d bytes, %d packets dropped by rate limit\n", ps.ForwardedBytes, ps.ForwardDropped)
+	}
+	fmt.Fprintf(w, "path history:\n")
+	if len(hist) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	orNone := func(path string) string {
+		if path == "" {
+			return "none"
+		}
+		return path
+	}
+	for _, pc := range hist {
+		fmt.Fprintf(w, "  %s  %s -> %s  %s",
+			pc.Time.Local().Format("2006-01-02 15:04:05"),
+			orNone(pc.From), orNone(pc.To), pc.Reason)
+		if pc.Latency != 0 {
+			fmt.Fprintf(w, ", latency %v", pc.Latency.Round(time.Millisecond/10))
+		}
+		if pc.Loss != 0 {
+			fmt.Fprintf(w, ", loss %.0f%%", pc.Loss*100)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return nil
+}
+
 func dnsOrQuoteHostname(st *ipnstate.Status, ps *ipnstate.PeerStatus) string {
 	baseName := dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix)
 	if baseName != "" {
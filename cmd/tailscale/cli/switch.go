@@ -0,0 +1,95 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var switchCmd = &ffcli.Command{
+	Name:       "switch",
+	ShortUsage: "switch [--remove] [<profile>]",
+	ShortHelp:  "Switch between login profiles",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale switch' command switches this machine to another login
+profile, each of which is logged in to its own tailnet with its own node
+key. Switching doesn't require logging in again.
+
+With no arguments, it lists the profiles. Switching to a profile that
+doesn't exist creates it, logged out; run 'tailscale up' to log it in.
+The profile in use before profiles were first used is named "default".
+`),
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("switch", flag.ExitOnError)
+		fs.BoolVar(&switchArgs.remove, "remove", false, "delete the profile instead of switching to it")
+		return fs
+	})(),
+	Exec: runSwitch,
+}
+
+var switchArgs struct {
+	remove bool
+}
+
+func runSwitch(ctx context.Context, args []string) error {
+	var profiles []ipn.LoginProfile
+	var err error
+	switch {
+	case len(args) > 1:
+		return errors.New("too many arguments; expected at most one profile name")
+	case len(args) == 0 && switchArgs.remove:
+		return errors.New("--remove requires a profile name")
+	case len(args) == 0:
+		profiles, err = tailscale.LoginProfiles(ctx)
+	case switchArgs.remove:
+		profiles, err = tailscale.DeleteProfile(ctx, args[0])
+	default:
+		if err := ipn.CheckProfileName(args[0]); err != nil {
+			return err
+		}
+		profiles, err = tailscale.SwitchProfile(ctx, args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 && !switchArgs.remove {
+		for _, p := range profiles {
+			if !p.Current {
+				continue
+			}
+			if p.LoginName == "" {
+				fmt.Printf("Switched to profile %q, which is logged out; run 'tailscale up' to log in.\n", p.Name)
+			} else {
+				fmt.Printf("Switched to profile %q (%s).\n", p.Name, p.LoginName)
+			}
+			return nil
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROFILE\tLOGIN\tCONTROL SERVER")
+	for _, p := range profiles {
+		name, login := p.Name, p.LoginName
+		if p.Current {
+			name += "*"
+		}
+		if login == "" {
+			login = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, login, p.ControlURL)
+	}
+	return tw.Flush()
+}
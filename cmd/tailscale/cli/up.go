@@ -9,10 +9,12 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -22,6 +24,7 @@ import (
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
@@ -69,6 +72,7 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.StringVar(&upArgs.server, "login-server", ipn.DefaultControlURL, "base URL of control server")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
 	upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	upf.BoolVar(&upArgs.dns64, "dns64", false, "with --accept-dns, when this device has no IPv4 connectivity, resolve IPv4-only names to IPv6 addresses of a subnet router doing NAT64")
 	upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
 	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
@@ -78,6 +82,11 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	upf.StringVar(&upArgs.advertiseEndpoints, "advertise-endpoints", "", "ip:ports at which peers can reach this node directly, in addition to those found automatically, such as the public side of port forwards (comma-separated, e.g. \"203.0.113.7:41641\")")
+	upf.BoolVar(&upArgs.advertisePeerRelay, "advertise-peer-relay", false, "offer to relay traffic between other tailnet nodes that can't connect to each other directly")
+	upf.BoolVar(&upArgs.qos, "qos", false, "prioritize outbound traffic: --qos-classes first, then interactive flows, then bulk transfers")
+	upf.StringVar(&upArgs.forwardRateLimit, "forward-rate-limit", "", "as a subnet router or exit node, the most bits per second to forward for each peer, with an optional k, M or G suffix (e.g. \"20M\"), or empty string for no limit")
+	upf.StringVar(&upArgs.qosClasses, "qos-classes", "", "with --qos, classes of traffic to send before all other traffic, highest priority first, each a name and \"+\"-separated ports or DSCP values (comma-separated, e.g. \"ssh:22,voice:5060+dscp46\")")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
 	}
@@ -103,6 +112,7 @@ type upArgsT struct {
 	server                 string
 	acceptRoutes           bool
 	acceptDNS              bool
+	dns64                  bool
 	singleRoutes           bool
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
@@ -112,6 +122,11 @@ type upArgsT struct {
 	advertiseRoutes        string
 	advertiseDefaultRoute  bool
 	advertiseTags          string
+	advertiseEndpoints     string
+	advertisePeerRelay     bool
+	qos                    bool
+	qosClasses             string
+	forwardRateLimit       string
 	snat                   bool
 	netfilterMode          string
 	authKey                string
@@ -207,6 +222,27 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		}
 	}
 
+	var endpoints []netaddr.IPPort
+	if upArgs.advertiseEndpoints != "" {
+		for _, s := range strings.Split(upArgs.advertiseEndpoints, ",") {
+			ipp, err := netaddr.ParseIPPort(s)
+			if err != nil || ipp.Port() == 0 {
+				return nil, fmt.Errorf("%q is not a valid ip:port endpoint", s)
+			}
+			endpoints = append(endpoints, ipp)
+		}
+	}
+
+	qosClasses, err := preftype.ParseQoSClasses(upArgs.qosClasses)
+	if err != nil {
+		return nil, err
+	}
+
+	forwardRateLimit, err := parseBitRate(upArgs.forwardRateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --forward-rate-limit: %v", err)
+	}
+
 	if len(upArgs.hostname) > 256 {
 		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
@@ -218,10 +254,16 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.ExitNodeIP = exitNodeIP
 	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
 	prefs.CorpDNS = upArgs.acceptDNS
+	prefs.DNS64 = upArgs.dns64
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
 	prefs.AdvertiseRoutes = routes
 	prefs.AdvertiseTags = tags
+	prefs.AdvertiseEndpoints = endpoints
+	prefs.AdvertisePeerRelay = upArgs.advertisePeerRelay
+	prefs.QoS = upArgs.qos
+	prefs.QoSClasses = qosClasses
+	prefs.ForwardRateLimit = forwardRateLimit
 	prefs.Hostname = upArgs.hostname
 	prefs.ForceDaemon = upArgs.forceDaemon
 	prefs.OperatorUser = upArgs.opUser
@@ -508,7 +550,13 @@ func init() {
 	// The rest are 1:1:
 	addPrefFlagMapping("accept-dns", "CorpDNS")
 	addPrefFlagMapping("accept-routes", "RouteAll")
+	addPrefFlagMapping("dns64", "DNS64")
 	addPrefFlagMapping("advertise-tags", "AdvertiseTags")
+	addPrefFlagMapping("advertise-endpoints", "AdvertiseEndpoints")
+	addPrefFlagMapping("advertise-peer-relay", "AdvertisePeerRelay")
+	addPrefFlagMapping("qos", "QoS")
+	addPrefFlagMapping("qos-classes", "QoSClasses")
+	addPrefFlagMapping("forward-rate-limit", "ForwardRateLimit")
 	addPrefFlagMapping("host-routes", "AllowSingleHosts")
 	addPrefFlagMapping("hostname", "Hostname")
 	addPrefFlagMapping("login-server", "ControlURL")
@@ -654,15 +702,26 @@ func checkForAccidentalSettingReverts(newPrefs, curPrefs *ipn.Prefs, env upCheck
 	return errors.New(sb.String())
 }
 
-// applyImplicitPrefs mutates prefs to add implicit preferences. Currently
-// this is just the operator user, which only needs to be set if it doesn't
-// match the current user.
+// applyImplicitPrefs mutates prefs to add implicit preferences: the
+// operator user, which only needs to be set if it doesn't match the
+// current user, automatic exit node selection, unless prefs name an
+// exit node, and the "tailscale serve" handlers.
 //
 // curUser is os.Getenv("USER"). It's pulled out for testability.
 func applyImplicitPrefs(prefs, oldPrefs *ipn.Prefs, curUser string) {
 	if prefs.OperatorUser == "" && oldPrefs.OperatorUser == curUser {
 		prefs.OperatorUser = oldPrefs.OperatorUser
 	}
+	if oldPrefs.AutoExitNode && prefs.ExitNodeIP.IsZero() && prefs.ExitNodeID.IsZero() {
+		// There's no flag for it; it's set by "tailscale exit-node
+		// use auto". Keep the exit node it picked, too.
+		prefs.AutoExitNode = true
+		prefs.ExitNodeID = oldPrefs.ExitNodeID
+	}
+	if prefs.Serve == nil {
+		// There's no flag for it; it's set by "tailscale serve".
+		prefs.Serve = oldPrefs.Serve
+	}
 }
 
 func flagAppliesToOS(flag, goos string) bool {
@@ -679,6 +738,11 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 	ret := make(map[string]interface{})
 
 	exitNodeIPStr := func() string {
+		if prefs.AutoExitNode {
+			// Not set by --exit-node, so nothing for the up
+			// checker to revert.
+			return ""
+		}
 		if !prefs.ExitNodeIP.IsZero() {
 			return prefs.ExitNodeIP.String()
 		}
@@ -719,6 +783,32 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			set(prefs.ExitNodeAllowLANAccess)
 		case "advertise-tags":
 			set(strings.Join(prefs.AdvertiseTags, ","))
+		case "advertise-endpoints":
+			var sb strings.Builder
+			for i, ep := range prefs.AdvertiseEndpoints {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(ep.String())
+			}
+			set(sb.String())
+		case "advertise-peer-relay":
+			set(prefs.AdvertisePeerRelay)
+		case "dns64":
+			set(prefs.DNS64)
+		case "qos":
+			set(prefs.QoS)
+		case "forward-rate-limit":
+			set(formatBitRate(prefs.ForwardRateLimit))
+		case "qos-classes":
+			var sb strings.Builder
+			for i, c := range prefs.QoSClasses {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(c.String())
+			}
+			set(sb.String())
 		case "hostname":
 			set(prefs.Hostname)
 		case "operator":
@@ -733,7 +823,7 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			}
 			set(sb.String())
 		case "advertise-exit-node":
-			set(hasExitNodeRoutes(prefs.AdvertiseRoutes))
+			set(tsaddr.ContainsExitRoutes(prefs.AdvertiseRoutes))
 		case "snat-subnet-routes":
 			set(!prefs.NoSNAT)
 		case "netfilter-mode":
@@ -755,25 +845,11 @@ func fmtFlagValueArg(flagName string, val interface{}) string {
 	return fmt.Sprintf("--%s=%v", flagName, shellquote.Join(fmt.Sprint(val)))
 }
 
-func hasExitNodeRoutes(rr []netaddr.IPPrefix) bool {
-	var v4, v6 bool
-	for _, r := range rr {
-		if r.Bits() == 0 {
-			if r.IP().Is4() {
-				v4 = true
-			} else if r.IP().Is6() {
-				v6 = true
-			}
-		}
-	}
-	return v4 && v6
-}
-
 // withoutExitNodes returns rr unchanged if it has only 1 or 0 /0
 // routes. If it has both IPv4 and IPv6 /0 routes, then it returns
 // a copy with all /0 routes removed.
 func withoutExitNodes(rr []netaddr.IPPrefix) []netaddr.IPPrefix {
-	if !hasExitNodeRoutes(rr) {
+	if !tsaddr.ContainsExitRoutes(rr) {
 		return rr
 	}
 	var out []netaddr.IPPrefix
@@ -808,3 +884,56 @@ func exitNodeIP(p *ipn.Prefs, st *ipnstate.Status) (ip netaddr.IP) {
 	}
 	return
 }
+
+// bitRateUnits are the suffixes that parseBitRate accepts, largest
+// first.
+var bitRateUnits = []struct {
+	suffix string
+	bits   int64
+}{
+	{"G", 1e9},
+	{"M", 1e6},
+	{"k", 1e3},
+}
+
+// minBitRate is the least non-zero rate parseBitRate accepts.
+const minBitRate = 8
+
+// parseBitRate parses a rate in bits per second, with an optional k,
+// M or G suffix, such as "20M". The empty string is zero.
+func parseBitRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num, mult := s, int64(1)
+	for _, u := range bitRateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, mult = strings.TrimSuffix(s, u.suffix), u.bits
+			break
+		}
+	}
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64/mult {
+		return 0, fmt.Errorf("%q is not a valid rate", s)
+	}
+	if v*mult > 0 && v*mult < minBitRate {
+		// Limits are applied in bytes per second, so smaller
+		// rates would round down to zero: no limit.
+		return 0, fmt.Errorf("%q is less than %d bits per second", s, minBitRate)
+	}
+	return v * mult, nil
+}
+
+// formatBitRate formats bits per second as parseBitRate parses it,
+// with the largest suffix that represents it exactly.
+func formatBitRate(v int64) string {
+	if v == 0 {
+		return ""
+	}
+	for _, u := range bitRateUnits {
+		if v%u.bits == 0 {
+			return strconv.FormatInt(v/u.bits, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(v, 10)
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/version"
 )
 
@@ -22,6 +23,7 @@ var versionCmd = &ffcli.Command{
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("version", flag.ExitOnError)
 		fs.BoolVar(&versionArgs.daemon, "daemon", false, "also print local node's daemon version")
+		fs.BoolVar(&versionArgs.json, "json", false, "output in JSON format")
 		return fs
 	})(),
 	Exec: runVersion,
@@ -29,23 +31,33 @@ var versionCmd = &ffcli.Command{
 
 var versionArgs struct {
 	daemon bool // also check local node's daemon version
+	json   bool
 }
 
 func runVersion(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		log.Fatalf("too many non-flag arguments: %q", args)
 	}
-	if !versionArgs.daemon {
-		fmt.Println(version.String())
-		return nil
+	out := apitype.VersionOutput{
+		Schema: apitype.CLIOutputSchema,
+		Client: version.String(),
+	}
+	if versionArgs.daemon {
+		st, err := tailscale.StatusWithoutPeers(ctx)
+		if err != nil {
+			return err
+		}
+		out.Daemon = st.Version
 	}
 
-	fmt.Printf("Client: %s\n", version.String())
-
-	st, err := tailscale.StatusWithoutPeers(ctx)
-	if err != nil {
-		return err
+	switch {
+	case versionArgs.json:
+		return printJSON(out)
+	case versionArgs.daemon:
+		fmt.Printf("Client: %s\n", out.Client)
+		fmt.Printf("Daemon: %s\n", out.Daemon)
+	default:
+		fmt.Println(out.Client)
 	}
-	fmt.Printf("Daemon: %s\n", st.Version)
 	return nil
 }
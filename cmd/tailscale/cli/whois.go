@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var whoisCmd = &ffcli.Command{
+	Name:       "whois",
+	ShortUsage: "whois <ip[:port]>",
+	ShortHelp:  "Show the machine and user associated with a Tailscale IP",
+	LongHelp: strings.TrimSpace(`
+'tailscale whois' shows the machine and user that own a Tailscale IP
+address, along with the machine's tags and capabilities and the
+destinations on this machine that the packet filter lets it reach.
+
+The argument may also be an ip:port, such as the remote address of an
+incoming connection, or the name of a peer.
+`),
+	Exec: runWhoIs,
+}
+
+func runWhoIs(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: whois <ip[:port]>")
+	}
+	addr, err := whoisAddr(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	res, err := tailscale.WhoIs(ctx, addr)
+	if err != nil {
+		return err
+	}
+	printWhoIs(os.Stdout, res)
+	return nil
+}
+
+// whoisAddr returns arg as an ip:port for the LocalAPI whois handler.
+// A bare IP or peer name gets port 0.
+func whoisAddr(ctx context.Context, arg string) (string, error) {
+	if ipp, err := netaddr.ParseIPPort(arg); err == nil {
+		return ipp.String(), nil
+	}
+	ipStr, err := tailscaleIPFromArg(ctx, arg)
+	if err != nil {
+		return "", err
+	}
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		return "", err
+	}
+	return netaddr.IPPortFrom(ip, 0).String(), nil
+}
+
+func printWhoIs(w io.Writer, res *apitype.WhoIsResponse) {
+	if n := res.Node; n != nil {
+		fmt.Fprintf(w, "Machine:\n")
+		fmt.Fprintf(w, "  Name:          %s\n", strings.TrimSuffix(n.Name, "."))
+		fmt.Fprintf(w, "  ID:            %s\n", n.StableID)
+		var addrs []string
+		for _, a := range n.Addresses {
+			addrs = append(addrs, a.IP().String())
+		}
+		fmt.Fprintf(w, "  Addresses:     %s\n", strings.Join(addrs, ", "))
+		if len(res.Tags) > 0 {
+			fmt.Fprintf(w, "  Tags:          %s\n", strings.Join(res.Tags, ", "))
+		}
+		if res.Online != nil {
+			fmt.Fprintf(w, "  Online:        %v\n", *res.Online)
+		}
+		for i, c := range res.Caps {
+			if i == 0 {
+				fmt.Fprintf(w, "  Capabilities:  %s\n", c)
+			} else {
+				fmt.Fprintf(w, "                 %s\n", c)
+			}
+		}
+	}
+	if u := res.UserProfile; u != nil && len(res.Tags) == 0 {
+		fmt.Fprintf(w, "User:\n")
+		fmt.Fprintf(w, "  Name:          %s\n", u.LoginName)
+		fmt.Fprintf(w, "  ID:            %d\n", u.ID)
+	}
+	if len(res.AllowedDsts) > 0 {
+		fmt.Fprintf(w, "Allowed to reach:\n")
+		for _, d := range res.AllowedDsts {
+			fmt.Fprintf(w, "  %s\n", d)
+		}
+	}
+}
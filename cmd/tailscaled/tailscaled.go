@@ -12,6 +12,7 @@ package main // import "tailscale.com/cmd/tailscaled"
 import (
 	"context"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
@@ -29,6 +30,7 @@ import (
 
 	"github.com/go-multierror/multierror"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
@@ -76,10 +78,20 @@ var args struct {
 	cleanup    bool
 	debug      string
 	port       uint16
+	extraPorts []uint16
 	statepath  string
 	socketpath string
 	verbose    int
 	socksAddr  string // listen address for SOCKS5 server
+
+	// dnsHostsFile is the path of an optional hosts(5)-style file
+	// whose entries are merged into MagicDNS.
+	dnsHostsFile string
+
+	// confPath is the path of the optional config file; see
+	// package conffile. config is its loaded contents.
+	confPath string
+	config   *conffile.Config
 }
 
 var (
@@ -109,8 +121,11 @@ func main() {
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
+	flag.Var(flagtype.PortListValue(&args.extraPorts, wgengine.MaxExtraListenPorts), "extra-ports", fmt.Sprintf(`up to %d more UDP ports or port ranges to also listen on for peer-to-peer traffic (e.g. "41642,41700-41710")`, wgengine.MaxExtraListenPorts))
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	flag.StringVar(&args.dnsHostsFile, "dns-hosts-file", "", "optional path of a hosts(5)-style file whose entries override MagicDNS records; reloaded when changed")
+	flag.StringVar(&args.confPath, "config", "", "optional path of a JSON or HuJSON config file declaring prefs to apply at startup and on SIGHUP")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -152,6 +167,17 @@ func main() {
 		log.Fatalf("--socket is required")
 	}
 
+	if args.confPath != "" {
+		// Load it before anything starts, so a bad config is
+		// reported right away.
+		c, err := conffile.Load(args.confPath)
+		if err != nil {
+			log.SetFlags(0)
+			log.Fatalf("--config: %v", err)
+		}
+		args.config = c
+	}
+
 	err := run()
 
 	// Remove file sharing from Windows shell (noop in non-windows)
@@ -174,6 +200,8 @@ func ipnServerOpts() (o ipnserver.Options) {
 	o.Port = 41112
 	o.StatePath = args.statepath
 	o.SocketPath = args.socketpath // even for goos=="windows", for tests
+	o.DNSHostsFile = args.dnsHostsFile
+	o.Config = args.config
 
 	switch goos {
 	default:
@@ -258,6 +286,10 @@ func run() error {
 		return err
 	}
 
+	if tunDev, _, ok := e.(wgengine.InternalsGetter).GetInternals(); ok {
+		expvar.Publish("tstun_qos", tunDev.QoSExpVar())
+	}
+
 	var ns *netstack.Impl
 	if useNetstack || wrapNetstack {
 		onlySubnets := wrapNetstack && !useNetstack
@@ -271,6 +303,8 @@ func run() error {
 		}()
 	}
 
+	dialer := tssocks.NewDialer(e, ns)
+
 	e = wgengine.NewWatchdog(e)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -294,6 +328,7 @@ func run() error {
 
 	opts := ipnServerOpts()
 	opts.DebugMux = debugMux
+	opts.Dialer = dialer
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
 	if err != nil && err != context.Canceled {
@@ -345,8 +380,9 @@ func shouldWrapNetstack() bool {
 
 func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.Engine, useNetstack bool, err error) {
 	conf := wgengine.Config{
-		ListenPort:  args.port,
-		LinkMonitor: linkMon,
+		ListenPort:       args.port,
+		ExtraListenPorts: args.extraPorts,
+		LinkMonitor:      linkMon,
 	}
 	useNetstack = name == "userspace-networking"
 	if !useNetstack {
@@ -391,6 +427,7 @@ func newDebugMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
 	return mux
 }
 
@@ -39,9 +39,10 @@ const NonceLen = 24
 type MessageType byte
 
 const (
-	TypePing        = MessageType(0x01)
-	TypePong        = MessageType(0x02)
-	TypeCallMeMaybe = MessageType(0x03)
+	TypePing           = MessageType(0x01)
+	TypePong           = MessageType(0x02)
+	TypeCallMeMaybe    = MessageType(0x03)
+	TypePortPrediction = MessageType(0x04)
 )
 
 const v0 = byte(0)
@@ -71,6 +72,8 @@ func Parse(p []byte) (Message, error) {
 		return parsePong(ver, p)
 	case TypeCallMeMaybe:
 		return parseCallMeMaybe(ver, p)
+	case TypePortPrediction:
+		return parsePortPrediction(ver, p)
 	default:
 		return nil, fmt.Errorf("unknown message type 0x%02x", byte(t))
 	}
@@ -97,10 +100,15 @@ func appendMsgHeader(b []byte, t MessageType, ver uint8, dataLen int) (all, data
 
 type Ping struct {
 	TxID [12]byte
+
+	// Padding is the number of zero bytes appended to the
+	// message, to probe whether packets of a given size make it
+	// through the path. Receivers ignore it.
+	Padding int
 }
 
 func (m *Ping) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePing, v0, 12)
+	ret, d := appendMsgHeader(b, TypePing, v0, 12+m.Padding)
 	copy(d, m.TxID[:])
 	return ret
 }
@@ -111,6 +119,7 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	}
 	m = new(Ping)
 	copy(m.TxID[:], p)
+	m.Padding = len(p) - 12
 	return m, nil
 }
 
@@ -207,6 +216,44 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	return m, nil
 }
 
+// PortPrediction is a message sent only over DERP, after a
+// CallMeMaybe, by a node behind a NAT whose mappings vary by
+// destination but whose ports appear to be allocated sequentially.
+//
+// It tells the recipient where the sender's NAT probably mapped the
+// sender's packets to the recipient: at Last.Port()+Delta,
+// Last.Port()+2*Delta, and so on, on Last.IP(). The recipient may
+// then ping those ports to get through both NATs.
+type PortPrediction struct {
+	// Last is the most recent NAT mapping the sender knows of,
+	// as seen by a STUN server.
+	Last netaddr.IPPort
+	// Delta is the step between successively allocated ports.
+	Delta int16
+}
+
+const portPredictionLen = 16 + 2 + 2
+
+func (m *PortPrediction) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypePortPrediction, v0, portPredictionLen)
+	ip16 := m.Last.IP().As16()
+	d = d[copy(d, ip16[:]):]
+	binary.BigEndian.PutUint16(d, m.Last.Port())
+	binary.BigEndian.PutUint16(d[2:], uint16(m.Delta))
+	return ret
+}
+
+func parsePortPrediction(ver uint8, p []byte) (m *PortPrediction, err error) {
+	if len(p) < portPredictionLen {
+		return nil, errShort
+	}
+	m = new(PortPrediction)
+	ip, _ := netaddr.FromStdIP(net.IP(p[:16]))
+	m.Last = netaddr.IPPortFrom(ip, binary.BigEndian.Uint16(p[16:]))
+	m.Delta = int16(binary.BigEndian.Uint16(p[18:]))
+	return m, nil
+}
+
 // MessageSummary returns a short summary of m for logging purposes.
 func MessageSummary(m Message) string {
 	switch m := m.(type) {
@@ -216,6 +263,8 @@ func MessageSummary(m Message) string {
 		return fmt.Sprintf("pong tx=%x", m.TxID[:6])
 	case *CallMeMaybe:
 		return "call-me-maybe"
+	case *PortPrediction:
+		return fmt.Sprintf("port-prediction last=%v delta=%+d", m.Last, m.Delta)
 	default:
 		return fmt.Sprintf("%#v", m)
 	}
@@ -137,6 +137,65 @@ func (n Notify) String() string {
 	return s[0:len(s)-1] + "}"
 }
 
+// NotifyWatchOpt is a bitmask of the kinds of Notify messages to
+// watch for with LocalBackend.WatchNotifications. Zero means all of
+// them.
+type NotifyWatchOpt uint64
+
+const (
+	// NotifyWatchNetMap watches NetMap.
+	NotifyWatchNetMap NotifyWatchOpt = 1 << iota
+	// NotifyWatchPrefs watches Prefs.
+	NotifyWatchPrefs
+	// NotifyWatchState watches State, along with ErrMessage,
+	// LoginFinished and BrowseToURL.
+	NotifyWatchState
+	// NotifyWatchEngine watches Engine.
+	NotifyWatchEngine
+	// NotifyWatchFiles watches FilesWaiting and IncomingFiles.
+	NotifyWatchFiles
+
+	// NotifyInitialState makes a watch start with a Notify of the
+	// current state, prefs and netmap, those that are watched.
+	NotifyInitialState
+)
+
+// Filter returns n with only the fields that m watches, and whether
+// any of them are set.
+func (m NotifyWatchOpt) Filter(n Notify) (_ Notify, ok bool) {
+	if m&^NotifyInitialState == 0 {
+		return n, true
+	}
+	if m&NotifyWatchNetMap == 0 {
+		n.NetMap = nil
+	}
+	if m&NotifyWatchPrefs == 0 {
+		n.Prefs = nil
+	}
+	if m&NotifyWatchState == 0 {
+		n.State = nil
+		n.ErrMessage = nil
+		n.LoginFinished = nil
+		n.BrowseToURL = nil
+	}
+	if m&NotifyWatchEngine == 0 {
+		n.Engine = nil
+	}
+	if m&NotifyWatchFiles == 0 {
+		n.FilesWaiting = nil
+		n.IncomingFiles = nil
+	}
+	// The rest are only sent to watchers of everything.
+	n.BackendLogID = nil
+	n.PingResult = nil
+	n.LocalTCPPort = nil
+
+	ok = n.NetMap != nil || n.Prefs != nil || n.State != nil ||
+		n.ErrMessage != nil || n.LoginFinished != nil || n.BrowseToURL != nil ||
+		n.Engine != nil || n.FilesWaiting != nil || n.IncomingFiles != nil
+	return n, ok
+}
+
 // PartialFile represents an in-progress file transfer.
 type PartialFile struct {
 	Name         string    // e.g. "foo.jpg"
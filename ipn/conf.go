@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+	"tailscale.com/types/preftype"
+)
+
+// ConfigVAlpha is the config file format of tailscaled's --config
+// flag, version "alpha0". Fields that are unset (nil, or empty for
+// opt.Bool) leave the corresponding prefs alone, so they can still be
+// changed with the tailscale CLI.
+type ConfigVAlpha struct {
+	Version string // "alpha0"
+
+	ServerURL *string  `json:",omitempty"` // the control server URL
+	AuthKey   *string  `json:",omitempty"` // used to log in if needed
+	Enabled   opt.Bool `json:",omitempty"` // whether to be connected; WantRunning
+	Hostname  *string  `json:",omitempty"`
+
+	AcceptDNS    opt.Bool `json:",omitempty"` // CorpDNS
+	AcceptRoutes opt.Bool `json:",omitempty"` // RouteAll
+	DNS64        opt.Bool `json:",omitempty"`
+
+	// ExitNode is the Tailscale IP or stable node ID of the exit
+	// node to use, or empty for none.
+	ExitNode                   *string  `json:",omitempty"`
+	AllowLANWhileUsingExitNode opt.Bool `json:",omitempty"`
+
+	AdvertiseRoutes []netaddr.IPPrefix `json:",omitempty"`
+	AdvertiseTags   []string           `json:",omitempty"`
+
+	// AdvertiseEndpoints are ip:ports at which peers can reach this
+	// node directly, such as the public side of port forwards.
+	AdvertiseEndpoints []netaddr.IPPort `json:",omitempty"`
+	AdvertisePeerRelay opt.Bool         `json:",omitempty"`
+
+	// QoS enables prioritizing outbound traffic, with QoSClasses
+	// first, highest priority first.
+	QoS        opt.Bool            `json:",omitempty"`
+	QoSClasses []preftype.QoSClass `json:",omitempty"`
+
+	// ForwardRateLimit is the rate, in bits per second, at which to
+	// forward each peer's traffic as a subnet router or exit node,
+	// or zero for no limit.
+	ForwardRateLimit *int64 `json:",omitempty"`
+
+	ShieldsUp opt.Bool `json:",omitempty"`
+
+	// NetfilterMode is "on", "nodivert" or "off". Linux only.
+	NetfilterMode *string  `json:",omitempty"`
+	NoSNAT        opt.Bool `json:",omitempty"`
+}
+
+// ToPrefs validates c and returns the prefs edits it declares.
+func (c *ConfigVAlpha) ToPrefs() (MaskedPrefs, error) {
+	var mp MaskedPrefs
+	if c == nil {
+		return mp, nil
+	}
+	if c.Version != "alpha0" {
+		return mp, fmt.Errorf("unsupported config version %q; want \"alpha0\"", c.Version)
+	}
+	if c.ServerURL != nil {
+		mp.ControlURL = *c.ServerURL
+		mp.ControlURLSet = true
+	}
+	if v, ok := c.Enabled.Get(); ok {
+		mp.WantRunning = v
+		mp.WantRunningSet = true
+	}
+	if c.Hostname != nil {
+		if len(*c.Hostname) > 256 {
+			return mp, fmt.Errorf("hostname too long: %d bytes (max 256)", len(*c.Hostname))
+		}
+		mp.Hostname = *c.Hostname
+		mp.HostnameSet = true
+	}
+	if v, ok := c.AcceptDNS.Get(); ok {
+		mp.CorpDNS = v
+		mp.CorpDNSSet = true
+	}
+	if v, ok := c.DNS64.Get(); ok {
+		mp.DNS64 = v
+		mp.DNS64Set = true
+	}
+	if v, ok := c.AcceptRoutes.Get(); ok {
+		mp.RouteAll = v
+		mp.RouteAllSet = true
+	}
+	if c.ExitNode != nil {
+		if ip, err := netaddr.ParseIP(*c.ExitNode); err == nil {
+			mp.ExitNodeIP = ip
+		} else {
+			mp.ExitNodeID = tailcfg.StableNodeID(*c.ExitNode)
+		}
+		mp.ExitNodeIPSet = true
+		mp.ExitNodeIDSet = true
+		mp.AutoExitNodeSet = true // a configured exit node isn't automatic
+	}
+	if v, ok := c.AllowLANWhileUsingExitNode.Get(); ok {
+		mp.ExitNodeAllowLANAccess = v
+		mp.ExitNodeAllowLANAccessSet = true
+	}
+	if c.AdvertiseRoutes != nil {
+		routes, err := checkAdvertiseRoutes(c.AdvertiseRoutes)
+		if err != nil {
+			return mp, err
+		}
+		mp.AdvertiseRoutes = routes
+		mp.AdvertiseRoutesSet = true
+	}
+	if c.AdvertiseTags != nil {
+		for _, tag := range c.AdvertiseTags {
+			if err := tailcfg.CheckTag(tag); err != nil {
+				return mp, fmt.Errorf("tag: %q: %s", tag, err)
+			}
+		}
+		mp.AdvertiseTags = append([]string{}, c.AdvertiseTags...)
+		mp.AdvertiseTagsSet = true
+	}
+	if c.AdvertiseEndpoints != nil {
+		for _, ep := range c.AdvertiseEndpoints {
+			if ep.Port() == 0 {
+				return mp, fmt.Errorf("endpoint %v has no port", ep)
+			}
+		}
+		mp.AdvertiseEndpoints = append([]netaddr.IPPort{}, c.AdvertiseEndpoints...)
+		mp.AdvertiseEndpointsSet = true
+	}
+	if v, ok := c.AdvertisePeerRelay.Get(); ok {
+		mp.AdvertisePeerRelay = v
+		mp.AdvertisePeerRelaySet = true
+	}
+	if v, ok := c.QoS.Get(); ok {
+		mp.QoS = v
+		mp.QoSSet = true
+	}
+	if c.QoSClasses != nil {
+		if err := preftype.CheckQoSClasses(c.QoSClasses); err != nil {
+			return mp, err
+		}
+		mp.QoSClasses = make([]preftype.QoSClass, len(c.QoSClasses))
+		for i := range c.QoSClasses {
+			mp.QoSClasses[i] = *c.QoSClasses[i].Clone()
+		}
+		mp.QoSClassesSet = true
+	}
+	if c.ForwardRateLimit != nil {
+		if v := *c.ForwardRateLimit; v < 0 || v > 0 && v < 8 {
+			return mp, fmt.Errorf("ForwardRateLimit %d is neither zero nor at least 8 bits per second", v)
+		}
+		mp.ForwardRateLimit = *c.ForwardRateLimit
+		mp.ForwardRateLimitSet = true
+	}
+	if v, ok := c.ShieldsUp.Get(); ok {
+		mp.ShieldsUp = v
+		mp.ShieldsUpSet = true
+	}
+	if c.NetfilterMode != nil {
+		switch *c.NetfilterMode {
+		case "on":
+			mp.NetfilterMode = preftype.NetfilterOn
+		case "nodivert":
+			mp.NetfilterMode = preftype.NetfilterNoDivert
+		case "off":
+			mp.NetfilterMode = preftype.NetfilterOff
+		default:
+			return mp, fmt.Errorf("invalid NetfilterMode %q; want on, nodivert or off", *c.NetfilterMode)
+		}
+		mp.NetfilterModeSet = true
+	}
+	if v, ok := c.NoSNAT.Get(); ok {
+		mp.NoSNAT = v
+		mp.NoSNATSet = true
+	}
+	return mp, nil
+}
+
+var (
+	ipv4Default = netaddr.MustParseIPPrefix("0.0.0.0/0")
+	ipv6Default = netaddr.MustParseIPPrefix("::/0")
+)
+
+// checkAdvertiseRoutes checks routes the same way as "tailscale up
+// --advertise-routes" and returns them sorted and deduplicated.
+func checkAdvertiseRoutes(routes []netaddr.IPPrefix) ([]netaddr.IPPrefix, error) {
+	seen := map[netaddr.IPPrefix]bool{}
+	var ret []netaddr.IPPrefix
+	for _, ipp := range routes {
+		if ipp != ipp.Masked() {
+			return nil, fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+		}
+		if !seen[ipp] {
+			seen[ipp] = true
+			ret = append(ret, ipp)
+		}
+	}
+	if seen[ipv4Default] != seen[ipv6Default] {
+		return nil, errors.New("exit node routes 0.0.0.0/0 and ::/0 must be advertised together")
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Bits() != ret[j].Bits() {
+			return ret[i].Bits() < ret[j].Bits()
+		}
+		return ret[i].IP().Less(ret[j].IP())
+	})
+	return ret, nil
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conffile handles tailscaled's config file, which declares
+// the node's prefs and is given with the --config flag.
+package conffile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/ipn"
+)
+
+// Config is a loaded and validated config file.
+type Config struct {
+	Path   string           // where it was loaded from
+	Raw    []byte           // its contents, as HuJSON
+	Parsed ipn.ConfigVAlpha // the parsed contents
+	Prefs  ipn.MaskedPrefs  // the prefs edits it declares
+}
+
+// AuthKey returns the auth key in c, if any.
+func (c *Config) AuthKey() string {
+	if c.Parsed.AuthKey == nil {
+		return ""
+	}
+	return *c.Parsed.AuthKey
+}
+
+// Load reads, parses and validates the config file at path, which is
+// JSON or HuJSON (JSON with comments and trailing commas).
+func Load(path string) (*Config, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.Path = path
+	return c, nil
+}
+
+// Parse parses and validates the contents of a config file.
+func Parse(raw []byte) (*Config, error) {
+	c := &Config{Raw: raw}
+	dec := hujson.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c.Parsed); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	mp, err := c.Parsed.ToPrefs()
+	if err != nil {
+		return nil, err
+	}
+	c.Prefs = mp
+	return c, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conffile
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/preftype"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{
+		// A node that's a subnet router.
+		"Version": "alpha0",
+		"AuthKey": "tskey-abc",
+		"Hostname": "router",
+		"AcceptDNS": false,
+		"ExitNode": "100.64.0.7",
+		"AdvertiseRoutes": ["10.1.0.0/16", "10.0.0.0/24", "10.1.0.0/16"],
+		"AdvertiseTags": ["tag:router"],
+		"NetfilterMode": "nodivert",
+		"QoS": true,
+		"QoSClasses": [{"Name": "ssh", "Ports": [22]}],
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.AuthKey(); got != "tskey-abc" {
+		t.Errorf("AuthKey = %q", got)
+	}
+
+	p := ipn.NewPrefs()
+	p.ExitNodeID = "nOLD"
+	p.AutoExitNode = true
+	p.ApplyEdits(&c.Prefs)
+	want := ipn.NewPrefs()
+	want.Hostname = "router"
+	want.CorpDNS = false
+	want.ExitNodeIP = netaddr.MustParseIP("100.64.0.7")
+	want.AdvertiseRoutes = []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.1.0.0/16"),
+		netaddr.MustParseIPPrefix("10.0.0.0/24"),
+	}
+	want.AdvertiseTags = []string{"tag:router"}
+	want.NetfilterMode = preftype.NetfilterNoDivert
+	want.QoS = true
+	want.QoSClasses = []preftype.QoSClass{{Name: "ssh", Ports: []uint16{22}}}
+	if !p.Equals(want) {
+		t.Errorf("prefs = %v; want %v", p.Pretty(), want.Pretty())
+	}
+
+	c, err = Parse([]byte(`{"Version": "alpha0", "ExitNode": "nABCDEF1CNTRL"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Prefs.ExitNodeID, tailcfg.StableNodeID("nABCDEF1CNTRL"); got != want {
+		t.Errorf("ExitNodeID = %q; want %q", got, want)
+	}
+	if !c.Prefs.ExitNodeIP.IsZero() {
+		t.Errorf("ExitNodeIP = %v; want none", c.Prefs.ExitNodeIP)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		`{}`,
+		`{"Version": "alpha1"}`,
+		`{"Version": "alpha0", "NoSuchField": true}`,
+		`{"Version": "alpha0", "AdvertiseTags": ["router"]}`,
+		`{"Version": "alpha0", "AdvertiseRoutes": ["10.0.0.1/8"]}`,
+		`{"Version": "alpha0", "AdvertiseRoutes": ["0.0.0.0/0"]}`,
+		`{"Version": "alpha0", "NetfilterMode": "maybe"}`,
+		`{"Version": "alpha0", "QoSClasses": [{"Name": "bulk", "Ports": [22]}]}`,
+		`{"Version": "alpha0", "QoSClasses": [{"Name": "voice", "DSCP": [64]}]}`,
+		`{"Version": "alpha0",`,
+	}
+	for _, in := range tests {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("Parse(%s) succeeded; want error", in)
+		}
+	}
+}
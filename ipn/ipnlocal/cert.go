@@ -0,0 +1,273 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"tailscale.com/ipn"
+	"tailscale.com/version"
+)
+
+// certRenewBefore is how long before a certificate expires that
+// GetCertificate gets a new one.
+const certRenewBefore = 30 * 24 * time.Hour
+
+// acmeAccountKeyStateKey is the StateStore key of the ACME account key
+// that certificates are requested with.
+const acmeAccountKeyStateKey = ipn.StateKey("_acme-account-key")
+
+// certStateKey returns the StateStore key of the PEM certificate chain
+// (ext ".crt") or private key (ext ".key") for domain.
+func certStateKey(domain, ext string) ipn.StateKey {
+	return ipn.StateKey("_cert-" + domain + ext)
+}
+
+// acmeMu serializes ACME orders, so that concurrent TLS handshakes
+// don't each ask for the same certificate.
+var acmeMu sync.Mutex
+
+// GetCertificate returns the node's TLS certificate for domain, which
+// must be one of the netmap's DNS.CertDomains.
+//
+// Certificates are kept in the StateStore. If there's none for domain,
+// or it expires within certRenewBefore, GetCertificate gets a new one
+// from Let's Encrypt, answering the ACME dns-01 challenge with SetDNS.
+func (b *LocalBackend) GetCertificate(ctx context.Context, domain string) (*tls.Certificate, error) {
+	if !b.isCertDomain(domain) {
+		return nil, fmt.Errorf("invalid domain %q; must be one of the node's certificate domains", domain)
+	}
+	b.mu.Lock()
+	cert := b.certs[domain]
+	b.mu.Unlock()
+	if certValid(cert, time.Now()) {
+		return cert, nil
+	}
+
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+
+	// Another caller may have stored a new one while we waited.
+	cert, err := b.loadCert(domain)
+	if err != nil || !certValid(cert, time.Now()) {
+		b.logf("cert: getting certificate for %q", domain)
+		cert, err = b.getCertACME(ctx, domain)
+		if err != nil {
+			return nil, fmt.Errorf("getting certificate for %q: %w", domain, err)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.certs == nil {
+		b.certs = make(map[string]*tls.Certificate)
+	}
+	b.certs[domain] = cert
+	return cert, nil
+}
+
+// isCertDomain reports whether domain is one of the netmap's
+// DNS.CertDomains.
+func (b *LocalBackend) isCertDomain(domain string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil {
+		return false
+	}
+	for _, d := range b.netMap.DNS.CertDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// certValid reports whether cert, if non-nil, is valid for at least
+// certRenewBefore after now.
+func certValid(cert *tls.Certificate, now time.Time) bool {
+	return cert != nil && cert.Leaf != nil &&
+		!now.Before(cert.Leaf.NotBefore) &&
+		now.Add(certRenewBefore).Before(cert.Leaf.NotAfter)
+}
+
+// loadCert returns the certificate for domain from the StateStore.
+func (b *LocalBackend) loadCert(domain string) (*tls.Certificate, error) {
+	certPEM, err := b.store.ReadState(certStateKey(domain, ".crt"))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := b.store.ReadState(certStateKey(domain, ".key"))
+	if err != nil {
+		return nil, err
+	}
+	return parseCertPEM(certPEM, keyPEM)
+}
+
+func parseCertPEM(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// getCertACME gets a new certificate for domain from Let's Encrypt and
+// saves it to the StateStore.
+//
+// acmeMu must be held.
+func (b *LocalBackend) getCertACME(ctx context.Context, domain string) (*tls.Certificate, error) {
+	key, err := b.acmeAccountKey()
+	if err != nil {
+		return nil, fmt.Errorf("account key: %w", err)
+	}
+	ac := &acme.Client{
+		Key:       key,
+		UserAgent: "tailscaled/" + version.Long,
+	}
+
+	if _, err := ac.GetReg(ctx, "" /* pre-RFC param */); err != nil {
+		if !errors.Is(err, acme.ErrNoAccount) {
+			return nil, fmt.Errorf("acme.GetReg: %w", err)
+		}
+		_, err := ac.Register(ctx, new(acme.Account), acme.AcceptTOS)
+		if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+			return nil, fmt.Errorf("acme.Register: %w", err)
+		}
+	}
+
+	order, err := ac.AuthorizeOrder(ctx, []acme.AuthzID{{Type: "dns", Value: domain}})
+	if err != nil {
+		return nil, fmt.Errorf("acme.AuthorizeOrder: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		az, err := ac.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("acme.GetAuthorization: %w", err)
+		}
+		if az.Status == acme.StatusValid {
+			continue
+		}
+		var ch *acme.Challenge
+		for _, c := range az.Challenges {
+			if c.Type == "dns-01" {
+				ch = c
+				break
+			}
+		}
+		if ch == nil {
+			return nil, errors.New("no dns-01 challenge offered")
+		}
+		rec, err := ac.DNS01ChallengeRecord(ch.Token)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.SetDNS(ctx, "_acme-challenge."+domain, rec); err != nil {
+			return nil, fmt.Errorf("SetDNS: %w", err)
+		}
+		if _, err := ac.Accept(ctx, ch); err != nil {
+			return nil, fmt.Errorf("acme.Accept: %w", err)
+		}
+		if _, err := ac.WaitAuthorization(ctx, az.URI); err != nil {
+			return nil, fmt.Errorf("acme.WaitAuthorization: %w", err)
+		}
+	}
+	order, err = ac.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("acme.WaitOrder: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, certKey)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := ac.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("acme.CreateOrderCert: %w", err)
+	}
+
+	var certPEM bytes.Buffer
+	for _, d := range der {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: d})
+	}
+	keyPEM, err := encodeECKey(certKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertPEM(certPEM.Bytes(), keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.store.WriteState(certStateKey(domain, ".key"), keyPEM); err != nil {
+		return nil, err
+	}
+	if err := b.store.WriteState(certStateKey(domain, ".crt"), certPEM.Bytes()); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// acmeAccountKey returns the ACME account key from the StateStore,
+// creating it if needed.
+//
+// acmeMu must be held.
+func (b *LocalBackend) acmeAccountKey() (crypto.Signer, error) {
+	bs, err := b.store.ReadState(acmeAccountKeyStateKey)
+	switch {
+	case err == nil:
+		if blk, _ := pem.Decode(bs); blk != nil {
+			if k, err := x509.ParseECPrivateKey(blk.Bytes); err == nil {
+				return k, nil
+			}
+		}
+		b.logf("cert: replacing malformed ACME account key")
+	case errors.Is(err, ipn.ErrStateNotExist):
+	default:
+		return nil, err
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	bs, err = encodeECKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.store.WriteState(acmeAccountKeyStateKey, bs); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func encodeECKey(k *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/net/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// localDNSHostsPollInterval is how often the local DNS hosts file is
+// checked for changes.
+const localDNSHostsPollInterval = 5 * time.Second
+
+// SetLocalDNSHostsFile sets the path of an optional hosts(5)-style
+// file whose entries are merged into the MagicDNS records served by
+// the internal resolver. The file is reloaded whenever it changes.
+//
+// Entries in the file take precedence over records for the same name
+// from the control plane, including MagicDNS names of peers: a name
+// listed in the file resolves only to the IPs listed for it there.
+// Names outside the MagicDNS domains are routed to the internal
+// resolver too, when Tailscale manages the OS DNS configuration.
+//
+// This must be called before the LocalBackend starts being used.
+func (b *LocalBackend) SetLocalDNSHostsFile(path string) {
+	b.mu.Lock()
+	b.localDNSHostsFile = path
+	b.mu.Unlock()
+	if path == "" {
+		return
+	}
+	fi, _ := os.Stat(path)
+	b.loadLocalDNSHosts(path)
+	go b.pollLocalDNSHosts(path, fi)
+}
+
+// pollLocalDNSHosts reloads the local DNS hosts file at path whenever
+// its modification time or size differ from lastFI, until b is shut
+// down.
+func (b *LocalBackend) pollLocalDNSHosts(path string, lastFI os.FileInfo) {
+	t := time.NewTicker(localDNSHostsPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+		fi, _ := os.Stat(path)
+		if sameFileInfo(fi, lastFI) {
+			continue
+		}
+		lastFI = fi
+		b.loadLocalDNSHosts(path)
+		b.authReconfig()
+	}
+}
+
+// sameFileInfo reports whether a and b, either of which may be nil if
+// the file didn't exist, look like the same version of a file.
+func sameFileInfo(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// loadLocalDNSHosts reads and parses the local DNS hosts file at path.
+//
+// A missing file is treated as empty. If the file can't be read or
+// parsed, the previously loaded entries are kept and the error is
+// reported in DNSStatus.
+func (b *LocalBackend) loadLocalDNSHosts(path string) {
+	hosts, err := readLocalDNSHosts(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.localDNSHostsErr = err
+	if err != nil {
+		b.logf("local DNS hosts file: %v", err)
+		return
+	}
+	b.localDNSHosts = hosts
+	b.logf("local DNS hosts file: loaded %d names from %s", len(hosts), path)
+}
+
+func readLocalDNSHosts(path string) (map[dnsname.FQDN][]netaddr.IP, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dns.ParseHosts(f)
+}
+
+// DNSStatus returns the DNS configuration most recently given to the
+// engine, along with the state of the local DNS hosts file.
+func (b *LocalBackend) DNSStatus() *apitype.DNSStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := &apitype.DNSStatus{
+		LocalHostsFile: b.localDNSHostsFile,
+	}
+	if b.localDNSHostsErr != nil {
+		st.LocalHostsError = b.localDNSHostsErr.Error()
+	}
+	cfg := b.dnsCfg
+	if cfg == nil {
+		return st
+	}
+	for _, ipp := range cfg.DefaultResolvers {
+		st.DefaultResolvers = append(st.DefaultResolvers, ipp.String())
+	}
+	if len(cfg.Routes) > 0 {
+		st.Routes = map[string][]string{}
+		for suffix, ipps := range cfg.Routes {
+			rs := []string{}
+			for _, ipp := range ipps {
+				rs = append(rs, ipp.String())
+			}
+			st.Routes[suffix.WithTrailingDot()] = rs
+		}
+	}
+	for _, d := range cfg.SearchDomains {
+		st.SearchDomains = append(st.SearchDomains, d.WithoutTrailingDot())
+	}
+	for name, ips := range cfg.Hosts {
+		src := "control"
+		if _, ok := b.localDNSHosts[name]; ok {
+			src = "local"
+		}
+		st.Hosts = append(st.Hosts, apitype.DNSHost{
+			Name:   name.WithoutTrailingDot(),
+			IPs:    ips,
+			Source: src,
+		})
+	}
+	sort.Slice(st.Hosts, func(i, j int) bool { return st.Hosts[i].Name < st.Hosts[j].Name })
+	return st
+}
+
+// routeLocalDNSHosts adds routes to dcfg for the names in hosts, from
+// the local DNS hosts file, that aren't already routed to the internal
+// resolver, so that the OS sends queries for them to it. Each name is
+// routed on its own, which makes the internal resolver authoritative
+// for the names under it too.
+func routeLocalDNSHosts(dcfg *dns.Config, hosts map[dnsname.FQDN][]netaddr.IP) {
+	for name := range hosts {
+		routed := false
+		for suffix := range dcfg.Routes {
+			if suffix.Contains(name) {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			dcfg.Routes[name] = nil
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/dns"
+	"tailscale.com/util/dnsname"
+)
+
+func TestRouteLocalDNSHosts(t *testing.T) {
+	ip := netaddr.MustParseIP("192.168.1.10")
+	corpDNS := netaddr.MustParseIPPort("10.0.0.53:53")
+	dcfg := dns.Config{
+		Routes: map[dnsname.FQDN][]netaddr.IPPort{
+			"example.ts.net.":   nil,
+			"corp.example.com.": {corpDNS},
+		},
+		Hosts: map[dnsname.FQDN][]netaddr.IP{},
+	}
+	hosts := map[dnsname.FQDN][]netaddr.IP{
+		"peer.example.ts.net.":  {ip}, // already internal
+		"git.corp.example.com.": {ip}, // already sent to 100.100.100.100
+		"nas.home.arpa.":        {ip},
+		"printer.":              {ip},
+	}
+	routeLocalDNSHosts(&dcfg, hosts)
+	want := map[dnsname.FQDN][]netaddr.IPPort{
+		"example.ts.net.":   nil,
+		"corp.example.com.": {corpDNS},
+		"nas.home.arpa.":    nil,
+		"printer.":          nil,
+	}
+	if !reflect.DeepEqual(dcfg.Routes, want) {
+		t.Errorf("Routes = %v; want %v", dcfg.Routes, want)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"sort"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// updateAutoExitNode chooses the exit node, if b.prefs.AutoExitNode is
+// set. If the current exit node is still online, it's kept, unless
+// force is set, in which case the best one is chosen regardless.
+//
+// If no exit node is online, the current one is kept, so traffic
+// keeps going to it (and nowhere) rather than leaking out to the
+// local network.
+func (b *LocalBackend) updateAutoExitNode(force bool) {
+	b.mu.Lock()
+	auto := b.prefs.AutoExitNode && b.netMap != nil
+	b.mu.Unlock()
+	if !auto {
+		return
+	}
+	latency := b.peerLatencies()
+
+	b.mu.Lock()
+	if !b.prefs.AutoExitNode || b.netMap == nil {
+		b.mu.Unlock()
+		return
+	}
+	cur := b.prefs.ExitNodeID
+	keep := cur
+	if force {
+		keep = ""
+	}
+	id := pickExitNode(b.netMap, keep, latency)
+	if id == "" || (id == cur && b.prefs.ExitNodeIP.IsZero()) {
+		if id == "" && cur != "" {
+			b.logf("auto exit node: no exit node online; keeping %v", cur)
+		}
+		b.mu.Unlock()
+		return
+	}
+	b.logf("auto exit node: switching from %q to %v", cur, id)
+	newp := b.prefs.Clone()
+	newp.ExitNodeID = id
+	newp.ExitNodeIP = netaddr.IP{}
+	b.setPrefsLockedOnEntry("autoExitNode", newp) // does a b.mu.Unlock
+}
+
+// peerLatencies returns the latencies to peers that magicsock has
+// measured.
+func (b *LocalBackend) peerLatencies() map[key.Public]time.Duration {
+	sb := new(ipnstate.StatusBuilder)
+	b.e.UpdateStatus(sb)
+	m := map[key.Public]time.Duration{}
+	for k, ps := range sb.Status().Peer {
+		if ps.Latency != 0 {
+			m[k] = ps.Latency
+		}
+	}
+	return m
+}
+
+// pickExitNode returns the ID of the exit node to use among nm's
+// peers: cur, if it's non-zero and still an online exit node, or else
+// the online exit node with the lowest latency. Exit nodes with an
+// unknown latency come after those with a known one. It returns the
+// zero ID if no exit node is online.
+func pickExitNode(nm *netmap.NetworkMap, cur tailcfg.StableNodeID, latency map[key.Public]time.Duration) tailcfg.StableNodeID {
+	var cands []*tailcfg.Node
+	for _, p := range nm.Peers {
+		if p.StableID == "" || !tsaddr.ContainsExitRoutes(p.AllowedIPs) {
+			continue
+		}
+		if p.Online != nil && !*p.Online {
+			continue
+		}
+		if p.StableID == cur {
+			return cur
+		}
+		cands = append(cands, p)
+	}
+	if len(cands) == 0 {
+		return ""
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		li, iok := latency[key.Public(cands[i].Key)]
+		lj, jok := latency[key.Public(cands[j].Key)]
+		if iok != jok {
+			return iok
+		}
+		if li != lj {
+			return li < lj
+		}
+		return cands[i].StableID < cands[j].StableID
+	})
+	return cands[0].StableID
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+func TestPickExitNode(t *testing.T) {
+	exitRoutes := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("0.0.0.0/0"),
+		netaddr.MustParseIPPrefix("::/0"),
+	}
+	online, offline := true, false
+	node := func(id string, keyByte byte, isOnline *bool, exit bool) *tailcfg.Node {
+		n := &tailcfg.Node{
+			StableID: tailcfg.StableNodeID(id),
+			Key:      tailcfg.NodeKey{keyByte},
+			Online:   isOnline,
+		}
+		if exit {
+			n.AllowedIPs = exitRoutes
+		}
+		return n
+	}
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			node("plain", 1, &online, false),
+			node("far", 2, &online, true),
+			node("near", 3, &online, true),
+			node("down", 4, &offline, true),
+			node("unknown", 5, nil, true),
+		},
+	}
+	latency := map[key.Public]time.Duration{
+		{2}: 80 * time.Millisecond,
+		{3}: 10 * time.Millisecond,
+		{4}: time.Millisecond,
+	}
+
+	tests := []struct {
+		name    string
+		cur     tailcfg.StableNodeID
+		latency map[key.Public]time.Duration
+		want    tailcfg.StableNodeID
+	}{
+		{"lowest_latency", "", latency, "near"},
+		{"keep_online", "far", latency, "far"},
+		{"replace_offline", "down", latency, "near"},
+		{"replace_non_exit", "plain", latency, "near"},
+		{"unknown_latency_by_id", "", nil, "far"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickExitNode(nm, tt.cur, tt.latency); got != tt.want {
+				t.Errorf("pickExitNode = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := pickExitNode(&netmap.NetworkMap{Peers: nm.Peers[:1]}, "", latency); got != "" {
+		t.Errorf("pickExitNode without exit nodes = %q; want none", got)
+	}
+}
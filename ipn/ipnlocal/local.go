@@ -7,6 +7,7 @@ package ipnlocal
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -95,6 +96,7 @@ type LocalBackend struct {
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	serverURL             string           // tailcontrol URL
 	newDecompressor       func() (controlclient.Decompressor, error)
+	profilesMu            sync.Mutex // serializes changes to login profiles
 
 	filterHash deephash.Sum
 
@@ -103,6 +105,8 @@ type LocalBackend struct {
 	httpTestClient *http.Client // for controlclient. nil by default, used by tests.
 	ccGen          clientGen    // function for producing controlclient; lazily populated
 	notify         func(ipn.Notify)
+	notifyWatchers map[*notifyWatcher]bool
+	dialer         func(ctx context.Context, network, addr string) (net.Conn, error) // or nil; see SetDialer
 	cc             controlclient.Client
 	stateKey       ipn.StateKey // computed in part from user-provided value
 	userID         string       // current controlling user ID (for Windows, primarily)
@@ -126,6 +130,9 @@ type LocalBackend struct {
 	prevIfState      *interfaces.State
 	peerAPIServer    *peerAPIServer // or nil
 	peerAPIListeners []*peerAPIListener
+	serveListeners   map[serveListenerKey]*serveListener
+	serveKey         []byte                      // HMAC key for Serve identity headers, once loaded
+	certs            map[string]*tls.Certificate // by domain; see GetCertificate
 	incomingFiles    map[*incomingFile]bool
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
@@ -138,6 +145,13 @@ type LocalBackend struct {
 	// immediately.
 	directFileRoot string
 
+	// localDNSHostsFile is the path of the optional hosts(5)-style
+	// file whose entries override MagicDNS records, or empty.
+	localDNSHostsFile string
+	localDNSHosts     map[dnsname.FQDN][]netaddr.IP // last successfully parsed localDNSHostsFile
+	localDNSHostsErr  error                         // last error reading localDNSHostsFile, if any
+	dnsCfg            *dns.Config                   // last DNS config given to the engine, or nil
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -232,13 +246,16 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 	defer b.mu.Unlock()
 
 	hadPAC := b.prevIfState.HasPAC()
+	hadV4 := b.prevIfState != nil && b.prevIfState.HaveV4
+	haveV4 := ifst != nil && ifst.HaveV4
 	b.prevIfState = ifst
 	b.maybePauseControlClientLocked()
 
 	// If the PAC-ness of the network changed, reconfig wireguard+route to
-	// add/remove subnets.
-	if hadPAC != ifst.HasPAC() {
-		b.logf("linkChange: in state %v; PAC changed from %v->%v", b.state, hadPAC, ifst.HasPAC())
+	// add/remove subnets. Likewise if IPv4 connectivity came or went, as
+	// that decides whether DNS64 is used.
+	if hadPAC != ifst.HasPAC() || hadV4 != haveV4 {
+		b.logf("linkChange: in state %v; PAC changed from %v->%v, v4 from %v->%v", b.state, hadPAC, ifst.HasPAC(), hadV4, haveV4)
 		switch b.state {
 		case ipn.NoState, ipn.Stopped:
 			// Do nothing.
@@ -390,6 +407,8 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			LastSeen:           lastSeen,
 			ShareeNode:         p.Hostinfo.ShareeNode,
 			ExitNode:           p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNodeOption:     tsaddr.ContainsExitRoutes(p.AllowedIPs),
+			Online:             p.Online != nil && *p.Online,
 		})
 	}
 }
@@ -421,6 +440,72 @@ func (b *LocalBackend) WhoIs(ipp netaddr.IPPort) (n *tailcfg.Node, u tailcfg.Use
 	return n, u, true
 }
 
+// WhoIsResponse is like WhoIs but returns the fuller
+// apitype.WhoIsResponse, including the node's tags, capabilities
+// and what the packet filter lets it reach on this node.
+func (b *LocalBackend) WhoIsResponse(ipp netaddr.IPPort) (res *apitype.WhoIsResponse, ok bool) {
+	n, u, ok := b.WhoIs(ipp)
+	if !ok {
+		return nil, false
+	}
+	b.mu.Lock()
+	var pf []filter.Match
+	if b.netMap != nil {
+		pf = b.netMap.PacketFilter
+	}
+	b.mu.Unlock()
+	return &apitype.WhoIsResponse{
+		Node:        n,
+		UserProfile: &u,
+		Tags:        nodeTags(n),
+		Caps:        n.Capabilities,
+		Online:      n.Online,
+		AllowedDsts: allowedDsts(pf, n.Addresses),
+	}, true
+}
+
+// nodeTags returns the ACL tags of n, as it requested them in its
+// Hostinfo. The control server checks a node's requested tags against
+// the tailnet's tag owners when it registers.
+func nodeTags(n *tailcfg.Node) []string {
+	return n.Hostinfo.RequestTags
+}
+
+// allowedDsts returns the destinations of the packet filter rules in
+// pf that match traffic from any of the single IP addresses in addrs,
+// without duplicates, in filter order.
+func allowedDsts(pf []filter.Match, addrs []netaddr.IPPrefix) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, m := range pf {
+		if !matchesAnySrc(m, addrs) {
+			continue
+		}
+		for _, d := range m.Dsts {
+			s := d.String()
+			if !seen[s] {
+				seen[s] = true
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+func matchesAnySrc(m filter.Match, addrs []netaddr.IPPrefix) bool {
+	for _, a := range addrs {
+		if !a.IsSingleIP() {
+			continue
+		}
+		for _, src := range m.Srcs {
+			if src.Contains(a.IP()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // SetDecompressor sets a decompression function, which must be a zstd
 // reader.
 //
@@ -431,6 +516,98 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetDialer sets the func that Dial uses to make connections. It
+// should resolve MagicDNS names and reach Tailscale IPs even in
+// userspace networking mode.
+func (b *LocalBackend) SetDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialer = dial
+}
+
+// Dial connects to addr using the func from SetDialer, or the system
+// dialer if none was set.
+//
+// The host of addr must be the Tailscale IP or MagicDNS name of a node
+// in the netmap, or an IP in a subnet route of a peer, if this node
+// accepts routes. Dial makes connections on behalf of LocalAPI
+// callers, so it refuses other hosts, such as the local machine's own
+// loopback services, which tailscaled may be able to reach when they
+// can't.
+func (b *LocalBackend) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	dial := b.dialer
+	ip, err := b.tailnetDialIPLocked(host)
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return dial(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// tailnetDialIPLocked returns the IP that Dial connects to for host,
+// or an error if it's not in the tailnet.
+//
+// b.mu must be held.
+func (b *LocalBackend) tailnetDialIPLocked(host string) (netaddr.IP, error) {
+	nm := b.netMap
+	if nm == nil {
+		return netaddr.IP{}, errors.New("no netmap")
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err != nil {
+		var ok bool
+		if ip, ok = nodeIPByName(nm, host); !ok {
+			return netaddr.IP{}, fmt.Errorf("no node named %q", host)
+		}
+	}
+	if n := b.nodeByAddr[ip]; n != nil {
+		return ip, nil
+	}
+	if b.prefs != nil && b.prefs.RouteAll && !ip.IsLoopback() {
+		for _, p := range nm.Peers {
+			for _, r := range p.AllowedIPs {
+				// Exit node routes don't make the whole
+				// internet part of the tailnet.
+				if r.Bits() != 0 && r.Contains(ip) {
+					return ip, nil
+				}
+			}
+		}
+	}
+	return netaddr.IP{}, fmt.Errorf("%v is not in the tailnet", ip)
+}
+
+// nodeIPByName returns the first Tailscale IP of the node in nm with
+// the given MagicDNS name, which may be a FQDN or the part before the
+// tailnet's MagicDNS suffix.
+func nodeIPByName(nm *netmap.NetworkMap, name string) (ip netaddr.IP, ok bool) {
+	name = strings.TrimSuffix(name, ".")
+	suffix := nm.MagicDNSSuffix()
+	nodes := nm.Peers
+	if nm.SelfNode != nil {
+		nodes = append([]*tailcfg.Node{nm.SelfNode}, nodes...)
+	}
+	for _, n := range nodes {
+		fqdn := strings.TrimSuffix(n.Name, ".")
+		if fqdn == "" || len(n.Addresses) == 0 {
+			continue
+		}
+		if strings.EqualFold(fqdn, name) || strings.EqualFold(dnsname.TrimSuffix(fqdn, suffix), name) {
+			return n.Addresses[0].IP(), true
+		}
+	}
+	return netaddr.IP{}, false
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -550,6 +727,9 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	// This is currently (2020-07-28) necessary; conditionally disabling it is fragile!
 	// This is where netmap information gets propagated to router and magicsock.
 	b.authReconfig()
+	if st.NetMap != nil {
+		b.updateAutoExitNode(false)
+	}
 }
 
 // findExitNodeIDLocked updates b.prefs to reference an exit node by ID,
@@ -792,8 +972,17 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 	b.setNetMapLocked(nil)
 	persistv := b.prefs.Persist
+	staticEndpoints := b.prefs.AdvertiseEndpoints
+	peerRelay := b.prefs.AdvertisePeerRelay
+	qos, qosClasses := b.prefs.QoS, b.prefs.QoSClasses
+	forwardRateLimit := b.prefs.ForwardRateLimit
 	b.mu.Unlock()
 
+	b.e.SetStaticEndpoints(staticEndpoints)
+	b.e.SetPeerRelay(peerRelay)
+	b.e.SetQoS(qos, qosClasses)
+	b.e.SetForwardRateLimit(forwardRateLimitBytes(forwardRateLimit))
+
 	b.updateFilter(nil, nil)
 
 	if b.portpoll != nil {
@@ -1164,9 +1353,13 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
+	watchers := make([]*notifyWatcher, 0, len(b.notifyWatchers))
+	for w := range b.notifyWatchers {
+		watchers = append(watchers, w)
+	}
 	b.mu.Unlock()
 
-	if notifyFunc == nil {
+	if notifyFunc == nil && len(watchers) == 0 {
 		return
 	}
 
@@ -1175,7 +1368,98 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	}
 
 	n.Version = version.Long
-	notifyFunc(n)
+	if notifyFunc != nil {
+		notifyFunc(n)
+	}
+	for _, w := range watchers {
+		w.send(n)
+	}
+}
+
+// notifyWatcher is a subscriber to the Notify messages sent by a
+// LocalBackend, added by WatchNotifications.
+type notifyWatcher struct {
+	mask   ipn.NotifyWatchOpt
+	ch     chan ipn.Notify
+	cancel context.CancelFunc // ends the watch
+}
+
+// notifyWatcherQueueLen is how many Notify messages a notifyWatcher
+// can fall behind by before its watch is ended.
+const notifyWatcherQueueLen = 64
+
+var errNotifyWatcherTooSlow = errors.New("notification watcher fell too far behind")
+
+func (w *notifyWatcher) send(n ipn.Notify) {
+	n, ok := w.mask.Filter(n)
+	if !ok {
+		return
+	}
+	select {
+	case w.ch <- n:
+	default:
+		// Don't let a slow watcher block the backend, nor
+		// silently miss messages: end its watch. It can watch
+		// again with NotifyInitialState to catch up.
+		w.cancel()
+	}
+}
+
+// WatchNotifications calls fn with each Notify message that b sends
+// matching mask, until ctx is done or fn returns false. If mask has
+// ipn.NotifyInitialState, fn is first called with the current state,
+// prefs and netmap.
+//
+// It returns nil if fn returned false, or else why the watch ended.
+func (b *LocalBackend) WatchNotifications(ctx context.Context, mask ipn.NotifyWatchOpt, fn func(ipn.Notify) (keepGoing bool)) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &notifyWatcher{
+		mask:   mask,
+		ch:     make(chan ipn.Notify, notifyWatcherQueueLen),
+		cancel: cancel,
+	}
+
+	b.mu.Lock()
+	if mask&ipn.NotifyInitialState != 0 {
+		state := b.state
+		n := ipn.Notify{
+			Version: version.Long,
+			State:   &state,
+			NetMap:  b.netMap,
+		}
+		if b.prefs != nil {
+			n.Prefs = b.prefs.Clone()
+		}
+		if n, ok := mask.Filter(n); ok {
+			w.ch <- n
+		}
+	}
+	if b.notifyWatchers == nil {
+		b.notifyWatchers = map[*notifyWatcher]bool{}
+	}
+	b.notifyWatchers[w] = true
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.notifyWatchers, w)
+		b.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case n := <-w.ch:
+			if !fn(n) {
+				return nil
+			}
+		case <-watchCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errNotifyWatcherTooSlow
+		}
+	}
 }
 
 func (b *LocalBackend) sendFileNotify() {
@@ -1184,7 +1468,7 @@ func (b *LocalBackend) sendFileNotify() {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
-	if notifyFunc == nil || apiSrv == nil {
+	if (notifyFunc == nil && len(b.notifyWatchers) == 0) || apiSrv == nil {
 		b.mu.Unlock()
 		return
 	}
@@ -1485,6 +1769,69 @@ func (b *LocalBackend) Ping(ipStr string, useTSMP bool) {
 	})
 }
 
+// PathHistory returns the recent changes of the network path to the
+// peer handling ip, oldest first.
+func (b *LocalBackend) PathHistory(ip netaddr.IP) ([]ipnstate.PathChange, error) {
+	return b.e.PathHistory(ip)
+}
+
+// errNoResolver is returned by DNS diagnostics when the engine has no
+// internal DNS resolver.
+var errNoResolver = errors.New("no internal DNS resolver")
+
+// SetDNSQueryLogging enables or disables the in-memory log of DNS
+// queries handled by the internal resolver. If logNames is false, the
+// names being queried are not recorded.
+func (b *LocalBackend) SetDNSQueryLogging(enabled, logNames bool) error {
+	r, ok := b.e.GetResolver()
+	if !ok {
+		return errNoResolver
+	}
+	r.SetQueryLogging(enabled, logNames)
+	b.logf("DNS query log: enabled=%v names=%v", enabled, logNames)
+	return nil
+}
+
+// DNSQueryLog returns the entries in the internal resolver's query
+// log with a Seq greater than since.
+func (b *LocalBackend) DNSQueryLog(since uint64) (*apitype.DNSQueryLog, error) {
+	r, ok := b.e.GetResolver()
+	if !ok {
+		return nil, errNoResolver
+	}
+	ents, enabled, logNames := r.QueryLog(since)
+	return &apitype.DNSQueryLog{
+		Enabled: enabled,
+		Names:   logNames,
+		Entries: ents,
+	}, nil
+}
+
+// DNSQuery runs a diagnostic query for name and qtype through the
+// internal resolver and returns the response, along with the decisions
+// the resolver made to produce it.
+func (b *LocalBackend) DNSQuery(ctx context.Context, name, qtype string) (*dnstype.QueryResult, error) {
+	r, ok := b.e.GetResolver()
+	if !ok {
+		return nil, errNoResolver
+	}
+	res, err := r.Query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if res.Route == "local" {
+		b.mu.Lock()
+		fqdn, _ := dnsname.ToFQDN(res.Name)
+		_, fromHostsFile := b.localDNSHosts[fqdn]
+		hostsFile := b.localDNSHostsFile
+		b.mu.Unlock()
+		if fromHostsFile {
+			res.Path = append(res.Path, "record comes from local hosts file "+hostsFile)
+		}
+	}
+	return res, nil
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -1537,6 +1884,18 @@ func (b *LocalBackend) SetCurrentUserID(uid string) {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	if (mp.ExitNodeIDSet || mp.ExitNodeIPSet) && !mp.AutoExitNodeSet {
+		// Choosing an exit node turns off choosing it automatically.
+		mpc := *mp
+		mpc.AutoExitNodeSet = true
+		mpc.AutoExitNode = false
+		mp = &mpc
+	}
+	if mp.ServeSet {
+		if err := ipn.CheckServeHandlers(mp.Serve); err != nil {
+			return nil, err
+		}
+	}
 	b.mu.Lock()
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
@@ -1554,6 +1913,17 @@ func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	return p1, nil
 }
 
+// forwardRateLimitBytes returns the forwarding rate limit, in bytes
+// per second, of a limit of bits bits per second. It rounds up, so
+// that small limits don't become zero, which is no limit.
+func forwardRateLimitBytes(bits int64) int64 {
+	n := bits / 8
+	if bits%8 > 0 {
+		n++
+	}
+	return n
+}
+
 // SetPrefs saves new user preferences and propagates them throughout
 // the system. Implements Backend.
 func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
@@ -1623,6 +1993,10 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	if netMap != nil {
 		b.e.SetDERPMap(netMap.DERPMap)
 	}
+	b.e.SetStaticEndpoints(newp.AdvertiseEndpoints)
+	b.e.SetPeerRelay(newp.AdvertisePeerRelay)
+	b.e.SetQoS(newp.QoS, newp.QoSClasses)
+	b.e.SetForwardRateLimit(forwardRateLimitBytes(newp.ForwardRateLimit))
 
 	if !oldp.WantRunning && newp.WantRunning {
 		b.logf("transitioning to running; doing Login...")
@@ -1635,7 +2009,15 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 		b.authReconfig()
 	}
 
+	// authReconfig may have had nothing to do, so apply any Serve
+	// changes here.
+	b.updateServeListeners()
+
 	b.send(ipn.Notify{Prefs: newp})
+
+	if newp.AutoExitNode && !oldp.AutoExitNode {
+		b.updateAutoExitNode(true)
+	}
 }
 
 func (b *LocalBackend) getPeerAPIPortForTSMPPing(ip netaddr.IP) (port uint16, ok bool) {
@@ -1725,6 +2107,8 @@ func (b *LocalBackend) authReconfig() {
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
+	localHosts := b.localDNSHosts
+	haveV4 := b.prevIfState != nil && b.prevIfState.HaveV4
 	b.mu.Unlock()
 
 	if blocked {
@@ -1819,6 +2203,11 @@ func (b *LocalBackend) authReconfig() {
 		}
 		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
+	// Entries from the local hosts file replace any records for the
+	// same name from the control plane.
+	for fqdn, ips := range localHosts {
+		dcfg.Hosts[fqdn] = ips
+	}
 
 	if uc.CorpDNS {
 		addDefault := func(resolvers []dnstype.Resolver) {
@@ -1859,6 +2248,7 @@ func (b *LocalBackend) authReconfig() {
 				dcfg.Routes[dom] = nil // resolve internally with dcfg.Hosts
 			}
 		}
+		routeLocalDNSHosts(&dcfg, localHosts)
 
 		// Set FallbackResolvers as the default resolvers in the
 		// scenarios that can't handle a purely split-DNS config. See
@@ -1886,8 +2276,20 @@ func (b *LocalBackend) authReconfig() {
 			// We don't support split DNS at all on Android yet.
 			addDefault(nm.DNS.FallbackResolvers)
 		}
+
+		// Without IPv4 connectivity of our own, IPv4-only names
+		// are reachable only through a subnet router doing NAT64,
+		// so if asked to, synthesize AAAA records pointing at it
+		// for them.
+		if uc.DNS64 && !haveV4 && peerHasRoute(cfg, tsaddr.TailscaleNAT64Range()) {
+			dcfg.DNS64Prefix = tsaddr.TailscaleNAT64Range()
+		}
 	}
 
+	b.mu.Lock()
+	b.dnsCfg = &dcfg
+	b.mu.Unlock()
+
 	err = b.e.Reconfig(cfg, rcfg, &dcfg, nm.Debug)
 	if err == wgengine.ErrNoChanges {
 		return
@@ -1895,6 +2297,19 @@ func (b *LocalBackend) authReconfig() {
 	b.logf("[v1] authReconfig: ra=%v dns=%v 0x%02x: %v", uc.RouteAll, uc.CorpDNS, flags, err)
 
 	b.initPeerAPIListener()
+	b.updateServeListeners()
+}
+
+// peerHasRoute reports whether any peer in cfg is routed pfx.
+func peerHasRoute(cfg *wgcfg.Config, pfx netaddr.IPPrefix) bool {
+	for _, p := range cfg.Peers {
+		for _, r := range p.AllowedIPs {
+			if r == pfx {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func parseResolver(cfg dnstype.Resolver) (netaddr.IPPort, error) {
@@ -1954,6 +2369,17 @@ func (b *LocalBackend) closePeerAPIListenersLocked() {
 	b.peerAPIListeners = nil
 }
 
+// tunName returns the name of the engine's TUN device, if known.
+func (b *LocalBackend) tunName() string {
+	if ge, ok := b.e.(wgengine.InternalsGetter); ok {
+		if tunWrap, _, ok := ge.GetInternals(); ok {
+			name, _ := tunWrap.Name()
+			return name
+		}
+	}
+	return ""
+}
+
 // peerAPIListenAsync is whether the operating system requires that we
 // retry listening on the peerAPI ip/port for whatever reason.
 //
@@ -2000,17 +2426,10 @@ func (b *LocalBackend) initPeerAPIListener() {
 		return
 	}
 
-	var tunName string
-	if ge, ok := b.e.(wgengine.InternalsGetter); ok {
-		if tunWrap, _, ok := ge.GetInternals(); ok {
-			tunName, _ = tunWrap.Name()
-		}
-	}
-
 	ps := &peerAPIServer{
 		b:              b,
 		rootDir:        fileRoot,
-		tunName:        tunName,
+		tunName:        b.tunName(),
 		selfNode:       selfNode,
 		directFileMode: b.directFileRoot != "",
 	}
@@ -2218,6 +2637,7 @@ func applyPrefsToHostinfo(hi *tailcfg.Hostinfo, prefs *ipn.Prefs) {
 		hi.DeviceModel = m
 	}
 	hi.ShieldsUp = prefs.ShieldsUp
+	hi.PeerRelay = prefs.AdvertisePeerRelay
 }
 
 // enterState transitions the backend into newState, updating internal
@@ -2241,6 +2661,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	} else if oldState == ipn.Running {
 		// Transitioning away from running.
 		b.closePeerAPIListenersLocked()
+		b.closeServeListenersLocked()
 	}
 	b.maybePauseControlClientLocked()
 	b.mu.Unlock()
@@ -2277,6 +2698,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 			addrs = append(addrs, addr.IP().String())
 		}
 		systemd.Status("Connected; %s; %s", activeLogin, strings.Join(addrs, " "))
+		b.updateServeListeners()
 	default:
 		b.logf("[unexpected] unknown newState %#v", newState)
 	}
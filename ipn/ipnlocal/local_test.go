@@ -5,6 +5,7 @@
 package ipnlocal
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -19,6 +20,7 @@ import (
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/wgcfg"
 )
 
@@ -493,3 +495,144 @@ func TestFileTargets(t *testing.T) {
 	}
 	// (other cases handled by TestPeerAPIBase above)
 }
+
+func TestWatchNotifications(t *testing.T) {
+	b := new(LocalBackend)
+	b.prefs = ipn.NewPrefs()
+
+	got := make(chan ipn.Notify, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.WatchNotifications(context.Background(), ipn.NotifyWatchState|ipn.NotifyInitialState, func(n ipn.Notify) bool {
+			got <- n
+			return n.State == nil || *n.State != ipn.Running
+		})
+	}()
+	next := func() ipn.Notify {
+		t.Helper()
+		select {
+		case n := <-got:
+			return n
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for Notify")
+			panic("unreachable")
+		}
+	}
+
+	// The initial state is sent with the watcher registered, so
+	// nothing sent after it's received can be missed.
+	n := next()
+	if n.State == nil || *n.State != ipn.NoState || n.Prefs != nil {
+		t.Fatalf("initial Notify = %v; want just state NoState", n)
+	}
+
+	b.send(ipn.Notify{Prefs: ipn.NewPrefs()}) // not watched
+	running := ipn.Running
+	b.send(ipn.Notify{State: &running, Prefs: ipn.NewPrefs()})
+	n = next()
+	if n.State == nil || *n.State != ipn.Running || n.Prefs != nil {
+		t.Fatalf("Notify = %v; want just state Running", n)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WatchNotifications = %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.notifyWatchers) != 0 {
+		t.Errorf("%d watchers left after watch ended", len(b.notifyWatchers))
+	}
+}
+
+func TestAllowedDsts(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	ssh := filter.NetPortRange{Net: pfx("100.64.0.1/32"), Ports: filter.PortRange{First: 22, Last: 22}}
+	web := filter.NetPortRange{Net: pfx("100.64.0.1/32"), Ports: filter.PortRange{First: 80, Last: 443}}
+	all := filter.NetPortRange{Net: pfx("0.0.0.0/0"), Ports: filter.PortRange{First: 0, Last: 65535}}
+	pf := []filter.Match{
+		{Srcs: []netaddr.IPPrefix{pfx("100.64.0.2/32")}, Dsts: []filter.NetPortRange{ssh}},
+		{Srcs: []netaddr.IPPrefix{pfx("100.64.0.0/24")}, Dsts: []filter.NetPortRange{ssh, web}},
+		{Srcs: []netaddr.IPPrefix{pfx("10.0.0.0/8")}, Dsts: []filter.NetPortRange{all}},
+	}
+	tests := []struct {
+		name  string
+		addrs []netaddr.IPPrefix
+		want  []string
+	}{
+		{"exact_and_range", []netaddr.IPPrefix{pfx("100.64.0.2/32")}, []string{"100.64.0.1/32:22", "100.64.0.1/32:80-443"}},
+		{"range_only", []netaddr.IPPrefix{pfx("100.64.0.3/32")}, []string{"100.64.0.1/32:22", "100.64.0.1/32:80-443"}},
+		{"none", []netaddr.IPPrefix{pfx("100.100.0.1/32")}, nil},
+		{"ignore_subnets", []netaddr.IPPrefix{pfx("10.1.0.0/16")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := allowedDsts(pf, tt.addrs)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailnetDialIP(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	self := &tailcfg.Node{
+		Name:      "self.example.ts.net.",
+		Addresses: []netaddr.IPPrefix{pfx("100.64.0.1/32")},
+	}
+	peer := &tailcfg.Node{
+		Name:       "peer.example.ts.net.",
+		Addresses:  []netaddr.IPPrefix{pfx("100.64.0.2/32"), pfx("fd7a:115c:a1e0::2/128")},
+		AllowedIPs: []netaddr.IPPrefix{pfx("100.64.0.2/32"), pfx("10.1.0.0/16"), pfx("0.0.0.0/0")},
+	}
+	b := &LocalBackend{
+		netMap: &netmap.NetworkMap{
+			Name:     "self.example.ts.net.",
+			SelfNode: self,
+			Peers:    []*tailcfg.Node{peer},
+		},
+		nodeByAddr: map[netaddr.IP]*tailcfg.Node{
+			netaddr.MustParseIP("100.64.0.1"):        self,
+			netaddr.MustParseIP("100.64.0.2"):        peer,
+			netaddr.MustParseIP("fd7a:115c:a1e0::2"): peer,
+		},
+		prefs: &ipn.Prefs{RouteAll: true},
+	}
+	tests := []struct {
+		host string
+		want string // or "" for an error
+	}{
+		{"100.64.0.2", "100.64.0.2"},
+		{"fd7a:115c:a1e0::2", "fd7a:115c:a1e0::2"},
+		{"peer", "100.64.0.2"},
+		{"peer.example.ts.net", "100.64.0.2"},
+		{"PEER.example.ts.net.", "100.64.0.2"},
+		{"self", "100.64.0.1"},
+		{"10.1.2.3", "10.1.2.3"},  // subnet route
+		{"10.2.0.1", ""},          // only via the exit node route
+		{"8.8.8.8", ""},           // likewise
+		{"127.0.0.1", ""},         // tailscaled's own loopback
+		{"localhost", ""},         // not a node
+		{"100.64.0.3", ""},        // not in the netmap
+		{"other.example.com", ""}, // not a node
+		{"peer.example.com", ""},  // wrong suffix
+	}
+	for _, tt := range tests {
+		got, err := b.tailnetDialIPLocked(tt.host)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %v; want error", tt.host, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("%q: got %v, %v; want %v", tt.host, got, err, tt.want)
+		}
+	}
+
+	// Subnet routes are only dialable if this node accepts them.
+	b.prefs.RouteAll = false
+	if got, err := b.tailnetDialIPLocked("10.1.2.3"); err == nil {
+		t.Errorf("without RouteAll: got %v; want error", got)
+	}
+}
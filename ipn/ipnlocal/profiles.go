@@ -0,0 +1,233 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"tailscale.com/ipn"
+)
+
+// Login profiles let a node be logged in to several tailnets and
+// switch between them without logging in again.
+//
+// The prefs of the profile in use live where they always have, in the
+// backend's state key, so nothing else needs to know about profiles.
+// The others are saved side by side in the same store, under state
+// keys derived from it, along with an index of all of them:
+//
+//	<key>-profiles        JSON profileIndex
+//	<key>-profile-<name>  prefs of the saved profile <name>
+//
+// Switching profiles saves the current prefs under the current
+// profile's key and restarts the backend with the saved prefs of the
+// new one. The machine key is shared by all profiles; each has its own
+// node key in its prefs' Persist.
+
+// defaultProfileName is the name of the profile in use when profiles
+// are first used.
+const defaultProfileName = "default"
+
+var errProfilesNeedStateKey = errors.New("login profiles require tailscaled to manage state; frontend-owned state has no profiles")
+
+// profileIndex is the index of login profiles in the state store.
+type profileIndex struct {
+	Current  string             // name of the profile in use
+	Profiles []ipn.LoginProfile // Current fields unset
+}
+
+func profilesStateKey(key ipn.StateKey) ipn.StateKey {
+	return key + "-profiles"
+}
+
+func profileStateKey(key ipn.StateKey, name string) ipn.StateKey {
+	return key + "-profile-" + ipn.StateKey(name)
+}
+
+// find returns the index of the profile named name in idx.Profiles,
+// or -1.
+func (idx *profileIndex) find(name string) int {
+	for i, p := range idx.Profiles {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// update updates the profile named name from prefs, adding it if it
+// doesn't exist.
+func (idx *profileIndex) update(name string, prefs *ipn.Prefs) {
+	i := idx.find(name)
+	if i < 0 {
+		idx.Profiles = append(idx.Profiles, ipn.LoginProfile{Name: name})
+		i = len(idx.Profiles) - 1
+	}
+	p := &idx.Profiles[i]
+	p.LoginName = ""
+	if prefs.Persist != nil {
+		p.LoginName = prefs.Persist.LoginName
+	}
+	p.ControlURL = prefs.ControlURLOrDefault()
+}
+
+// readProfileIndex reads the index of the login profiles of the state
+// in key. If there is none, it returns an index with just the default
+// profile, in use.
+func (b *LocalBackend) readProfileIndex(key ipn.StateKey) (*profileIndex, error) {
+	bs, err := b.store.ReadState(profilesStateKey(key))
+	if errors.Is(err, ipn.ErrStateNotExist) || (err == nil && len(bs) == 0) {
+		return &profileIndex{
+			Current:  defaultProfileName,
+			Profiles: []ipn.LoginProfile{{Name: defaultProfileName}},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := new(profileIndex)
+	if err := json.Unmarshal(bs, idx); err != nil {
+		return nil, fmt.Errorf("parsing login profiles: %w", err)
+	}
+	return idx, nil
+}
+
+func (b *LocalBackend) writeProfileIndex(key ipn.StateKey, idx *profileIndex) error {
+	bs, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return b.store.WriteState(profilesStateKey(key), bs)
+}
+
+// currentStateForProfiles returns the backend's state key, its prefs,
+// and the frontend log ID it was started with.
+func (b *LocalBackend) currentStateForProfiles() (key ipn.StateKey, prefs *ipn.Prefs, frontendLogID string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stateKey == "" || b.prefs == nil {
+		return "", nil, "", errProfilesNeedStateKey
+	}
+	if b.hostinfo != nil {
+		frontendLogID = b.hostinfo.FrontendLogID
+	}
+	return b.stateKey, b.prefs.Clone(), frontendLogID, nil
+}
+
+// LoginProfiles returns the login profiles, sorted by name.
+func (b *LocalBackend) LoginProfiles() ([]ipn.LoginProfile, error) {
+	b.profilesMu.Lock()
+	defer b.profilesMu.Unlock()
+
+	key, prefs, _, err := b.currentStateForProfiles()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := b.readProfileIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	idx.update(idx.Current, prefs)
+	ret := append([]ipn.LoginProfile(nil), idx.Profiles...)
+	for i := range ret {
+		ret[i].Current = ret[i].Name == idx.Current
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+// SwitchProfile saves the current login profile and switches to the
+// one named name, restarting the backend with its prefs. If there's
+// no such profile, a new one is created, logged out.
+func (b *LocalBackend) SwitchProfile(name string) error {
+	if err := ipn.CheckProfileName(name); err != nil {
+		return err
+	}
+	b.profilesMu.Lock()
+	defer b.profilesMu.Unlock()
+
+	key, prefs, frontendLogID, err := b.currentStateForProfiles()
+	if err != nil {
+		return err
+	}
+	idx, err := b.readProfileIndex(key)
+	if err != nil {
+		return err
+	}
+	if idx.Current == name {
+		return nil
+	}
+
+	if err := b.store.WriteState(profileStateKey(key, idx.Current), prefs.ToBytes()); err != nil {
+		return fmt.Errorf("saving profile %q: %w", idx.Current, err)
+	}
+	idx.update(idx.Current, prefs)
+
+	var next *ipn.Prefs
+	if idx.find(name) >= 0 {
+		bs, err := b.store.ReadState(profileStateKey(key, name))
+		if err != nil {
+			return fmt.Errorf("reading profile %q: %w", name, err)
+		}
+		if next, err = ipn.PrefsFromBytes(bs, false); err != nil {
+			return fmt.Errorf("reading profile %q: %w", name, err)
+		}
+	} else {
+		b.logf("creating login profile %q", name)
+		next = ipn.NewPrefs()
+		next.WantRunning = false
+	}
+	idx.update(name, next)
+
+	b.logf("switching from login profile %q to %q", idx.Current, name)
+	idx.Current = name
+	if err := b.writeProfileIndex(key, idx); err != nil {
+		return fmt.Errorf("saving login profiles: %w", err)
+	}
+	return b.Start(ipn.Options{
+		FrontendLogID: frontendLogID,
+		StateKey:      key,
+		Prefs:         next,
+	})
+}
+
+// DeleteProfile deletes the login profile named name, which must not
+// be in use.
+//
+// It doesn't log the profile's node out; it just forgets it.
+func (b *LocalBackend) DeleteProfile(name string) error {
+	b.profilesMu.Lock()
+	defer b.profilesMu.Unlock()
+
+	key, _, _, err := b.currentStateForProfiles()
+	if err != nil {
+		return err
+	}
+	idx, err := b.readProfileIndex(key)
+	if err != nil {
+		return err
+	}
+	if name == idx.Current {
+		return fmt.Errorf("profile %q is in use; switch to another profile first", name)
+	}
+	i := idx.find(name)
+	if i < 0 {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	idx.Profiles = append(idx.Profiles[:i], idx.Profiles[i+1:]...)
+	if err := b.writeProfileIndex(key, idx); err != nil {
+		return fmt.Errorf("saving login profiles: %w", err)
+	}
+	// StateStore can't delete keys, so at least don't leave the
+	// profile's node key behind.
+	if err := b.store.WriteState(profileStateKey(key, name), nil); err != nil {
+		return fmt.Errorf("deleting profile %q: %w", name, err)
+	}
+	b.logf("deleted login profile %q", name)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/types/persist"
+	"tailscale.com/wgengine"
+)
+
+func TestLoginProfiles(t *testing.T) {
+	store := new(ipn.MemoryStore)
+	work := ipn.NewPrefs()
+	work.WantRunning = false
+	work.Persist = &persist.Persist{LoginName: "alice@work.example"}
+	if err := store.WriteState(ipn.GlobalDaemonStateKey, work.ToBytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLocalBackend(t.Logf, "logid", store, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+	b.SetControlClientGetterForTesting(func(opts controlclient.Options) (controlclient.Client, error) {
+		cc := newMockControl()
+		cc.opts = opts
+		cc.logf = opts.Logf
+		cc.persist = opts.Persist
+		return cc, nil
+	})
+
+	if _, err := b.LoginProfiles(); err != errProfilesNeedStateKey {
+		t.Fatalf("LoginProfiles before Start = %v; want errProfilesNeedStateKey", err)
+	}
+	if err := b.Start(ipn.Options{StateKey: ipn.GlobalDaemonStateKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(want ...ipn.LoginProfile) {
+		t.Helper()
+		got, err := b.LoginProfiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LoginProfiles = %+v; want %+v", got, want)
+		}
+	}
+	controlURL := work.ControlURLOrDefault()
+	check(ipn.LoginProfile{Name: "default", LoginName: "alice@work.example", ControlURL: controlURL, Current: true})
+
+	if err := b.SwitchProfile("bad name"); err == nil {
+		t.Error("SwitchProfile with invalid name succeeded")
+	}
+
+	// Switching to a new profile starts it logged out.
+	if err := b.SwitchProfile("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if p := b.Prefs(); p.Persist != nil && p.Persist.LoginName != "" {
+		t.Errorf("new profile logged in as %q", p.Persist.LoginName)
+	}
+	check(
+		ipn.LoginProfile{Name: "default", LoginName: "alice@work.example", ControlURL: controlURL},
+		ipn.LoginProfile{Name: "lab", ControlURL: controlURL, Current: true},
+	)
+
+	// Switching back restores the saved identity.
+	if err := b.SwitchProfile("default"); err != nil {
+		t.Fatal(err)
+	}
+	if p := b.Prefs(); p.Persist == nil || p.Persist.LoginName != "alice@work.example" {
+		t.Errorf("switched back to prefs %v; want alice@work.example's", p.Pretty())
+	}
+
+	if err := b.DeleteProfile("default"); err == nil {
+		t.Error("DeleteProfile of profile in use succeeded")
+	}
+	if err := b.DeleteProfile("nope"); err == nil {
+		t.Error("DeleteProfile of missing profile succeeded")
+	}
+	if err := b.DeleteProfile("lab"); err != nil {
+		t.Fatal(err)
+	}
+	check(ipn.LoginProfile{Name: "default", LoginName: "alice@work.example", ControlURL: controlURL, Current: true})
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/wgengine"
+)
+
+// serveSigningKeyStateKey is the StateStore key of the HMAC key that
+// signs the identity headers added by Serve handlers.
+const serveSigningKeyStateKey = ipn.StateKey("_serve-signing-key")
+
+// serveCertTimeout is how long a TLS handshake with a Serve handler
+// waits for the node's certificate, which on first use means an ACME
+// order.
+const serveCertTimeout = 2 * time.Minute
+
+// serveListenerKey identifies a serveListener.
+type serveListenerKey struct {
+	ip netaddr.IP
+	h  ipn.ServeHandler
+}
+
+// serveListener runs one of the prefs' Serve handlers on one of the
+// node's Tailscale IPs.
+type serveListener struct {
+	b     *LocalBackend
+	h     ipn.ServeHandler
+	ln    net.Listener
+	srv   *http.Server
+	proxy http.Handler
+}
+
+// updateServeListeners starts and stops Serve handler listeners to
+// match the current prefs and netmap. Handlers only run while the
+// backend is in the Running state.
+func (b *LocalBackend) updateServeListeners() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	want := map[serveListenerKey]bool{}
+	if b.state == ipn.Running && b.netMap != nil && b.prefs != nil {
+		isNetstack := wgengine.IsNetstack(b.e)
+		for i, a := range b.netMap.Addresses {
+			if i > 0 && isNetstack {
+				// Netstack listens on all addresses at once.
+				break
+			}
+			for _, h := range b.prefs.Serve {
+				want[serveListenerKey{a.IP(), h}] = true
+			}
+		}
+	}
+	for k, sl := range b.serveListeners {
+		if !want[k] {
+			sl.Close()
+			delete(b.serveListeners, k)
+		}
+	}
+	for k := range want {
+		if _, ok := b.serveListeners[k]; ok {
+			continue
+		}
+		sl, err := b.newServeListenerLocked(k.ip, k.h)
+		if err != nil {
+			b.logf("serve: %v on %v: %v", k.h, k.ip, err)
+			continue
+		}
+		if b.serveListeners == nil {
+			b.serveListeners = make(map[serveListenerKey]*serveListener)
+		}
+		b.serveListeners[k] = sl
+		b.logf("serve: serving %v on %v", k.h, sl.ln.Addr())
+		go sl.serve()
+		if k.h.TLS {
+			go b.warmServeCert()
+		}
+	}
+}
+
+// closeServeListenersLocked stops all Serve handler listeners.
+//
+// b.mu must be held.
+func (b *LocalBackend) closeServeListenersLocked() {
+	for k, sl := range b.serveListeners {
+		sl.Close()
+		delete(b.serveListeners, k)
+	}
+}
+
+func (b *LocalBackend) newServeListenerLocked(ip netaddr.IP, h ipn.ServeHandler) (*serveListener, error) {
+	key, err := b.serveSigningKeyLocked()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := newServeProxy(h, key, b.checkServeSocket)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := b.listenTailnetLocked(ip, h.Port)
+	if err != nil {
+		return nil, err
+	}
+	sl := &serveListener{
+		b:     b,
+		h:     h,
+		ln:    ln,
+		proxy: proxy,
+	}
+	sl.srv = &http.Server{Handler: sl}
+	if h.TLS {
+		sl.srv.TLSConfig = &tls.Config{GetCertificate: b.serveCertificate}
+	}
+	return sl, nil
+}
+
+// listenTailnetLocked listens on TCP port of the Tailscale IP ip.
+//
+// b.mu must be held.
+func (b *LocalBackend) listenTailnetLocked(ip netaddr.IP, port uint16) (net.Listener, error) {
+	ipStr := ip.String()
+
+	var lc net.ListenConfig
+	if initListenConfig != nil {
+		// See peerAPIServer.listen.
+		if err := initListenConfig(&lc, ip, b.prevIfState, b.tunName()); err != nil {
+			return nil, err
+		}
+		ipStr = ""
+	}
+	if wgengine.IsNetstack(b.e) {
+		ipStr = ""
+	}
+
+	tcp4or6 := "tcp4"
+	if ip.Is6() {
+		tcp4or6 = "tcp6"
+	}
+	return lc.Listen(context.Background(), tcp4or6, net.JoinHostPort(ipStr, strconv.Itoa(int(port))))
+}
+
+func (sl *serveListener) serve() {
+	var err error
+	if sl.h.TLS {
+		err = sl.srv.ServeTLS(sl.ln, "", "")
+	} else {
+		err = sl.srv.Serve(sl.ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		sl.b.logf("serve: %v: %v", sl.h, err)
+	}
+}
+
+func (sl *serveListener) Close() error {
+	return sl.srv.Close()
+}
+
+// ServeHTTP proxies r to the handler's target, replacing any identity
+// headers from the client with ones for the peer making it, which
+// the proxy signs.
+func (sl *serveListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ipp, err := netaddr.ParseIPPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad remote address", http.StatusBadRequest)
+		return
+	}
+	n, u, ok := sl.b.WhoIs(ipp)
+	if !ok {
+		// In netstack mode we listen on all interfaces, so
+		// this can be someone on the LAN.
+		http.Error(w, "not a Tailscale peer", http.StatusForbidden)
+		return
+	}
+	r.Header.Del(ipn.ServeUserLoginHeader)
+	r.Header.Del(ipn.ServeUserNameHeader)
+	r.Header.Del(ipn.ServeSignatureHeader)
+	if len(nodeTags(n)) == 0 {
+		r.Header.Set(ipn.ServeUserLoginHeader, u.LoginName)
+		r.Header.Set(ipn.ServeUserNameHeader, u.DisplayName)
+	}
+	sl.proxy.ServeHTTP(w, r)
+}
+
+// newServeProxy returns a reverse proxy to h's target that signs the
+// requests it makes with key, as rewritten for the target. For Unix
+// socket targets, it calls checkSocket with the socket's path before
+// each connection, which fails if checkSocket returns an error.
+func newServeProxy(h ipn.ServeHandler, key []byte, checkSocket func(path string) error) (http.Handler, error) {
+	u, err := h.TargetURL()
+	if err != nil {
+		return nil, err
+	}
+	var rp *httputil.ReverseProxy
+	if u.Scheme == "unix" {
+		sock := u.Path
+		rp = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "localhost"})
+		rp.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				if err := checkSocket(sock); err != nil {
+					return nil, err
+				}
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+	} else {
+		rp = httputil.NewSingleHostReverseProxy(u)
+	}
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		ipn.SignServeRequest(r, key, time.Now())
+	}
+	return rp, nil
+}
+
+// ServeSigningKey returns the HMAC key with which Serve handlers sign
+// the identity headers they add, creating it if needed. Services can
+// check requests with it using ipn.VerifyServeRequest.
+func (b *LocalBackend) ServeSigningKey() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.serveSigningKeyLocked()
+}
+
+func (b *LocalBackend) serveSigningKeyLocked() ([]byte, error) {
+	if b.serveKey != nil {
+		return b.serveKey, nil
+	}
+	bs, err := b.store.ReadState(serveSigningKeyStateKey)
+	switch {
+	case err == nil:
+		key, err := hex.DecodeString(string(bs))
+		if err == nil && len(key) == 32 {
+			b.serveKey = key
+			return key, nil
+		}
+		b.logf("serve: replacing malformed signing key")
+	case errors.Is(err, ipn.ErrStateNotExist):
+	default:
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := b.store.WriteState(serveSigningKeyStateKey, []byte(hex.EncodeToString(key))); err != nil {
+		return nil, err
+	}
+	b.serveKey = key
+	return key, nil
+}
+
+// checkServeSocket returns an error unless path is a Unix socket that
+// Serve handlers may proxy to: one owned by the operator user, or by
+// tailscaled's own user if there's no operator. That keeps users who
+// can edit prefs from publishing sockets they couldn't open
+// themselves, such as the Docker daemon's.
+func (b *LocalBackend) checkServeSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a Unix socket", path)
+	}
+	owner, ok := fileOwner(fi)
+	if !ok {
+		return fmt.Errorf("unix targets are not supported on %s", runtime.GOOS)
+	}
+	want := b.OperatorUserID()
+	if want == "" {
+		want = strconv.Itoa(os.Getuid())
+	}
+	if owner != want {
+		return fmt.Errorf("%s is owned by uid %s, not the operator (uid %s)", path, owner, want)
+	}
+	return nil
+}
+
+// warmServeCert gets the node's certificate for TLS Serve handlers
+// ahead of their first handshake, which might otherwise time out
+// waiting for an ACME order.
+func (b *LocalBackend) warmServeCert() {
+	if _, err := b.serveCertificate(&tls.ClientHelloInfo{}); err != nil {
+		b.logf("serve: %v", err)
+	}
+}
+
+// serveCertificate is the tls.Config.GetCertificate hook of TLS Serve
+// handlers. Clients connecting by IP address, without SNI, get the
+// certificate of the node's first certificate domain.
+func (b *LocalBackend) serveCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hi.ServerName, "."))
+	if name == "" {
+		b.mu.Lock()
+		if b.netMap != nil && len(b.netMap.DNS.CertDomains) > 0 {
+			name = b.netMap.DNS.CertDomains[0]
+		}
+		b.mu.Unlock()
+	}
+	if name == "" {
+		return nil, errors.New("node has no certificate domains")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serveCertTimeout)
+	defer cancel()
+	return b.GetCertificate(ctx, name)
+}
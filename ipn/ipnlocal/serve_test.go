@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+)
+
+func TestServeListenerIdentityHeaders(t *testing.T) {
+	var got *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Clone(context.Background())
+	}))
+	defer backend.Close()
+
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLocalBackend(t.Logf, "logid", new(ipn.MemoryStore), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	alice := &tailcfg.Node{ID: 1, User: 10}
+	server := &tailcfg.Node{ID: 2, User: 10, Hostinfo: tailcfg.Hostinfo{RequestTags: []string{"tag:server"}}}
+	b.mu.Lock()
+	b.netMap = &netmap.NetworkMap{
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			10: {ID: 10, LoginName: "alice@example.com", DisplayName: "Alice"},
+		},
+	}
+	b.nodeByAddr = map[netaddr.IP]*tailcfg.Node{
+		netaddr.MustParseIP("100.64.0.1"): alice,
+		netaddr.MustParseIP("100.64.0.2"): server,
+	}
+	b.mu.Unlock()
+
+	key, err := b.ServeSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ipn.ServeHandler{Port: 80, Target: backend.URL + "/app"}
+	proxy, err := newServeProxy(h, key, b.checkServeSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := &serveListener{b: b, h: h, proxy: proxy}
+
+	do := func(remoteAddr string) int {
+		t.Helper()
+		got = nil
+		req := httptest.NewRequest("GET", "http://100.64.0.3/docs?page=2", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(ipn.ServeUserLoginHeader, "mallory@example.com")
+		rec := httptest.NewRecorder()
+		sl.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do("100.64.0.1:1234"); code != 200 {
+		t.Fatalf("user node: status %d", code)
+	}
+	if v := got.Header.Get(ipn.ServeUserLoginHeader); v != "alice@example.com" {
+		t.Errorf("login = %q; want alice@example.com", v)
+	}
+	if v := got.Header.Get(ipn.ServeUserNameHeader); v != "Alice" {
+		t.Errorf("name = %q; want Alice", v)
+	}
+	if got.RequestURI != "/app/docs?page=2" {
+		t.Errorf("request URI = %q; want /app/docs?page=2", got.RequestURI)
+	}
+	// The signature covers the request as the target got it.
+	if err := ipn.VerifyServeRequest(got, key, time.Now(), time.Minute); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+
+	if code := do("100.64.0.2:1234"); code != 200 {
+		t.Fatalf("tagged node: status %d", code)
+	}
+	if v := got.Header.Get(ipn.ServeUserLoginHeader); v != "" {
+		t.Errorf("tagged node login = %q; want none", v)
+	}
+	if err := ipn.VerifyServeRequest(got, key, time.Now(), time.Minute); err != nil {
+		t.Errorf("tagged node signature: %v", err)
+	}
+
+	if code := do("192.168.1.5:1234"); code != http.StatusForbidden {
+		t.Errorf("non-peer: status %d; want %d", code, http.StatusForbidden)
+	}
+	if got != nil {
+		t.Error("non-peer request was proxied")
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix socket targets on Windows")
+	}
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ipn.VerifyServeRequest(r, []byte("key"), time.Now(), time.Minute); err != nil {
+			t.Errorf("signature: %v", err)
+		}
+		w.Write([]byte("hello"))
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLocalBackend(t.Logf, "logid", new(ipn.MemoryStore), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	proxy, err := newServeProxy(ipn.ServeHandler{Port: 80, Target: "unix:" + sock}, []byte("key"), b.checkServeSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://100.64.0.3/", nil))
+		return rec.Code
+	}
+
+	// With no operator, sockets owned by tailscaled's user are allowed.
+	if code := get(); code != 200 {
+		t.Fatalf("own socket: status %d", code)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkServeSocket(file); err == nil {
+		t.Error("regular file accepted as a socket")
+	}
+
+	other := "nobody"
+	if u, err := user.Current(); err == nil && u.Username == other {
+		other = "root"
+	}
+	if _, err := user.Lookup(other); err != nil {
+		t.Skipf("no user %q to be operator: %v", other, err)
+	}
+	b.mu.Lock()
+	b.prefs = &ipn.Prefs{OperatorUser: other}
+	b.mu.Unlock()
+	if err := b.checkServeSocket(sock); err == nil {
+		t.Error("socket not owned by the operator accepted")
+	}
+	if code := get(); code != http.StatusBadGateway {
+		t.Errorf("socket not owned by the operator: status %d; want %d", code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package ipnlocal
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileOwner returns the uid of the owner of the file described by fi.
+func fileOwner(fi os.FileInfo) (uid string, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return strconv.FormatUint(uint64(st.Uid), 10), true
+}
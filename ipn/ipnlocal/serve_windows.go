@@ -0,0 +1,13 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import "os"
+
+// fileOwner reports that it can't tell who owns files, so Serve
+// handlers don't proxy to Unix sockets on Windows.
+func fileOwner(fi os.FileInfo) (uid string, ok bool) {
+	return "", false
+}
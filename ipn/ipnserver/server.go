@@ -32,6 +32,7 @@ import (
 	"inet.af/peercred"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/localapi"
 	"tailscale.com/log/filelogger"
@@ -85,6 +86,21 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// DNSHostsFile, if non-empty, is the path of a hosts(5)-style
+	// file whose entries are merged into MagicDNS.
+	// See ipnlocal.LocalBackend.SetLocalDNSHostsFile.
+	DNSHostsFile string
+
+	// Dialer, if non-nil, is how the LocalAPI dial handler makes
+	// TCP connections. See ipnlocal.LocalBackend.SetDialer.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Config, if non-nil, is the tailscaled config file. Its prefs
+	// are applied when the backend is autostarted, and again when
+	// it's reloaded on SIGHUP. Its auth key is only used at
+	// startup.
+	Config *conffile.Config
 }
 
 // server is an IPN backend and its set of 0 or more active connections
@@ -681,6 +697,10 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	b.SetLocalDNSHostsFile(opts.DNSHostsFile)
+	if opts.Dialer != nil {
+		b.SetDialer(opts.Dialer)
+	}
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
@@ -692,12 +712,38 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
 
 	if opts.AutostartStateKey != "" {
+		startOpts := ipn.Options{StateKey: opts.AutostartStateKey}
+		if opts.Config != nil {
+			prefs, err := configuredPrefs(store, opts.AutostartStateKey, opts.Config)
+			if err != nil {
+				return err
+			}
+			startOpts.UpdatePrefs = prefs
+			startOpts.AuthKey = opts.Config.AuthKey()
+		}
 		server.bs.GotCommand(context.TODO(), &ipn.Command{
 			Version: version.Long,
 			Start: &ipn.StartArgs{
-				Opts: ipn.Options{StateKey: opts.AutostartStateKey},
+				Opts: startOpts,
 			},
 		})
+	} else if opts.Config != nil {
+		logf("ipnserver: not in server mode; ignoring config file %s", opts.Config.Path)
+	}
+	if opts.Config != nil && opts.AutostartStateKey != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for {
+				select {
+				case <-hup:
+					server.reloadConfig(opts.Config.Path)
+				case <-runDone:
+					return
+				}
+			}
+		}()
 	}
 
 	systemd.Ready()
@@ -722,6 +768,41 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	return ctx.Err()
 }
 
+// configuredPrefs returns the prefs stored under key in store, with
+// the edits declared by the config file c applied.
+func configuredPrefs(store ipn.StateStore, key ipn.StateKey, c *conffile.Config) (*ipn.Prefs, error) {
+	prefs := ipn.NewPrefs()
+	bs, err := store.ReadState(key)
+	switch {
+	case err == nil:
+		prefs, err = ipn.PrefsFromBytes(bs, false)
+		if err != nil {
+			return nil, fmt.Errorf("loading prefs for config: %w", err)
+		}
+	case err == ipn.ErrStateNotExist:
+	default:
+		return nil, fmt.Errorf("loading prefs for config: %w", err)
+	}
+	prefs.ApplyEdits(&c.Prefs)
+	return prefs, nil
+}
+
+// reloadConfig re-reads the config file at path and applies its
+// prefs. If the file is invalid, the current prefs are kept.
+func (s *server) reloadConfig(path string) {
+	c, err := conffile.Load(path)
+	if err != nil {
+		s.logf("ipnserver: config reload failed, keeping current prefs: %v", err)
+		return
+	}
+	mp := c.Prefs
+	if _, err := s.b.EditPrefs(&mp); err != nil {
+		s.logf("ipnserver: applying reloaded config: %v", err)
+		return
+	}
+	s.logf("ipnserver: reloaded config %s", path)
+}
+
 // BabysitProc runs the current executable as a child process with the
 // provided args, capturing its output, writing it to files, and
 // restarting the process on any crashes.
@@ -54,6 +54,18 @@ type Status struct {
 
 	Peer map[key.Public]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
+
+	// QoS is the outbound traffic of each QoS class, in priority
+	// order, if QoS is enabled.
+	QoS []QoSClassStatus `json:",omitempty"`
+}
+
+// QoSClassStatus is the outbound traffic of a QoS class.
+type QoSClassStatus struct {
+	Name    string
+	Queued  int   // packets waiting to be sent
+	Sent    int64 // packets sent since tailscaled started
+	Dropped int64 // packets dropped because the queue was full
 }
 
 func (s *Status) Peers() []key.Public {
@@ -87,6 +99,11 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PeerRelay is the name of the tailnet node relaying traffic
+	// to this peer, if a peer relay is in use instead of a direct
+	// path. CurAddr is then empty.
+	PeerRelay string `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
@@ -96,6 +113,34 @@ type PeerStatus struct {
 	KeepAlive     bool
 	ExitNode      bool // true if this is the currently selected exit node.
 
+	// ExitNodeOption is whether the node can be used as an exit
+	// node: it advertises default routes and they're approved.
+	ExitNodeOption bool `json:",omitempty"`
+
+	// Online is whether the control plane reports the node as
+	// currently connected to it.
+	Online bool
+
+	// Latency is the round-trip time of the direct or peer relay
+	// path to the node that magicsock last measured, or zero if
+	// that's unknown, such as when the node is only reachable via
+	// DERP.
+	Latency time.Duration `json:",omitempty"`
+
+	// PathMTU is the largest packet size, in bytes, that magicsock
+	// found fits through the direct path to the node, or zero if
+	// that's unknown. Bigger packets are answered with ICMP "packet
+	// too big" errors.
+	PathMTU int `json:",omitempty"`
+
+	// ForwardedBytes and ForwardDropped are the bytes and packets
+	// from the node that this node, as a subnet router or exit node,
+	// forwarded and dropped to keep within its per-peer forwarding
+	// rate limit, since the limit was last set. They're zero if
+	// there's no limit.
+	ForwardedBytes int64 `json:",omitempty"`
+	ForwardDropped int64 `json:",omitempty"`
+
 	// Active is whether the node was recently active. The
 	// definition is somewhat undefined but has historically and
 	// currently means that there was some packet sent to this
@@ -248,6 +293,9 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PeerRelay; v != "" {
+		e.PeerRelay = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -281,6 +329,24 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if st.ExitNode {
 		e.ExitNode = true
 	}
+	if st.ExitNodeOption {
+		e.ExitNodeOption = true
+	}
+	if st.Online {
+		e.Online = true
+	}
+	if v := st.Latency; v != 0 {
+		e.Latency = v
+	}
+	if v := st.PathMTU; v != 0 {
+		e.PathMTU = v
+	}
+	if v := st.ForwardedBytes; v != 0 {
+		e.ForwardedBytes = v
+	}
+	if v := st.ForwardDropped; v != 0 {
+		e.ForwardDropped = v
+	}
 	if st.ShareeNode {
 		e.ShareeNode = true
 	}
@@ -388,7 +454,9 @@ table tbody tr:nth-child(even) td { background-color: #f5f5f5; }
 		f("<td>")
 
 		if ps.Active {
-			if ps.Relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer relay <b>%s</b>", html.EscapeString(ps.PeerRelay))
+			} else if ps.Relay != "" && ps.CurAddr == "" {
 				f("relay <b>%s</b>", html.EscapeString(ps.Relay))
 			} else if ps.CurAddr != "" {
 				f("direct <b>%s</b>", html.EscapeString(ps.CurAddr))
@@ -423,6 +491,31 @@ func osEmoji(os string) string {
 	return "👽"
 }
 
+// PathChange is a change of the network path that packets to a peer
+// take, for diagnosing connections that flap between paths.
+type PathChange struct {
+	Time time.Time
+
+	// From and To are the old and new paths: a direct "ip:port"
+	// endpoint, "derp-N" for DERP region N, "peer-relay-NAME" for
+	// the peer relay NAME, or empty for none.
+	From string `json:",omitempty"`
+	To   string `json:",omitempty"`
+
+	// Reason is why the path changed, such as "pong" (a direct path
+	// was confirmed), "better-path" or "timeout" (the direct path
+	// stopped answering pings).
+	Reason string
+
+	// Latency is the measured round-trip time of the new path, or
+	// zero if unknown, as for DERP.
+	Latency time.Duration `json:",omitempty"`
+
+	// Loss is the fraction of recent pings on the old path that
+	// got no reply. It's zero for DERP.
+	Loss float64 `json:",omitempty"`
+}
+
 // PingResult contains response information for the "tailscale ping" subcommand,
 // saying how Tailscale can reach a Tailscale IP or subnet-routed IP.
 type PingResult struct {
@@ -446,6 +539,10 @@ type PingResult struct {
 	// It is not currently set for TSMP pings.
 	DERPRegionCode string
 
+	// PeerRelay is the name of the tailnet node that relayed the
+	// ping, if a peer relay was used.
+	PeerRelay string `json:",omitempty"`
+
 	// PeerAPIPort is set by TSMP ping responses for peers that
 	// are running a peerapi server. This is the port they're
 	// running the server on.
@@ -6,6 +6,7 @@
 package localapi
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -30,6 +31,7 @@ import (
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/wgkey"
 )
 
 func randHex(n int) string {
@@ -104,6 +106,22 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveSetDNS(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
+	case "/localapi/v0/dns-query-log":
+		h.serveDNSQueryLog(w, r)
+	case "/localapi/v0/dns-status":
+		h.serveDNSStatus(w, r)
+	case "/localapi/v0/dns-query":
+		h.serveDNSQuery(w, r)
+	case "/localapi/v0/profiles":
+		h.serveProfiles(w, r)
+	case "/localapi/v0/watch-ipn-bus":
+		h.serveWatchIPNBus(w, r)
+	case "/localapi/v0/serve-signing-key":
+		h.serveServeSigningKey(w, r)
+	case "/localapi/v0/dial":
+		h.serveDial(w, r)
+	case "/localapi/v0/path-history":
+		h.servePathHistory(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -144,15 +162,11 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing 'addr' parameter", 400)
 		return
 	}
-	n, u, ok := b.WhoIs(ipp)
+	res, ok := b.WhoIsResponse(ipp)
 	if !ok {
 		http.Error(w, "no match for IP:port", 404)
 		return
 	}
-	res := &apitype.WhoIsResponse{
-		Node:        n,
-		UserProfile: &u,
-	}
 	j, err := json.MarshalIndent(res, "", "\t")
 	if err != nil {
 		http.Error(w, "JSON encoding error", 500)
@@ -209,6 +223,28 @@ func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
 	e.Encode(st)
 }
 
+func (h *Handler) servePathHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "path history access denied", http.StatusForbidden)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	hist, err := h.b.PathHistory(ip)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	makeNonNil(&hist)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(hist)
+}
+
 func (h *Handler) serveLogout(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "logout access denied", http.StatusForbidden)
@@ -416,6 +452,295 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+// serveServeSigningKey returns the hex HMAC key that the Serve
+// reverse proxies sign identity headers with. It needs write access,
+// as anyone with the key can forge the headers.
+func (h *Handler) serveServeSigningKey(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "serve signing key access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	key, err := h.b.ServeSigningKey()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, hex.EncodeToString(key)+"\n")
+}
+
+func (h *Handler) serveDNSStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "DNS status access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.DNSStatus())
+}
+
+func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "DNS query access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' parameter", 400)
+		return
+	}
+	qtype := r.FormValue("type")
+	if qtype == "" {
+		qtype = "A"
+	}
+	res, err := h.b.DNSQuery(r.Context(), name, qtype)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(res)
+}
+
+// serveWatchIPNBus streams the ipn.Notify messages matching the
+// ipn.NotifyWatchOpt in the "mask" parameter as JSON, one per line,
+// until the client goes away.
+func (h *Handler) serveWatchIPNBus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "watch ipn bus access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "not a flusher", http.StatusInternalServerError)
+		return
+	}
+	var mask ipn.NotifyWatchOpt
+	if s := r.FormValue("mask"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad mask", 400)
+			return
+		}
+		mask = ipn.NotifyWatchOpt(v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	enc := json.NewEncoder(w)
+	err := h.b.WatchNotifications(r.Context(), mask, func(n ipn.Notify) bool {
+		if err := enc.Encode(redactNotify(n)); err != nil {
+			h.logf("watch-ipn-bus: %v", err)
+			return false
+		}
+		f.Flush()
+		return true
+	})
+	if err != nil && r.Context().Err() == nil {
+		h.logf("watch-ipn-bus: %v", err)
+	}
+}
+
+// redactNotify returns n without the node's private keys, which
+// LocalAPI callers have no need for: the WireGuard private key in its
+// NetMap, and the keys in its Prefs' Persist.
+func redactNotify(n ipn.Notify) ipn.Notify {
+	if n.NetMap != nil {
+		nm := *n.NetMap
+		nm.PrivateKey = wgkey.Private{}
+		n.NetMap = &nm
+	}
+	if n.Prefs != nil && n.Prefs.Persist != nil {
+		p := *n.Prefs
+		pp := *p.Persist
+		pp.LegacyFrontendPrivateMachineKey = wgkey.Private{}
+		pp.PrivateNodeKey = wgkey.Private{}
+		pp.OldPrivateNodeKey = wgkey.Private{}
+		p.Persist = &pp
+		n.Prefs = &p
+	}
+	return n
+}
+
+// dialUpgradeProto is the HTTP Upgrade protocol of serveDial.
+const dialUpgradeProto = "ts-dial"
+
+// serveDial dials the host and port given in the Dial-Host and
+// Dial-Port request headers and, on success, upgrades the HTTP
+// connection to a raw stream to that TCP connection.
+func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "dial access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), dialUpgradeProto) {
+		http.Error(w, "missing 'Upgrade: "+dialUpgradeProto+"' header", 400)
+		return
+	}
+	host, port := r.Header.Get("Dial-Host"), r.Header.Get("Dial-Port")
+	if host == "" || port == "" {
+		http.Error(w, "missing Dial-Host or Dial-Port header", 400)
+		return
+	}
+	serveDialUpgrade(w, r, h.logf, h.b.Dial, net.JoinHostPort(host, port))
+}
+
+// serveDialUpgrade connects to addr using dial, then answers r with a
+// 101 Switching Protocols response and relays bytes between the
+// hijacked client connection and the new one until the remote side
+// closes.
+func serveDialUpgrade(w http.ResponseWriter, r *http.Request, logf logger.Logf, dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "not a hijacker", http.StatusInternalServerError)
+		return
+	}
+	outConn, err := dial(r.Context(), "tcp", addr)
+	if err != nil {
+		http.Error(w, "dial failure: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer outConn.Close()
+
+	reqConn, brw, err := hj.Hijack()
+	if err != nil {
+		logf("dial: hijack: %v", err)
+		return
+	}
+	defer reqConn.Close()
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: upgrade\r\n\r\n", dialUpgradeProto)
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(reqConn, outConn)
+	}()
+	go func() {
+		io.Copy(outConn, brw.Reader)
+		// The client is done sending. Pass that on, and keep
+		// relaying the reply until the remote side closes.
+		if cw, ok := outConn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			outConn.Close()
+		}
+	}()
+	<-done
+}
+
+// serveProfiles lists the login profiles (GET), switches to the one
+// named by the "name" parameter (POST), or deletes it (DELETE).
+func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "profiles access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST", "DELETE":
+		if !h.PermitWrite {
+			http.Error(w, "profiles write access denied", http.StatusForbidden)
+			return
+		}
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "missing 'name' parameter", 400)
+			return
+		}
+		var err error
+		if r.Method == "POST" {
+			err = h.b.SwitchProfile(name)
+		} else {
+			err = h.b.DeleteProfile(name)
+		}
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	profiles, err := h.b.LoginProfiles()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(profiles)
+}
+
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// Require write access even to read the log, as the names
+	// being looked up say a lot about what the machine's users
+	// are doing.
+	if !h.PermitWrite {
+		http.Error(w, "DNS query log access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		enable, err := strconv.ParseBool(r.FormValue("enable"))
+		if err != nil {
+			http.Error(w, "invalid 'enable' parameter", 400)
+			return
+		}
+		if err := h.b.SetDNSQueryLogging(enable, defBool(r.FormValue("names"), false)); err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+	case "GET":
+	default:
+		http.Error(w, "want GET or POST", 400)
+		return
+	}
+	var since uint64
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid 'since' parameter", 400)
+			return
+		}
+	}
+	ql, err := h.b.DNSQueryLog(since)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	makeNonNil(&ql.Entries)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ql)
+}
+
 var dialPeerTransportOnce struct {
 	sync.Once
 	v *http.Transport
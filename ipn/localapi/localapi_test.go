@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/wgkey"
+)
+
+func TestRedactNotify(t *testing.T) {
+	newKey := func() wgkey.Private {
+		k, err := wgkey.NewPrivate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	nm := &netmap.NetworkMap{Name: "foo.example.ts.net", PrivateKey: newKey()}
+	prefs := ipn.NewPrefs()
+	prefs.Persist = &persist.Persist{
+		LegacyFrontendPrivateMachineKey: newKey(),
+		PrivateNodeKey:                  newKey(),
+		OldPrivateNodeKey:               newKey(),
+		LoginName:                       "foo@example.com",
+	}
+
+	j, err := json.Marshal(redactNotify(ipn.Notify{NetMap: nm, Prefs: prefs}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "privkey:") {
+		t.Errorf("redacted Notify contains a private key: %s", j)
+	}
+	for _, want := range []string{nm.Name, prefs.Persist.LoginName} {
+		if !strings.Contains(string(j), want) {
+			t.Errorf("redacted Notify lacks %q: %s", want, j)
+		}
+	}
+
+	// The Notify, which is shared with other watchers, is left alone.
+	if nm.PrivateKey.IsZero() || prefs.Persist.PrivateNodeKey.IsZero() {
+		t.Error("redactNotify modified its argument")
+	}
+}
+
+func TestServeDialUpgrade(t *testing.T) {
+	// An echo server that replies with whatever it read once the
+	// client half-closes, which checks that CloseWrite is relayed.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		c.Write(append([]byte("echo: "), b...))
+	}()
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != "peer:80" {
+			return nil, errors.New("unreachable")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, echo.Addr().String())
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveDialUpgrade(w, r, t.Logf, dial, r.Header.Get("Dial-Host")+":80")
+	}))
+	defer ts.Close()
+
+	dialLocalAPI := func(host string) (*net.TCPConn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+		req.Header.Set("Upgrade", dialUpgradeProto)
+		req.Header.Set("Connection", "upgrade")
+		req.Header.Set("Dial-Host", host)
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*net.TCPConn), br, res
+	}
+
+	c, _, res := dialLocalAPI("nowhere")
+	c.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("failed dial: status = %v; want %v", res.Status, http.StatusBadGateway)
+	}
+
+	c, br, res := dialLocalAPI("peer")
+	defer c.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %v; want 101", res.Status)
+	}
+	if got := res.Header.Get("Upgrade"); got != dialUpgradeProto {
+		t.Errorf("Upgrade = %q; want %q", got, dialUpgradeProto)
+	}
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	got, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "echo: hello" {
+		t.Errorf("read %q; want %q", got, "echo: hello")
+	}
+}
@@ -94,6 +94,13 @@ type Prefs struct {
 	// routed directly or via the exit node.
 	ExitNodeAllowLANAccess bool
 
+	// AutoExitNode specifies whether the backend chooses the exit
+	// node itself, setting ExitNodeID to the online exit node with
+	// the lowest latency, and choosing again when that one goes
+	// offline. Setting ExitNodeID or ExitNodeIP with EditPrefs turns
+	// it off.
+	AutoExitNode bool
+
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
 	CorpDNS bool
@@ -180,6 +187,43 @@ type Prefs struct {
 	// operate tailscaled without being root or using sudo.
 	OperatorUser string `json:",omitempty"`
 
+	// Serve are the identity-aware HTTP reverse proxies to run on
+	// the node's Tailscale IPs. At most one may use any given port.
+	Serve []ServeHandler `json:",omitempty"`
+
+	// AdvertiseEndpoints are ip:ports that peers can reach this
+	// node's WireGuard port at, in addition to the ones it discovers
+	// itself, such as the public side of manually configured port
+	// forwards.
+	AdvertiseEndpoints []netaddr.IPPort `json:",omitempty"`
+
+	// AdvertisePeerRelay specifies whether this node offers to
+	// relay UDP traffic between other tailnet nodes that can't
+	// reach each other directly.
+	AdvertisePeerRelay bool `json:",omitempty"`
+
+	// QoS specifies whether to prioritize outbound traffic: the
+	// QoSClasses first, in order, then flows that haven't sent much
+	// recently, then bulk transfers.
+	QoS bool `json:",omitempty"`
+
+	// QoSClasses are the classes of outbound traffic that QoS sends
+	// before all other traffic, highest priority first.
+	QoSClasses []preftype.QoSClass `json:",omitempty"`
+
+	// ForwardRateLimit is the rate, in bits per second, at which
+	// this node forwards the traffic of each peer, by its Tailscale
+	// IP, when acting as a subnet router or exit node. Zero means no
+	// limit.
+	ForwardRateLimit int64 `json:",omitempty"`
+
+	// DNS64 specifies whether, when this node has no IPv4
+	// connectivity of its own, 100.100.100.100 synthesizes AAAA
+	// records for IPv4-only names, pointing at a subnet router that
+	// advertises tsaddr.TailscaleNAT64Range. It has no effect
+	// without CorpDNS.
+	DNS64 bool `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -198,6 +242,7 @@ type MaskedPrefs struct {
 	ExitNodeIDSet             bool `json:",omitempty"`
 	ExitNodeIPSet             bool `json:",omitempty"`
 	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
+	AutoExitNodeSet           bool `json:",omitempty"`
 	CorpDNSSet                bool `json:",omitempty"`
 	WantRunningSet            bool `json:",omitempty"`
 	LoggedOutSet              bool `json:",omitempty"`
@@ -212,6 +257,13 @@ type MaskedPrefs struct {
 	NoSNATSet                 bool `json:",omitempty"`
 	NetfilterModeSet          bool `json:",omitempty"`
 	OperatorUserSet           bool `json:",omitempty"`
+	ServeSet                  bool `json:",omitempty"`
+	AdvertiseEndpointsSet     bool `json:",omitempty"`
+	AdvertisePeerRelaySet     bool `json:",omitempty"`
+	QoSSet                    bool `json:",omitempty"`
+	QoSClassesSet             bool `json:",omitempty"`
+	ForwardRateLimitSet       bool `json:",omitempty"`
+	DNS64Set                  bool `json:",omitempty"`
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
@@ -287,6 +339,9 @@ func (p *Prefs) pretty(goos string) string {
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
 	}
+	if p.AutoExitNode {
+		sb.WriteString("autoexit=true ")
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
@@ -308,6 +363,24 @@ func (p *Prefs) pretty(goos string) string {
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
+	if len(p.Serve) > 0 {
+		fmt.Fprintf(&sb, "serve=%v ", p.Serve)
+	}
+	if len(p.AdvertiseEndpoints) > 0 {
+		fmt.Fprintf(&sb, "endpoints=%v ", p.AdvertiseEndpoints)
+	}
+	if p.AdvertisePeerRelay {
+		sb.WriteString("peerrelay=true ")
+	}
+	if p.QoS {
+		fmt.Fprintf(&sb, "qos=%v ", p.QoSClasses)
+	}
+	if p.ForwardRateLimit != 0 {
+		fmt.Fprintf(&sb, "fwdlimit=%v ", p.ForwardRateLimit)
+	}
+	if p.DNS64 {
+		sb.WriteString("dns64=true ")
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -340,6 +413,7 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
 		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
+		p.AutoExitNode == p2.AutoExitNode &&
 		p.CorpDNS == p2.CorpDNS &&
 		p.WantRunning == p2.WantRunning &&
 		p.LoggedOut == p2.LoggedOut &&
@@ -354,6 +428,13 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.ForceDaemon == p2.ForceDaemon &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
+		compareServeHandlers(p.Serve, p2.Serve) &&
+		compareIPPorts(p.AdvertiseEndpoints, p2.AdvertiseEndpoints) &&
+		p.AdvertisePeerRelay == p2.AdvertisePeerRelay &&
+		p.QoS == p2.QoS &&
+		preftype.QoSClassesEqual(p.QoSClasses, p2.QoSClasses) &&
+		p.ForwardRateLimit == p2.ForwardRateLimit &&
+		p.DNS64 == p2.DNS64 &&
 		p.Persist.Equals(p2.Persist)
 }
 
@@ -381,6 +462,30 @@ func compareStrings(a, b []string) bool {
 	return true
 }
 
+func compareIPPorts(a, b []netaddr.IPPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareServeHandlers(a, b []ServeHandler) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // NewPrefs returns the default preferences to use.
 func NewPrefs() *Prefs {
 	// Provide default values for options which might be missing
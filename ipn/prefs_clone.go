@@ -23,6 +23,12 @@ func (src *Prefs) Clone() *Prefs {
 	*dst = *src
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.Serve = append(src.Serve[:0:0], src.Serve...)
+	dst.AdvertiseEndpoints = append(src.AdvertiseEndpoints[:0:0], src.AdvertiseEndpoints...)
+	dst.QoSClasses = make([]preftype.QoSClass, len(src.QoSClasses))
+	for i := range dst.QoSClasses {
+		dst.QoSClasses[i] = *src.QoSClasses[i].Clone()
+	}
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
 		*dst.Persist = *src.Persist
@@ -39,6 +45,7 @@ var _PrefsNeedsRegeneration = Prefs(struct {
 	ExitNodeID             tailcfg.StableNodeID
 	ExitNodeIP             netaddr.IP
 	ExitNodeAllowLANAccess bool
+	AutoExitNode           bool
 	CorpDNS                bool
 	WantRunning            bool
 	LoggedOut              bool
@@ -53,5 +60,12 @@ var _PrefsNeedsRegeneration = Prefs(struct {
 	NoSNAT                 bool
 	NetfilterMode          preftype.NetfilterMode
 	OperatorUser           string
+	Serve                  []ServeHandler
+	AdvertiseEndpoints     []netaddr.IPPort
+	AdvertisePeerRelay     bool
+	QoS                    bool
+	QoSClasses             []preftype.QoSClass
+	ForwardRateLimit       int64
+	DNS64                  bool
 	Persist                *persist.Persist
 }{})
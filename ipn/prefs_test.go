@@ -40,6 +40,7 @@ func TestPrefsEqual(t *testing.T) {
 		"ExitNodeID",
 		"ExitNodeIP",
 		"ExitNodeAllowLANAccess",
+		"AutoExitNode",
 		"CorpDNS",
 		"WantRunning",
 		"LoggedOut",
@@ -54,6 +55,13 @@ func TestPrefsEqual(t *testing.T) {
 		"NoSNAT",
 		"NetfilterMode",
 		"OperatorUser",
+		"Serve",
+		"AdvertiseEndpoints",
+		"AdvertisePeerRelay",
+		"QoS",
+		"QoSClasses",
+		"ForwardRateLimit",
+		"DNS64",
 		"Persist",
 	}
 	if have := fieldsOf(reflect.TypeOf(Prefs{})); !reflect.DeepEqual(have, prefsHandles) {
@@ -157,6 +165,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{},
+			&Prefs{AutoExitNode: true},
+			false,
+		},
+		{
+			&Prefs{AutoExitNode: true},
+			&Prefs{AutoExitNode: true},
+			true,
+		},
+
 		{
 			&Prefs{CorpDNS: true},
 			&Prefs{CorpDNS: false},
@@ -260,6 +279,68 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3001"}}},
+			false,
+		},
+		{
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeHandler{{Port: 8080, Target: "http://127.0.0.1:3000"}}},
+			false,
+		},
+		{
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3000", TLS: true}}},
+			false,
+		},
+		{
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3000"}}},
+			&Prefs{Serve: []ServeHandler{{Port: 80, Target: "http://127.0.0.1:3000"}}},
+			true,
+		},
+
+		{
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("203.0.113.1:41641")}},
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("203.0.113.1:41642")}},
+			false,
+		},
+		{
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("203.0.113.1:41641")}},
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("203.0.113.1:41641")}},
+			true,
+		},
+		{
+			&Prefs{AdvertisePeerRelay: true},
+			&Prefs{AdvertisePeerRelay: false},
+			false,
+		},
+		{
+			&Prefs{QoS: true},
+			&Prefs{QoS: false},
+			false,
+		},
+		{
+			&Prefs{QoSClasses: []preftype.QoSClass{{Name: "ssh", Ports: []uint16{22}}}},
+			&Prefs{QoSClasses: []preftype.QoSClass{{Name: "ssh", Ports: []uint16{2222}}}},
+			false,
+		},
+		{
+			&Prefs{QoSClasses: []preftype.QoSClass{{Name: "voice", DSCP: []int{46}}}},
+			&Prefs{QoSClasses: []preftype.QoSClass{{Name: "voice", DSCP: []int{46}}}},
+			true,
+		},
+		{
+			&Prefs{ForwardRateLimit: 10e6},
+			&Prefs{ForwardRateLimit: 20e6},
+			false,
+		},
+		{
+			&Prefs{DNS64: true},
+			&Prefs{DNS64: false},
+			false,
+		},
+
 		{
 			&Prefs{Persist: &persist.Persist{}},
 			&Prefs{Persist: &persist.Persist{LoginName: "dave"}},
@@ -364,6 +445,36 @@ func TestPrefsPretty(t *testing.T) {
 			"windows",
 			"Prefs{ra=false mesh=false dns=false want=false shields=true Persist=nil}",
 		},
+		{
+			Prefs{Serve: []ServeHandler{{Port: 443, Target: "unix:/run/app.sock", TLS: true}}},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false serve=[https:443=>unix:/run/app.sock] Persist=nil}",
+		},
+		{
+			Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("203.0.113.1:41641")}},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false endpoints=[203.0.113.1:41641] Persist=nil}",
+		},
+		{
+			Prefs{AdvertisePeerRelay: true},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false peerrelay=true Persist=nil}",
+		},
+		{
+			Prefs{QoS: true, QoSClasses: []preftype.QoSClass{{Name: "voice", Ports: []uint16{5060}, DSCP: []int{46}}}},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false qos=[voice:5060+dscp46] Persist=nil}",
+		},
+		{
+			Prefs{ForwardRateLimit: 10e6},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false fwdlimit=10000000 Persist=nil}",
+		},
+		{
+			Prefs{CorpDNS: true, DNS64: true},
+			"windows",
+			"Prefs{ra=false mesh=false dns=true want=false dns64=true Persist=nil}",
+		},
 		{
 			Prefs{AllowSingleHosts: true},
 			"windows",
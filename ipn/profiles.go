@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LoginProfile is a named set of prefs, including the node identity
+// in their Persist, that the backend can switch to without logging in
+// again.
+type LoginProfile struct {
+	// Name is the profile's user-chosen name.
+	Name string
+
+	// LoginName is the name of the user the profile's node was
+	// last logged in as, if any.
+	LoginName string `json:",omitempty"`
+
+	// ControlURL is the control server the profile uses.
+	ControlURL string `json:",omitempty"`
+
+	// Current is whether the profile is the one in use.
+	Current bool `json:",omitempty"`
+}
+
+// maxProfileNameLen is the maximum length of a LoginProfile name.
+const maxProfileNameLen = 64
+
+// CheckProfileName returns an error if name isn't a valid LoginProfile
+// name. Valid names are made of ASCII letters, digits, '-', '_' and
+// '.', and are at most 64 bytes long.
+func CheckProfileName(name string) error {
+	if name == "" {
+		return errors.New("empty profile name")
+	}
+	if len(name) > maxProfileNameLen {
+		return fmt.Errorf("profile name %q is longer than %d bytes", name, maxProfileNameLen)
+	}
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid character %q in profile name %q", r, name)
+		}
+	}
+	return nil
+}
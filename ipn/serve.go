@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// ServeHandler is an HTTP reverse proxy that tailscaled runs on the
+// node's Tailscale IPs, forwarding requests to a local service along
+// with the identity of the caller. See Prefs.Serve.
+type ServeHandler struct {
+	// Port is the TCP port to listen on.
+	Port uint16
+
+	// Target is where requests are proxied to. It's either an
+	// http or https URL whose host is localhost or a loopback IP
+	// (such as "http://127.0.0.1:3000" or
+	// "http://localhost:8080/app"), or "unix:" followed by the path
+	// of a Unix socket speaking HTTP.
+	Target string
+
+	// TLS is whether to terminate TLS on Port using the node's
+	// certificate for its MagicDNS name, rather than serving plain
+	// HTTP.
+	TLS bool `json:",omitempty"`
+}
+
+func (h ServeHandler) String() string {
+	scheme := "http"
+	if h.TLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s:%d=>%s", scheme, h.Port, h.Target)
+}
+
+// Check returns an error if h isn't a valid ServeHandler.
+func (h ServeHandler) Check() error {
+	if h.Port == 0 {
+		return errors.New("serve: missing port")
+	}
+	_, err := h.TargetURL()
+	return err
+}
+
+// TargetURL parses h.Target. For a Unix socket target, it returns a
+// URL with scheme "unix" and the socket's absolute path in Path.
+//
+// TCP targets are limited to localhost, which any local user can
+// connect to anyway. tailscaled runs as root, so it could open Unix
+// sockets that the user setting Serve can't, such as the Docker
+// daemon's; tailscaled only proxies to sockets owned by the operator
+// user (see Prefs.OperatorUser), which it checks when connecting.
+func (h ServeHandler) TargetURL() (*url.URL, error) {
+	if strings.HasPrefix(h.Target, "unix:") {
+		sock := strings.TrimPrefix(h.Target, "unix:")
+		if !path.IsAbs(sock) {
+			return nil, fmt.Errorf("serve: socket path in target %q must be absolute", h.Target)
+		}
+		return &url.URL{Scheme: "unix", Path: path.Clean(sock)}, nil
+	}
+	u, err := url.Parse(h.Target)
+	if err != nil {
+		return nil, fmt.Errorf("serve: invalid target %q: %w", h.Target, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("serve: target %q must be an http, https or unix target", h.Target)
+	}
+	if host := u.Hostname(); host != "localhost" {
+		ip, err := netaddr.ParseIP(host)
+		if err != nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("serve: target %q is not on localhost", h.Target)
+		}
+	}
+	return u, nil
+}
+
+// CheckServeHandlers returns an error if any of hs is invalid or if
+// two of them use the same port.
+func CheckServeHandlers(hs []ServeHandler) error {
+	seen := map[uint16]bool{}
+	for _, h := range hs {
+		if err := h.Check(); err != nil {
+			return err
+		}
+		if seen[h.Port] {
+			return fmt.Errorf("serve: port %d is used more than once", h.Port)
+		}
+		seen[h.Port] = true
+	}
+	return nil
+}
+
+// Headers that a ServeHandler sets on the requests it proxies. Any
+// copies sent by the client are removed first.
+const (
+	// ServeUserLoginHeader is the login name of the user who owns
+	// the calling node, such as "alice@example.com". It's absent
+	// for tagged nodes.
+	ServeUserLoginHeader = "Tailscale-User-Login"
+
+	// ServeUserNameHeader is the display name of the user who owns
+	// the calling node. It's absent for tagged nodes.
+	ServeUserNameHeader = "Tailscale-User-Name"
+
+	// ServeSignatureHeader authenticates the other two headers, and
+	// the request they're in; see SignServeRequest.
+	ServeSignatureHeader = "Tailscale-User-Signature"
+)
+
+// SignServeRequest sets the ServeSignatureHeader of r, a request about
+// to be proxied to a ServeHandler's target, to
+// "t=<unix time>,v1=<hex HMAC-SHA256>", where the HMAC is keyed by key
+// and covers the time, r's method, host and request URI, and the
+// values of the ServeUserLoginHeader and ServeUserNameHeader.
+//
+// Services can check it with VerifyServeRequest to make sure a request
+// came through tailscaled rather than directly from another local
+// process. As the request line is signed, a copy of the headers can't
+// be used to make other requests.
+func SignServeRequest(r *http.Request, key []byte, t time.Time) {
+	unix := t.Unix()
+	mac := serveRequestMAC(r, r.URL.RequestURI(), key, unix)
+	r.Header.Set(ServeSignatureHeader, fmt.Sprintf("t=%d,v1=%x", unix, mac))
+}
+
+// VerifyServeRequest returns an error unless r, as received by a
+// service, has a valid signature from SignServeRequest, made with key
+// no more than maxAge from now.
+func VerifyServeRequest(r *http.Request, key []byte, now time.Time, maxAge time.Duration) error {
+	sig := r.Header.Get(ServeSignatureHeader)
+	if sig == "" {
+		return errors.New("missing " + ServeSignatureHeader + " header")
+	}
+	var unix int64
+	var mac []byte
+	for _, f := range strings.Split(sig, ",") {
+		k, v, ok := cutString(f, "=")
+		if !ok {
+			return errors.New("malformed " + ServeSignatureHeader + " header")
+		}
+		var err error
+		switch k {
+		case "t":
+			unix, err = strconv.ParseInt(v, 10, 64)
+		case "v1":
+			mac, err = hex.DecodeString(v)
+		}
+		if err != nil {
+			return errors.New("malformed " + ServeSignatureHeader + " header")
+		}
+	}
+	if unix == 0 || mac == nil {
+		return errors.New("malformed " + ServeSignatureHeader + " header")
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	if !hmac.Equal(mac, serveRequestMAC(r, uri, key, unix)) {
+		return errors.New("bad " + ServeSignatureHeader + " header")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return errors.New("expired " + ServeSignatureHeader + " header")
+	}
+	return nil
+}
+
+// serveRequestMAC returns the HMAC of SignServeRequest for r, whose
+// request URI is uri, at the given unix time.
+func serveRequestMAC(r *http.Request, uri string, key []byte, unix int64) []byte {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "%d\n%s\n%s\n%s\n%s\n%s", unix, r.Method, host, uri,
+		r.Header.Get(ServeUserLoginHeader), r.Header.Get(ServeUserNameHeader))
+	return m.Sum(nil)
+}
+
+func cutString(s, sep string) (before, after string, ok bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
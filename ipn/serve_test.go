@@ -0,0 +1,98 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServeHandlerCheck(t *testing.T) {
+	tests := []struct {
+		h  ServeHandler
+		ok bool
+	}{
+		{ServeHandler{Port: 80, Target: "http://127.0.0.1:3000"}, true},
+		{ServeHandler{Port: 80, Target: "https://localhost:8443/app"}, true},
+		{ServeHandler{Port: 80, Target: "http://[::1]:3000"}, true},
+		{ServeHandler{Port: 443, Target: "unix:/run/app.sock", TLS: true}, true},
+		{ServeHandler{Target: "http://127.0.0.1:3000"}, false},
+		{ServeHandler{Port: 80, Target: "unix:"}, false},
+		{ServeHandler{Port: 80, Target: "unix:run/app.sock"}, false},
+		{ServeHandler{Port: 80, Target: "http://10.0.0.1:3000"}, false},
+		{ServeHandler{Port: 80, Target: "http://example.com"}, false},
+		{ServeHandler{Port: 80, Target: "ftp://127.0.0.1"}, false},
+		{ServeHandler{Port: 80, Target: "3000"}, false},
+	}
+	for _, tt := range tests {
+		err := tt.h.Check()
+		if (err == nil) != tt.ok {
+			t.Errorf("%v.Check() = %v; want ok=%v", tt.h, err, tt.ok)
+		}
+	}
+
+	dup := []ServeHandler{
+		{Port: 80, Target: "http://127.0.0.1:3000"},
+		{Port: 80, Target: "http://127.0.0.1:3001"},
+	}
+	if err := CheckServeHandlers(dup); err == nil {
+		t.Error("CheckServeHandlers allowed a duplicate port")
+	}
+}
+
+func TestServeRequestSignature(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1625000000, 0)
+
+	// signed returns a request as proxied to the target, and as
+	// received by the service there.
+	signed := func() (out, in *http.Request) {
+		out = httptest.NewRequest("GET", "http://127.0.0.1:3000/app/docs?page=2", nil)
+		out.Host = "foo.example.ts.net"
+		out.RequestURI = ""
+		out.Header.Set(ServeUserLoginHeader, "alice@example.com")
+		out.Header.Set(ServeUserNameHeader, "Alice Smith")
+		SignServeRequest(out, key, now)
+
+		in = httptest.NewRequest(out.Method, out.URL.RequestURI(), nil)
+		in.Host = out.Host
+		in.Header = out.Header.Clone()
+		return out, in
+	}
+
+	_, in := signed()
+	if err := VerifyServeRequest(in, key, now.Add(time.Second), time.Minute); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	if err := VerifyServeRequest(in, []byte("other key"), now, time.Minute); err == nil {
+		t.Error("signature verified with the wrong key")
+	}
+	if err := VerifyServeRequest(in, key, now.Add(time.Hour), time.Minute); err == nil {
+		t.Error("expired signature verified")
+	}
+
+	forgeries := map[string]func(r *http.Request){
+		"changed login": func(r *http.Request) {
+			r.Header.Set(ServeUserLoginHeader, "mallory@example.com")
+		},
+		"other path":   func(r *http.Request) { r.RequestURI = "/app/admin?page=2" },
+		"other query":  func(r *http.Request) { r.RequestURI = "/app/docs?page=3" },
+		"other method": func(r *http.Request) { r.Method = "POST" },
+		"other host":   func(r *http.Request) { r.Host = "bar.example.ts.net" },
+		"malformed": func(r *http.Request) {
+			r.Header.Set(ServeSignatureHeader, "t=1625000000")
+		},
+		"missing": func(r *http.Request) { r.Header.Del(ServeSignatureHeader) },
+	}
+	for name, forge := range forgeries {
+		_, in := signed()
+		forge(in)
+		if err := VerifyServeRequest(in, key, now, time.Minute); err == nil {
+			t.Errorf("%s: signature verified", name)
+		}
+	}
+}
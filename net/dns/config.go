@@ -39,6 +39,12 @@ type Config struct {
 	// it to resolve, you also need to add appropriate routes to
 	// Routes.
 	Hosts map[dnsname.FQDN][]netaddr.IP
+	// DNS64Prefix, if non-zero, is a /96 prefix in which
+	// 100.100.100.100 synthesizes AAAA records for names that only
+	// have A records, so that IPv6-only clients can reach IPv4-only
+	// hosts through a NAT64 translator for the prefix.
+	// Setting it makes 100.100.100.100 the OS's only resolver.
+	DNS64Prefix netaddr.IPPrefix
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -52,6 +58,9 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
+	if !c.DNS64Prefix.IsZero() {
+		fmt.Fprintf(w, " DNS64Prefix:%v", c.DNS64Prefix)
+	}
 	w.WriteString("}")
 }
 
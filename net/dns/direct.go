@@ -7,6 +7,7 @@ package dns
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
@@ -16,8 +17,12 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 )
 
@@ -76,7 +81,7 @@ func readResolv(r io.Reader) (config OSConfig, err error) {
 	return config, nil
 }
 
-func (m directManager) readResolvFile(path string) (OSConfig, error) {
+func (m *directManager) readResolvFile(path string) (OSConfig, error) {
 	b, err := m.fs.ReadFile(path)
 	if err != nil {
 		return OSConfig{}, err
@@ -85,7 +90,7 @@ func (m directManager) readResolvFile(path string) (OSConfig, error) {
 }
 
 // readResolvConf reads DNS configuration from /etc/resolv.conf.
-func (m directManager) readResolvConf() (OSConfig, error) {
+func (m *directManager) readResolvConf() (OSConfig, error) {
 	return m.readResolvFile(resolvConf)
 }
 
@@ -145,21 +150,90 @@ func isResolvedRunning() bool {
 // to the disappearance of the Tailscale interface.
 // The caller must call Down before program shutdown
 // or as cleanup if the program terminates unexpectedly.
+//
+// Other programs (DHCP clients, NetworkManager, VPN software) may
+// overwrite resolv.conf after we write it. If watch is set, the
+// manager watches for that and reacts according to its clobberPolicy.
 type directManager struct {
-	fs wholeFileFS
+	logf  logger.Logf
+	fs    wholeFileFS
+	watch bool // whether to watch resolv.conf for being overwritten
+
+	ctx      context.Context    // good until Close
+	ctxClose context.CancelFunc // closes ctx
+
+	mu        sync.Mutex
+	policy    clobberPolicy
+	want      []byte      // resolv.conf contents we wrote, or nil if none
+	clobbered []byte      // resolv.conf contents last found instead of want
+	watching  bool        // whether watchResolvConf is running
+	repairs   []time.Time // times of recent repairs, within clobberRepairWindow
+}
+
+// clobberPolicy is what a directManager does when it notices that
+// another program overwrote the resolv.conf it wrote.
+type clobberPolicy int
+
+const (
+	// clobberRepair rewrites resolv.conf, keeping the other
+	// program's version as the new base configuration. If
+	// resolv.conf keeps getting overwritten, it gives up and
+	// behaves like clobberWarn, to avoid fighting over the file
+	// forever.
+	clobberRepair clobberPolicy = iota
+	// clobberWarn leaves the other program's resolv.conf in place
+	// and reports the DNS configuration as unhealthy.
+	clobberWarn
+)
+
+const (
+	// resolvConfPollInterval is how often resolv.conf is checked
+	// when it can't be watched for changes.
+	resolvConfPollInterval = 5 * time.Second
+
+	// clobberMaxRepairs is how many times resolv.conf is repaired
+	// within clobberRepairWindow before clobberRepair gives up.
+	clobberMaxRepairs   = 5
+	clobberRepairWindow = time.Minute
+)
+
+// clobberPolicyFromEnv returns the clobberPolicy requested by the
+// TS_DNS_RESOLV_CONF_CLOBBER environment variable: "warn" or, by
+// default, "repair".
+func clobberPolicyFromEnv(logf logger.Logf) clobberPolicy {
+	switch v := os.Getenv("TS_DNS_RESOLV_CONF_CLOBBER"); v {
+	case "", "repair":
+		return clobberRepair
+	case "warn":
+		return clobberWarn
+	default:
+		logf("dns: unknown TS_DNS_RESOLV_CONF_CLOBBER value %q; using \"repair\"", v)
+		return clobberRepair
+	}
 }
 
-func newDirectManager() directManager {
-	return directManager{fs: directFS{}}
+func newDirectManager(logf logger.Logf) *directManager {
+	m := newDirectManagerOnFS(logf, directFS{})
+	m.watch = true
+	m.policy = clobberPolicyFromEnv(logf)
+	return m
 }
 
-func newDirectManagerOnFS(fs wholeFileFS) directManager {
-	return directManager{fs: fs}
+// newDirectManagerOnFS returns a directManager that configures DNS
+// through fs. It doesn't watch resolv.conf for being overwritten.
+func newDirectManagerOnFS(logf logger.Logf, fs wholeFileFS) *directManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &directManager{
+		logf:     logf,
+		fs:       fs,
+		ctx:      ctx,
+		ctxClose: cancel,
+	}
 }
 
 // ownedByTailscale reports whether /etc/resolv.conf seems to be a
 // tailscale-managed file.
-func (m directManager) ownedByTailscale() (bool, error) {
+func (m *directManager) ownedByTailscale() (bool, error) {
 	isRegular, err := m.fs.Stat(resolvConf)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -182,7 +256,7 @@ func (m directManager) ownedByTailscale() (bool, error) {
 
 // backupConfig creates or updates a backup of /etc/resolv.conf, if
 // resolv.conf does not currently contain a Tailscale-managed config.
-func (m directManager) backupConfig() error {
+func (m *directManager) backupConfig() error {
 	if _, err := m.fs.Stat(resolvConf); err != nil {
 		if os.IsNotExist(err) {
 			// No resolv.conf, nothing to back up. Also get rid of any
@@ -204,7 +278,7 @@ func (m directManager) backupConfig() error {
 	return m.fs.Rename(resolvConf, backupConf)
 }
 
-func (m directManager) restoreBackup() error {
+func (m *directManager) restoreBackup() error {
 	if _, err := m.fs.Stat(backupConf); err != nil {
 		if os.IsNotExist(err) {
 			// No backup, nothing we can do.
@@ -236,8 +310,12 @@ func (m directManager) restoreBackup() error {
 	return nil
 }
 
-func (m directManager) SetDNS(config OSConfig) error {
+func (m *directManager) SetDNS(config OSConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if config.IsZero() {
+		m.want = nil
 		if err := m.restoreBackup(); err != nil {
 			return err
 		}
@@ -251,6 +329,13 @@ func (m directManager) SetDNS(config OSConfig) error {
 		if err := atomicWriteFile(m.fs, resolvConf, buf.Bytes(), 0644); err != nil {
 			return err
 		}
+		m.want = buf.Bytes()
+		m.clobbered = nil
+		m.repairs = nil
+		if m.watch && !m.watching {
+			m.watching = true
+			go m.watchResolvConf()
+		}
 	}
 
 	// We might have taken over a configuration managed by resolved,
@@ -266,11 +351,11 @@ func (m directManager) SetDNS(config OSConfig) error {
 	return nil
 }
 
-func (m directManager) SupportsSplitDNS() bool {
+func (m *directManager) SupportsSplitDNS() bool {
 	return false
 }
 
-func (m directManager) GetBaseConfig() (OSConfig, error) {
+func (m *directManager) GetBaseConfig() (OSConfig, error) {
 	owned, err := m.ownedByTailscale()
 	if err != nil {
 		return OSConfig{}, err
@@ -283,7 +368,12 @@ func (m directManager) GetBaseConfig() (OSConfig, error) {
 	return m.readResolvFile(fileToRead)
 }
 
-func (m directManager) Close() error {
+func (m *directManager) Close() error {
+	m.ctxClose()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.want = nil
+
 	// We used to keep a file for the tailscale config and symlinked
 	// to it, but then we stopped because /etc/resolv.conf being a
 	// symlink to surprising places breaks snaps and other sandboxing
@@ -326,6 +416,94 @@ func (m directManager) Close() error {
 	return nil
 }
 
+// watchResolvConf checks resolv.conf whenever it changes, or
+// periodically if changes can't be watched for, until m is closed.
+func (m *directManager) watchResolvConf() {
+	var tick <-chan time.Time
+	changed, err := watchFile(m.ctx, resolvConf)
+	if err != nil {
+		m.logf("dns: can't watch %s, polling instead: %v", resolvConf, err)
+		t := time.NewTicker(resolvConfPollInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-changed:
+		case <-tick:
+		}
+		m.checkResolvConf()
+	}
+}
+
+// checkResolvConf checks whether resolv.conf still has the contents m
+// wrote to it and, if not, acts according to m's clobberPolicy.
+func (m *directManager) checkResolvConf() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.want == nil {
+		return
+	}
+	got, err := m.fs.ReadFile(resolvConf)
+	if err == nil && bytes.Equal(got, m.want) {
+		return
+	}
+	if m.clobbered != nil && bytes.Equal(got, m.clobbered) {
+		// Already reported, and we've decided to leave it.
+		return
+	}
+
+	var writer string
+	switch {
+	case os.IsNotExist(err):
+		writer = "deleted"
+		got = []byte{}
+	case err != nil:
+		m.logf("dns: checking %s: %v", resolvConf, err)
+		return
+	default:
+		writer = resolvOwner(got)
+		if writer == "" {
+			writer = "unknown program"
+		}
+		writer = "overwritten by " + writer
+	}
+
+	now := time.Now()
+	for len(m.repairs) > 0 && now.Sub(m.repairs[0]) > clobberRepairWindow {
+		m.repairs = m.repairs[1:]
+	}
+	if m.policy == clobberRepair && len(m.repairs) < clobberMaxRepairs {
+		m.logf("dns: %s was %s; rewriting it", resolvConf, writer)
+		// Keep what the other program wrote as the backup, so
+		// that it's what gets restored when Tailscale DNS is
+		// turned off. If the file was deleted, keep the old backup.
+		if len(got) > 0 {
+			if err := m.backupConfig(); err != nil {
+				m.logf("dns: backing up %s: %v", resolvConf, err)
+			}
+		}
+		if err := atomicWriteFile(m.fs, resolvConf, m.want, 0644); err != nil {
+			m.logf("dns: rewriting %s: %v", resolvConf, err)
+			health.SetDNSHealth(fmt.Errorf("%s was %s and couldn't be rewritten: %w", resolvConf, writer, err))
+			return
+		}
+		m.repairs = append(m.repairs, now)
+		health.SetDNSHealth(nil)
+		return
+	}
+
+	m.clobbered = got
+	if m.policy == clobberRepair {
+		m.logf("dns: %s was %s %d times within %v; no longer rewriting it", resolvConf, writer, len(m.repairs)+1, clobberRepairWindow)
+	} else {
+		m.logf("dns: %s was %s; leaving it alone", resolvConf, writer)
+	}
+	health.SetDNSHealth(fmt.Errorf("%s was %s; Tailscale DNS settings are not in effect", resolvConf, writer))
+}
+
 func atomicWriteFile(fs wholeFileFS, filename string, data []byte, perm os.FileMode) error {
 	var randBytes [12]byte
 	if _, err := rand.Read(randBytes[:]); err != nil {
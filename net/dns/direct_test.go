@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/util/dnsname"
 )
 
@@ -44,7 +45,7 @@ func TestSetDNS(t *testing.T) {
 		}
 	}
 
-	m := directManager{fs: directFS{prefix: tmp}}
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
 	if err := m.SetDNS(OSConfig{
 		Nameservers:   []netaddr.IP{netaddr.MustParseIP("8.8.8.8"), netaddr.MustParseIP("8.8.4.4")},
 		SearchDomains: []dnsname.FQDN{"ts.net.", "ts-dns.test."},
@@ -81,3 +82,89 @@ search ts.net ts-dns.test
 	}
 	assertBaseState(t)
 }
+
+func TestResolvConfClobber(t *testing.T) {
+	tmp := t.TempDir()
+	resolvPath := filepath.Join(tmp, "etc", "resolv.conf")
+	backupPath := filepath.Join(tmp, "etc", "resolv.pre-tailscale-backup.conf")
+	if err := os.MkdirAll(filepath.Dir(resolvPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(resolvPath, []byte("nameserver 9.9.9.9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readFile := func(t *testing.T, path string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	clobber := func(t *testing.T, contents string) {
+		t.Helper()
+		if err := ioutil.WriteFile(resolvPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer health.SetDNSHealth(nil)
+
+	m := newDirectManagerOnFS(t.Logf, directFS{prefix: tmp})
+	defer m.Close()
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	want := readFile(t, resolvPath)
+
+	// An untouched resolv.conf is left alone.
+	m.checkResolvConf()
+	if got := readFile(t, resolvPath); got != want {
+		t.Fatalf("resolv.conf changed without clobbering:\n%s", got)
+	}
+
+	// By default, an overwritten resolv.conf is repaired, and what the
+	// other program wrote becomes the backup.
+	const nm = "# Generated by NetworkManager\nnameserver 1.1.1.1\n"
+	clobber(t, nm)
+	m.checkResolvConf()
+	if got := readFile(t, resolvPath); got != want {
+		t.Errorf("resolv.conf after repair:\n%s, want:\n%s", got, want)
+	}
+	if got := readFile(t, backupPath); got != nm {
+		t.Errorf("resolv.conf backup:\n%s, want:\n%s", got, nm)
+	}
+	if err := health.DNSHealth(); err != nil {
+		t.Errorf("DNS health after repair = %v; want nil", err)
+	}
+
+	// Repairs stop after clobberMaxRepairs within clobberRepairWindow.
+	for i := 1; i < clobberMaxRepairs; i++ {
+		clobber(t, nm)
+		m.checkResolvConf()
+	}
+	clobber(t, nm)
+	m.checkResolvConf()
+	if got := readFile(t, resolvPath); got != nm {
+		t.Errorf("resolv.conf repaired more than %d times:\n%s", clobberMaxRepairs, got)
+	}
+	if health.DNSHealth() == nil {
+		t.Error("DNS health after giving up = nil; want error")
+	}
+
+	// With the warn policy, resolv.conf is never repaired.
+	if err := m.SetDNS(OSConfig{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}}); err != nil {
+		t.Fatal(err)
+	}
+	health.SetDNSHealth(nil)
+	m.mu.Lock()
+	m.policy = clobberWarn
+	m.mu.Unlock()
+	clobber(t, nm)
+	m.checkResolvConf()
+	if got := readFile(t, resolvPath); got != nm {
+		t.Errorf("resolv.conf with warn policy:\n%s, want:\n%s", got, nm)
+	}
+	if health.DNSHealth() == nil {
+		t.Error("DNS health with warn policy = nil; want error")
+	}
+}
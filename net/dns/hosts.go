@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// ParseHosts parses r, the contents of a hosts(5)-style file, and
+// returns the IPs listed for each name.
+//
+// Each non-blank line is an IP address followed by one or more names
+// for it. Everything after a '#' is a comment. A name listed on more
+// than one line gets all of those lines' IPs, in order.
+//
+// Unlike most hosts file parsers, ParseHosts rejects malformed lines
+// rather than skipping them, so typos are reported instead of silently
+// ignored.
+func ParseHosts(r io.Reader) (map[dnsname.FQDN][]netaddr.IP, error) {
+	hosts := map[dnsname.FQDN][]netaddr.IP{}
+	bs := bufio.NewScanner(r)
+	lineNum := 0
+	for bs.Scan() {
+		lineNum++
+		line := bs.Bytes()
+		if i := bytes.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: no names for %s", lineNum, fields[0])
+		}
+		ip, err := netaddr.ParseIP(string(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		for _, f := range fields[1:] {
+			// The resolver lowercases names before looking
+			// them up, so do the same here.
+			fqdn, err := dnsname.ToFQDN(strings.ToLower(string(f)))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			hosts[fqdn] = append(hosts[fqdn], ip)
+		}
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[dnsname.FQDN][]netaddr.IP
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			in:   "\n# just a comment\n\n",
+			want: map[dnsname.FQDN][]netaddr.IP{},
+		},
+		{
+			name: "basic",
+			in: `
+10.0.0.1   db.corp.example  db   # the database
+fd7a::1    db.corp.example
+10.0.0.2	Web.Corp.Example.
+`,
+			want: map[dnsname.FQDN][]netaddr.IP{
+				"db.corp.example.":  {netaddr.MustParseIP("10.0.0.1"), netaddr.MustParseIP("fd7a::1")},
+				"db.":               {netaddr.MustParseIP("10.0.0.1")},
+				"web.corp.example.": {netaddr.MustParseIP("10.0.0.2")},
+			},
+		},
+		{
+			name:    "bad_ip",
+			in:      "10.0.0.300 foo\n",
+			wantErr: true,
+		},
+		{
+			name:    "no_names",
+			in:      "10.0.0.1 # foo\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseHosts(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -82,6 +82,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.DNS64Prefix = cfg.DNS64Prefix
 	routes := map[dnsname.FQDN][]netaddr.IPPort{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -93,14 +94,18 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// Similarly, the OS always gets search paths.
 	ocfg.SearchDomains = cfg.SearchDomains
 
+	// DNS64 synthesis happens in quad-100, so all queries must go
+	// through it.
+	dns64 := !cfg.DNS64Prefix.IsZero()
+
 	// Deal with trivial configs first.
 	switch {
-	case !cfg.needsOSResolver():
+	case !cfg.needsOSResolver() && !dns64:
 		// Set search domains, but nothing else. This also covers the
 		// case where cfg is entirely zero, in which case these
 		// configs clear all Tailscale DNS settings.
 		return rcfg, ocfg, nil
-	case cfg.hasDefaultResolversOnly():
+	case cfg.hasDefaultResolversOnly() && !dns64:
 		// Trivial CorpDNS configuration, just override the OS
 		// resolver.
 		ocfg.Nameservers = toIPsOnly(cfg.DefaultResolvers)
@@ -135,7 +140,7 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// This bool is used in a couple of places below to implement this
 	// workaround.
 	isWindows := runtime.GOOS == "windows"
-	if cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !isWindows {
+	if !dns64 && cfg.singleResolverSet() != nil && m.os.SupportsSplitDNS() && !isWindows {
 		// Split DNS configuration requested, where all split domains
 		// go to the same resolvers. We can let the OS do it.
 		ocfg.Nameservers = toIPsOnly(cfg.singleResolverSet())
@@ -151,10 +156,10 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 
 	// If the OS can't do native split-dns, read out the underlying
 	// resolver config and blend it into our config.
-	if m.os.SupportsSplitDNS() {
+	if m.os.SupportsSplitDNS() && !dns64 {
 		ocfg.MatchDomains = cfg.matchDomains()
 	}
-	if !m.os.SupportsSplitDNS() || isWindows {
+	if !m.os.SupportsSplitDNS() || isWindows || dns64 {
 		bcfg, err := m.os.GetBaseConfig()
 		if err != nil {
 			return resolver.Config{}, OSConfig{}, err
@@ -187,6 +192,11 @@ func toIPPorts(ips []netaddr.IP) (ret []netaddr.IPPort) {
 	return ret
 }
 
+// Resolver returns the Manager's DNS Resolver.
+func (m *Manager) Resolver() *resolver.Resolver {
+	return m.resolver
+}
+
 func (m *Manager) EnqueueRequest(bs []byte, from netaddr.IPPort) error {
 	return m.resolver.EnqueueRequest(bs, from)
 }
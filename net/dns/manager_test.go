@@ -368,6 +368,58 @@ func TestManager(t *testing.T) {
 				LocalDomains: fqdns("ts.com."),
 			},
 		},
+		{
+			name: "dns64",
+			in: Config{
+				SearchDomains: fqdns("tailscale.com", "universe.tf"),
+				DNS64Prefix:   netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96"),
+			},
+			bs: OSConfig{
+				Nameservers: mustIPs("8.8.8.8"),
+			},
+			os: OSConfig{
+				Nameservers:   mustIPs("100.100.100.100"),
+				SearchDomains: fqdns("tailscale.com", "universe.tf"),
+			},
+			rs: resolver.Config{
+				Routes:      upstreams(".", "8.8.8.8:53"),
+				DNS64Prefix: netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96"),
+			},
+		},
+		{
+			name: "dns64-routes-split",
+			in: Config{
+				Routes:      upstreams("corp.com", "2.2.2.2:53"),
+				DNS64Prefix: netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96"),
+			},
+			split: true,
+			bs: OSConfig{
+				Nameservers: mustIPs("8.8.8.8"),
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes: upstreams(
+					".", "8.8.8.8:53",
+					"corp.com.", "2.2.2.2:53"),
+				DNS64Prefix: netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96"),
+			},
+		},
+		{
+			name: "dns64-corp",
+			in: Config{
+				DefaultResolvers: mustIPPs("1.1.1.1:53"),
+				DNS64Prefix:      netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96"),
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes:      upstreams(".", "1.1.1.1:53"),
+				DNS64Prefix: netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96"),
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -384,10 +436,11 @@ func TestManager(t *testing.T) {
 			}
 			trIP := cmp.Transformer("ipStr", func(ip netaddr.IP) string { return ip.String() })
 			trIPPort := cmp.Transformer("ippStr", func(ipp netaddr.IPPort) string { return ipp.String() })
+			trIPPrefix := cmp.Transformer("ippfxStr", func(p netaddr.IPPrefix) string { return p.String() })
 			if diff := cmp.Diff(f.OSConfig, test.os, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("wrong OSConfig (-got+want)\n%s", diff)
 			}
-			if diff := cmp.Diff(f.ResolverConfig, test.rs, trIP, trIPPort, cmpopts.EquateEmpty()); diff != "" {
+			if diff := cmp.Diff(f.ResolverConfig, test.rs, trIP, trIPPort, trIPPrefix, cmpopts.EquateEmpty()); diff != "" {
 				t.Errorf("wrong resolver.Config (-got+want)\n%s", diff)
 			}
 		})
@@ -68,7 +68,7 @@ func isResolvedActive() bool {
 		return false
 	}
 
-	config, err := newDirectManager().readResolvConf()
+	config, err := newDirectManagerOnFS(logger.Discard, directFS{}).readResolvConf()
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,253 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
+)
+
+// queryTypes maps the record type names accepted by Query to types.
+var queryTypes = map[string]dns.Type{
+	"A":     dns.TypeA,
+	"NS":    dns.TypeNS,
+	"CNAME": dns.TypeCNAME,
+	"SOA":   dns.TypeSOA,
+	"PTR":   dns.TypePTR,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"AAAA":  dns.TypeAAAA,
+	"SRV":   dns.TypeSRV,
+	"ALL":   dns.TypeALL,
+	"ANY":   dns.TypeALL,
+}
+
+// parseQueryType parses s, a record type name such as "AAAA" or a
+// record type number.
+func parseQueryType(s string) (dns.Type, error) {
+	if t, ok := queryTypes[strings.ToUpper(s)]; ok {
+		return t, nil
+	}
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return dns.Type(n), nil
+	}
+	return 0, fmt.Errorf("unknown DNS record type %q", s)
+}
+
+// typeString returns t's name without its "Type" prefix, such as "A"
+// or "AAAA".
+func typeString(t dns.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+// Query runs a query for name and qtype through r as if it had
+// arrived from the network, and returns the response along with the
+// decisions r made to produce it: whether it was answered from local
+// records, which route it was forwarded along, which upstream
+// answered, and whether DNS64 synthesis applied. It's meant for
+// diagnostics.
+//
+// qtype is a record type name such as "A" or "AAAA", or a record type
+// number.
+func (r *Resolver) Query(ctx context.Context, name, qtype string) (*dnstype.QueryResult, error) {
+	fqdn, err := dnsname.ToFQDN(strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	typ, err := parseQueryType(qtype)
+	if err != nil {
+		return nil, err
+	}
+	query, err := debugQueryPacket(fqdn, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &dnstype.QueryResult{
+		Name: fqdn.WithoutTrailingDot(),
+		Type: typeString(typ),
+	}
+	start := time.Now()
+	out, err := r.respond(query)
+	switch {
+	case err == nil:
+		res.Route = "local"
+		res.Path = append(res.Path, r.explainLocal(fqdn, typ))
+	case err == errNotOurName:
+		out = r.debugForward(ctx, fqdn, typ, query, res)
+		if out == nil {
+			return res, nil
+		}
+	default:
+		return nil, err
+	}
+	res.Latency = time.Since(start)
+
+	if err := debugParseResponse(out, res); err != nil {
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
+// explainLocal describes why r answered a query for name and typ
+// itself.
+func (r *Resolver) explainLocal(name dnsname.FQDN, typ dns.Type) string {
+	if typ == dns.TypePTR {
+		return "reverse lookup answered from MagicDNS records"
+	}
+	if dnsname.HasSuffix(name.WithoutTrailingDot(), ".onion") {
+		return ".onion names are never resolved (RFC 7686)"
+	}
+	r.mu.Lock()
+	hosts := r.hostToIP
+	localDomains := r.localDomains
+	r.mu.Unlock()
+	if ips, ok := hosts[name]; ok {
+		return fmt.Sprintf("found in MagicDNS records: %v", ips)
+	}
+	for _, suffix := range localDomains {
+		if suffix.Contains(name) {
+			return fmt.Sprintf("not in MagicDNS records, but within %s, which is answered only from them", suffix.WithTrailingDot())
+		}
+	}
+	return "answered locally"
+}
+
+// debugForward forwards query, a query for name and typ, the way
+// handleQuery would, recording each step in res. It returns the
+// response, or nil if there was none, in which case res.Error says
+// why.
+func (r *Resolver) debugForward(ctx context.Context, name dnsname.FQDN, typ dns.Type, query []byte, res *dnstype.QueryResult) []byte {
+	if typ == dns.TypePTR {
+		res.Path = append(res.Path, "not the address of a MagicDNS name")
+	} else {
+		res.Path = append(res.Path, "not in MagicDNS records or within a MagicDNS domain")
+	}
+
+	suffix, rr := r.forwarder.resolvers(name)
+	if len(rr) == 0 {
+		res.Path = append(res.Path, "no DNS route matches the name")
+		res.Error = errNoUpstreams.Error()
+		return nil
+	}
+	res.Route = string(suffix)
+	ipps := make([]string, len(rr))
+	for i, rd := range rr {
+		ipps[i] = rd.ipp.String()
+	}
+	res.Path = append(res.Path, fmt.Sprintf("matches route %s; forwarding to %s", suffix.WithTrailingDot(), strings.Join(ipps, ", ")))
+
+	ctx, cancel := context.WithTimeout(ctx, responseTimeout)
+	defer cancel()
+	var fi forwardInfo
+	out, err := r.forwarder.exchange(ctx, query, &fi)
+	if err != nil {
+		res.Path = append(res.Path, "no upstream responded")
+		res.Error = err.Error()
+		return nil
+	}
+	res.Upstream = fi.upstream.String()
+	res.Path = append(res.Path, fmt.Sprintf("response from %v used", fi.upstream))
+
+	r.forwarder.mu.Lock()
+	dns64Prefix := r.forwarder.dns64Prefix
+	r.forwarder.mu.Unlock()
+	if !dns64Prefix.IsZero() && typ == dns.TypeAAAA {
+		if syn := r.forwarder.dns64(ctx, dns64Prefix, query, out); !bytes.Equal(syn, out) {
+			res.Path = append(res.Path, fmt.Sprintf("no AAAA records upstream; synthesized from A records in %v (DNS64)", dns64Prefix))
+			out = syn
+		}
+	}
+	return out
+}
+
+// debugQueryPacket returns a recursive query for name and typ.
+func debugQueryPacket(name dnsname.FQDN, typ dns.Type) ([]byte, error) {
+	qname, err := dns.NewName(name.WithTrailingDot())
+	if err != nil {
+		return nil, err
+	}
+	b := dns.NewBuilder(nil, dns.Header{
+		ID:               uint16(rand.Intn(1 << 16)),
+		RecursionDesired: true,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dns.Question{Name: qname, Type: typ, Class: dns.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// debugParseResponse fills in res's RCode and Answers from the DNS
+// response out.
+func debugParseResponse(out []byte, res *dnstype.QueryResult) error {
+	var p dns.Parser
+	h, err := p.Start(out)
+	if err != nil {
+		return err
+	}
+	res.RCode = rcodeString(h.RCode)
+	if err := p.SkipAllQuestions(); err != nil {
+		return err
+	}
+	for {
+		rr, err := p.Answer()
+		if err == dns.ErrSectionDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res.Answers = append(res.Answers, dnstype.QueryAnswer{
+			Name: strings.TrimSuffix(rr.Header.Name.String(), "."),
+			Type: typeString(rr.Header.Type),
+			TTL:  rr.Header.TTL,
+			Data: resourceData(rr.Body),
+		})
+	}
+}
+
+// resourceData returns the data of the resource record body b in
+// presentation format, or the empty string for record types it
+// doesn't know.
+func resourceData(b dns.ResourceBody) string {
+	switch b := b.(type) {
+	case *dns.AResource:
+		return netaddr.IPv4(b.A[0], b.A[1], b.A[2], b.A[3]).String()
+	case *dns.AAAAResource:
+		return netaddr.IPv6Raw(b.AAAA).String()
+	case *dns.CNAMEResource:
+		return b.CNAME.String()
+	case *dns.PTRResource:
+		return b.PTR.String()
+	case *dns.NSResource:
+		return b.NS.String()
+	case *dns.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dns.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dns.TXTResource:
+		quoted := make([]string, len(b.TXT))
+		for i, s := range b.TXT {
+			quoted[i] = strconv.Quote(s)
+		}
+		return strings.Join(quoted, " ")
+	case *dns.SOAResource:
+		return fmt.Sprintf("%s %s %d", b.NS, b.MBox, b.Serial)
+	}
+	return ""
+}
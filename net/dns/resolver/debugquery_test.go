@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestQuery(t *testing.T) {
+	server := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+	defer server.Shutdown()
+	upstream := netaddr.MustParseIPPort(server.PacketConn.LocalAddr().String())
+
+	r := newResolver(t)
+	defer r.Close()
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]netaddr.IPPort{
+		"site.": {upstream},
+	}
+	r.SetConfig(cfg)
+
+	ctx := context.Background()
+
+	res, err := r.Query(ctx, "TEST1.ipn.dev", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Name != "test1.ipn.dev" || res.Type != "A" || res.Route != "local" || res.RCode != "Success" {
+		t.Errorf("local query = %+v", res)
+	}
+	if len(res.Answers) != 1 || res.Answers[0].Data != testipv4.String() {
+		t.Errorf("local answers = %+v; want %v", res.Answers, testipv4)
+	}
+
+	res, err = r.Query(ctx, "missing.ipn.dev.", "AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Route != "local" || res.RCode != "NameError" || len(res.Answers) != 0 {
+		t.Errorf("local NXDOMAIN query = %+v", res)
+	}
+
+	res, err = r.Query(ctx, "test.site", "AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Route != "site." || res.Upstream != upstream.String() || res.RCode != "Success" {
+		t.Errorf("forwarded query = %+v", res)
+	}
+	if len(res.Answers) != 1 || res.Answers[0].Type != "AAAA" || res.Answers[0].Data != testipv6.String() {
+		t.Errorf("forwarded answers = %+v; want %v", res.Answers, testipv6)
+	}
+	if len(res.Path) != 3 {
+		t.Errorf("forwarded path = %q; want 3 steps", res.Path)
+	}
+
+	res, err = r.Query(ctx, "example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Route != "" || res.Error == "" || res.RCode != "" {
+		t.Errorf("unroutable query = %+v; want error", res)
+	}
+
+	if _, err := r.Query(ctx, "test.site", "BOGUS"); err == nil {
+		t.Error("Query with unknown type succeeded")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"context"
+	"errors"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+// errNoDNS64 is returned by synthesizeDNS64 when there's nothing to
+// synthesize from.
+var errNoDNS64 = errors.New("no A records to synthesize from")
+
+// dns64 implements DNS64 (RFC 6147) on top of a forwarded AAAA query:
+// if the upstream response res to query has no AAAA records for the
+// name, the name's A records are looked up and AAAA records are
+// synthesized from them by embedding each IPv4 address in the low 32
+// bits of prefix.
+//
+// It returns res unmodified if query isn't an AAAA query, if res
+// already has AAAA records or isn't a successful response, or if
+// synthesis fails for any reason.
+func (f *forwarder) dns64(ctx context.Context, prefix netaddr.IPPrefix, query, res []byte) []byte {
+	_, qtype, err := questionFromQuery(query)
+	if err != nil || qtype != dns.TypeAAAA {
+		return res
+	}
+	if !needsDNS64(res) {
+		return res
+	}
+	aquery, err := dns64Query(query)
+	if err != nil {
+		return res
+	}
+	ares, err := f.exchange(ctx, aquery, nil)
+	if err != nil {
+		return res
+	}
+	out, err := synthesizeDNS64(prefix, query, ares)
+	if err != nil {
+		if err != errNoDNS64 {
+			f.logf("dns64: %v", err)
+		}
+		return res
+	}
+	return out
+}
+
+// needsDNS64 reports whether the AAAA response res is a successful
+// response without any AAAA records, and so should be replaced by a
+// synthesized one.
+func needsDNS64(res []byte) bool {
+	var p dns.Parser
+	h, err := p.Start(res)
+	if err != nil || h.RCode != dns.RCodeSuccess {
+		return false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return false
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		if ah.Type == dns.TypeAAAA {
+			return false
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return false
+		}
+	}
+}
+
+// dns64Query returns an A query for the name in the AAAA query q,
+// with the same ID and flags.
+func dns64Query(q []byte) ([]byte, error) {
+	var p dns.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	question.Type = dns.TypeA
+
+	b := dns.NewBuilder(nil, h)
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// synthesizeDNS64 returns a response to the AAAA query q built from
+// ares, the response to the equivalent A query, as described in RFC
+// 6147 section 5.1.7: each A record becomes an AAAA record for the
+// IPv4 address embedded in prefix, and CNAME records are kept.
+//
+// It returns errNoDNS64 if ares has no A records.
+func synthesizeDNS64(prefix netaddr.IPPrefix, q, ares []byte) ([]byte, error) {
+	var qp dns.Parser
+	qh, err := qp.Start(q)
+	if err != nil {
+		return nil, err
+	}
+	question, err := qp.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	var p dns.Parser
+	h, err := p.Start(ares)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode != dns.RCodeSuccess {
+		return nil, errNoDNS64
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	h.ID = qh.ID
+	b := dns.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	synthesized := 0
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch ah.Type {
+		case dns.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ip := dns64Addr(prefix, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+			if err := b.AAAAResource(ah, dns.AAAAResource{AAAA: ip.As16()}); err != nil {
+				return nil, err
+			}
+			synthesized++
+		case dns.TypeCNAME:
+			r, err := p.CNAMEResource()
+			if err != nil {
+				return nil, err
+			}
+			if err := b.CNAMEResource(ah, r); err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if synthesized == 0 {
+		return nil, errNoDNS64
+	}
+	return b.Finish()
+}
+
+// dns64Addr returns the IPv6 address in the /96 prefix that embeds
+// ipv4 in its low 32 bits.
+func dns64Addr(prefix netaddr.IPPrefix, ipv4 netaddr.IP) netaddr.IP {
+	ret := prefix.IP().As16()
+	v4 := ipv4.As4()
+	copy(ret[12:], v4[:])
+	return netaddr.IPFrom16(ret)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/util/dnsname"
+)
+
+func TestDNS64(t *testing.T) {
+	test4 := netaddr.MustParseIP("10.1.2.3")
+	server := serveDNS(t, "127.0.0.1:0",
+		"dual.site.", resolveToIP(testipv4, testipv6, "dns.site."),
+		"v4only.site.", resolveToIPv4Only(test4),
+	)
+	defer server.Shutdown()
+
+	r := newResolver(t)
+	defer r.Close()
+
+	prefix := netaddr.MustParseIPPrefix("fd7a:115c:a1e0:b1a:0:64::/96")
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]netaddr.IPPort{
+		".": {netaddr.MustParseIPPort(server.PacketConn.LocalAddr().String())},
+	}
+	cfg.DNS64Prefix = prefix
+	r.SetConfig(cfg)
+
+	tests := []struct {
+		name  string
+		query []byte
+		want  netaddr.IP
+	}{
+		{"v4only-AAAA", dnspacket("v4only.site.", dns.TypeAAAA, noEdns), netaddr.MustParseIP("fd7a:115c:a1e0:b1a:0:64:a01:203")},
+		{"v4only-A", dnspacket("v4only.site.", dns.TypeA, noEdns), test4},
+		{"dual-AAAA", dnspacket("dual.site.", dns.TypeAAAA, noEdns), testipv6},
+		{"local-AAAA", dnspacket("test1.ipn.dev.", dns.TypeAAAA, noEdns), netaddr.IP{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := syncRespond(r, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := unpackResponse(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.rcode != dns.RCodeSuccess {
+				t.Errorf("rcode = %v; want success", res.rcode)
+			}
+			if res.ip != tt.want {
+				t.Errorf("ip = %v; want %v", res.ip, tt.want)
+			}
+		})
+	}
+
+	// Without a prefix, nothing is synthesized.
+	cfg.DNS64Prefix = netaddr.IPPrefix{}
+	r.SetConfig(cfg)
+	payload, err := syncRespond(r, dnspacket("v4only.site.", dns.TypeAAAA, noEdns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := unpackResponse(payload); err != nil || !res.ip.IsZero() {
+		t.Errorf("without DNS64 got ip %v, err %v; want no answer", res.ip, err)
+	}
+}
@@ -163,6 +163,10 @@ type forwarder struct {
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
 	routes []route
+
+	// dns64Prefix, if non-zero, is the /96 prefix in which to
+	// synthesize AAAA records for names that only have A records.
+	dns64Prefix netaddr.IPPrefix
 }
 
 func init() {
@@ -275,6 +279,12 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]netaddr.IPPort)
 	f.routes = routes
 }
 
+func (f *forwarder) setDNS64Prefix(prefix netaddr.IPPrefix) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dns64Prefix = prefix
+}
+
 var stdNetPacketListener packetListener = new(net.ListenConfig)
 
 type packetListener interface {
@@ -458,17 +468,18 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, dst netaddr.IPPo
 	return out, nil
 }
 
-// resolvers returns the resolvers to use for domain.
-func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+// resolvers returns the resolvers to use for domain, along with the
+// suffix of the route they came from.
+func (f *forwarder) resolvers(domain dnsname.FQDN) (suffix dnsname.FQDN, rr []resolverAndDelay) {
 	f.mu.Lock()
 	routes := f.routes
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers
 		}
 	}
-	return nil
+	return "", nil
 }
 
 // forwardQuery is information and state about a forwarded DNS query that's
@@ -495,31 +506,74 @@ type forwardQuery struct {
 	// ...
 }
 
-// forward forwards the query to all upstream nameservers and returns the first response.
-func (f *forwarder) forward(query packet) error {
-	domain, err := nameFromQuery(query.bs)
+// forwardInfo records how a forwarded query was handled, for the
+// Resolver's query log.
+type forwardInfo struct {
+	route    dnsname.FQDN   // suffix of the route used; "." for the default route
+	upstream netaddr.IPPort // upstream whose response was used
+	rcode    dns.RCode      // rcode of that response
+}
+
+// forward forwards the query to all upstream nameservers and sends the
+// first response to f.responses.
+//
+// If fi is non-nil, it's populated with details of how the query was
+// forwarded.
+func (f *forwarder) forward(query packet, fi *forwardInfo) error {
+	ctx, cancel := context.WithTimeout(f.ctx, responseTimeout)
+	defer cancel()
+
+	res, err := f.exchange(ctx, query.bs, fi)
 	if err != nil {
 		return err
 	}
+	f.mu.Lock()
+	dns64Prefix := f.dns64Prefix
+	f.mu.Unlock()
+	if !dns64Prefix.IsZero() {
+		res = f.dns64(ctx, dns64Prefix, query.bs, res)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case f.responses <- packet{res, query.addr}:
+		return nil
+	}
+}
+
+// exchange forwards query to all upstream nameservers for its name and
+// returns the first response.
+//
+// If fi is non-nil, it's populated with details of how the query was
+// forwarded.
+func (f *forwarder) exchange(ctx context.Context, query []byte, fi *forwardInfo) ([]byte, error) {
+	domain, err := nameFromQuery(query)
+	if err != nil {
+		return nil, err
+	}
 
-	clampEDNSSize(query.bs, maxResponseBytes)
+	clampEDNSSize(query, maxResponseBytes)
 
-	resolvers := f.resolvers(domain)
+	suffix, resolvers := f.resolvers(domain)
+	if fi != nil {
+		fi.route = suffix
+	}
 	if len(resolvers) == 0 {
-		return errNoUpstreams
+		return nil, errNoUpstreams
 	}
 
 	fq := &forwardQuery{
-		txid:           getTxID(query.bs),
-		packet:         query.bs,
+		txid:           getTxID(query),
+		packet:         query,
 		closeOnCtxDone: new(closePool),
 	}
 	defer fq.closeOnCtxDone.Close()
 
-	ctx, cancel := context.WithTimeout(f.ctx, responseTimeout)
-	defer cancel()
-
-	resc := make(chan []byte, 1)
+	type result struct {
+		res  []byte
+		from netaddr.IPPort
+	}
+	resc := make(chan result, 1)
 	var (
 		mu       sync.Mutex
 		firstErr error
@@ -546,7 +600,7 @@ func (f *forwarder) forward(query packet) error {
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- result{resb, rr.ipp}:
 			default:
 			}
 		}(rr)
@@ -554,19 +608,18 @@ func (f *forwarder) forward(query packet) error {
 
 	select {
 	case v := <-resc:
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case f.responses <- packet{v, query.addr}:
-			return nil
+		if fi != nil {
+			fi.upstream = v.from
+			fi.rcode, _ = rcodeFromResponse(v.res)
 		}
+		return v.res, nil
 	case <-ctx.Done():
 		mu.Lock()
 		defer mu.Unlock()
 		if firstErr != nil {
-			return firstErr
+			return nil, firstErr
 		}
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 }
 
@@ -574,23 +627,43 @@ var initListenConfig func(_ *net.ListenConfig, _ *monitor.Mon, tunName string) e
 
 // nameFromQuery extracts the normalized query name from bs.
 func nameFromQuery(bs []byte) (dnsname.FQDN, error) {
+	name, _, err := questionFromQuery(bs)
+	return name, err
+}
+
+// questionFromQuery extracts the normalized query name and the query
+// type from bs.
+func questionFromQuery(bs []byte) (dnsname.FQDN, dns.Type, error) {
 	var parser dns.Parser
 
 	hdr, err := parser.Start(bs)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	if hdr.Response {
-		return "", errNotQuery
+		return "", 0, errNotQuery
 	}
 
 	q, err := parser.Question()
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	n := q.Name.Data[:q.Name.Length]
-	return dnsname.ToFQDN(rawNameToLower(n))
+	name, err := dnsname.ToFQDN(rawNameToLower(n))
+	if err != nil {
+		return "", 0, err
+	}
+	return name, q.Type, nil
+}
+
+// rcodeFromResponse returns the RCODE in the header of the DNS
+// response bs.
+func rcodeFromResponse(bs []byte) (rcode dns.RCode, ok bool) {
+	if len(bs) < headerBytes {
+		return 0, false
+	}
+	return dns.RCode(bs[3] & 0x0f), true
 }
 
 // closePool is a dynamic set of io.Closers to close as a group.
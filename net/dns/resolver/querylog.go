@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+)
+
+// maxQueryLogEntries is the number of most recent queries retained
+// in a Resolver's query log.
+const maxQueryLogEntries = 1000
+
+// queryLog is a bounded in-memory log of the most recent queries
+// handled by a Resolver.
+//
+// It's disabled by default, as DNS queries reveal a lot about what a
+// machine's users are doing. Nothing is recorded while it's disabled,
+// and disabling it discards all recorded entries.
+type queryLog struct {
+	mu       sync.Mutex
+	enabled  bool
+	logNames bool
+	seq      uint64                  // Seq of the most recently added entry
+	ents     []dnstype.QueryLogEntry // ring buffer of up to maxQueryLogEntries
+	head     int                     // index of the oldest entry in ents, once full
+}
+
+// isEnabled reports whether q is recording queries.
+func (q *queryLog) isEnabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.enabled
+}
+
+func (q *queryLog) setEnabled(enabled, logNames bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !enabled {
+		q.ents = nil
+		q.head = 0
+		logNames = false
+	}
+	q.enabled = enabled
+	q.logNames = logNames
+}
+
+// add adds e to q, assigning its Seq and dropping the oldest entry
+// if q is full.
+func (q *queryLog) add(e dnstype.QueryLogEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.enabled {
+		return
+	}
+	if !q.logNames {
+		e.Name = ""
+	}
+	q.seq++
+	e.Seq = q.seq
+	if len(q.ents) < maxQueryLogEntries {
+		q.ents = append(q.ents, e)
+		return
+	}
+	q.ents[q.head] = e
+	q.head = (q.head + 1) % len(q.ents)
+}
+
+// entries returns the entries in q with a Seq greater than since,
+// oldest first.
+func (q *queryLog) entries(since uint64) (ents []dnstype.QueryLogEntry, enabled, logNames bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.ents {
+		e := q.ents[(q.head+i)%len(q.ents)]
+		if e.Seq > since {
+			ents = append(ents, e)
+		}
+	}
+	return ents, q.enabled, q.logNames
+}
+
+// SetQueryLogging enables or disables r's in-memory log of recent
+// queries. If logNames is false, the names being queried are not
+// recorded. Disabling the log discards any entries already recorded.
+//
+// The query log is disabled by default.
+func (r *Resolver) SetQueryLogging(enabled, logNames bool) {
+	r.qlog.setEnabled(enabled, logNames)
+}
+
+// QueryLog returns the entries in r's query log with a Seq greater
+// than since, oldest first. It also reports whether the query log is
+// enabled and whether it's recording query names.
+func (r *Resolver) QueryLog(since uint64) (ents []dnstype.QueryLogEntry, enabled, logNames bool) {
+	return r.qlog.entries(since)
+}
+
+// logQuery records the outcome of a query in r's query log.
+//
+// fi is non-nil if the query was forwarded upstream. Otherwise, out is
+// the locally generated response, if any. err is the error that
+// prevented a response from being produced, if any.
+func (r *Resolver) logQuery(query []byte, start time.Time, fi *forwardInfo, out []byte, err error) {
+	e := dnstype.QueryLogEntry{
+		Time:    start,
+		Latency: time.Since(start),
+	}
+	if name, typ, err := questionFromQuery(query); err == nil {
+		e.Name = name.WithoutTrailingDot()
+		e.Type = typeString(typ)
+	}
+	switch {
+	case fi != nil:
+		e.Route = string(fi.route)
+		if err == nil {
+			e.Upstream = fi.upstream.String()
+			e.RCode = rcodeString(fi.rcode)
+		}
+	case out != nil:
+		e.Route = "local"
+		if rcode, ok := rcodeFromResponse(out); ok {
+			e.RCode = rcodeString(rcode)
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.qlog.add(e)
+}
+
+// rcodeString returns rcode's name without its "RCode" prefix, such
+// as "Success" or "NameError".
+func rcodeString(rcode dns.RCode) string {
+	return strings.TrimPrefix(rcode.String(), "RCode")
+}
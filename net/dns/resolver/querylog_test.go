@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/types/dnstype"
+)
+
+func TestQueryLog(t *testing.T) {
+	r := newResolver(t)
+	defer r.Close()
+	r.SetConfig(dnsCfg)
+
+	// Disabled by default.
+	syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA, noEdns))
+	if ents, enabled, _ := r.QueryLog(0); enabled || len(ents) != 0 {
+		t.Fatalf("QueryLog = %v, %v; want nothing while disabled", ents, enabled)
+	}
+
+	r.SetQueryLogging(true, false)
+	syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA, noEdns))
+	ents, enabled, logNames := r.QueryLog(0)
+	if !enabled || logNames {
+		t.Fatalf("enabled, logNames = %v, %v; want true, false", enabled, logNames)
+	}
+	if len(ents) != 1 {
+		t.Fatalf("got %d entries; want 1", len(ents))
+	}
+	if e := ents[0]; e.Seq != 1 || e.Name != "" || e.Type != "A" || e.Route != "local" || e.RCode != "Success" {
+		t.Errorf("entry = %+v; want unnamed local A query", e)
+	}
+
+	r.SetQueryLogging(true, true)
+	syncRespond(r, dnspacket("test3.ipn.dev.", dns.TypeAAAA, noEdns))
+	ents, _, _ = r.QueryLog(1)
+	if len(ents) != 1 {
+		t.Fatalf("got %d entries since 1; want 1", len(ents))
+	}
+	if e := ents[0]; e.Seq != 2 || e.Name != "test3.ipn.dev" || e.Type != "AAAA" || e.RCode != "NameError" {
+		t.Errorf("entry = %+v; want named NXDOMAIN AAAA query", e)
+	}
+
+	r.SetQueryLogging(false, false)
+	if ents, enabled, _ := r.QueryLog(0); enabled || len(ents) != 0 {
+		t.Errorf("QueryLog = %v, %v; want log discarded when disabled", ents, enabled)
+	}
+}
+
+func TestQueryLogBounded(t *testing.T) {
+	var q queryLog
+	q.setEnabled(true, true)
+	const n = maxQueryLogEntries + 10
+	for i := 0; i < n; i++ {
+		q.add(dnstype.QueryLogEntry{Name: "foo"})
+	}
+	ents, _, _ := q.entries(0)
+	if len(ents) != maxQueryLogEntries {
+		t.Fatalf("got %d entries; want %d", len(ents), maxQueryLogEntries)
+	}
+	if got, want := ents[0].Seq, uint64(n-maxQueryLogEntries+1); got != want {
+		t.Errorf("oldest Seq = %d; want %d", got, want)
+	}
+	if got, want := ents[len(ents)-1].Seq, uint64(n); got != want {
+		t.Errorf("newest Seq = %d; want %d", got, want)
+	}
+	if ents, _, _ := q.entries(n - 3); len(ents) != 3 {
+		t.Errorf("got %d entries since %d; want 3", len(ents), n-3)
+	}
+}
@@ -79,6 +79,11 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// DNS64Prefix, if non-zero, is a /96 prefix used to synthesize
+	// AAAA records (RFC 6147) for forwarded names that only have A
+	// records, by embedding each IPv4 address in the prefix's low
+	// 32 bits.
+	DNS64Prefix netaddr.IPPrefix
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -104,6 +109,9 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	if arpa > 0 {
 		fmt.Fprintf(w, "+%darpa", arpa)
 	}
+	if !c.DNS64Prefix.IsZero() {
+		fmt.Fprintf(w, " DNS64Prefix:%v", c.DNS64Prefix)
+	}
 	w.WriteString("}")
 }
 
@@ -162,6 +170,9 @@ type Resolver struct {
 
 	activeQueriesAtomic int32 // number of DNS queries in flight
 
+	// qlog is the log of recent queries. It's disabled by default.
+	qlog queryLog
+
 	// responses is an unbuffered channel to which responses are returned.
 	responses chan packet
 	// errors is an unbuffered channel to which errors are returned.
@@ -217,6 +228,7 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	}
 
 	r.forwarder.setRoutes(cfg.Routes)
+	r.forwarder.setDNS64Prefix(cfg.DNS64Prefix)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -360,14 +372,30 @@ func (r *Resolver) resolveLocalReverse(ip netaddr.IP) (dnsname.FQDN, dns.RCode)
 func (r *Resolver) handleQuery(pkt packet) {
 	defer atomic.AddInt32(&r.activeQueriesAtomic, -1)
 
+	var start time.Time
+	logging := r.qlog.isEnabled()
+	if logging {
+		start = time.Now()
+	}
+
+	var fi *forwardInfo // non-nil if forwarded and logging
 	out, err := r.respond(pkt.bs)
 	if err == errNotOurName {
-		err = r.forwarder.forward(pkt)
+		if logging {
+			fi = new(forwardInfo)
+		}
+		err = r.forwarder.forward(pkt, fi)
 		if err == nil {
 			// forward will send response into r.responses, nothing to do.
+			if logging {
+				r.logQuery(pkt.bs, start, fi, nil, nil)
+			}
 			return
 		}
 	}
+	if logging {
+		r.logQuery(pkt.bs, start, fi, out, err)
+	}
 	if err != nil {
 		select {
 		case <-r.closed:
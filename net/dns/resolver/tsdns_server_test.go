@@ -67,6 +67,33 @@ func resolveToIP(ipv4, ipv6 netaddr.IP, ns string) dns.HandlerFunc {
 	}
 }
 
+// resolveToIPv4Only returns a handler function which responds
+// to queries of type A it receives with an A record containing ipv4,
+// and to all other queries with an empty successful response.
+func resolveToIPv4Only(ipv4 netaddr.IP) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		if len(req.Question) != 1 {
+			panic("not a single-question request")
+		}
+		question := req.Question[0]
+
+		if question.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+				},
+				A: ipv4.IPAddr().IP,
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
 // resolveToIPLowercase returns a handler function which canonicalizes responses
 // by lowercasing the question and answer names, and responds
 // to queries of type A it receives with an A record containing ipv4,
@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchFile returns a channel that receives a value whenever the file
+// at path is written, replaced or removed, until ctx is done.
+//
+// It watches path's directory rather than path itself, so that it
+// keeps working when the file is replaced by a rename.
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// The fd is non-blocking, so os.File uses the runtime poller for
+	// it, and closing f unblocks Read.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		base := filepath.Base(path)
+		buf := make([]byte, 4096)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			if inotifyEventsName(buf[:n], base) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
+
+// inotifyEventsName reports whether any of the inotify events in b
+// is for a file named name.
+func inotifyEventsName(b []byte, name string) bool {
+	for len(b) >= unix.SizeofInotifyEvent {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&b[0]))
+		end := unix.SizeofInotifyEvent + int(ev.Len)
+		if end > len(b) {
+			return false
+		}
+		evName := b[unix.SizeofInotifyEvent:end]
+		// The name is NUL-padded.
+		for len(evName) > 0 && evName[len(evName)-1] == 0 {
+			evName = evName[:len(evName)-1]
+		}
+		if string(evName) == name {
+			return true
+		}
+		b = b[end:]
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"runtime"
+)
+
+// watchFile returns a channel that receives a value whenever the file
+// at path changes. It's only implemented on Linux; elsewhere, callers
+// must poll.
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	return nil, errors.New("watching files is not supported on " + runtime.GOOS)
+}
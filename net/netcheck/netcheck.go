@@ -93,6 +93,16 @@ type Report struct {
 	GlobalV4 string // ip:port of global IPv4
 	GlobalV6 string // [ip]:port of global IPv6
 
+	// MappingPortDelta is, for IPv4 NATs whose mappings vary by
+	// destination, the apparent step between the ports the NAT
+	// allocates to successive destinations, if it seems to
+	// allocate them sequentially. Zero means unknown or random.
+	MappingPortDelta int
+	// MappingLastPort is the most recently allocated of the IPv4
+	// mapped ports, if MappingPortDelta is non-zero. The NAT's
+	// next mapping is then likely MappingLastPort+MappingPortDelta.
+	MappingLastPort uint16
+
 	// TODO: update Clone when adding new fields
 }
 
@@ -520,6 +530,12 @@ type reportState struct {
 	inFlight      map[stun.TxID]func(netaddr.IPPort) // called without c.mu held
 	gotEP4        string
 	timers        []*time.Timer
+
+	// mappedPorts4 are the distinct ports of the IPv4 STUN replies
+	// that were mapped to the same IP as gotEP4. mappedIPVaries4
+	// is whether any reply was mapped to another IP.
+	mappedPorts4    []uint16
+	mappedIPVaries4 bool
 }
 
 func (rs *reportState) anyUDP() bool {
@@ -662,6 +678,7 @@ func (rs *reportState) addNodeLatency(node *tailcfg.DERPNode, ipp netaddr.IPPort
 		if rs.gotEP4 == "" {
 			rs.gotEP4 = ipPortStr
 			ret.GlobalV4 = ipPortStr
+			rs.mappedPorts4 = []uint16{ipp.Port()}
 			rs.startHairCheckLocked(ipp)
 		} else {
 			if rs.gotEP4 != ipPortStr {
@@ -669,8 +686,81 @@ func (rs *reportState) addNodeLatency(node *tailcfg.DERPNode, ipp netaddr.IPPort
 			} else if ret.MappingVariesByDestIP == "" {
 				ret.MappingVariesByDestIP.Set(false)
 			}
+			rs.addMappedPort4Locked(ipp)
+		}
+	}
+}
+
+// addMappedPort4Locked records that a STUN server saw us as ipp,
+// which is not the first IPv4 address we were seen as, and updates
+// the report's guess of how the NAT allocates ports.
+func (rs *reportState) addMappedPort4Locked(ipp netaddr.IPPort) {
+	if first, err := netaddr.ParseIPPort(rs.gotEP4); err != nil || first.IP() != ipp.IP() {
+		rs.mappedIPVaries4 = true
+	}
+	for _, p := range rs.mappedPorts4 {
+		if p == ipp.Port() {
+			return
+		}
+	}
+	rs.mappedPorts4 = append(rs.mappedPorts4, ipp.Port())
+
+	ret := rs.report
+	ret.MappingPortDelta, ret.MappingLastPort = 0, 0
+	if !rs.mappedIPVaries4 {
+		ret.MappingPortDelta, ret.MappingLastPort = portAllocationPattern(rs.mappedPorts4)
+	}
+}
+
+const (
+	// maxPortDelta is the largest step between successively
+	// allocated ports that portAllocationPattern considers
+	// sequential.
+	maxPortDelta = 16
+	// maxPortSkips is how many allocations portAllocationPattern
+	// allows, on average, between two of the ports it's given,
+	// since other hosts behind the NAT may be allocating ports
+	// too.
+	maxPortSkips = 4
+)
+
+// portAllocationPattern reports whether ports, the distinct ports a
+// NAT mapped one of our sockets to for different destinations,
+// look like they were allocated sequentially. If so, it returns the
+// step between allocations and the most recently allocated port.
+// Otherwise it returns zeros.
+//
+// The order the ports were allocated in isn't known (STUN replies
+// can arrive in any order), so it assumes the common case of ports
+// counting up.
+func portAllocationPattern(ports []uint16) (delta int, last uint16) {
+	if len(ports) < 2 {
+		return 0, 0
+	}
+	sorted := append([]uint16(nil), ports...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// A single gap can't tell a step apart from skipped ports, so
+	// with two ports assume the most common step of 1.
+	delta = 1
+	if len(sorted) > 2 {
+		delta = 0
+		for i := 1; i < len(sorted); i++ {
+			delta = gcd(delta, int(sorted[i]-sorted[i-1]))
 		}
 	}
+	first, last := sorted[0], sorted[len(sorted)-1]
+	span := int(last-first) / delta
+	if delta > maxPortDelta || span > maxPortSkips*(len(sorted)-1) {
+		return 0, 0
+	}
+	return delta, last
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
 }
 
 func (rs *reportState) stopProbes() {
@@ -989,6 +1079,9 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		if r.GlobalV6 != "" {
 			fmt.Fprintf(w, " v6a=%v", r.GlobalV6)
 		}
+		if r.MappingPortDelta != 0 {
+			fmt.Fprintf(w, " portdelta=%+d", r.MappingPortDelta)
+		}
 		fmt.Fprintf(w, " derp=%v", r.PreferredDERP)
 		if r.PreferredDERP != 0 {
 			fmt.Fprintf(w, " derpdist=")
@@ -595,6 +595,18 @@ func TestLogConciseReport(t *testing.T) {
 			},
 			want: "udp=true v4=false v6=false mapvarydest= hair= portmap=UC derp=0",
 		},
+		{
+			name: "sequential_nat",
+			r: &Report{
+				UDP:                   true,
+				IPv4:                  true,
+				MappingVariesByDestIP: "true",
+				GlobalV4:              "1.2.3.4:10001",
+				MappingPortDelta:      1,
+				MappingLastPort:       10002,
+			},
+			want: "udp=true v6=false mapvarydest=true hair= portmap=? v4a=1.2.3.4:10001 portdelta=+1 derp=0",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -608,6 +620,33 @@ func TestLogConciseReport(t *testing.T) {
 	}
 }
 
+func TestPortAllocationPattern(t *testing.T) {
+	tests := []struct {
+		name      string
+		ports     []uint16
+		wantDelta int
+		wantLast  uint16
+	}{
+		{"one_port", []uint16{1000}, 0, 0},
+		{"consecutive", []uint16{1001, 1000}, 1, 1001},
+		{"consecutive_three", []uint16{1002, 1000, 1001}, 1, 1002},
+		{"step_two", []uint16{1000, 1002, 1006}, 2, 1006},
+		{"some_skipped", []uint16{1000, 1003}, 1, 1003},
+		{"one_gap_of_two", []uint16{1000, 1002}, 1, 1002},
+		{"too_many_skipped", []uint16{1000, 1013}, 0, 0},
+		{"random", []uint16{31337, 50123}, 0, 0},
+		{"step_too_big", []uint16{1000, 1100}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta, last := portAllocationPattern(tt.ports)
+			if delta != tt.wantDelta || last != tt.wantLast {
+				t.Errorf("portAllocationPattern(%v) = %v, %v; want %v, %v", tt.ports, delta, last, tt.wantDelta, tt.wantLast)
+			}
+		})
+	}
+}
+
 func TestSortRegions(t *testing.T) {
 	unsortedMap := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{},
@@ -47,6 +47,11 @@ type ICMP4Code uint8
 
 const (
 	ICMP4NoCode ICMP4Code = 0
+
+	// ICMP4FragmentationNeeded is the ICMP4Unreachable code
+	// telling the sender that its packet was too big for the next
+	// hop and had the Don't Fragment bit set.
+	ICMP4FragmentationNeeded ICMP4Code = 4
 )
 
 // ICMP4Header is an IPv4+ICMPv4 header.
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"tailscale.com/types/ipproto"
+)
+
+// TCP option kinds.
+const (
+	tcpOptEnd = 0
+	tcpOptNOP = 1
+	tcpOptMSS = 2
+)
+
+// MSSForMTU returns the biggest TCP maximum segment size of an IPv4
+// (ipVersion 4) or IPv6 packet that fits in mtu bytes.
+func MSSForMTU(ipVersion uint8, mtu int) int {
+	if ipVersion == 6 {
+		return mtu - ip6HeaderLength - tcpHeaderLength
+	}
+	return mtu - ip4HeaderLength - tcpHeaderLength
+}
+
+// ClampMSS lowers the maximum segment size option of q, a TCP SYN or
+// SYN-ACK, to mss if it's bigger, so that the segments of the
+// connection fit through a path with a smaller MTU than the ends'
+// links. It modifies q's buffer in place, keeping the TCP checksum
+// valid, and reports whether it changed it.
+func ClampMSS(q *Parsed, mss int) bool {
+	if q.IPProto != ipproto.TCP || q.TCPFlags&TCPSyn == 0 || mss <= 0 {
+		return false
+	}
+	if q.dataofs > len(q.b) || q.dataofs < q.subofs+tcpHeaderLength {
+		return false
+	}
+	opts := q.b[q.subofs+tcpHeaderLength : q.dataofs]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case tcpOptEnd:
+			return false
+		case tcpOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return false
+		}
+		n := int(opts[i+1])
+		if n < 2 || i+n > len(opts) {
+			return false
+		}
+		if opts[i] != tcpOptMSS || n != 4 {
+			i += n
+			continue
+		}
+		old := binary.BigEndian.Uint16(opts[i+2:])
+		if int(old) <= mss {
+			return false
+		}
+		binary.BigEndian.PutUint16(opts[i+2:], uint16(mss))
+
+		// Update the checksum incrementally (RFC 1624). The
+		// options start 16-bit aligned, so an MSS at an odd
+		// offset into them straddles two checksum words.
+		oldWord, newWord := old, uint16(mss)
+		if i%2 == 1 {
+			oldWord, newWord = bits.ReverseBytes16(oldWord), bits.ReverseBytes16(newWord)
+		}
+		csum := q.b[q.subofs+16 : q.subofs+18]
+		sum := uint32(^binary.BigEndian.Uint16(csum)) + uint32(^oldWord) + uint32(newWord)
+		for sum > 0xffff {
+			sum = sum&0xffff + sum>>16
+		}
+		binary.BigEndian.PutUint16(csum, ^uint16(sum))
+		return true
+	}
+	return false
+}
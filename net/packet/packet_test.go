@@ -6,6 +6,7 @@ package packet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"reflect"
 	"testing"
 
@@ -560,3 +561,177 @@ func BenchmarkString(b *testing.B) {
 		})
 	}
 }
+
+func TestTooBig(t *testing.T) {
+	payload := make([]byte, 1400)
+	udp4 := Generate(UDP4Header{
+		IP4Header: IP4Header{
+			Src: netaddr.MustParseIP("100.64.0.1"),
+			Dst: netaddr.MustParseIP("100.64.0.2"),
+		},
+		SrcPort: 123,
+		DstPort: 456,
+	}, payload)
+	udp4DF := append([]byte(nil), udp4...)
+	udp4DF[6] |= 0x40 // Don't Fragment
+	udp6 := Generate(UDP6Header{
+		IP6Header: IP6Header{
+			Src: netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+			Dst: netaddr.MustParseIP("fd7a:115c:a1e0::2"),
+		},
+		SrcPort: 123,
+		DstPort: 456,
+	}, payload)
+
+	t.Run("ipv4", func(t *testing.T) {
+		var q Parsed
+		q.Decode(udp4DF)
+		b := TooBig(&q, 1300)
+		if len(b) != 20+4+4+20+8 {
+			t.Fatalf("len = %d; want %d", len(b), 20+4+4+20+8)
+		}
+		var got Parsed
+		got.Decode(b)
+		if got.IPProto != ICMPv4 || got.Src.IP() != q.Dst.IP() || got.Dst.IP() != q.Src.IP() {
+			t.Errorf("got %v; want ICMPv4 from %v to %v", got.String(), q.Dst.IP(), q.Src.IP())
+		}
+		if !got.IsError() {
+			t.Errorf("not an ICMP error")
+		}
+		if typ, code := ICMP4Type(b[20]), ICMP4Code(b[21]); typ != ICMP4Unreachable || code != ICMP4FragmentationNeeded {
+			t.Errorf("type, code = %v, %v; want %v, %v", typ, code, ICMP4Unreachable, ICMP4FragmentationNeeded)
+		}
+		if mtu := int(b[26])<<8 | int(b[27]); mtu != 1300 {
+			t.Errorf("mtu = %d; want 1300", mtu)
+		}
+		if !bytes.Equal(b[28:], udp4DF[:28]) {
+			t.Errorf("quoted packet = %x; want %x", b[28:], udp4DF[:28])
+		}
+		if c := ip4Checksum(b[20:]); c != 0 {
+			t.Errorf("bad ICMP checksum")
+		}
+
+		// Never answer an error with an error.
+		if b := TooBig(&got, 1300); b != nil {
+			t.Errorf("TooBig of ICMP error = %x; want nil", b)
+		}
+	})
+	t.Run("ipv4-fragmentable", func(t *testing.T) {
+		var q Parsed
+		q.Decode(udp4)
+		if b := TooBig(&q, 1300); b != nil {
+			t.Errorf("got %x; want nil without Don't Fragment", b)
+		}
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		var q Parsed
+		q.Decode(udp6)
+		b := TooBig(&q, 1300)
+		if len(b) != minIP6MTU {
+			t.Fatalf("len = %d; want %d", len(b), minIP6MTU)
+		}
+		var got Parsed
+		got.Decode(b)
+		if got.IPProto != ICMPv6 || got.Src.IP() != q.Dst.IP() || got.Dst.IP() != q.Src.IP() {
+			t.Errorf("got %v; want ICMPv6 from %v to %v", got.String(), q.Dst.IP(), q.Src.IP())
+		}
+		if !got.IsError() {
+			t.Errorf("not an ICMP error")
+		}
+		if typ := ICMP6Type(b[40]); typ != ICMP6PacketTooBig {
+			t.Errorf("type = %v; want %v", typ, ICMP6PacketTooBig)
+		}
+		if mtu := int(b[44])<<24 | int(b[45])<<16 | int(b[46])<<8 | int(b[47]); mtu != 1300 {
+			t.Errorf("mtu = %d; want 1300", mtu)
+		}
+		if !bytes.Equal(b[48:], udp6[:len(b)-48]) {
+			t.Errorf("quoted packet doesn't match")
+		}
+		pseudo := append([]byte(nil), b...)
+		got.IP6Header().marshalPseudo(pseudo)
+		if c := ip4Checksum(pseudo); c != 0 {
+			t.Errorf("bad ICMPv6 checksum")
+		}
+	})
+}
+
+// tcp4 returns an IPv4 TCP packet from 100.64.0.1:123 to
+// 100.64.0.2:456 with the given flags and options, and a valid
+// checksum.
+func tcp4(flags TCPFlag, opts []byte) []byte {
+	b := make([]byte, ip4HeaderLength+tcpHeaderLength+len(opts))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = byte(TCP)
+	copy(b[12:16], []byte{100, 64, 0, 1})
+	copy(b[16:20], []byte{100, 64, 0, 2})
+	tcp := b[ip4HeaderLength:]
+	binary.BigEndian.PutUint16(tcp[0:2], 123)
+	binary.BigEndian.PutUint16(tcp[2:4], 456)
+	tcp[12] = byte((tcpHeaderLength + len(opts)) / 4 << 4)
+	tcp[13] = byte(flags)
+	copy(tcp[tcpHeaderLength:], opts)
+	binary.BigEndian.PutUint16(tcp[16:18], ip4Checksum(tcp4Pseudo(b)))
+	return b
+}
+
+// tcp4Pseudo returns the TCP segment of IPv4 packet b prefixed by its
+// pseudo-header, for checksumming.
+func tcp4Pseudo(b []byte) []byte {
+	tcp := b[ip4HeaderLength:]
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:8], b[12:20])
+	pseudo[9] = byte(TCP)
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	return append(pseudo, tcp...)
+}
+
+func TestClampMSS(t *testing.T) {
+	mss := func(v uint16) []byte { return []byte{tcpOptMSS, 4, byte(v >> 8), byte(v)} }
+	nop := []byte{tcpOptNOP}
+	cat := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+
+	tests := []struct {
+		name    string
+		flags   TCPFlag
+		opts    []byte
+		clamp   int
+		wantMSS int // or 0 for unchanged
+	}{
+		{"syn", TCPSyn, mss(1460), 1160, 1160},
+		{"synack", TCPSynAck, cat(mss(1460), nop, nop, nop, nop), 1160, 1160},
+		{"odd_offset", TCPSyn, cat(nop, mss(1460), nop, nop, nop), 1111, 1111},
+		{"after_other_options", TCPSyn, cat([]byte{4, 2}, nop, nop, mss(1460)), 1160, 1160},
+		{"already_smaller", TCPSyn, mss(1000), 1160, 0},
+		{"no_mss", TCPSyn, cat(nop, nop, nop, nop), 1160, 0},
+		{"not_syn", TCPAck, mss(1460), 1160, 0},
+		{"truncated_option", TCPSyn, cat(nop, nop, nop, []byte{tcpOptMSS}), 1160, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tcp4(tt.flags, tt.opts)
+			orig := append([]byte(nil), b...)
+			var q Parsed
+			q.Decode(b)
+			changed := ClampMSS(&q, tt.clamp)
+			if changed != (tt.wantMSS != 0) {
+				t.Fatalf("ClampMSS = %v; want %v", changed, tt.wantMSS != 0)
+			}
+			if !changed {
+				if !bytes.Equal(b, orig) {
+					t.Errorf("packet modified:\n got %x\nwant %x", b, orig)
+				}
+				return
+			}
+			if i := bytes.Index(b[ip4HeaderLength+tcpHeaderLength:], []byte{tcpOptMSS, 4}); i < 0 {
+				t.Fatal("MSS option gone")
+			} else if got := binary.BigEndian.Uint16(b[ip4HeaderLength+tcpHeaderLength+i+2:]); int(got) != tt.wantMSS {
+				t.Errorf("MSS = %d; want %d", got, tt.wantMSS)
+			}
+			if c := ip4Checksum(tcp4Pseudo(b)); c != 0 {
+				t.Errorf("bad TCP checksum after clamping")
+			}
+		})
+	}
+}
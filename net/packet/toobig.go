@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "encoding/binary"
+
+// minIP6MTU is the smallest MTU that IPv6 links may have. ICMPv6
+// errors are truncated to fit in it.
+const minIP6MTU = 1280
+
+// TooBig returns an ICMP error telling the sender of q that q doesn't
+// fit in mtu bytes: an IPv4 "fragmentation needed" or an IPv6 "packet
+// too big". The error comes from q's destination, as if it were the
+// router that couldn't forward q.
+//
+// It returns nil if the sender shouldn't be told: if q is an IPv4
+// packet without the Don't Fragment bit, which may be fragmented
+// instead, or if q is itself an ICMP error.
+func TooBig(q *Parsed, mtu int) []byte {
+	if q.IsError() {
+		return nil
+	}
+	switch q.IPVersion {
+	case 4:
+		if len(q.b) < ip4HeaderLength || q.b[6]&0x40 == 0 {
+			return nil
+		}
+		h := ICMP4Header{
+			IP4Header: IP4Header{
+				Src: q.Dst.IP(),
+				Dst: q.Src.IP(),
+			},
+			Type: ICMP4Unreachable,
+			Code: ICMP4FragmentationNeeded,
+		}
+		// The rest of the ICMP header is two unused bytes and
+		// the next-hop MTU, followed by the IP header and first 8
+		// bytes of the packet that didn't fit.
+		orig := q.b
+		if n := q.subofs + 8; len(orig) > n {
+			orig = orig[:n]
+		}
+		payload := make([]byte, 4+len(orig))
+		binary.BigEndian.PutUint16(payload[2:4], uint16(mtu))
+		copy(payload[4:], orig)
+		return Generate(h, payload)
+	case 6:
+		h := ICMP6Header{
+			IP6Header: IP6Header{
+				Src: q.Dst.IP(),
+				Dst: q.Src.IP(),
+			},
+			Type: ICMP6PacketTooBig,
+			Code: ICMP6NoCode,
+		}
+		// The rest of the ICMPv6 header is the MTU, followed by as
+		// much of the packet that didn't fit as fits in the
+		// minimum IPv6 MTU.
+		orig := q.b
+		if n := minIP6MTU - h.Len() - 4; len(orig) > n {
+			orig = orig[:n]
+		}
+		payload := make([]byte, 4+len(orig))
+		binary.BigEndian.PutUint32(payload[0:4], uint32(mtu))
+		copy(payload[4:], orig)
+		return Generate(h, payload)
+	default:
+		return nil
+	}
+}
@@ -27,14 +27,21 @@ import (
 //
 // If ns is non-nil, it is used for dialing when needed.
 func NewServer(logf logger.Logf, e wgengine.Engine, ns *netstack.Impl) *socks5.Server {
-	d := &dialer{ns: ns}
-	e.AddNetworkMapCallback(d.onNewNetmap)
 	return &socks5.Server{
 		Logf:   logf,
-		Dialer: d.DialContext,
+		Dialer: NewDialer(e, ns),
 	}
 }
 
+// NewDialer returns a dialer like the SOCKS5 server's, which resolves
+// MagicDNS names from e's network map and dials Tailscale IPs using
+// ns, if non-nil.
+func NewDialer(e wgengine.Engine, ns *netstack.Impl) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &dialer{ns: ns}
+	e.AddNetworkMapCallback(d.onNewNetmap)
+	return d.DialContext
+}
+
 // dialer is the Tailscale SOCKS5 dialer.
 type dialer struct {
 	ns *netstack.Impl
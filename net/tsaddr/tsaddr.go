@@ -36,6 +36,7 @@ var (
 	tsUlaRange   oncePrefix
 	ula4To6Range oncePrefix
 	ulaEph6Range oncePrefix
+	nat64Range   oncePrefix
 )
 
 // TailscaleServiceIP returns the listen address of services
@@ -105,6 +106,40 @@ func Tailscale4To6(ipv4 netaddr.IP) netaddr.IP {
 	return netaddr.IPFrom16(ret)
 }
 
+// TailscaleNAT64Range returns the subset of TailscaleULARange used
+// for DNS64 synthesis and NAT64 translation: a subnet router
+// advertising this range translates packets to an address in it into
+// IPv4 packets to the IPv4 address in its low 32 bits.
+func TailscaleNAT64Range() netaddr.IPPrefix {
+	// As with the other ranges above, the bits from /48 to /96 have
+	// no significance beyond not overlapping the other ranges.
+	nat64Range.Do(func() { mustPrefix(&nat64Range.v, "fd7a:115c:a1e0:b1a:0:64::/96") })
+	return nat64Range.v
+}
+
+// TailscaleNAT64 returns the address in TailscaleNAT64Range that maps
+// to ipv4. Returns a zero IP if ipv4 isn't an IPv4 address.
+func TailscaleNAT64(ipv4 netaddr.IP) netaddr.IP {
+	if !ipv4.Is4() {
+		return netaddr.IP{}
+	}
+	ret := TailscaleNAT64Range().IP().As16()
+	v4 := ipv4.As4()
+	copy(ret[12:], v4[:])
+	return netaddr.IPFrom16(ret)
+}
+
+// UnmapTailscaleNAT64 returns the IPv4 address that ipv6, an address
+// in TailscaleNAT64Range, maps to. Returns a zero IP if ipv6 isn't in
+// TailscaleNAT64Range.
+func UnmapTailscaleNAT64(ipv6 netaddr.IP) netaddr.IP {
+	if !TailscaleNAT64Range().Contains(ipv6) {
+		return netaddr.IP{}
+	}
+	b := ipv6.As16()
+	return netaddr.IPv4(b[12], b[13], b[14], b[15])
+}
+
 func mustPrefix(v *netaddr.IPPrefix, prefix string) {
 	var err error
 	*v, err = netaddr.ParseIPPrefix(prefix)
@@ -164,3 +199,20 @@ func NewContainsIPFunc(addrs []netaddr.IPPrefix) func(ip netaddr.IP) bool {
 	}
 	return func(ip netaddr.IP) bool { return m[ip] }
 }
+
+// ContainsExitRoutes reports whether rr contains both the IPv4 and
+// IPv6 default routes, as offered by exit nodes.
+func ContainsExitRoutes(rr []netaddr.IPPrefix) bool {
+	var v4, v6 bool
+	for _, r := range rr {
+		if r.Bits() != 0 {
+			continue
+		}
+		if r.IP().Is4() {
+			v4 = true
+		} else if r.IP().Is6() {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
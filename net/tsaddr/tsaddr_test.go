@@ -79,3 +79,20 @@ func BenchmarkTailscaleServiceAddr(b *testing.B) {
 		sinkIP = TailscaleServiceIP()
 	}
 }
+
+func TestTailscaleNAT64(t *testing.T) {
+	if got, want := TailscaleNAT64Range().String(), "fd7a:115c:a1e0:b1a:0:64::/96"; got != want {
+		t.Errorf("range = %q; want %q", got, want)
+	}
+	v4 := netaddr.MustParseIP("192.168.1.2")
+	v6 := TailscaleNAT64(v4)
+	if got, want := v6.String(), "fd7a:115c:a1e0:b1a:0:64:c0a8:102"; got != want {
+		t.Errorf("TailscaleNAT64(%v) = %v; want %v", v4, got, want)
+	}
+	if got := UnmapTailscaleNAT64(v6); got != v4 {
+		t.Errorf("UnmapTailscaleNAT64(%v) = %v; want %v", v6, got, v4)
+	}
+	if got := UnmapTailscaleNAT64(netaddr.MustParseIP("fd7a:115c:a1e0::1")); !got.IsZero() {
+		t.Errorf("UnmapTailscaleNAT64 outside range = %v; want zero", got)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/ipproto"
+)
+
+const (
+	ip4HeaderLen = 20
+	ip6HeaderLen = 40
+
+	// nat64Growth is how many bytes longer a packet gets when
+	// translated from IPv4 (without options) to IPv6.
+	nat64Growth = ip6HeaderLen - ip4HeaderLen
+)
+
+// maxNAT64Flows is the maximum number of flows a nat64 remembers.
+// Beyond that, the least recently used flows are forgotten and their
+// return traffic is no longer translated.
+const maxNAT64Flows = 8192
+
+// nat64 is a stateful NAT64 (RFC 7915) translator for subnet routers
+// serving IPv6-only peers.
+//
+// IPv6 packets from a peer to an address in tsaddr.TailscaleNAT64Range
+// are translated into IPv4 packets to the IPv4 address embedded in
+// the destination, from the peer's Tailscale IPv4 address, as given to
+// setPeers. The IPv4 packets coming back on those flows are translated
+// into IPv6 again, to the peer's Tailscale IPv6 address.
+//
+// Only TCP, UDP and ICMP echo are translated. Packets with IPv6
+// extension headers, fragmented IPv4 packets and ICMP errors are not.
+type nat64 struct {
+	mu    sync.Mutex
+	peers map[netaddr.IP]netaddr.IP // peers' Tailscale IPv6 to IPv4 addresses
+	flows flowtrack.Cache           // IPv4 flows created by in, to the peer's IPv6 address
+}
+
+func newNAT64() *nat64 {
+	return &nat64{
+		flows: flowtrack.Cache{MaxEntries: maxNAT64Flows},
+	}
+}
+
+// setPeers sets the peers whose packets are translated, as a map from
+// each peer's Tailscale IPv6 address to its Tailscale IPv4 address.
+func (n *nat64) setPeers(peers map[netaddr.IP]netaddr.IP) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peers = peers
+}
+
+// in translates pkt, an IPv6 packet from a peer, to IPv4 in place if
+// it's addressed to tsaddr.TailscaleNAT64Range.
+//
+// It reports whether pkt was addressed to the NAT64 range. If so, out
+// is the translated packet, which is a suffix of pkt, or nil if pkt
+// can't be translated and should be dropped.
+func (n *nat64) in(pkt []byte) (out []byte, isNAT64 bool) {
+	if len(pkt) < ip6HeaderLen || pkt[0]>>4 != 6 {
+		return nil, false
+	}
+	dst4 := tsaddr.UnmapTailscaleNAT64(ip6At(pkt[24:40]))
+	if dst4.IsZero() {
+		return nil, false
+	}
+	src6 := ip6At(pkt[8:24])
+	n.mu.Lock()
+	src4, ok := n.peers[src6]
+	n.mu.Unlock()
+	if !ok {
+		// Only peers with a Tailscale IPv4 address can be
+		// translated.
+		return nil, true
+	}
+	payloadLen := int(binary.BigEndian.Uint16(pkt[4:6]))
+	if ip6HeaderLen+payloadLen > len(pkt) {
+		return nil, true
+	}
+	pkt = pkt[:ip6HeaderLen+payloadLen]
+	payload := pkt[ip6HeaderLen:]
+
+	proto := ipproto.Proto(pkt[6])
+	var sport, dport uint16
+	switch proto {
+	case ipproto.TCP, ipproto.UDP:
+		if len(payload) < 8 {
+			return nil, true
+		}
+		sport = binary.BigEndian.Uint16(payload[0:2])
+		dport = binary.BigEndian.Uint16(payload[2:4])
+	case ipproto.ICMPv6:
+		const icmp6EchoRequest, icmp4EchoRequest = 128, 8
+		if len(payload) < 8 || payload[0] != icmp6EchoRequest {
+			return nil, true
+		}
+		payload[0] = icmp4EchoRequest
+		proto = ipproto.ICMPv4
+		sport = binary.BigEndian.Uint16(payload[4:6]) // echo ID
+		dport = sport
+	default:
+		return nil, true
+	}
+	if proto == ipproto.TCP && len(payload) < 20 {
+		return nil, true
+	}
+
+	tc := pkt[0]<<4 | pkt[1]>>4
+	hopLimit := pkt[7]
+
+	// The IPv4 header goes right before the payload, overwriting
+	// the tail of the IPv6 header, which was fully read above.
+	out = pkt[nat64Growth:]
+	out[0] = 0x45 // version 4, 20 byte header
+	out[1] = tc
+	binary.BigEndian.PutUint16(out[2:4], uint16(ip4HeaderLen+payloadLen))
+	binary.BigEndian.PutUint16(out[4:6], 0)      // ID
+	binary.BigEndian.PutUint16(out[6:8], 0x4000) // DF, no fragment offset
+	out[8] = hopLimit
+	out[9] = byte(proto)
+	a4, b4 := src4.As4(), dst4.As4()
+	copy(out[12:16], a4[:])
+	copy(out[16:20], b4[:])
+	out[10], out[11] = 0, 0
+	binary.BigEndian.PutUint16(out[10:12], checksumFold(checksumAdd(0, out[:ip4HeaderLen])))
+	setL4Checksum(proto, src4, dst4, payload)
+
+	n.mu.Lock()
+	n.flows.Add(flowtrack.Tuple{
+		Proto: proto,
+		Src:   netaddr.IPPortFrom(src4, sport),
+		Dst:   netaddr.IPPortFrom(dst4, dport),
+	}, src6)
+	n.mu.Unlock()
+	return out, true
+}
+
+// out translates pkt[:size], an IPv4 packet to be sent to a peer, to
+// IPv6 in place if it belongs to a flow previously translated by in.
+//
+// It returns the size of the translated packet, or size if pkt wasn't
+// translated. pkt must have room for the packet to grow by
+// nat64Growth bytes.
+func (n *nat64) out(pkt []byte, size int) int {
+	if size < ip4HeaderLen || pkt[0]>>4 != 4 {
+		return size
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if ihl < ip4HeaderLen || totalLen < ihl || totalLen > size {
+		return size
+	}
+	if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+		// Fragmented (MF set or non-zero offset).
+		return size
+	}
+	if len(pkt) < totalLen+nat64Growth {
+		return size
+	}
+	src4 := netaddr.IPv4(pkt[12], pkt[13], pkt[14], pkt[15])
+	dst4 := netaddr.IPv4(pkt[16], pkt[17], pkt[18], pkt[19])
+	if !tsaddr.IsTailscaleIP(dst4) {
+		// Not to a peer's Tailscale IPv4 address, so not a
+		// reply to a translated flow.
+		return size
+	}
+	payload := pkt[ihl:totalLen]
+
+	proto := ipproto.Proto(pkt[9])
+	var sport, dport uint16
+	switch proto {
+	case ipproto.TCP, ipproto.UDP:
+		if len(payload) < 8 {
+			return size
+		}
+		sport = binary.BigEndian.Uint16(payload[0:2])
+		dport = binary.BigEndian.Uint16(payload[2:4])
+	case ipproto.ICMPv4:
+		const icmp4EchoReply = 0
+		if len(payload) < 8 || payload[0] != icmp4EchoReply {
+			return size
+		}
+		sport = binary.BigEndian.Uint16(payload[4:6]) // echo ID
+		dport = sport
+	default:
+		return size
+	}
+
+	n.mu.Lock()
+	v, ok := n.flows.Get(flowtrack.Tuple{
+		Proto: proto,
+		Src:   netaddr.IPPortFrom(dst4, dport),
+		Dst:   netaddr.IPPortFrom(src4, sport),
+	})
+	n.mu.Unlock()
+	if !ok {
+		return size
+	}
+	dst6 := v.(netaddr.IP)
+
+	tos := pkt[1]
+	ttl := pkt[8]
+	payloadLen := len(payload)
+	copy(pkt[ip6HeaderLen:], payload)
+	payload = pkt[ip6HeaderLen : ip6HeaderLen+payloadLen]
+	if proto == ipproto.ICMPv4 {
+		const icmp6EchoReply = 129
+		payload[0] = icmp6EchoReply
+		proto = ipproto.ICMPv6
+	}
+
+	src6 := tsaddr.TailscaleNAT64(src4)
+	pkt[0] = 0x60 | tos>>4
+	pkt[1] = tos << 4
+	pkt[2], pkt[3] = 0, 0 // flow label
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(payloadLen))
+	pkt[6] = byte(proto)
+	pkt[7] = ttl
+	a16, b16 := src6.As16(), dst6.As16()
+	copy(pkt[8:24], a16[:])
+	copy(pkt[24:40], b16[:])
+	setL4Checksum(proto, src6, dst6, payload)
+	return ip6HeaderLen + payloadLen
+}
+
+// ip6At returns the IPv6 address in the first 16 bytes of b.
+func ip6At(b []byte) netaddr.IP {
+	var a [16]byte
+	copy(a[:], b)
+	return netaddr.IPv6Raw(a)
+}
+
+// setL4Checksum recomputes the checksum of payload, the TCP, UDP,
+// ICMPv4 or ICMPv6 payload of an IP packet from src to dst.
+func setL4Checksum(proto ipproto.Proto, src, dst netaddr.IP, payload []byte) {
+	var off int
+	switch proto {
+	case ipproto.TCP:
+		off = 16
+	case ipproto.UDP:
+		off = 6
+	case ipproto.ICMPv4, ipproto.ICMPv6:
+		off = 2
+	default:
+		return
+	}
+	payload[off], payload[off+1] = 0, 0
+	var sum uint32
+	if proto != ipproto.ICMPv4 {
+		// ICMPv4 is the only one without a pseudo-header.
+		sum = pseudoHeaderSum(proto, src, dst, len(payload))
+	}
+	c := checksumFold(checksumAdd(sum, payload))
+	if proto == ipproto.UDP && c == 0 {
+		// Zero means "no checksum" for UDP.
+		c = 0xffff
+	}
+	binary.BigEndian.PutUint16(payload[off:], c)
+}
+
+// pseudoHeaderSum returns the unfolded checksum of the IPv4 or IPv6
+// pseudo-header for a proto payload of length n from src to dst.
+func pseudoHeaderSum(proto ipproto.Proto, src, dst netaddr.IP, n int) uint32 {
+	var sum uint32
+	if src.Is4() {
+		a, b := src.As4(), dst.As4()
+		sum = checksumAdd(sum, a[:])
+		sum = checksumAdd(sum, b[:])
+	} else {
+		a, b := src.As16(), dst.As16()
+		sum = checksumAdd(sum, a[:])
+		sum = checksumAdd(sum, b[:])
+	}
+	return sum + uint32(proto) + uint32(n)
+}
+
+// checksumAdd adds b to the unfolded one's complement sum.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds sum into 16 bits and returns its complement, the
+// Internet checksum.
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/ipproto"
+)
+
+func udp6(src, dst netaddr.IP, sport, dport uint16, payload string) []byte {
+	header := &packet.UDP6Header{
+		IP6Header: packet.IP6Header{
+			Src: src,
+			Dst: dst,
+		},
+		SrcPort: sport,
+		DstPort: dport,
+	}
+	return packet.Generate(header, []byte(payload))
+}
+
+// checksumOK reports whether the L4 checksum of payload, sent from src
+// to dst, is valid.
+func checksumOK(proto ipproto.Proto, src, dst netaddr.IP, payload []byte) bool {
+	var sum uint32
+	if proto != ipproto.ICMPv4 {
+		sum = pseudoHeaderSum(proto, src, dst, len(payload))
+	}
+	return checksumFold(checksumAdd(sum, payload)) == 0
+}
+
+func TestNAT64UDP(t *testing.T) {
+	client4 := netaddr.MustParseIP("100.101.102.103")
+	// Not tsaddr.Tailscale4To6(client4): a peer's addresses come
+	// from its netmap entry, not from each other.
+	client6 := netaddr.MustParseIP("fd7a:115c:a1e0:ab12:4843:cd96:6265:6667")
+	server4 := netaddr.MustParseIP("192.168.1.2")
+	server6 := tsaddr.TailscaleNAT64(server4)
+
+	nat := newNAT64()
+	nat.setPeers(map[netaddr.IP]netaddr.IP{client6: client4})
+
+	// Packets not addressed to the NAT64 range are left alone.
+	other := udp6(client6, netaddr.MustParseIP("fd7a:115c:a1e0::1"), 1234, 53, "hi")
+	if _, ok := nat.in(other); ok {
+		t.Fatal("in translated packet outside NAT64 range")
+	}
+
+	// Nor are packets from peers without a Tailscale IPv4 address.
+	eph := udp6(netaddr.MustParseIP("fd7a:115c:a1e0:efe3::1"), server6, 1234, 53, "hi")
+	if out, ok := nat.in(eph); !ok || out != nil {
+		t.Fatalf("in(ephemeral peer) = %v, %v; want drop", out, ok)
+	}
+
+	// Nor are packets from addresses that aren't a known peer's,
+	// even if they look like the 4to6 mapping of one.
+	mapped := udp6(tsaddr.Tailscale4To6(client4), server6, 1234, 53, "hi")
+	if out, ok := nat.in(mapped); !ok || out != nil {
+		t.Fatalf("in(unknown peer) = %v, %v; want drop", out, ok)
+	}
+
+	pkt := udp6(client6, server6, 1234, 53, "query")
+	out, ok := nat.in(pkt)
+	if !ok || out == nil {
+		t.Fatalf("in = %v, %v; want translated packet", out, ok)
+	}
+	if got, want := len(out), len(pkt)-nat64Growth; got != want {
+		t.Errorf("translated length = %d; want %d", got, want)
+	}
+	var p packet.Parsed
+	p.Decode(out)
+	if p.IPVersion != 4 || p.IPProto != ipproto.UDP {
+		t.Fatalf("translated packet = %v; want UDP4", p.String())
+	}
+	if p.Src != netaddr.IPPortFrom(client4, 1234) || p.Dst != netaddr.IPPortFrom(server4, 53) {
+		t.Errorf("translated packet = %v; want %v:1234 => %v:53", p.String(), client4, server4)
+	}
+	if checksumFold(checksumAdd(0, out[:ip4HeaderLen])) != 0 {
+		t.Error("bad IPv4 header checksum")
+	}
+	if !checksumOK(ipproto.UDP, client4, server4, out[ip4HeaderLen:]) {
+		t.Error("bad UDP checksum after in")
+	}
+	if string(p.Payload()) != "query" {
+		t.Errorf("payload = %q; want %q", p.Payload(), "query")
+	}
+
+	// The reply is translated back.
+	reply := udp4(server4.String(), client4.String(), 53, 1234)
+	buf := make([]byte, len(reply)+nat64Growth)
+	copy(buf, reply)
+	n := nat.out(buf, len(reply))
+	if got, want := n, len(reply)+nat64Growth; got != want {
+		t.Fatalf("out = %d; want %d", got, want)
+	}
+	p.Decode(buf[:n])
+	if p.IPVersion != 6 || p.IPProto != ipproto.UDP {
+		t.Fatalf("translated reply = %v; want UDP6", p.String())
+	}
+	if p.Src != netaddr.IPPortFrom(server6, 53) || p.Dst != netaddr.IPPortFrom(client6, 1234) {
+		t.Errorf("translated reply = %v; want %v:53 => %v:1234", p.String(), server6, client6)
+	}
+	if !checksumOK(ipproto.UDP, server6, client6, buf[ip6HeaderLen:n]) {
+		t.Error("bad UDP checksum after out")
+	}
+	if string(p.Payload()) != "udp_payload" {
+		t.Errorf("reply payload = %q; want %q", p.Payload(), "udp_payload")
+	}
+
+	// IPv4 packets of other flows are left alone.
+	unrelated := udp4(server4.String(), client4.String(), 53, 9999)
+	buf = make([]byte, len(unrelated)+nat64Growth)
+	copy(buf, unrelated)
+	if n := nat.out(buf, len(unrelated)); n != len(unrelated) {
+		t.Errorf("out(unrelated) = %d; want %d", n, len(unrelated))
+	}
+}
+
+func TestNAT64Echo(t *testing.T) {
+	client4 := netaddr.MustParseIP("100.101.102.103")
+	client6 := tsaddr.Tailscale4To6(client4)
+	server4 := netaddr.MustParseIP("10.0.0.1")
+	server6 := tsaddr.TailscaleNAT64(server4)
+
+	nat := newNAT64()
+	nat.setPeers(map[netaddr.IP]netaddr.IP{client6: client4})
+
+	// ICMPv6 echo request, ID 0x1234, sequence 1.
+	icmp := []byte{128, 0, 0, 0, 0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}
+	setL4Checksum(ipproto.ICMPv6, client6, server6, icmp)
+	pkt := packet.Generate(packet.IP6Header{
+		IPProto: ipproto.ICMPv6,
+		Src:     client6,
+		Dst:     server6,
+	}, icmp)
+
+	out, ok := nat.in(pkt)
+	if !ok || out == nil {
+		t.Fatalf("in = %v, %v; want translated packet", out, ok)
+	}
+	var p packet.Parsed
+	p.Decode(out)
+	if !p.IsEchoRequest() || p.Dst.IP() != server4 {
+		t.Fatalf("translated packet = %v; want ICMPv4 echo request to %v", p.String(), server4)
+	}
+	if !checksumOK(ipproto.ICMPv4, client4, server4, out[ip4HeaderLen:]) {
+		t.Error("bad ICMPv4 checksum after in")
+	}
+
+	// Turn the translated request into its reply and send it back.
+	reply := append([]byte(nil), out...)
+	copy(reply[12:16], out[16:20])
+	copy(reply[16:20], out[12:16])
+	reply[ip4HeaderLen] = 0 // echo reply
+	setL4Checksum(ipproto.ICMPv4, server4, client4, reply[ip4HeaderLen:])
+
+	buf := make([]byte, len(reply)+nat64Growth)
+	copy(buf, reply)
+	n := nat.out(buf, len(reply))
+	if n != len(reply)+nat64Growth {
+		t.Fatalf("out = %d; want translated reply", n)
+	}
+	p.Decode(buf[:n])
+	if p.IPVersion != 6 || p.IPProto != ipproto.ICMPv6 || buf[ip6HeaderLen] != 129 {
+		t.Fatalf("translated reply = %v; want ICMPv6 echo reply", p.String())
+	}
+	if p.Src.IP() != server6 || p.Dst.IP() != client6 {
+		t.Errorf("translated reply = %v; want %v => %v", p.String(), server6, client6)
+	}
+	if id := binary.BigEndian.Uint16(buf[ip6HeaderLen+4:]); id != 0x1234 {
+		t.Errorf("echo ID = %#x; want 0x1234", id)
+	}
+	if !checksumOK(ipproto.ICMPv6, server6, client6, buf[ip6HeaderLen:n]) {
+		t.Error("bad ICMPv6 checksum after out")
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/preftype"
+)
+
+// Outbound QoS.
+//
+// By default, poll hands packets read from the TUN device to
+// wireguard-go one at a time, in order, so when wireguard-go can't
+// keep up, a bulk transfer delays everything queued behind it. With
+// QoS enabled (see SetQoS), poll instead reads ahead into a queue per
+// class of traffic, and a dispatcher goroutine hands wireguard-go the
+// packets of the highest priority non-empty queue first.
+//
+// The classes are, in priority order: the configured classes
+// (preftype.QoSClass, matched by port or DSCP), then
+// preftype.QoSInteractive for other flows, then preftype.QoSBulk for
+// flows that have sent more than qosBulkBytes without pausing for
+// qosFlowIdle. Flows are told apart by their flowtrack.Tuple. Each
+// queue holds at most qosQueueLen packets; packets that arrive at a
+// full queue are dropped, as at a congested router, so that their
+// senders back off.
+//
+// Packets injected with InjectOutbound bypass the queues.
+//
+// The queues here only fill once wireguard-go's own do: it reads
+// ahead into a queue per peer, which it sends from in order. Under a
+// sustained uplink bottleneck, magicsock's UDP writes block on the
+// socket's full send buffer, wireguard-go's queues fill up behind
+// them, and it stops reading; from then on, each packet it takes is
+// the highest priority one waiting here. Packets already in its
+// queues can't be reordered.
+
+const (
+	// qosQueueLen is the most packets queued per class.
+	qosQueueLen = 256
+
+	// qosBulkBytes is how many bytes a flow sends, without pausing,
+	// before it's bulk.
+	qosBulkBytes = 1 << 20
+
+	// qosFlowIdle is how long a flow pauses for its byte count to be
+	// reset.
+	qosFlowIdle = time.Second
+
+	// qosMaxFlows is how many flows' byte counts we keep.
+	qosMaxFlows = 1024
+)
+
+// qosClass is a class of outbound traffic, with its queue.
+type qosClass struct {
+	name  string
+	ports map[uint16]bool
+	dscp  [64]bool
+
+	q [][]byte // packets, oldest first; guarded by qosScheduler.mu
+}
+
+// qosFlow is the recent traffic of a flow.
+type qosFlow struct {
+	bytes int64     // sent since the flow was last idle
+	last  mono.Time // of the last packet
+}
+
+// qosScheduler queues outbound packets by class. It's created by
+// SetQoS, and replaced or closed by the next call.
+type qosScheduler struct {
+	config  []preftype.QoSClass // as passed to SetQoS; read-only
+	metrics *qosMetrics
+	ready   chan struct{} // signaled (non-blocking) by enqueue and close
+
+	// classes are in priority order: the configured classes, then
+	// interactive and bulk.
+	classes           []*qosClass
+	interactive, bulk *qosClass
+
+	// flows and parsed are only used by poll.
+	flows  flowtrack.Cache // of *qosFlow
+	parsed packet.Parsed
+
+	mu     sync.Mutex
+	closed bool // no more packets are accepted
+}
+
+func newQoSScheduler(classes []preftype.QoSClass, m *qosMetrics) *qosScheduler {
+	q := &qosScheduler{
+		config:  make([]preftype.QoSClass, len(classes)),
+		metrics: m,
+		ready:   make(chan struct{}, 1),
+		flows:   flowtrack.Cache{MaxEntries: qosMaxFlows},
+	}
+	for i, c := range classes {
+		q.config[i] = *c.Clone()
+		qc := &qosClass{
+			name:  c.Name,
+			ports: map[uint16]bool{},
+		}
+		for _, port := range c.Ports {
+			qc.ports[port] = true
+		}
+		for _, dscp := range c.DSCP {
+			if dscp >= 0 && dscp < len(qc.dscp) {
+				qc.dscp[dscp] = true
+			}
+		}
+		q.classes = append(q.classes, qc)
+	}
+	q.interactive = &qosClass{name: preftype.QoSInteractive}
+	q.bulk = &qosClass{name: preftype.QoSBulk}
+	q.classes = append(q.classes, q.interactive, q.bulk)
+	return q
+}
+
+// dscpOf returns the DSCP value that IP packet b is marked with.
+func dscpOf(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	switch b[0] >> 4 {
+	case 4:
+		return int(b[1] >> 2)
+	case 6:
+		// The traffic class straddles the first two bytes.
+		return int(b[0]&0x0f)<<2 | int(b[1]>>6)
+	}
+	return 0
+}
+
+// classify returns the class of the packet b.
+// It must only be called from poll.
+func (q *qosScheduler) classify(b []byte, now mono.Time) *qosClass {
+	p := &q.parsed
+	p.Decode(b)
+	hasPorts := p.IPProto == ipproto.TCP || p.IPProto == ipproto.UDP
+	dscp := dscpOf(b)
+	for _, c := range q.classes {
+		if c == q.interactive {
+			break
+		}
+		if c.dscp[dscp] || hasPorts && (c.ports[p.Src.Port()] || c.ports[p.Dst.Port()]) {
+			return c
+		}
+	}
+
+	key := flowtrack.Tuple{Proto: p.IPProto, Src: p.Src, Dst: p.Dst}
+	var f *qosFlow
+	if v, ok := q.flows.Get(key); ok {
+		f = v.(*qosFlow)
+	} else {
+		f = new(qosFlow)
+		q.flows.Add(key, f)
+	}
+	if now.Sub(f.last) > qosFlowIdle {
+		f.bytes = 0
+	}
+	f.bytes += int64(len(b))
+	f.last = now
+	if f.bytes > qosBulkBytes {
+		return q.bulk
+	}
+	return q.interactive
+}
+
+// enqueue queues a copy of the packet b, or drops it if its class's
+// queue is full or q is closed.
+// It must only be called from poll.
+func (q *qosScheduler) enqueue(b []byte) {
+	c := q.classify(b, mono.Now())
+	q.mu.Lock()
+	if q.closed || len(c.q) >= qosQueueLen {
+		// If q was closed by SetQoS while poll was using it,
+		// its dispatcher may already be gone.
+		q.mu.Unlock()
+		q.metrics.dropped.Get(c.name).Add(1)
+		return
+	}
+	c.q = append(c.q, append([]byte(nil), b...))
+	q.mu.Unlock()
+	q.metrics.depth.Get(c.name).Add(1)
+	q.signal()
+}
+
+// signal wakes dequeue, if it's waiting.
+func (q *qosScheduler) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue returns the oldest packet of the highest priority class
+// that has one, waiting for one if there are none. It returns false
+// once q is closed and drained, or when done is closed.
+func (q *qosScheduler) dequeue(done <-chan struct{}) (pkt []byte, ok bool) {
+	for {
+		q.mu.Lock()
+		for _, c := range q.classes {
+			if len(c.q) == 0 {
+				continue
+			}
+			pkt = c.q[0]
+			c.q[0] = nil
+			c.q = c.q[1:]
+			q.mu.Unlock()
+			q.metrics.depth.Get(c.name).Add(-1)
+			q.metrics.sent.Get(c.name).Add(1)
+			return pkt, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-q.ready:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// close stops q from accepting packets. Its dispatcher exits once
+// the packets already queued are sent.
+func (q *qosScheduler) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+// qosMetrics are the metrics of a Wrapper's QoS schedulers, by class
+// name. They outlive any one scheduler.
+type qosMetrics struct {
+	depth   metrics.LabelMap // packets queued
+	sent    metrics.LabelMap // packets dequeued for wireguard-go
+	dropped metrics.LabelMap // packets dropped because their queue was full
+}
+
+func newQoSMetrics() *qosMetrics {
+	return &qosMetrics{
+		depth:   metrics.LabelMap{Label: "class"},
+		sent:    metrics.LabelMap{Label: "class"},
+		dropped: metrics.LabelMap{Label: "class"},
+	}
+}
+
+// SetQoS enables prioritizing outbound packets by class, with the
+// given classes taking priority over all other traffic in order, or
+// disables it if enable is false. Packets that are already queued
+// are still sent. Calls that don't change the configuration are
+// no-ops.
+func (t *Wrapper) SetQoS(enable bool, classes []preftype.QoSClass) {
+	t.qosMu.Lock()
+	defer t.qosMu.Unlock()
+	old, _ := t.qos.Load().(*qosScheduler)
+	if (old != nil) == enable && (!enable || preftype.QoSClassesEqual(old.config, classes)) {
+		return
+	}
+	var q *qosScheduler
+	if enable {
+		q = newQoSScheduler(classes, t.qosMetrics)
+	}
+	t.qos.Store(q)
+	if old != nil {
+		old.close()
+	}
+	if q != nil {
+		go t.dispatchQoS(q)
+	}
+}
+
+// dispatchQoS hands the packets queued in q to Read, until q is closed
+// and drained, or t is closed.
+func (t *Wrapper) dispatchQoS(q *qosScheduler) {
+	for {
+		pkt, ok := q.dequeue(t.closed)
+		if !ok {
+			return
+		}
+		t.sendOutbound(tunReadResult{data: pkt, queued: true})
+	}
+}
+
+// QoSStats are the outbound packets of a QoS class.
+type QoSStats struct {
+	Class   string
+	Queued  int   // waiting for wireguard-go
+	Sent    int64 // handed to wireguard-go
+	Dropped int64 // because the class's queue was full
+}
+
+// QoSStats returns the stats of t's QoS classes, in priority order, or
+// nil if QoS is disabled. Sent and Dropped count from when t was
+// created.
+func (t *Wrapper) QoSStats() []QoSStats {
+	q, _ := t.qos.Load().(*qosScheduler)
+	if q == nil {
+		return nil
+	}
+	ret := make([]QoSStats, len(q.classes))
+	q.mu.Lock()
+	for i, c := range q.classes {
+		ret[i] = QoSStats{Class: c.name, Queued: len(c.q)}
+	}
+	q.mu.Unlock()
+	for i := range ret {
+		ret[i].Sent = t.qosMetrics.sent.Get(ret[i].Class).Value()
+		ret[i].Dropped = t.qosMetrics.dropped.Get(ret[i].Class).Value()
+	}
+	return ret
+}
+
+// QoSExpVar returns the QoS metrics of t, for registering with
+// expvar.Publish.
+func (t *Wrapper) QoSExpVar() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("gauge_queue_depth", &t.qosMetrics.depth)
+	m.Set("counter_packets_sent", &t.qosMetrics.sent)
+	m.Set("counter_packets_dropped", &t.qosMetrics.dropped)
+	return m
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sync"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tstime/rate"
+)
+
+// Forwarding rate limits.
+//
+// A subnet router or exit node forwards packets from its peers to
+// destinations other than itself, and the replies back to them. With
+// a forwarding rate limit set (see SetForwardRateLimit), each peer, by
+// its Tailscale IP, gets a token bucket of bytes that the packets
+// forwarded in both directions share: inbound ones from the peer, and
+// outbound ones to it from other sources. Packets that the peer has no
+// tokens for are dropped instead of forwarded. Packets of other IPs,
+// such as hosts on a peer's own subnet routes, aren't limited.
+
+// minForwardBurst is the least burst size, in bytes, that forwarding
+// rate limits allow. It's well above any packet size that
+// wireguard-go hands us.
+const minForwardBurst = 16 << 10
+
+// ForwardStats are the packets from and to a peer that a Wrapper
+// forwarded or dropped to keep within the forwarding rate limit.
+type ForwardStats struct {
+	Bytes   int64 // forwarded
+	Dropped int64 // packets
+}
+
+// forwardLimiter is the forwarding rate limit of a Wrapper.
+type forwardLimiter struct {
+	limit rate.Limit // bytes per second
+	burst int
+
+	mu    sync.Mutex
+	peers map[netaddr.IP]*peerForwardLimiter
+}
+
+// peerForwardLimiter is the token bucket and stats of a peer IP.
+type peerForwardLimiter struct {
+	lim   *rate.Limiter
+	stats ForwardStats
+}
+
+func newForwardLimiter(bytesPerSec int64) *forwardLimiter {
+	burst := int(bytesPerSec / 4)
+	if burst < minForwardBurst {
+		burst = minForwardBurst
+	}
+	return &forwardLimiter{
+		limit: rate.Limit(bytesPerSec),
+		burst: burst,
+		peers: map[netaddr.IP]*peerForwardLimiter{},
+	}
+}
+
+// allow reports whether to forward a packet of n bytes from or to
+// peer.
+func (fl *forwardLimiter) allow(peer netaddr.IP, n int) bool {
+	if !tsaddr.IsTailscaleIP(peer) {
+		return true
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	pl, ok := fl.peers[peer]
+	if !ok {
+		pl = &peerForwardLimiter{lim: rate.NewLimiter(fl.limit, fl.burst)}
+		fl.peers[peer] = pl
+	}
+	if !pl.lim.AllowN(n) {
+		pl.stats.Dropped++
+		return false
+	}
+	pl.stats.Bytes += int64(n)
+	return true
+}
+
+// SetForwardRateLimit sets the rate, in bytes per second, at which t
+// forwards the packets of each peer, by its Tailscale IP. Zero means
+// no limit. Forwarded packets are inbound ones whose destination
+// isn't one of this node's IPs, per IsLocalIP, and outbound ones whose
+// source isn't.
+func (t *Wrapper) SetForwardRateLimit(bytesPerSec int64) {
+	t.forwardLimitMu.Lock()
+	defer t.forwardLimitMu.Unlock()
+	old, _ := t.forwardLimit.Load().(*forwardLimiter)
+	if old != nil && int64(old.limit) == bytesPerSec || old == nil && bytesPerSec == 0 {
+		return
+	}
+	var fl *forwardLimiter
+	if bytesPerSec > 0 {
+		fl = newForwardLimiter(bytesPerSec)
+	}
+	t.forwardLimit.Store(fl)
+}
+
+// ForwardStats returns the packets forwarded and dropped by peer
+// Tailscale IP since the forwarding rate limit was last set, or nil
+// if there's no limit.
+func (t *Wrapper) ForwardStats() map[netaddr.IP]ForwardStats {
+	fl, _ := t.forwardLimit.Load().(*forwardLimiter)
+	if fl == nil {
+		return nil
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	ret := make(map[netaddr.IP]ForwardStats, len(fl.peers))
+	for ip, pl := range fl.peers {
+		ret[ip] = pl.stats
+	}
+	return ret
+}
+
+// PruneForwardPeers forgets the forwarding rate limit state and stats
+// of the peer IPs that keep reports false, such as the Tailscale IPs
+// of peers that left the network map.
+func (t *Wrapper) PruneForwardPeers(keep func(netaddr.IP) bool) {
+	fl, _ := t.forwardLimit.Load().(*forwardLimiter)
+	if fl == nil {
+		return
+	}
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	for ip := range fl.peers {
+		if !keep(ip) {
+			delete(fl.peers, ip)
+		}
+	}
+}
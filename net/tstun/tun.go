@@ -27,8 +27,11 @@ import (
 // GCE (1460 MTU?!).
 //
 // 1280 is the smallest MTU allowed for IPv6, which is a sensible
-// "probably works everywhere" setting until we develop proper PMTU
-// discovery.
+// "probably works everywhere" setting. For paths that can't even
+// carry that, magicsock discovers each peer's path MTU, and Wrapper
+// clamps the MSS of TCP connections and sends ICMP "packet too big"
+// errors for other packets that exceed it. The same goes for paths
+// smaller than a bigger TS_DEBUG_MTU.
 var tunMTU = 1280
 
 func init() {
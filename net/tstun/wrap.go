@@ -118,9 +118,26 @@ type Wrapper struct {
 
 	// filter atomically stores the currently active packet filter
 	filter atomic.Value // of *filter.Filter
+	// nat64 atomically stores the NAT64 translator, or nil if NAT64
+	// is disabled. nat64Mu serializes SetNAT64.
+	nat64Mu sync.Mutex
+	nat64   atomic.Value // of *nat64
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
 
+	// qosMu serializes SetQoS calls.
+	qosMu sync.Mutex
+	// qos atomically stores the outbound QoS scheduler, or nil if
+	// QoS is disabled.
+	qos        atomic.Value // of *qosScheduler
+	qosMetrics *qosMetrics
+
+	// forwardLimitMu serializes SetForwardRateLimit calls.
+	forwardLimitMu sync.Mutex
+	// forwardLimit atomically stores the forwarding rate limiter,
+	// or nil if there's no limit.
+	forwardLimit atomic.Value // of *forwardLimiter
+
 	// PreFilterIn is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
 	PreFilterIn FilterFunc
@@ -139,6 +156,25 @@ type Wrapper struct {
 	// running for the given IP address.
 	PeerAPIPort func(netaddr.IP) (port uint16, ok bool)
 
+	// PeerMTU, if non-nil, returns the path MTU to the peer that
+	// packets to or from the given IP address go through, or zero
+	// if it's unknown. The MSS of TCP SYNs to and from the peer is
+	// clamped to fit it, and outbound packets that don't fit are
+	// answered with ICMP "packet too big" errors.
+	PeerMTU func(netaddr.IP) int
+
+	// MinPeerMTU, if non-nil, returns the smallest path MTU that
+	// PeerMTU may return, or zero if it always returns zero. It
+	// saves looking up the peers of packets that fit regardless.
+	MinPeerMTU func() int
+
+	// IsLocalIP, if non-nil, reports whether the given IP address
+	// is one of this node's own. Inbound packets to other addresses,
+	// and outbound ones from other addresses, are forwarded ones,
+	// subject to the forwarding rate limit. Without it, there's no
+	// limit.
+	IsLocalIP func(netaddr.IP) bool
+
 	// disableFilter disables all filtering when set. This should only be used in tests.
 	disableFilter bool
 
@@ -152,6 +188,10 @@ type Wrapper struct {
 type tunReadResult struct {
 	data []byte
 	err  error
+
+	// queued is whether data was read from the TUN device and queued
+	// by the QoS scheduler, rather than being in t.buffer or injected.
+	queued bool
 }
 
 func WrapTAP(logf logger.Logf, tdev tun.Device) *Wrapper {
@@ -177,6 +217,7 @@ func wrap(logf logger.Logf, tdev tun.Device, isTAP bool) *Wrapper {
 		eventsOther:  make(chan tun.Event),
 		// TODO(dmytro): (highly rate-limited) hexdumps should happen on unknown packets.
 		filterFlags: filter.LogAccepts | filter.LogDrops,
+		qosMetrics:  newQoSMetrics(),
 	}
 
 	go tun.poll()
@@ -351,6 +392,12 @@ func (t *Wrapper) poll() {
 				t.logf("tap regular frame: %x", t.buffer[PacketStartOffset:PacketStartOffset+n])
 			}
 		}
+		if q, _ := t.qos.Load().(*qosScheduler); q != nil && err == nil {
+			// The scheduler copies the packet, so t.buffer is
+			// free again.
+			q.enqueue(t.buffer[PacketStartOffset : PacketStartOffset+n])
+			goto DoRead
+		}
 		t.sendOutbound(tunReadResult{data: t.buffer[PacketStartOffset : PacketStartOffset+n], err: err})
 	}
 }
@@ -407,9 +454,49 @@ func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
 		}
 	}
 
+	if fl, _ := t.forwardLimit.Load().(*forwardLimiter); fl != nil && t.IsLocalIP != nil && !t.IsLocalIP(p.Src.IP()) {
+		// Forwarded to the peer, such as a download through
+		// this exit node.
+		if !fl.allow(p.Dst.IP(), len(p.Buffer())) {
+			return filter.DropSilently
+		}
+	}
+
+	if mtu := t.peerMTU(p, p.Dst.IP()); mtu != 0 {
+		if len(p.Buffer()) > mtu {
+			if outp := packet.TooBig(p, mtu); outp != nil {
+				t.InjectInboundCopy(outp)
+				return filter.DropSilently
+			}
+		}
+		packet.ClampMSS(p, packet.MSSForMTU(p.IPVersion, mtu))
+	}
+
 	return filter.Accept
 }
 
+// peerMTU returns the path MTU to the peer that p goes to or comes
+// from, at ip, if p might not fit it: if it's bigger than the
+// smallest path MTU, or a TCP SYN, whose MSS says how big the
+// connection's segments get. Otherwise, or if the path MTU is
+// unknown, it returns zero.
+func (t *Wrapper) peerMTU(p *packet.Parsed, ip netaddr.IP) int {
+	if t.PeerMTU == nil {
+		return 0
+	}
+	if t.MinPeerMTU != nil {
+		min := t.MinPeerMTU()
+		if min == 0 {
+			return 0
+		}
+		isSYN := p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0
+		if len(p.Buffer()) <= min && !isSYN {
+			return 0
+		}
+	}
+	return t.PeerMTU(ip)
+}
+
 // noteActivity records that there was a read or write at the current time.
 func (t *Wrapper) noteActivity() {
 	t.lastActivityAtomic.StoreAtomic(mono.Now())
@@ -435,10 +522,11 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 	pkt := res.data
 	n := copy(buf[offset:], pkt)
 	// t.buffer has a fixed location in memory.
-	// If the packet is not from t.buffer, then it is an injected packet.
+	// If the packet is not from t.buffer or the QoS scheduler,
+	// then it is an injected packet.
 	// &pkt[0] can be used because empty packets do not reach t.outbound.
-	isInjectedPacket := &pkt[0] != &t.buffer[PacketStartOffset]
-	if !isInjectedPacket {
+	isInjectedPacket := !res.queued && &pkt[0] != &t.buffer[PacketStartOffset]
+	if !isInjectedPacket && !res.queued {
 		// We are done with t.buffer. Let poll re-use it.
 		t.sendBufferConsumed()
 	}
@@ -462,6 +550,10 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 		}
 	}
 
+	if nat, _ := t.nat64.Load().(*nat64); nat != nil && p.IPVersion == 4 {
+		n = nat.out(buf[offset:], n)
+	}
+
 	t.noteActivity()
 	return n, nil
 }
@@ -541,12 +633,36 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		}
 	}
 
+	if fl, _ := t.forwardLimit.Load().(*forwardLimiter); fl != nil && t.IsLocalIP != nil && !t.IsLocalIP(p.Dst.IP()) {
+		if !fl.allow(p.Src.IP(), len(buf)) {
+			return filter.DropSilently
+		}
+	}
+
+	if p.IPProto == ipproto.TCP && p.TCPFlags&packet.TCPSyn != 0 {
+		// Keep our replies to the peer within its path MTU.
+		if mtu := t.peerMTU(p, p.Src.IP()); mtu != 0 {
+			packet.ClampMSS(p, packet.MSSForMTU(p.IPVersion, mtu))
+		}
+	}
+
 	return filter.Accept
 }
 
 // Write accepts an incoming packet. The packet begins at buf[offset:],
 // like wireguard-go/tun.Device.Write.
 func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
+	if nat, _ := t.nat64.Load().(*nat64); nat != nil {
+		if out, ok := nat.in(buf[offset:]); ok {
+			if out == nil {
+				return len(buf), nil
+			}
+			// The translated packet is shorter, and starts
+			// later in buf.
+			offset += nat64Growth
+			buf = buf[:offset+len(out)]
+		}
+	}
 	if !t.disableFilter {
 		if t.filterIn(buf[offset:]) != filter.Accept {
 			// If we're not accepting the packet, lie to wireguard-go and pretend
@@ -577,6 +693,31 @@ func (t *Wrapper) tdevWrite(buf []byte, offset int) (int, error) {
 	return t.tdev.Write(buf, offset)
 }
 
+// SetNAT64 enables translating IPv6 packets from peers to
+// tsaddr.TailscaleNAT64Range into IPv4 packets, and their replies back
+// into IPv6, or disables it if peers is nil. It's meant for subnet
+// routers advertising that range.
+//
+// Only packets from the peers in peers, a map from each peer's
+// Tailscale IPv6 address to its Tailscale IPv4 address, are
+// translated. They're filtered as IPv4 packets from the peer's
+// Tailscale IPv4 address.
+func (t *Wrapper) SetNAT64(peers map[netaddr.IP]netaddr.IP) {
+	t.nat64Mu.Lock()
+	defer t.nat64Mu.Unlock()
+	cur, _ := t.nat64.Load().(*nat64)
+	switch {
+	case peers != nil && cur == nil:
+		cur = newNAT64()
+		cur.setPeers(peers)
+		t.nat64.Store(cur)
+	case peers != nil:
+		cur.setPeers(peers)
+	case cur != nil:
+		t.nat64.Store((*nat64)(nil))
+	}
+}
+
 func (t *Wrapper) GetFilter() *filter.Filter {
 	filt, _ := t.filter.Load().(*filter.Filter)
 	return filt
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -19,6 +20,7 @@ import (
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -485,3 +487,451 @@ func TestPeerAPIBypass(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerMTU(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	tun.PeerMTU = func(ip netaddr.IP) int {
+		if ip == netaddr.MustParseIP("5.6.7.8") {
+			return 1400
+		}
+		return 0
+	}
+
+	bigUDP4 := func(dst string, size int, df bool) []byte {
+		b := packet.Generate(&packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netaddr.MustParseIP("1.2.3.4"),
+				Dst: netaddr.MustParseIP(dst),
+			},
+			SrcPort: 98,
+			DstPort: 98,
+		}, make([]byte, size-28))
+		if df {
+			b[6] |= 0x40
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		pkt     []byte
+		tooBig  bool // want an ICMP error, not the packet
+		dropped bool
+	}{
+		{"fits", bigUDP4("5.6.7.8", 1400, true), false, false},
+		{"too_big", bigUDP4("5.6.7.8", 1401, true), true, true},
+		{"too_big_fragmentable", bigUDP4("5.6.7.8", 1500, false), false, false},
+		{"unknown_mtu", bigUDP4("5.6.7.9", 1500, true), false, false},
+	}
+	var buf [MaxPacketSize]byte
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chtun.Outbound <- tt.pkt
+			n, err := tun.Read(buf[:], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped := n == 0; dropped != tt.dropped {
+				t.Errorf("dropped = %v; want %v", dropped, tt.dropped)
+			}
+			if !tt.tooBig {
+				return
+			}
+			var q packet.Parsed
+			q.Decode(<-chtun.Inbound)
+			if q.IPProto != ipproto.ICMPv4 || !q.IsError() || q.Dst.IP() != netaddr.MustParseIP("1.2.3.4") {
+				t.Errorf("got %v; want ICMP error to 1.2.3.4", q.String())
+			}
+			if mtu := binary.BigEndian.Uint16(q.Buffer()[26:28]); mtu != 1400 {
+				t.Errorf("ICMP error has MTU %d; want 1400", mtu)
+			}
+		})
+	}
+}
+
+func TestPeerMTUClampMSS(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	var lookups int
+	tun.PeerMTU = func(ip netaddr.IP) int {
+		lookups++
+		if ip == netaddr.MustParseIP("5.6.7.8") {
+			return 1200
+		}
+		return 0
+	}
+	tun.MinPeerMTU = func() int { return 1200 }
+
+	// syn returns a TCP SYN with an MSS option of 1460.
+	syn := func(src, dst string, sport, dport uint16) []byte {
+		b := tcp4syn(src, dst, sport, dport)
+		b = append(b, 2, 4, 0x05, 0xb4) // MSS 1460
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+		b[20+12] = 6 << 4 // 24 byte TCP header
+		return b
+	}
+	mssOf := func(b []byte) uint16 { return binary.BigEndian.Uint16(b[20+20+2:]) }
+
+	var buf [MaxPacketSize]byte
+	read := func(pkt []byte) []byte {
+		t.Helper()
+		chtun.Outbound <- pkt
+		n, err := tun.Read(buf[:], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	if got := mssOf(read(syn("1.2.3.4", "5.6.7.8", 1234, 98))); got != 1200-40 {
+		t.Errorf("outbound SYN to small path: MSS = %d; want %d", got, 1200-40)
+	}
+	go tun.Write(syn("5.6.7.8", "1.2.3.4", 1234, 89), 0)
+	if got := mssOf(<-chtun.Inbound); got != 1200-40 {
+		t.Errorf("inbound SYN from small path: MSS = %d; want %d", got, 1200-40)
+	}
+
+	// Packets that fit any path aren't looked up.
+	lookups = 0
+	read(udp4("1.2.3.4", "5.6.7.8", 98, 98))
+	if lookups != 0 {
+		t.Errorf("small packet looked up %d times; want 0", lookups)
+	}
+
+	// Nor is anything while no path MTU is known.
+	tun.MinPeerMTU = func() int { return 0 }
+	if got := mssOf(read(syn("1.2.3.4", "5.6.7.8", 1234, 98))); got != 1460 || lookups != 0 {
+		t.Errorf("without known path MTUs: MSS = %d after %d lookups; want 1460 after 0", got, lookups)
+	}
+}
+
+func TestQoSScheduler(t *testing.T) {
+	classes := []preftype.QoSClass{
+		{Name: "ssh", Ports: []uint16{22}},
+		{Name: "voice", DSCP: []int{46}},
+	}
+	ssh := tcp4syn("1.2.3.4", "5.6.7.8", 1234, 22)
+	voice := udp4("1.2.3.4", "5.6.7.8", 5060, 5060)
+	voice[1] = 46 << 2 // DSCP EF
+	other := udp4("1.2.3.4", "5.6.7.8", 1000, 2000)
+	bulk := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netaddr.MustParseIP("1.2.3.4"),
+			Dst: netaddr.MustParseIP("5.6.7.8"),
+		},
+		SrcPort: 3000,
+		DstPort: 4000,
+	}, make([]byte, 1372))
+
+	t.Run("classify", func(t *testing.T) {
+		q := newQoSScheduler(classes, newQoSMetrics())
+		now := mono.Now()
+		for _, tt := range []struct {
+			pkt  []byte
+			want string
+		}{
+			{ssh, "ssh"},
+			{voice, "voice"},
+			{other, preftype.QoSInteractive},
+		} {
+			if got := q.classify(tt.pkt, now).name; got != tt.want {
+				t.Errorf("class = %q; want %q", got, tt.want)
+			}
+		}
+
+		n := qosBulkBytes / len(bulk)
+		for i := 0; i < n; i++ {
+			if got := q.classify(bulk, now).name; got != preftype.QoSInteractive {
+				t.Fatalf("packet %d: class = %q; want %q", i, got, preftype.QoSInteractive)
+			}
+		}
+		if got := q.classify(bulk, now).name; got != preftype.QoSBulk {
+			t.Errorf("after %d bytes: class = %q; want %q", (n+1)*len(bulk), got, preftype.QoSBulk)
+		}
+		if got := q.classify(bulk, now.Add(2*qosFlowIdle)).name; got != preftype.QoSInteractive {
+			t.Errorf("after idle: class = %q; want %q", got, preftype.QoSInteractive)
+		}
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		q := newQoSScheduler(classes, newQoSMetrics())
+		q.enqueue(other)
+		q.enqueue(voice)
+		q.enqueue(ssh)
+		q.close()
+		for i, want := range [][]byte{ssh, voice, other} {
+			got, ok := q.dequeue(nil)
+			if !ok || !bytes.Equal(got, want) {
+				t.Errorf("dequeue %d = %x, %v; want %x", i, got, ok, want)
+			}
+		}
+		if _, ok := q.dequeue(nil); ok {
+			t.Error("dequeue of closed, drained scheduler succeeded")
+		}
+	})
+
+	t.Run("drops", func(t *testing.T) {
+		m := newQoSMetrics()
+		q := newQoSScheduler(classes, m)
+		for i := 0; i < qosQueueLen+1; i++ {
+			q.enqueue(other)
+		}
+		q.enqueue(ssh)
+		if got := m.depth.Get(preftype.QoSInteractive).Value(); got != qosQueueLen {
+			t.Errorf("interactive queue depth = %d; want %d", got, qosQueueLen)
+		}
+		if got := m.dropped.Get(preftype.QoSInteractive).Value(); got != 1 {
+			t.Errorf("interactive drops = %d; want 1", got)
+		}
+		if got := m.dropped.Get("ssh").Value(); got != 0 {
+			t.Errorf("ssh drops = %d; want 0", got)
+		}
+		if got, _ := q.dequeue(nil); !bytes.Equal(got, ssh) {
+			t.Errorf("dequeue = %x; want ssh packet", got)
+		}
+		if got := m.sent.Get("ssh").Value(); got != 1 {
+			t.Errorf("ssh sent = %d; want 1", got)
+		}
+	})
+}
+
+func TestQoSRead(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	tun.SetQoS(true, nil)
+	q := tun.qos.Load()
+	tun.SetQoS(true, nil)
+	if tun.qos.Load() != q {
+		t.Error("SetQoS with the same config replaced the scheduler")
+	}
+
+	pkt := udp4("1.2.3.4", "5.6.7.8", 98, 98)
+	chtun.Outbound <- pkt
+	var buf [MaxPacketSize]byte
+	n, err := tun.Read(buf[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], pkt) {
+		t.Errorf("read %x; want %x", buf[:n], pkt)
+	}
+	if got := tun.qosMetrics.sent.Get(preftype.QoSInteractive).Value(); got != 1 {
+		t.Errorf("interactive sent = %d; want 1", got)
+	}
+	wantStats := []QoSStats{
+		{Class: preftype.QoSInteractive, Sent: 1},
+		{Class: preftype.QoSBulk},
+	}
+	if got := tun.QoSStats(); !reflect.DeepEqual(got, wantStats) {
+		t.Errorf("QoSStats = %+v; want %+v", got, wantStats)
+	}
+
+	// Disabling QoS goes back to reading packets one at a time.
+	tun.SetQoS(false, nil)
+	chtun.Outbound <- pkt
+	if n, err = tun.Read(buf[:], 0); err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Errorf("read %x, %v; want %x", buf[:n], err, pkt)
+	}
+	if got := tun.QoSStats(); got != nil {
+		t.Errorf("QoSStats with QoS disabled = %+v; want nil", got)
+	}
+}
+
+// TestQoSReadPriority verifies that while wireguard-go isn't reading,
+// packets of higher priority classes overtake the bulk packets queued
+// ahead of them, end to end from the TUN device through Read.
+func TestQoSReadPriority(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	tun.SetQoS(true, []preftype.QoSClass{{Name: "ssh", Ports: []uint16{22}}})
+
+	var buf [MaxPacketSize]byte
+	read := func() []byte {
+		n, err := tun.Read(buf[:], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	ssh := tcp4syn("1.2.3.4", "5.6.7.8", 1234, 22)
+	other := udp4("1.2.3.4", "5.6.7.8", 1000, 2000)
+	bulk := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netaddr.MustParseIP("1.2.3.4"),
+			Dst: netaddr.MustParseIP("5.6.7.8"),
+		},
+		SrcPort: 3000,
+		DstPort: 4000,
+	}, make([]byte, 1372))
+
+	// Make a bulk flow, while keeping up with it.
+	for sent := 0; sent <= qosBulkBytes; sent += len(bulk) {
+		chtun.Outbound <- bulk
+		read()
+	}
+
+	// Then stop reading, as wireguard-go does when it's behind,
+	// while more bulk packets and then the others arrive. Each
+	// send returns once poll has queued the packet before it.
+	const backlog = 50
+	for i := 0; i < backlog; i++ {
+		chtun.Outbound <- bulk
+	}
+	chtun.Outbound <- other
+	chtun.Outbound <- ssh
+	chtun.Outbound <- bulk
+
+	// The dispatcher may have handed Read two bulk packets before
+	// the others arrived, but no more.
+	var got []string
+	for len(got) < backlog+3 {
+		switch p := read(); {
+		case bytes.Equal(p, ssh):
+			got = append(got, "ssh")
+		case bytes.Equal(p, other):
+			got = append(got, "other")
+		case bytes.Equal(p, bulk):
+			got = append(got, "bulk")
+		default:
+			t.Fatalf("read unexpected packet %x", p)
+		}
+	}
+	first := strings.Join(got[:4], ",")
+	switch first {
+	case "ssh,other,bulk,bulk", "bulk,ssh,other,bulk", "bulk,bulk,ssh,other":
+	default:
+		t.Errorf("first packets read = %s; want ssh and other within the first 4, in that order", first)
+	}
+	if got := tun.qosMetrics.dropped.Get(preftype.QoSBulk).Value(); got != 0 {
+		t.Errorf("bulk drops = %d; want 0", got)
+	}
+}
+
+func TestForwardRateLimit(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	self := netaddr.MustParseIP("100.64.0.1")
+	var sb netaddr.IPSetBuilder
+	sb.Add(self)
+	sb.AddPrefix(netaddr.MustParseIPPrefix("10.0.0.0/8")) // a subnet route
+	localNets, _ := sb.IPSet()
+	tun.SetFilter(filter.New([]filter.Match{{
+		IPProto: []ipproto.Proto{ipproto.UDP},
+		Srcs:    nets("100.64.0.0/10", "192.168.1.0/24"),
+		Dsts:    netports("100.64.0.1:*", "10.0.0.0/8:*"),
+	}}, localNets, localNets, nil, t.Logf))
+	tun.IsLocalIP = func(ip netaddr.IP) bool { return ip == self }
+
+	const pktSize = 1024
+	write := func(src, dst string, n int) {
+		t.Helper()
+		pkt := packet.Generate(&packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netaddr.MustParseIP(src),
+				Dst: netaddr.MustParseIP(dst),
+			},
+			SrcPort: 1000,
+			DstPort: 2000,
+		}, make([]byte, pktSize-28))
+		buf := append(make([]byte, PacketStartOffset), pkt...)
+		for i := 0; i < n; i++ {
+			if _, err := tun.Write(buf, PacketStartOffset); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write("100.64.0.2", "10.1.1.1", 1)
+	if got := tun.ForwardStats(); got != nil {
+		t.Errorf("without a limit, ForwardStats = %v; want nil", got)
+	}
+
+	// A rate low enough that the bucket doesn't noticeably refill
+	// during the test, so each peer gets minForwardBurst bytes.
+	tun.SetForwardRateLimit(1000)
+	const burstPkts = minForwardBurst / pktSize
+	write("100.64.0.2", "10.1.1.1", burstPkts+4)
+	write("100.64.0.3", "10.1.1.1", 1)
+	write("100.64.0.2", self.String(), 1)         // to us; not forwarded
+	write("192.168.1.5", "10.1.1.1", burstPkts+1) // not from a Tailscale IP
+
+	want := map[netaddr.IP]ForwardStats{
+		netaddr.MustParseIP("100.64.0.2"): {Bytes: burstPkts * pktSize, Dropped: 4},
+		netaddr.MustParseIP("100.64.0.3"): {Bytes: pktSize},
+	}
+	if got := tun.ForwardStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForwardStats = %v; want %v", got, want)
+	}
+
+	// Pruning forgets the peers that aren't kept.
+	peer2 := netaddr.MustParseIP("100.64.0.2")
+	tun.PruneForwardPeers(func(ip netaddr.IP) bool { return ip == peer2 })
+	delete(want, netaddr.MustParseIP("100.64.0.3"))
+	if got := tun.ForwardStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after pruning, ForwardStats = %v; want %v", got, want)
+	}
+
+	// Setting the same limit keeps the stats; removing it drops them.
+	tun.SetForwardRateLimit(1000)
+	if got := tun.ForwardStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after setting same limit, ForwardStats = %v; want %v", got, want)
+	}
+	tun.SetForwardRateLimit(0)
+	if got := tun.ForwardStats(); got != nil {
+		t.Errorf("after removing limit, ForwardStats = %v; want nil", got)
+	}
+}
+
+func TestForwardRateLimitDownload(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	self := netaddr.MustParseIP("100.64.0.1")
+	tun.IsLocalIP = func(ip netaddr.IP) bool { return ip == self }
+	// See TestForwardRateLimit.
+	tun.SetForwardRateLimit(1000)
+
+	const pktSize = 1024
+	read := func(src, dst string, n int) (forwarded int) {
+		t.Helper()
+		pkt := packet.Generate(&packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netaddr.MustParseIP(src),
+				Dst: netaddr.MustParseIP(dst),
+			},
+			SrcPort: 2000,
+			DstPort: 1000,
+		}, make([]byte, pktSize-28))
+		var buf [MaxPacketSize]byte
+		for i := 0; i < n; i++ {
+			chtun.Outbound <- pkt
+			got, err := tun.Read(buf[:], 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got > 0 {
+				forwarded++
+			}
+		}
+		return forwarded
+	}
+
+	// Replies from the internet to a peer using us as its exit node.
+	const burstPkts = minForwardBurst / pktSize
+	if got := read("8.8.8.8", "100.64.0.2", burstPkts+4); got != burstPkts {
+		t.Errorf("forwarded %d packets to peer; want %d", got, burstPkts)
+	}
+	// Our own packets to the peer aren't forwarded ones.
+	if got := read(self.String(), "100.64.0.2", 2); got != 2 {
+		t.Errorf("sent %d of our own packets to peer; want 2", got)
+	}
+
+	want := map[netaddr.IP]ForwardStats{
+		netaddr.MustParseIP("100.64.0.2"): {Bytes: burstPkts * pktSize, Dropped: 4},
+	}
+	if got := tun.ForwardStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForwardStats = %v; want %v", got, want)
+	}
+}
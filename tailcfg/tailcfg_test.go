@@ -28,7 +28,7 @@ func TestHostinfoEqual(t *testing.T) {
 	hiHandles := []string{
 		"IPNVersion", "FrontendLogID", "BackendLogID",
 		"OS", "OSVersion", "Package", "DeviceModel", "Hostname",
-		"ShieldsUp", "ShareeNode",
+		"ShieldsUp", "ShareeNode", "PeerRelay",
 		"GoArch",
 		"RoutableIPs", "RequestTags",
 		"Services", "NetInfo",
@@ -510,12 +510,13 @@ func TestEndpointTypeMarshal(t *testing.T) {
 		EndpointSTUN,
 		EndpointPortmapped,
 		EndpointSTUN4LocalPort,
+		EndpointExplicitConf,
 	}
 	got, err := json.Marshal(eps)
 	if err != nil {
 		t.Fatal(err)
 	}
-	const want = `[0,1,2,3,4]`
+	const want = `[0,1,2,3,4,5]`
 	if string(got) != want {
 		t.Errorf("got %s; want %s", got, want)
 	}
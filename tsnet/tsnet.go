@@ -72,14 +72,7 @@ func (s *Server) WhoIs(addr string) (w *apitype.WhoIsResponse, ok bool) {
 		}
 		ipp = ipp.WithIP(ip)
 	}
-	n, up, ok := s.lb.WhoIs(ipp)
-	if !ok {
-		return nil, false
-	}
-	return &apitype.WhoIsResponse{
-		Node:        n,
-		UserProfile: &up,
-	}, true
+	return s.lb.WhoIsResponse(ipp)
 }
 
 func (s *Server) doInit() {
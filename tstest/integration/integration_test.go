@@ -289,6 +289,39 @@ func TestNodeAddressIPFields(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
+// TestPeerRelayAdvertised tests that "tailscale up
+// --advertise-peer-relay" makes it to control, for peers to find.
+func TestPeerRelayAdvertised(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+	n1.MustUp("--advertise-peer-relay")
+	n1.AwaitRunning(t)
+
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		nodes := env.Control.AllNodes()
+		if len(nodes) != 1 {
+			return fmt.Errorf("got %d nodes; want 1", len(nodes))
+		}
+		if !nodes[0].Hostinfo.PeerRelay {
+			return errors.New("node doesn't advertise peer relay")
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
 func TestAddPingRequest(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
@@ -426,6 +426,9 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey tail
 		Addresses:         allowedIPs,
 		AllowedIPs:        allowedIPs,
 	}
+	if req.Hostinfo != nil {
+		s.nodes[req.NodeKey].Hostinfo = *req.Hostinfo.Clone()
+	}
 	requireAuth := s.RequireAuth
 	if requireAuth && s.nodeKeyAuthed[req.NodeKey] {
 		requireAuth = false
@@ -551,6 +554,9 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey tailcfg.M
 		endpoints := filterInvalidIPv6Endpoints(req.Endpoints)
 		node.Endpoints = endpoints
 		node.DiscoKey = req.DiscoKey
+		if req.Hostinfo != nil {
+			node.Hostinfo = *req.Hostinfo.Clone()
+		}
 		peersToUpdate = s.UpdateNode(node)
 	}
 
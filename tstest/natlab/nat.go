@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -85,6 +86,12 @@ type SNAT44 struct {
 	ExternalInterface *Interface
 	// Type specifies the mapping allocation behavior for this NAT.
 	Type NATType
+	// FirstPort, if non-zero, makes the NAT allocate WAN ports
+	// sequentially starting at FirstPort, like many consumer
+	// routers do, instead of randomly. This makes the mappings of
+	// an AddressDependentNAT or AddressAndPortDependentNAT
+	// predictable from the outside.
+	FirstPort uint16
 	// MappingTimeout is the lifetime of individual NAT sessions. Once
 	// a session expires, the mapped port effectively "closes" to new
 	// traffic. If MappingTimeout is 0, DefaultMappingTimeout is used.
@@ -102,6 +109,31 @@ type SNAT44 struct {
 	mu    sync.Mutex
 	byLAN map[natKey]*mapping         // lookup by outbound packet tuple
 	byWAN map[netaddr.IPPort]*mapping // lookup by wan ip:port only
+	// nextPort is the next WAN port to try allocating, if
+	// FirstPort is non-zero. Zero means FirstPort.
+	nextPort uint16
+
+	// forwards are the static port forwards, from WAN port to LAN
+	// ip:port. See AddPortForward.
+	forwards map[uint16]netaddr.IPPort
+	// fwdFlows are the flows that came in through a port forward,
+	// keyed by LAN ip:port (src) and remote ip:port (dst), mapping
+	// to the WAN ip:port that replies are sent from. They never
+	// expire.
+	fwdFlows map[natKey]netaddr.IPPort
+}
+
+// AddPortForward makes n forward packets arriving on its
+// ExternalInterface at wanPort to dst, like a manually configured
+// port forward on a home router. Replies to those packets are sent
+// from wanPort, but other traffic from dst is NATed as usual, so the
+// forward isn't visible to STUN. Forwarded packets bypass the
+// Firewall.
+func (n *SNAT44) AddPortForward(wanPort uint16, dst netaddr.IPPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.initLocked()
+	n.forwards[wanPort] = dst
 }
 
 func (n *SNAT44) timeNow() time.Time {
@@ -122,6 +154,8 @@ func (n *SNAT44) initLocked() {
 	if n.byLAN == nil {
 		n.byLAN = map[natKey]*mapping{}
 		n.byWAN = map[netaddr.IPPort]*mapping{}
+		n.forwards = map[uint16]netaddr.IPPort{}
+		n.fwdFlows = map[natKey]netaddr.IPPort{}
 	}
 	if n.ExternalInterface.Machine() != n.Machine {
 		panic(fmt.Sprintf("NAT given interface %s that is not part of given machine %s", n.ExternalInterface, n.Machine.Name))
@@ -149,6 +183,13 @@ func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
 	defer n.mu.Unlock()
 	n.initLocked()
 
+	if dst, ok := n.forwards[p.Dst.Port()]; ok && p.Dst.IP() == n.ExternalInterface.V4() {
+		n.fwdFlows[natKey{dst, p.Src}] = p.Dst
+		p.Dst = dst
+		p.Trace("port forward to %v", p.Dst)
+		return p
+	}
+
 	now := n.timeNow()
 	mapping := n.byWAN[p.Dst]
 	if mapping == nil || now.After(mapping.deadline) {
@@ -177,6 +218,12 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 			return p
 		}
 
+		if wanSrc, ok := n.fwdFlow(p.Src, p.Dst); ok {
+			p.Src = wanSrc
+			p.Trace("port forward reply from %v", p.Src)
+			return p
+		}
+
 		if n.Firewall != nil {
 			p2 := n.Firewall.HandleForward(p, iif, oif)
 			if p2 == nil {
@@ -214,6 +261,9 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 	case iif == n.ExternalInterface:
 		// Packet was already un-NAT-ed, we just need to either
 		// firewall it or let it through.
+		if _, ok := n.fwdFlow(p.Dst, p.Src); ok {
+			return p
+		}
 		if n.Firewall != nil {
 			return n.Firewall.HandleForward(p, iif, oif)
 		}
@@ -227,12 +277,25 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 	}
 }
 
+// fwdFlow returns the WAN ip:port of the port forward flow between
+// the LAN ip:port lan and the remote ip:port remote, if any.
+func (n *SNAT44) fwdFlow(lan, remote netaddr.IPPort) (wanSrc netaddr.IPPort, ok bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.initLocked()
+	wanSrc, ok = n.fwdFlows[natKey{lan, remote}]
+	return wanSrc, ok
+}
+
 func (n *SNAT44) allocateMappedPort() (net.PacketConn, netaddr.IPPort) {
 	// Clean up old entries before trying to allocate, to free up any
 	// expired ports.
 	n.gc()
 
 	ip := n.ExternalInterface.V4()
+	if n.FirstPort != 0 {
+		return n.allocateSequentialPort(ip)
+	}
 	pc, err := n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), "0"))
 	if err != nil {
 		panic(fmt.Sprintf("ran out of NAT ports: %v", err))
@@ -241,6 +304,23 @@ func (n *SNAT44) allocateMappedPort() (net.PacketConn, netaddr.IPPort) {
 	return pc, addr
 }
 
+// allocateSequentialPort allocates the first free WAN port on ip at
+// or after n.nextPort.
+func (n *SNAT44) allocateSequentialPort(ip netaddr.IP) (net.PacketConn, netaddr.IPPort) {
+	if n.nextPort == 0 {
+		n.nextPort = n.FirstPort
+	}
+	for n.nextPort != 0 {
+		port := n.nextPort
+		n.nextPort++ // wraps to 0 after the last port, ending the loop
+		pc, err := n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		if err == nil {
+			return pc, netaddr.IPPortFrom(ip, port)
+		}
+	}
+	panic("ran out of NAT ports")
+}
+
 func (n *SNAT44) gc() {
 	now := n.timeNow()
 	for _, m := range n.byLAN {
@@ -7,6 +7,7 @@ package natlab
 import (
 	"context"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
@@ -452,6 +453,55 @@ func TestNAT(t *testing.T) {
 	})
 }
 
+func TestNATSequentialPorts(t *testing.T) {
+	internet := NewInternet()
+	lan := &Network{
+		Name:    "LAN",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+	m := &Machine{Name: "NAT"}
+	wanIf := m.Attach("wan", internet)
+	lanIf := m.Attach("lan", lan)
+
+	n := &SNAT44{
+		Machine:           m,
+		ExternalInterface: wanIf,
+		Type:              AddressDependentNAT,
+		FirstPort:         10000,
+	}
+	// Take the port the NAT would allocate second, to check that
+	// it's skipped.
+	pc, err := m.ListenPacket(context.Background(), "udp", net.JoinHostPort(wanIf.V4().String(), "10001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	tests := []struct {
+		dst      netaddr.IPPort
+		wantPort uint16
+	}{
+		{ipp("2.2.2.2:5678"), 10000},
+		{ipp("3.3.3.3:5678"), 10002},
+		{ipp("2.2.2.2:9012"), 10000}, // existing mapping
+		{ipp("4.4.4.4:5678"), 10003},
+	}
+	for _, tt := range tests {
+		p := &Packet{
+			Src:     ipp("192.168.0.20:1234"),
+			Dst:     tt.dst,
+			Payload: []byte("foo"),
+		}
+		got := n.HandleForward(p, lanIf, wanIf)
+		if got == nil {
+			t.Fatalf("packet to %v dropped", tt.dst)
+		}
+		if got.Src.Port() != tt.wantPort {
+			t.Errorf("packet to %v mapped to port %d, want %d", tt.dst, got.Src.Port(), tt.wantPort)
+		}
+	}
+}
+
 type natTest struct {
 	src, dst       netaddr.IPPort
 	wantNewMapping bool
@@ -60,7 +60,17 @@ func (lim *Limiter) Allow() bool {
 	return lim.allow(mono.Now())
 }
 
+// AllowN reports whether n events may happen now, consuming n tokens
+// if so. It's never true if n is more than the burst size.
+func (lim *Limiter) AllowN(n int) bool {
+	return lim.allowN(mono.Now(), n)
+}
+
 func (lim *Limiter) allow(now mono.Time) bool {
+	return lim.allowN(now, 1)
+}
+
+func (lim *Limiter) allowN(now mono.Time, n int) bool {
 	lim.mu.Lock()
 	defer lim.mu.Unlock()
 
@@ -76,8 +86,8 @@ func (lim *Limiter) allow(now mono.Time) bool {
 		tokens = lim.burst
 	}
 
-	// Consume a token.
-	tokens--
+	// Consume the tokens.
+	tokens -= float64(n)
 
 	// Update state.
 	ok := tokens >= 0
@@ -7,7 +7,11 @@ package dnstype
 
 //go:generate go run tailscale.com/cmd/cloner --type=Resolver --clonefunc=true --output=dnstype_clone.go
 
-import "inet.af/netaddr"
+import (
+	"time"
+
+	"inet.af/netaddr"
+)
 
 // Resolver is the configuration for one DNS resolver.
 type Resolver struct {
@@ -25,3 +29,90 @@ type Resolver struct {
 	// resolver.
 	BootstrapResolution []netaddr.IP `json:",omitempty"`
 }
+
+// QueryLogEntry is a DNS query handled by tailscaled's internal
+// resolver, as recorded in its in-memory query log.
+type QueryLogEntry struct {
+	// Seq is a number identifying the entry. It increases
+	// monotonically for as long as the query log is enabled, so
+	// callers can ask for only the entries they haven't seen yet.
+	Seq uint64
+
+	// Time is when the query was received.
+	Time time.Time
+
+	// Name is the queried name. It's empty unless the query log
+	// was enabled with query names included.
+	Name string `json:",omitempty"`
+
+	// Type is the query type, such as "A", "AAAA" or "PTR".
+	Type string
+
+	// Route is how the query was resolved: "local" if it was
+	// answered from the resolver's own records, otherwise the DNS
+	// suffix of the route it was forwarded along ("." for the
+	// default route). It's empty if no route matched.
+	Route string `json:",omitempty"`
+
+	// Upstream is the ip:port of the upstream nameserver whose
+	// response was used, if the query was forwarded.
+	Upstream string `json:",omitempty"`
+
+	// Latency is how long it took to produce a response.
+	Latency time.Duration
+
+	// RCode is the response code, such as "Success" or
+	// "NameError". It's empty if no response was produced.
+	RCode string `json:",omitempty"`
+
+	// Error is the reason no response was produced, if any.
+	Error string `json:",omitempty"`
+}
+
+// QueryResult is the outcome of a diagnostic DNS query run through
+// tailscaled's internal resolver, along with how the resolver arrived
+// at it.
+type QueryResult struct {
+	// Name is the queried name, without a trailing dot.
+	Name string
+
+	// Type is the query type, such as "A", "AAAA" or "PTR".
+	Type string
+
+	// Path describes, in order, the decisions the resolver made
+	// while answering the query.
+	Path []string
+
+	// Route is how the query was resolved, as in QueryLogEntry.
+	Route string `json:",omitempty"`
+
+	// Upstream is the ip:port of the upstream nameserver whose
+	// response was used, if the query was forwarded.
+	Upstream string `json:",omitempty"`
+
+	// Latency is how long it took to produce a response.
+	Latency time.Duration
+
+	// RCode is the response code, such as "Success" or
+	// "NameError". It's empty if no response was produced.
+	RCode string `json:",omitempty"`
+
+	// Answers are the records in the answer section of the
+	// response.
+	Answers []QueryAnswer `json:",omitempty"`
+
+	// Error is the reason no response was produced, if any.
+	Error string `json:",omitempty"`
+}
+
+// QueryAnswer is a resource record in the answer section of a
+// QueryResult.
+type QueryAnswer struct {
+	Name string
+	Type string
+	TTL  uint32
+	// Data is the record's data in presentation format, such as
+	// an IP address for A and AAAA records or a name for CNAME
+	// records. It's empty for record types not understood.
+	Data string `json:",omitempty"`
+}
@@ -44,3 +44,57 @@ func (p portValue) Set(v string) error {
 	*p.n = uint16(n)
 	return nil
 }
+
+type portListValue struct {
+	ports *[]uint16
+	max   int
+}
+
+// PortListValue returns a flag.Value for a comma-separated list of
+// port numbers and inclusive port ranges, such as "41642,41700-41710".
+// If max is non-zero, lists of more than max ports are rejected.
+func PortListValue(dst *[]uint16, max int) flag.Value {
+	return portListValue{dst, max}
+}
+
+func (p portListValue) String() string {
+	if p.ports == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for i, n := range *p.ports {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprint(&sb, n)
+	}
+	return sb.String()
+}
+
+func (p portListValue) Set(v string) error {
+	var ports []uint16
+	for _, f := range strings.Split(v, ",") {
+		lo, hi := f, f
+		if i := strings.Index(f, "-"); i != -1 {
+			lo, hi = f[:i], f[i+1:]
+		}
+		var first, last uint16
+		if err := PortValue(&first, 0).Set(lo); err != nil {
+			return fmt.Errorf("%q: %w", f, err)
+		}
+		if err := PortValue(&last, 0).Set(hi); err != nil {
+			return fmt.Errorf("%q: %w", f, err)
+		}
+		if first == 0 || last < first {
+			return fmt.Errorf("%q: invalid port range", f)
+		}
+		if p.max != 0 && len(ports)+int(last-first)+1 > p.max {
+			return fmt.Errorf("more than %d ports", p.max)
+		}
+		for n := int(first); n <= int(last); n++ {
+			ports = append(ports, uint16(n))
+		}
+	}
+	*p.ports = ports
+	return nil
+}
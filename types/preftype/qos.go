@@ -0,0 +1,163 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//go:generate go run tailscale.com/cmd/cloner -type=QoSClass -output=preftype_clone.go
+
+// Names of the QoS classes that traffic not in any configured
+// QoSClass goes to. They can't be used as the names of configured
+// classes.
+const (
+	QoSInteractive = "interactive" // flows that haven't sent much recently
+	QoSBulk        = "bulk"        // flows that have been sending steadily
+)
+
+// QoSClass is a class of outbound traffic for prioritization. A
+// packet is in the first configured class that matches it by port or
+// DSCP. Configured classes are sent before all other traffic, in the
+// order they're configured.
+type QoSClass struct {
+	// Name names the class in metrics.
+	Name string
+
+	// Ports are TCP and UDP ports. Packets from or to any of them
+	// are in the class.
+	Ports []uint16 `json:",omitempty"`
+
+	// DSCP are DiffServ code points, from 0 to 63. Packets marked
+	// with any of them are in the class.
+	DSCP []int `json:",omitempty"`
+}
+
+// String returns c in the form ParseQoSClasses accepts, such as
+// "voice:5060+dscp46".
+func (c QoSClass) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.Name)
+	sep := byte(':')
+	for _, port := range c.Ports {
+		sb.WriteByte(sep)
+		sb.WriteString(strconv.Itoa(int(port)))
+		sep = '+'
+	}
+	for _, dscp := range c.DSCP {
+		sb.WriteByte(sep)
+		sb.WriteString("dscp")
+		sb.WriteString(strconv.Itoa(dscp))
+		sep = '+'
+	}
+	return sb.String()
+}
+
+// Equal reports whether c and c2 are the same class.
+func (c QoSClass) Equal(c2 QoSClass) bool {
+	if c.Name != c2.Name || len(c.Ports) != len(c2.Ports) || len(c.DSCP) != len(c2.DSCP) {
+		return false
+	}
+	for i := range c.Ports {
+		if c.Ports[i] != c2.Ports[i] {
+			return false
+		}
+	}
+	for i := range c.DSCP {
+		if c.DSCP[i] != c2.DSCP[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// QoSClassesEqual reports whether a and b are the same classes, in
+// the same order.
+func QoSClassesEqual(a, b []QoSClass) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseQoSClasses parses a comma-separated list of QoS classes, each
+// a name, a colon, and one or more "+"-separated matches: a port
+// number, or "dscp" followed by a DSCP value. For example,
+// "ssh:22,voice:5060+dscp46".
+func ParseQoSClasses(s string) ([]QoSClass, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var cs []QoSClass
+	for _, cstr := range strings.Split(s, ",") {
+		name, matches := cstr, ""
+		if i := strings.IndexByte(cstr, ':'); i >= 0 {
+			name, matches = cstr[:i], cstr[i+1:]
+		}
+		c := QoSClass{Name: name}
+		if matches == "" {
+			return nil, fmt.Errorf("QoS class %q matches no traffic", cstr)
+		}
+		for _, m := range strings.Split(matches, "+") {
+			if v := strings.TrimPrefix(m, "dscp"); v != m {
+				dscp, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("QoS class %q: invalid DSCP %q", name, v)
+				}
+				c.DSCP = append(c.DSCP, dscp)
+				continue
+			}
+			port, err := strconv.ParseUint(m, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("QoS class %q: invalid port %q", name, m)
+			}
+			c.Ports = append(c.Ports, uint16(port))
+		}
+		cs = append(cs, c)
+	}
+	if err := CheckQoSClasses(cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// CheckQoSClasses reports whether cs is a valid list of QoS classes.
+func CheckQoSClasses(cs []QoSClass) error {
+	seen := map[string]bool{}
+	for _, c := range cs {
+		switch {
+		case c.Name == "":
+			return errors.New("QoS class has no name")
+		case c.Name == QoSInteractive || c.Name == QoSBulk:
+			return fmt.Errorf("QoS class name %q is reserved", c.Name)
+		case strings.ContainsAny(c.Name, ":+,"):
+			return fmt.Errorf("QoS class name %q contains one of \":+,\"", c.Name)
+		case seen[c.Name]:
+			return fmt.Errorf("duplicate QoS class %q", c.Name)
+		case len(c.Ports) == 0 && len(c.DSCP) == 0:
+			return fmt.Errorf("QoS class %q matches no traffic", c.Name)
+		}
+		seen[c.Name] = true
+		for _, port := range c.Ports {
+			if port == 0 {
+				return fmt.Errorf("QoS class %q: invalid port 0", c.Name)
+			}
+		}
+		for _, dscp := range c.DSCP {
+			if dscp < 0 || dscp > 63 {
+				return fmt.Errorf("QoS class %q: DSCP %d out of range [0,63]", c.Name, dscp)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQoSClasses(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []QoSClass
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "ssh:22", want: []QoSClass{{Name: "ssh", Ports: []uint16{22}}}},
+		{
+			in: "ssh:22,voice:5060+dscp46",
+			want: []QoSClass{
+				{Name: "ssh", Ports: []uint16{22}},
+				{Name: "voice", Ports: []uint16{5060}, DSCP: []int{46}},
+			},
+		},
+		{in: "ssh", wantErr: true},
+		{in: "ssh:", wantErr: true},
+		{in: ":22", wantErr: true},
+		{in: "ssh:0", wantErr: true},
+		{in: "ssh:65536", wantErr: true},
+		{in: "voice:dscp64", wantErr: true},
+		{in: "voice:dscpx", wantErr: true},
+		{in: "ssh:22,ssh:2222", wantErr: true},
+		{in: "bulk:22", wantErr: true},
+		{in: "interactive:22", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQoSClasses(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseQoSClasses(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQoSClasses(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+		if err != nil || len(got) != 1 {
+			continue
+		}
+		if s := got[0].String(); s != tt.in {
+			t.Errorf("ParseQoSClasses(%q)[0].String() = %q", tt.in, s)
+		}
+	}
+}
@@ -41,10 +41,22 @@ func BenchmarkBatchTCP(b *testing.B) {
 	run(b, setupBatchTCPTest)
 }
 
+// BenchmarkWireGuardTest passes traffic through two userspace engines
+// over UDP on localhost, with magicsock reading and writing UDP
+// packets in batches, and one at a time.
 func BenchmarkWireGuardTest(b *testing.B) {
-	run(b, func(logf logger.Logf, traf *TrafficGen) {
-		setupWGTest(b, logf, traf, Addr1, Addr2)
-	})
+	for _, batchIO := range []bool{true, false} {
+		name := "batch"
+		if !batchIO {
+			name = "nobatch"
+		}
+		batchIO := batchIO
+		b.Run(name, func(b *testing.B) {
+			run(b, func(logf logger.Logf, traf *TrafficGen) {
+				setupWGTest(b, logf, traf, Addr1, Addr2, batchIO)
+			})
+		})
+	}
 }
 
 type SetupFunc func(logger.Logf, *TrafficGen)
@@ -26,7 +26,10 @@ import (
 	"tailscale.com/wgengine/wgcfg"
 )
 
-func setupWGTest(b *testing.B, logf logger.Logf, traf *TrafficGen, a1, a2 netaddr.IPPrefix) {
+// setupWGTest sets up two userspace engines passing traf between
+// them over UDP on localhost, reading and writing UDP packets in
+// batches if batchIO is true.
+func setupWGTest(b *testing.B, logf logger.Logf, traf *TrafficGen, a1, a2 netaddr.IPPrefix, batchIO bool) {
 	l1 := logger.WithPrefix(logf, "e1: ")
 	k1, err := wgkey.NewPrivate()
 	if err != nil {
@@ -42,10 +45,11 @@ func setupWGTest(b *testing.B, logf logger.Logf, traf *TrafficGen, a1, a2 netadd
 		traf: traf,
 	}
 	e1, err := wgengine.NewUserspaceEngine(l1, wgengine.Config{
-		Router:      router.NewFake(l1),
-		LinkMonitor: nil,
-		ListenPort:  0,
-		Tun:         t1,
+		Router:         router.NewFake(l1),
+		LinkMonitor:    nil,
+		ListenPort:     0,
+		Tun:            t1,
+		DisableBatchIO: !batchIO,
 	})
 	if err != nil {
 		log.Fatalf("e1 init: %v", err)
@@ -69,10 +73,11 @@ func setupWGTest(b *testing.B, logf logger.Logf, traf *TrafficGen, a1, a2 netadd
 		traf: traf,
 	}
 	e2, err := wgengine.NewUserspaceEngine(l2, wgengine.Config{
-		Router:      router.NewFake(l2),
-		LinkMonitor: nil,
-		ListenPort:  0,
-		Tun:         t2,
+		Router:         router.NewFake(l2),
+		LinkMonitor:    nil,
+		ListenPort:     0,
+		Tun:            t2,
+		DisableBatchIO: !batchIO,
 	})
 	if err != nil {
 		log.Fatalf("e2 init: %v", err)
@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/logger"
+)
+
+// Batched UDP I/O.
+//
+// wireguard-go's conn.Bind receives one packet per ReceiveFunc call,
+// and sends one per Send call, which costs a syscall per packet when
+// using the socket directly. Where the platform supports it
+// (recvmmsg and sendmmsg on Linux), magicsock batches both on its
+// primary port:
+//
+// The receive funcs read up to udpBatchSize packets per syscall into
+// a batchReader, and hand them out from there one at a time.
+//
+// Sends of WireGuard packets over a direct path are copied to a
+// batchWriter per address family, whose goroutine writes all the
+// packets queued since its last write with one syscall. A lone
+// packet goes out right away; under load, packets queue up while the
+// goroutine is in a syscall, so the batches grow with the load.
+// Disco and DERP packets, sends from extra ports, and sends that
+// also go via DERP are written directly.
+//
+// A batched send can't return the error of its write, which happens
+// later. So that errors still reach wireguard-go, and noV4/noV6 still
+// apply, a failed batch write makes sends go out directly for
+// batchWriteRetryInterval before batching is tried again.
+//
+// Elsewhere, with Options.DisableBatchIO, and for PacketConns that
+// aren't UDP sockets (as in tests), packets are read and written one
+// at a time.
+//
+// tstun.Wrapper still filters packets one at a time: wireguard-go's
+// tun.Device, which it implements, only reads and writes one packet
+// per call, so there's no batch for it to see.
+
+const (
+	// udpBatchSize is the most packets a batchReader reads, or a
+	// batchWriter writes, at once.
+	udpBatchSize = 32
+
+	// udpBatchBufSize is the size of each of a batchReader's packet
+	// buffers. Longer packets are truncated by the kernel and
+	// dropped; it's well above the size of WireGuard packets at any
+	// MTU we use, and of disco messages.
+	udpBatchBufSize = 1 << 14
+)
+
+// debugDisableBatchIO disables batched UDP reads and writes, like
+// Options.DisableBatchIO, for comparing against one packet at a time.
+var debugDisableBatchIO, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_BATCH_IO"))
+
+// batchPacket is a packet read by a batchReader.
+type batchPacket struct {
+	b   []byte // aliases the batchReader's buffers
+	src netaddr.IPPort
+}
+
+// batchReader reads packets from a RebindingUDPConn in batches. It's
+// owned by a single receive func.
+type batchReader struct {
+	disabled bool          // read one packet at a time; set by NewConn
+	queued   []batchPacket // read, but not yet returned
+	sys      batchReaderSys
+}
+
+// readFromNetaddr is like ruc.ReadFromNetaddr, but reads from ruc in
+// batches where possible.
+func (br *batchReader) readFromNetaddr(ruc *RebindingUDPConn, b []byte) (n int, ipp netaddr.IPPort, err error) {
+	for {
+		if len(br.queued) > 0 {
+			p := br.queued[0]
+			br.queued = br.queued[1:]
+			return copy(b, p.b), p.src, nil
+		}
+		pconn := ruc.currentConn()
+		udpConn, ok := pconn.(*net.UDPConn)
+		if !ok || !batchIOSupported || debugDisableBatchIO || br.disabled {
+			return ruc.ReadFromNetaddr(b)
+		}
+		br.queued, err = br.sys.readBatch(udpConn)
+		if err != nil && pconn == ruc.currentConn() {
+			return 0, netaddr.IPPort{}, err
+		}
+		// Loop to return the first packet, or if ruc was rebound,
+		// to read from the new socket.
+	}
+}
+
+// udpWriteQueueLen is how many packets a batchWriter queues before
+// sends block.
+const udpWriteQueueLen = 4 * udpBatchSize
+
+// batchWriteRetryInterval is how long after a failed batch write its
+// batchWriter refuses packets, so that they're written directly.
+const batchWriteRetryInterval = time.Second
+
+// batchOut is a packet queued by a batchWriter.
+type batchOut struct {
+	b   []byte // a copy of the packet
+	dst netaddr.IPPort
+}
+
+var batchOutPool = &sync.Pool{
+	New: func() interface{} { return new(batchOut) },
+}
+
+// batchWriter writes packets to a RebindingUDPConn in batches.
+type batchWriter struct {
+	ruc  *RebindingUDPConn
+	logf logger.Logf
+	done <-chan struct{} // closed when the Conn is
+	ch   chan *batchOut
+	sys  batchWriterSys // owned by run
+
+	failedAt mono.Time // of the last failed batch write; accessed atomically
+}
+
+func newBatchWriter(ruc *RebindingUDPConn, logf logger.Logf, done <-chan struct{}) *batchWriter {
+	w := &batchWriter{
+		ruc:  ruc,
+		logf: logf,
+		done: done,
+		ch:   make(chan *batchOut, udpWriteQueueLen),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues a copy of b to be sent to dst, blocking while the
+// queue is full. It reports false, without queueing b, if w can't
+// write it or a batch write failed within batchWriteRetryInterval, in
+// which case the caller should write it directly.
+func (w *batchWriter) enqueue(b []byte, dst netaddr.IPPort) bool {
+	if len(b) == 0 || dst.IP().Zone() != "" {
+		return false
+	}
+	if t := w.failedAt.LoadAtomic(); !t.IsZero() && mono.Since(t) < batchWriteRetryInterval {
+		return false
+	}
+	if _, ok := w.ruc.currentConn().(*net.UDPConn); !ok {
+		return false
+	}
+	p := batchOutPool.Get().(*batchOut)
+	p.b = append(p.b[:0], b...)
+	p.dst = dst
+	select {
+	case w.ch <- p:
+		return true
+	case <-w.done:
+		batchOutPool.Put(p)
+		return false
+	}
+}
+
+// run writes the packets queued by enqueue, until w.done is closed.
+func (w *batchWriter) run() {
+	pkts := make([]*batchOut, 0, udpBatchSize)
+	for {
+		select {
+		case p := <-w.ch:
+			pkts = append(pkts, p)
+		case <-w.done:
+			return
+		}
+	Fill:
+		for len(pkts) < udpBatchSize {
+			select {
+			case p := <-w.ch:
+				pkts = append(pkts, p)
+			default:
+				break Fill
+			}
+		}
+		w.write(pkts)
+		for i, p := range pkts {
+			batchOutPool.Put(p)
+			pkts[i] = nil
+		}
+		pkts = pkts[:0]
+	}
+}
+
+// write writes pkts to w.ruc. If that fails, it logs the error and
+// makes enqueue refuse packets for a while.
+func (w *batchWriter) write(pkts []*batchOut) {
+	uc, ok := w.ruc.currentConn().(*net.UDPConn)
+	if !ok {
+		// Rebound to a PacketConn that isn't a UDP socket
+		// since the packets were queued.
+		for _, p := range pkts {
+			w.ruc.WriteTo(p.b, p.dst.UDPAddr())
+		}
+		return
+	}
+	if err := w.sys.writeBatch(uc, pkts); err != nil {
+		w.logf("[v1] magicsock: batch write of %d packets: %v; writing directly for %v", len(pkts), err, batchWriteRetryInterval)
+		w.failedAt.StoreAtomic(mono.Now())
+	}
+}
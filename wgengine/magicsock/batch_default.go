@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package magicsock
+
+import "net"
+
+const batchIOSupported = false
+
+type batchReaderSys struct{}
+
+func (*batchReaderSys) readBatch(*net.UDPConn) ([]batchPacket, error) { panic("unreachable") }
+
+type batchWriterSys struct{}
+
+func (*batchWriterSys) writeBatch(*net.UDPConn, []*batchOut) error { panic("unreachable") }
@@ -0,0 +1,260 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+const batchIOSupported = true
+
+// mmsghdr is struct mmsghdr from recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// batchReaderSys is the recvmmsg state of a batchReader.
+type batchReaderSys struct {
+	conn *net.UDPConn    // the socket rc is of
+	rc   syscall.RawConn // of conn
+
+	buf   []byte // udpBatchSize buffers of udpBatchBufSize
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6 // big enough for IPv4 too
+	pkts  []batchPacket
+
+	// readFn does the recvmmsg. It's created once, so reads
+	// don't allocate.
+	readFn func(fd uintptr) bool
+	n      int           // result of the last readFn
+	errno  syscall.Errno // error of the last readFn
+}
+
+func (s *batchReaderSys) init() {
+	s.buf = make([]byte, udpBatchSize*udpBatchBufSize)
+	s.hdrs = make([]mmsghdr, udpBatchSize)
+	s.iovs = make([]unix.Iovec, udpBatchSize)
+	s.names = make([]unix.RawSockaddrInet6, udpBatchSize)
+	s.pkts = make([]batchPacket, 0, udpBatchSize)
+	for i := range s.hdrs {
+		s.iovs[i].Base = &s.buf[i*udpBatchBufSize]
+		s.iovs[i].SetLen(udpBatchBufSize)
+		h := &s.hdrs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		h.Iov = &s.iovs[i]
+		h.SetIovlen(1)
+	}
+	s.readFn = func(fd uintptr) bool {
+		for {
+			r, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(len(s.hdrs)), 0, 0, 0)
+			switch errno {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				// Wait for the socket to be readable.
+				return false
+			}
+			s.n, s.errno = int(r), errno
+			return true
+		}
+	}
+}
+
+// readBatch reads at least one packet from uc, blocking until there
+// is one. The returned packets are valid until the next call.
+func (s *batchReaderSys) readBatch(uc *net.UDPConn) ([]batchPacket, error) {
+	if s.conn != uc {
+		rc, err := uc.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		s.conn, s.rc = uc, rc
+	}
+	if s.readFn == nil {
+		s.init()
+	}
+	for i := range s.hdrs {
+		// Reset what the kernel wrote last time.
+		s.hdrs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		s.hdrs[i].hdr.Flags = 0
+	}
+	if err := s.rc.Read(s.readFn); err != nil {
+		return nil, err
+	}
+	if s.errno != 0 {
+		return nil, os.NewSyscallError("recvmmsg", s.errno)
+	}
+	pkts := s.pkts[:0]
+	for i := 0; i < s.n; i++ {
+		h := &s.hdrs[i]
+		if h.hdr.Flags&unix.MSG_TRUNC != 0 {
+			continue
+		}
+		src, ok := rawSockaddrToIPPort(&s.names[i])
+		if !ok {
+			continue
+		}
+		pkts = append(pkts, batchPacket{
+			b:   s.buf[i*udpBatchBufSize:][:h.len],
+			src: src,
+		})
+	}
+	return pkts, nil
+}
+
+// batchWriterSys is the sendmmsg state of a batchWriter.
+type batchWriterSys struct {
+	conn *net.UDPConn    // the socket rc is of
+	rc   syscall.RawConn // of conn
+
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6 // big enough for IPv4 too
+
+	// writeFn does the sendmmsg of hdrs[off:end]. It's created
+	// once, so writes don't allocate.
+	writeFn  func(fd uintptr) bool
+	off, end int
+	n        int           // result of the last writeFn
+	errno    syscall.Errno // error of the last writeFn
+}
+
+func (s *batchWriterSys) init() {
+	s.hdrs = make([]mmsghdr, udpBatchSize)
+	s.iovs = make([]unix.Iovec, udpBatchSize)
+	s.names = make([]unix.RawSockaddrInet6, udpBatchSize)
+	for i := range s.hdrs {
+		h := &s.hdrs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		h.Iov = &s.iovs[i]
+		h.SetIovlen(1)
+	}
+	s.writeFn = func(fd uintptr) bool {
+		for {
+			r, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[s.off])), uintptr(s.end-s.off), 0, 0, 0)
+			switch errno {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				// Wait for the socket to be writable.
+				return false
+			}
+			s.n, s.errno = int(r), errno
+			return true
+		}
+	}
+}
+
+// writeBatch writes pkts, at most udpBatchSize of them, to uc,
+// blocking until they're all written or failed. It returns the
+// first error, if any; packets after a failed one are still sent.
+func (s *batchWriterSys) writeBatch(uc *net.UDPConn, pkts []*batchOut) error {
+	if s.conn != uc {
+		rc, err := uc.SyscallConn()
+		if err != nil {
+			return err
+		}
+		s.conn, s.rc = uc, rc
+	}
+	if s.writeFn == nil {
+		s.init()
+	}
+	for i, p := range pkts {
+		s.iovs[i].Base = &p.b[0]
+		s.iovs[i].SetLen(len(p.b))
+		s.hdrs[i].hdr.Namelen = ipPortToRawSockaddr(&s.names[i], p.dst)
+	}
+	var firstErr error
+	for s.off, s.end = 0, len(pkts); s.off < s.end; {
+		if err := s.rc.Write(s.writeFn); err != nil {
+			return err
+		}
+		if s.errno != 0 {
+			// sendmmsg only fails if it sent nothing, so the
+			// packet at s.off is the bad one. Skip it.
+			if firstErr == nil {
+				firstErr = os.NewSyscallError("sendmmsg", s.errno)
+			}
+			s.off++
+			continue
+		}
+		s.off += s.n
+	}
+	for i := range pkts {
+		// Don't keep the packets alive.
+		s.iovs[i].Base = nil
+	}
+	return firstErr
+}
+
+// ipPortToRawSockaddr writes ipp, which has no zone, to sa, as a
+// RawSockaddrInet4 if it's an IPv4 address, and returns the length of
+// what it wrote.
+func ipPortToRawSockaddr(sa *unix.RawSockaddrInet6, ipp netaddr.IPPort) uint32 {
+	ip := ipp.IP()
+	if ip.Is4() {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = unix.RawSockaddrInet4{
+			Family: unix.AF_INET,
+			Port:   htons(ipp.Port()),
+			Addr:   ip.As4(),
+		}
+		return unix.SizeofSockaddrInet4
+	}
+	*sa = unix.RawSockaddrInet6{
+		Family: unix.AF_INET6,
+		Port:   htons(ipp.Port()),
+		Addr:   ip.As16(),
+	}
+	return unix.SizeofSockaddrInet6
+}
+
+// rawSockaddrToIPPort returns the address in sa, which is a
+// RawSockaddrInet6 or, per its Family, a RawSockaddrInet4.
+func rawSockaddrToIPPort(sa *unix.RawSockaddrInet6) (ipp netaddr.IPPort, ok bool) {
+	switch sa.Family {
+	case unix.AF_INET:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		a := sa4.Addr
+		return netaddr.IPPortFrom(netaddr.IPv4(a[0], a[1], a[2], a[3]), ntohs(sa4.Port)), true
+	case unix.AF_INET6:
+		ip := netaddr.IPFrom16(sa.Addr).Unmap()
+		if sa.Scope_id != 0 {
+			ip = ip.WithZone(zoneName(sa.Scope_id))
+		}
+		return netaddr.IPPortFrom(ip, ntohs(sa.Port)), true
+	}
+	return netaddr.IPPort{}, false
+}
+
+// ntohs returns the value of port, which is in network byte order.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// htons returns port in network byte order.
+func htons(port uint16) uint16 {
+	// Swapping bytes is its own inverse.
+	return ntohs(port)
+}
+
+// zoneName returns the name of the interface with index idx, as
+// package net names IPv6 zones.
+func zoneName(idx uint32) string {
+	if ifi, err := net.InterfaceByIndex(int(idx)); err == nil {
+		return ifi.Name
+	}
+	return strconv.FormatUint(uint64(idx), 10)
+}
@@ -159,7 +159,7 @@ func (c *Conn) sendAddrSet(b []byte, as *addrSet) error {
 	var success bool
 	var ret error
 	for _, addr := range dsts {
-		sent, err := c.sendAddr(addr, as.publicKey, b)
+		sent, err := c.sendAddr(primarySock, addr, as.publicKey, b)
 		if sent {
 			success = true
 		} else if ret == nil {
@@ -86,6 +86,13 @@ var (
 	debugReSTUNStopOnIdle, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_RESTUN_STOP_ON_IDLE"))
 	// debugAlwaysDERP disables the use of UDP, forcing all peer communication over DERP.
 	debugAlwaysDERP, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_ALWAYS_USE_DERP"))
+	// debugHardNATSpray enables the experimental traversal of hard
+	// (endpoint-dependent) NATs on both sides by predicting their
+	// port allocations and spraying disco pings at the predictions.
+	debugHardNATSpray, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_HARD_NAT_SPRAY"))
+	// debugDisablePMTU disables path MTU probing, leaving all path
+	// MTUs unknown.
+	debugDisablePMTU, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_PMTU"))
 )
 
 // useDerpRoute reports whether magicsock should enable the DERP
@@ -157,6 +164,10 @@ type Conn struct {
 	// TODO(danderson): now that we have global rate-limiting, is this still useful?
 	sendLogLimit *rate.Limiter
 
+	// sprayLimit is the rate budget for the disco pings sprayed at
+	// peers' predicted hard NAT ports, shared by all peers.
+	sprayLimit *rate.Limiter
+
 	// stunReceiveFunc holds the current STUN packet processing func.
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
@@ -172,6 +183,19 @@ type Conn struct {
 	// hot flows.
 	ippEndpoint4, ippEndpoint6 ippEndpointCache
 
+	// batch4 and batch6 are likewise owned by receiveIPv4 and
+	// receiveIPv6, to read packets in batches where possible.
+	batch4, batch6 batchReader
+
+	// batchOut4 and batchOut6 write WireGuard packets to pconn4 and
+	// pconn6 in batches. They're nil if batched I/O is unsupported
+	// or disabled, or, for batchOut6, if there's no pconn6.
+	batchOut4, batchOut6 *batchWriter
+
+	// extraSocks are the sockets of opts.ExtraPorts. The slice is
+	// immutable after NewConn.
+	extraSocks []*extraSock
+
 	// ============================================================
 	// Fields that must be accessed via atomic load/stores.
 
@@ -193,6 +217,13 @@ type Conn struct {
 	// port is the preferred port from opts.Port; 0 means auto.
 	port syncs.AtomicUint32
 
+	// minPathMTU is the smallest of pathMTUs, or zero if it's empty.
+	minPathMTU syncs.AtomicUint32
+	// pmtuMu guards pathMTUs, the known path MTUs of endpoints. It
+	// may be acquired with discoEndpoint.mu held.
+	pmtuMu   sync.Mutex
+	pathMTUs map[*discoEndpoint]int
+
 	// ============================================================
 	// mu guards all following fields; see userspaceEngine lock ordering rules
 	mu     sync.Mutex
@@ -232,6 +263,33 @@ type Conn struct {
 	// even if there was no change.
 	lastEndpointsTime time.Time
 
+	// staticEndpoints are the explicitly configured endpoints to
+	// advertise in addition to the discovered ones.
+	staticEndpoints []netaddr.IPPort
+
+	// hardNATSpray is whether hard NAT traversal by port
+	// prediction is enabled. See debugHardNATSpray.
+	hardNATSpray bool
+
+	// portPrediction, if non-nil, is where our NAT probably maps
+	// our packets to new destinations, from the last netcheck.
+	// It's only set if our NAT's mappings vary by destination but
+	// its ports look sequentially allocated.
+	portPrediction *disco.PortPrediction
+
+	// peerRelay is whether we relay UDP for other tailnet nodes.
+	// See peerrelay.go.
+	peerRelay bool
+
+	// relayPort and relayByPort map peers offering to relay for us
+	// to and from the port of their fake peerRelayMagicIP address,
+	// and relayAddrs are those addresses, in network map order.
+	// lastRelayPort is the last port handed out.
+	relayPort     map[tailcfg.NodeKey]uint16
+	relayByPort   map[uint16]peerRelay
+	relayAddrs    []netaddr.IPPort
+	lastRelayPort uint16
+
 	// onEndpointRefreshed are funcs to run (in their own goroutines)
 	// when endpoints are refreshed.
 	onEndpointRefreshed map[*discoEndpoint]func()
@@ -385,6 +443,12 @@ type Options struct {
 	// Zero means to pick one automatically.
 	Port uint16
 
+	// ExtraPorts are more local ports to listen on, besides Port.
+	// Peers are told about endpoints on each, and discovery picks
+	// the best pair of local port and peer endpoint to use. There
+	// may be at most MaxExtraPorts.
+	ExtraPorts []uint16
+
 	// EndpointsFunc optionally provides a func to be called when
 	// endpoints change. The called func does not own the slice.
 	EndpointsFunc func([]tailcfg.Endpoint)
@@ -401,6 +465,10 @@ type Options struct {
 	// It's meant for testing.
 	PacketListener nettype.PacketListener
 
+	// DisableBatchIO disables reading and writing UDP packets in
+	// batches, for comparing against one packet at a time.
+	DisableBatchIO bool
+
 	// NoteRecvActivity, if provided, is a func for magicsock to
 	// call whenever it receives a packet from a a
 	// discovery-capable peer if it's been more than ~10 seconds
@@ -458,6 +526,8 @@ func newConn() *Conn {
 	c := &Conn{
 		disableLegacy:   true,
 		sendLogLimit:    rate.NewLimiter(rate.Every(1*time.Minute), 1),
+		sprayLimit:      rate.NewLimiter(hardNATSprayRate, hardNATSprayBurst),
+		hardNATSpray:    debugHardNATSpray,
 		addrsByUDP:      make(map[netaddr.IPPort]*addrSet),
 		addrsByKey:      make(map[key.Public]*addrSet),
 		derpRecvCh:      make(chan derpReadResult),
@@ -481,6 +551,10 @@ func newConn() *Conn {
 func NewConn(opts Options) (*Conn, error) {
 	c := newConn()
 	c.port.Set(uint32(opts.Port))
+	if len(opts.ExtraPorts) > MaxExtraPorts {
+		return nil, fmt.Errorf("%d extra ports; at most %d are allowed", len(opts.ExtraPorts), MaxExtraPorts)
+	}
+	c.extraSocks = newExtraSocks(opts.Port, opts.ExtraPorts)
 	c.logf = opts.logf()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
@@ -500,6 +574,14 @@ func NewConn(opts Options) (*Conn, error) {
 
 	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
 	c.donec = c.connCtx.Done()
+	c.batch4.disabled = opts.DisableBatchIO
+	c.batch6.disabled = opts.DisableBatchIO
+	if batchIOSupported && !opts.DisableBatchIO && !debugDisableBatchIO {
+		c.batchOut4 = newBatchWriter(c.pconn4, c.logf, c.donec)
+		if c.pconn6 != nil {
+			c.batchOut6 = newBatchWriter(c.pconn6, c.logf, c.donec)
+		}
+	}
 	c.netChecker = &netcheck.Client{
 		Logf:                logger.WithPrefix(c.logf, "netcheck: "),
 		GetSTUNConn4:        func() netcheck.STUNConn { return c.pconn4 },
@@ -678,6 +760,19 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
 
+	var pp *disco.PortPrediction
+	if report.MappingVariesByDestIP.EqualBool(true) && report.MappingPortDelta != 0 {
+		if ipp, err := netaddr.ParseIPPort(report.GlobalV4); err == nil {
+			pp = &disco.PortPrediction{
+				Last:  netaddr.IPPortFrom(ipp.IP(), report.MappingLastPort),
+				Delta: int16(report.MappingPortDelta),
+			}
+		}
+	}
+	c.mu.Lock()
+	c.portPrediction = pp
+	c.mu.Unlock()
+
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
 		MappingVariesByDestIP: report.MappingVariesByDestIP,
@@ -887,6 +982,10 @@ func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnst
 // c.mu must be held
 func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netaddr.IPPort) {
 	res.LatencySeconds = latency.Seconds()
+	if name := c.peerRelayNameLocked(ep); name != "" {
+		res.PeerRelay = name
+		return
+	}
 	if ep.IP() != derpMagicIPAddr {
 		res.Endpoint = ep.String()
 		return
@@ -1007,6 +1106,15 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		}
 	}
 
+	// Explicitly configured endpoints go first: the user knows
+	// better than our guesses.
+	c.mu.Lock()
+	staticEndpoints := c.staticEndpoints
+	c.mu.Unlock()
+	for _, ep := range staticEndpoints {
+		addAddr(ep, tailcfg.EndpointExplicitConf)
+	}
+
 	// If we didn't have a portmap earlier, maybe it's done by now.
 	if !havePortmap {
 		portmapExt, havePortmap = c.portMapper.GetCachedMappingOrStartCreatingOne()
@@ -1034,6 +1142,13 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		addAddr(ipp(nr.GlobalV6), tailcfg.EndpointSTUN)
 	}
 
+	// Our extra ports, as STUN saw them after the last round. Ask
+	// again for the next one.
+	for _, ep := range c.extraSTUNEndpoints() {
+		addAddr(ep, tailcfg.EndpointSTUN)
+	}
+	c.stunExtraSockets(nr.PreferredDERP)
+
 	c.ignoreSTUNPackets()
 
 	if localAddr := c.pconn4.LocalAddr(); localAddr.IP.IsUnspecified() {
@@ -1051,11 +1166,19 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		}
 		for _, ip := range ips {
 			addAddr(netaddr.IPPortFrom(ip, uint16(localAddr.Port)), tailcfg.EndpointLocal)
+			for _, port := range c.boundExtraPorts() {
+				addAddr(netaddr.IPPortFrom(ip, port), tailcfg.EndpointLocal)
+			}
 		}
 	} else {
 		// Our local endpoint is bound to a particular address.
 		// Do not offer addresses on other local interfaces.
 		addAddr(ipp(localAddr.String()), tailcfg.EndpointLocal)
+		if ip, ok := netaddr.FromStdIP(localAddr.IP); ok {
+			for _, port := range c.boundExtraPorts() {
+				addAddr(netaddr.IPPortFrom(ip, port), tailcfg.EndpointLocal)
+			}
+		}
 	}
 
 	// Note: the endpoints are intentionally returned in priority order,
@@ -1065,8 +1188,10 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 	// Local interface addresses might have lower latency, but not be
 	// globally addressable.
 	//
-	// The STUN address(es) are always first so that legacy wireguard
-	// can use eps[0] as its only known endpoint address (although that's
+	// Explicitly configured endpoints come before even the STUN
+	// address(es): the user knows they're reachable. Either way,
+	// eps[0] is a globally addressable endpoint for legacy wireguard
+	// to use as its only known endpoint address (although that's
 	// obviously non-ideal).
 	//
 	// Despite this sorting, though, clients since 0.100 haven't relied
@@ -1139,29 +1264,52 @@ var udpAddrPool = &sync.Pool{
 	New: func() interface{} { return new(net.UDPAddr) },
 }
 
-// sendUDP sends UDP packet b to ipp.
+// sendUDP sends UDP packet b to ipp from the primary port.
 // See sendAddr's docs on the return value meanings.
 func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
+	return c.sendUDPFrom(primarySock, ipp, b)
+}
+
+// sendUDPBatched queues WireGuard packet b to be sent to ipp from the
+// primary port in a batch, if possible, and reports whether it did.
+// The batch write's errors are only logged, but after one fails,
+// sendUDPBatched reports false for a while, so that sends go through
+// sendAddr and return their errors.
+func (c *Conn) sendUDPBatched(ipp netaddr.IPPort, b []byte) bool {
+	if ipp.IsZero() || ipp.IP() == derpMagicIPAddr || ipp.IP() == peerRelayMagicIPAddr {
+		return false
+	}
+	w := c.batchOut6
+	if ipp.IP().Is4() {
+		w = c.batchOut4
+	}
+	return w != nil && w.enqueue(b, ipp)
+}
+
+// sendUDPFrom sends UDP packet b to ipp from the local socket sock.
+// See sendAddr's docs on the return value meanings.
+func (c *Conn) sendUDPFrom(sock int, ipp netaddr.IPPort, b []byte) (sent bool, err error) {
 	ua := udpAddrPool.Get().(*net.UDPAddr)
 	defer udpAddrPool.Put(ua)
-	return c.sendUDPStd(ipp.UDPAddrAt(ua), b)
+	return c.sendUDPStd(sock, ipp.UDPAddrAt(ua), b)
 }
 
-// sendUDP sends UDP packet b to addr.
+// sendUDP sends UDP packet b to addr from the local socket sock.
 // See sendAddr's docs on the return value meanings.
-func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
+func (c *Conn) sendUDPStd(sock int, addr *net.UDPAddr, b []byte) (sent bool, err error) {
+	pconn4, pconn6 := c.socketsOf(sock)
 	switch {
 	case addr.IP.To4() != nil:
-		_, err = c.pconn4.WriteTo(b, addr)
+		_, err = pconn4.WriteTo(b, addr)
 		if err != nil && c.noV4.Get() {
 			return false, nil
 		}
 	case len(addr.IP) == net.IPv6len:
-		if c.pconn6 == nil {
+		if pconn6 == nil {
 			// ignore IPv6 dest if we don't have an IPv6 address.
 			return false, nil
 		}
-		_, err = c.pconn6.WriteTo(b, addr)
+		_, err = pconn6.WriteTo(b, addr)
 		if err != nil && c.noV6.Get() {
 			return false, nil
 		}
@@ -1172,8 +1320,10 @@ func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 }
 
 // sendAddr sends packet b to addr, which is either a real UDP address
-// or a fake UDP address representing a DERP server (see derpmap.go).
+// or a fake UDP address representing a DERP server (see derpmap.go)
+// or a peer relay (see peerrelay.go).
 // The provided public key identifies the recipient.
+// UDP packets are sent from the local socket sock.
 //
 // The returned err is whether there was an error writing when it
 // should've worked.
@@ -1181,9 +1331,12 @@ func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 // An example of when they might be different: sending to an
 // IPv6 address when the local machine doesn't have IPv6 support
 // returns (false, nil); it's not an error, but nothing was sent.
-func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (sent bool, err error) {
+func (c *Conn) sendAddr(sock int, addr netaddr.IPPort, pubKey key.Public, b []byte) (sent bool, err error) {
+	if addr.IP() == peerRelayMagicIPAddr {
+		return c.sendPeerRelay(addr, pubKey, b)
+	}
 	if addr.IP() != derpMagicIPAddr {
-		return c.sendUDP(addr, b)
+		return c.sendUDPFrom(sock, addr, b)
 	}
 
 	ch := c.derpWriteChanOfAddr(addr, pubKey)
@@ -1594,11 +1747,11 @@ func (c *Conn) receiveIPv6(b []byte) (int, conn.Endpoint, error) {
 	health.ReceiveIPv6.Enter()
 	defer health.ReceiveIPv6.Exit()
 	for {
-		n, ipp, err := c.pconn6.ReadFromNetaddr(b)
+		n, ipp, err := c.batch6.readFromNetaddr(c.pconn6, b)
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6); ok {
+		if n, ep, ok := c.receiveIP(b[:n], ipp, primarySock, &c.ippEndpoint6); ok {
 			return n, ep, nil
 		}
 	}
@@ -1609,40 +1762,52 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 	health.ReceiveIPv4.Enter()
 	defer health.ReceiveIPv4.Exit()
 	for {
-		n, ipp, err := c.pconn4.ReadFromNetaddr(b)
+		n, ipp, err := c.batch4.readFromNetaddr(c.pconn4, b)
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4); ok {
+		if n, ep, ok := c.receiveIP(b[:n], ipp, primarySock, &c.ippEndpoint4); ok {
 			return n, ep, nil
 		}
 	}
 }
 
-// receiveIP is the shared bits of ReceiveIPv4 and ReceiveIPv6.
+// receiveIP is the shared bits of ReceiveIPv4 and ReceiveIPv6, and
+// the receive funcs of the extra ports. The packet arrived on the
+// local socket sock.
 //
 // ok is whether this read should be reported up to wireguard-go (our
-// caller).
-func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache) (ep conn.Endpoint, ok bool) {
+// caller), in which case n is the length of the packet at the start of
+// b to report. It's only different from len(b) for packets that came
+// through a peer relay.
+func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, sock int, cache *ippEndpointCache) (n int, ep conn.Endpoint, ok bool) {
 	if stun.Is(b) {
-		c.stunReceiveFunc.Load().(func([]byte, netaddr.IPPort))(b, ipp)
-		return nil, false
+		if sock == primarySock {
+			c.stunReceiveFunc.Load().(func([]byte, netaddr.IPPort))(b, ipp)
+		} else {
+			c.handleExtraSTUN(b, sock)
+		}
+		return 0, nil, false
+	}
+	if c.handleDiscoMessage(b, ipp, sock) {
+		return 0, nil, false
 	}
-	if c.handleDiscoMessage(b, ipp) {
-		return nil, false
+	if _, _, _, isRelay := parseRelayFrame(b); isRelay {
+		n, ep = c.receivePeerRelay(b, ipp)
+		return n, ep, n > 0
 	}
 	if !c.havePrivateKey.Get() {
 		// If we have no private key, we're logged out or
 		// stopped. Don't try to pass these wireguard packets
 		// up to wireguard-go; it'll just complain (issue 1167).
-		return nil, false
+		return 0, nil, false
 	}
 	if cache.ipp == ipp && cache.de != nil && cache.gen == cache.de.numStopAndReset() {
 		ep = cache.de
 	} else {
 		ep = c.findEndpoint(ipp, b)
 		if ep == nil {
-			return nil, false
+			return 0, nil, false
 		}
 		if de, ok := ep.(*discoEndpoint); ok {
 			cache.ipp = ipp
@@ -1651,7 +1816,7 @@ func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache)
 		}
 	}
 	c.noteRecvActivityFromEndpoint(ep)
-	return ep, true
+	return len(b), ep, true
 }
 
 // receiveDERP reads a packet from c.derpRecvCh into b and returns the associated endpoint.
@@ -1690,7 +1855,7 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep con
 	}
 
 	ipp := netaddr.IPPortFrom(derpMagicIPAddr, uint16(regionID))
-	if c.handleDiscoMessage(b[:n], ipp) {
+	if c.handleDiscoMessage(b[:n], ipp, primarySock) {
 		return 0, nil
 	}
 
@@ -1755,7 +1920,9 @@ const (
 	discoVerboseLog
 )
 
-func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
+// sendDiscoMessage sends m to dst, from the local socket sock if dst
+// is a UDP address.
+func (c *Conn) sendDiscoMessage(sock int, dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
@@ -1773,7 +1940,7 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 	c.mu.Unlock()
 
 	pkt = box.SealAfterPrecomputation(pkt, m.AppendMarshal(nil), &nonce, sharedKey)
-	sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
+	sent, err = c.sendAddr(sock, dst, key.Public(dstKey), pkt)
 	if sent {
 		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
 			c.logf("[v1] magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), derpStr(dst.String()), disco.MessageSummary(m))
@@ -1800,7 +1967,9 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 //
 // For messages received over DERP, the addr will be derpMagicIP (with
 // port being the region)
-func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bool) {
+//
+// sock is the local socket that msg arrived on, for replies.
+func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, sock int) (isDiscoMsg bool) {
 	const headerLen = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen
 	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
 		return false
@@ -1928,7 +2097,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 
 	switch dm := dm.(type) {
 	case *disco.Ping:
-		c.handlePingLocked(dm, de, src, sender, peerNode)
+		c.handlePingLocked(dm, de, src, sock, sender, peerNode)
 	case *disco.Pong:
 		if de == nil {
 			return
@@ -1947,11 +2116,23 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 				len(dm.MyNumber))
 			go de.handleCallMeMaybe(dm)
 		}
+	case *disco.PortPrediction:
+		if src.IP() != derpMagicIPAddr {
+			c.logf("[unexpected] PortPrediction packets should only come via DERP")
+			return
+		}
+		if de != nil && c.hardNATSpray {
+			c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got port prediction %v%+d",
+				c.discoShort, de.discoShort,
+				de.publicKey.ShortString(), derpStr(src.String()),
+				dm.Last, dm.Delta)
+			go de.handlePortPrediction(dm)
+		}
 	}
 	return
 }
 
-func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.IPPort, sender tailcfg.DiscoKey, peerNode *tailcfg.Node) {
+func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.IPPort, sock int, sender tailcfg.DiscoKey, peerNode *tailcfg.Node) {
 	if peerNode == nil {
 		c.logf("magicsock: disco: [unexpected] ignoring ping from unknown peer Node")
 		return
@@ -1963,13 +2144,19 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.I
 		c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got ping tx=%x", c.discoShort, de.discoShort, peerNode.Key.ShortString(), src, dm.TxID[:6])
 	}
 
-	// Remember this route if not present.
-	c.setAddrToDiscoLocked(src, sender, nil)
+	// Remember this route if not present. Peer relay addresses
+	// are shared by all the peers behind the relay, so they don't
+	// identify the sender.
+	if src.IP() != peerRelayMagicIPAddr {
+		c.setAddrToDiscoLocked(src, sender, nil)
+	}
 	de.addCandidateEndpoint(src)
 
 	ipDst := src
 	discoDest := sender
-	go c.sendDiscoMessage(ipDst, peerNode.Key, discoDest, &disco.Pong{
+	// Reply from the port the ping came in on, as that's the one the
+	// peer's path (and any firewall on it) lets through.
+	go c.sendDiscoMessage(sock, ipDst, peerNode.Key, discoDest, &disco.Pong{
 		TxID: dm.TxID,
 		Src:  src,
 	}, discoVerboseLog)
@@ -2011,7 +2198,19 @@ func (c *Conn) enqueueCallMeMaybe(derpAddr netaddr.IPPort, de *discoEndpoint) {
 	for _, ep := range c.lastEndpoints {
 		eps = append(eps, ep.Addr)
 	}
-	go de.sendDiscoMessage(derpAddr, &disco.CallMeMaybe{MyNumber: eps}, discoLog)
+	var pp *disco.PortPrediction
+	if c.hardNATSpray && c.portPrediction != nil {
+		// Our NAT is hard, so the peer's pings to eps likely
+		// won't get through. Tell it where our NAT probably
+		// mapped our pings to it, too.
+		pp = c.portPrediction
+	}
+	go func() {
+		de.sendDiscoMessage(primarySock, derpAddr, &disco.CallMeMaybe{MyNumber: eps}, discoLog)
+		if pp != nil {
+			de.sendDiscoMessage(primarySock, derpAddr, pp, discoLog)
+		}
+	}()
 }
 
 // setAddrToDiscoLocked records that newk is at src.
@@ -2245,6 +2444,10 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 		return
 	}
 
+	// Update the peer relays first, as they're candidate
+	// endpoints of the other peers.
+	c.updatePeerRelaysLocked(nm.Peers)
+
 	numDisco := 0
 	for _, n := range nm.Peers {
 		if n.DiscoKey.IsZero() {
@@ -2443,6 +2646,7 @@ func (c *connBind) Open(ignoredPort uint16) ([]conn.ReceiveFunc, uint16, error)
 	fns := []conn.ReceiveFunc{c.receiveIPv4, c.receiveIPv6, c.receiveDERP}
 	// TODO: Combine receiveIPv4 and receiveIPv6 and receiveIP into a single
 	// closure that closes over a *RebindingUDPConn?
+	fns = append(fns, c.extraReceiveFuncs()...)
 	return fns, c.LocalPort(), nil
 }
 
@@ -2463,6 +2667,7 @@ func (c *connBind) Close() error {
 	// Unblock all outstanding receives.
 	c.pconn4.Close()
 	c.pconn6.Close()
+	c.closeExtraSockets()
 	// Send an empty read result to unblock receiveDERP,
 	// which will then check connBind.Closed.
 	c.derpRecvCh <- derpReadResult{}
@@ -2504,6 +2709,7 @@ func (c *Conn) Close() error {
 		c.pconn6.Close()
 	}
 	c.pconn4.Close()
+	c.closeExtraSockets()
 
 	// Wait on goroutines updating right at the end, once everything is
 	// already closed. We want everything else in the Conn to be
@@ -2572,6 +2778,37 @@ func (c *Conn) shouldDoPeriodicReSTUNLocked() bool {
 
 func (c *Conn) onPortMapChanged() { c.ReSTUN("portmap-changed") }
 
+// SetStaticEndpoints sets endpoints to advertise in addition to the
+// discovered ones, such as the public side of manually configured
+// port forwards that STUN can't see. If they changed, it starts an
+// endpoint update.
+func (c *Conn) SetStaticEndpoints(eps []netaddr.IPPort) {
+	c.mu.Lock()
+	if ipPortsEqual(c.staticEndpoints, eps) {
+		c.mu.Unlock()
+		return
+	}
+	c.staticEndpoints = append([]netaddr.IPPort(nil), eps...)
+	started := c.started
+	c.mu.Unlock()
+
+	if started {
+		c.ReSTUN("static-endpoint-change")
+	}
+}
+
+func ipPortsEqual(a, b []netaddr.IPPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // ReSTUN triggers an address discovery.
 // The provided why string is for debug logging only.
 func (c *Conn) ReSTUN(why string) {
@@ -2619,6 +2856,7 @@ func (c *Conn) initialBind() error {
 	if err := c.bindSocket(&c.pconn6, "udp6", keepCurrentPort); err != nil {
 		c.logf("magicsock: ignoring IPv6 bind failure: %v", err)
 	}
+	c.bindExtraSockets()
 	return nil
 }
 
@@ -2646,17 +2884,7 @@ func (c *Conn) listenPacket(network string, host netaddr.IP, port uint16) (net.P
 // If curPortFate is set to dropCurrentPort, no attempt is made to reuse
 // the current port.
 func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate currentPortFate) error {
-	var host netaddr.IP
-	if inTest() && !c.simulatedNetwork {
-		switch network {
-		case "udp4":
-			host = netaddr.MustParseIP("127.0.0.1")
-		case "udp6":
-			host = netaddr.MustParseIP("::1")
-		default:
-			panic("unrecognized network in bindSocket: " + network)
-		}
-	}
+	host := c.bindHost(network)
 
 	if *rucPtr == nil {
 		*rucPtr = new(RebindingUDPConn)
@@ -2722,6 +2950,22 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	return fmt.Errorf("failed to bind any ports (tried %v)", ports)
 }
 
+// bindHost returns the local address to bind sockets of network
+// ("udp4" or "udp6") to; the zero IP means unspecified.
+func (c *Conn) bindHost(network string) netaddr.IP {
+	if inTest() && !c.simulatedNetwork {
+		switch network {
+		case "udp4":
+			return netaddr.MustParseIP("127.0.0.1")
+		case "udp6":
+			return netaddr.MustParseIP("::1")
+		default:
+			panic("unrecognized network in bindSocket: " + network)
+		}
+	}
+	return netaddr.IP{}
+}
+
 type currentPortFate uint8
 
 const (
@@ -2739,6 +2983,7 @@ func (c *Conn) rebind(curPortFate currentPortFate) error {
 	if err := c.bindSocket(&c.pconn6, "udp6", curPortFate); err != nil {
 		c.logf("magicsock: Rebind ignoring IPv6 bind failure: %v", err)
 	}
+	c.bindExtraSockets()
 	return nil
 }
 
@@ -3148,11 +3393,18 @@ type discoEndpoint struct {
 	heartBeatTimer *time.Timer    // nil when idle
 	lastSend       mono.Time      // last time there was outgoing packets sent to this peer (from wireguard-go)
 	lastFullPing   mono.Time      // last time we pinged all endpoints
+	lastSpray      mono.Time      // last time we sprayed pings at predicted hard NAT ports
 	derpAddr       netaddr.IPPort // fallback/bootstrap path, if non-zero (non-zero for well-behaved clients)
 
-	bestAddr           addrLatency // best non-DERP path; zero if none
-	bestAddrAt         mono.Time   // time best address re-confirmed
-	trustBestAddrUntil mono.Time   // time when bestAddr expires
+	bestAddr           addrLatency    // best non-DERP path; zero if none
+	bestAddrAt         mono.Time      // time best address re-confirmed
+	trustBestAddrUntil mono.Time      // time when bestAddr expires
+	pathMTU            int            // path MTU of bestAddr; zero if unknown
+	lastPMTUProbe      mono.Time      // last time we probed bestAddr's path MTU
+	pmtuPending        int            // probes of the latest round not yet answered or timed out
+	pmtuRoundMax       int            // biggest probe of the latest round that got a pong
+	lastPath           netaddr.IPPort // path last recorded in pathHistory
+	pathHistory        []pathChange   // recent path changes, oldest first
 	sentPing           map[stun.TxID]sentPing
 	endpointState      map[netaddr.IPPort]*endpointState
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
@@ -3210,6 +3462,19 @@ const (
 	// STUN-derived endpoint valid for. UDP NAT mappings typically
 	// expire at 30 seconds, so this is a few seconds shy of that.
 	endpointsFreshEnoughDuration = 27 * time.Second
+
+	// hardNATSprayPorts is how many of a peer's predicted hard NAT
+	// ports we ping per spray.
+	hardNATSprayPorts = 64
+
+	// hardNATSprayInterval is the minimum time between sprays to
+	// the same peer.
+	hardNATSprayInterval = 10 * time.Second
+
+	// hardNATSprayRate and hardNATSprayBurst are the rate budget
+	// for spray pings, across all peers.
+	hardNATSprayRate  = rate.Limit(200) // per second
+	hardNATSprayBurst = 16
 )
 
 // endpointState is some state and history for a specific endpoint of
@@ -3234,6 +3499,9 @@ type endpointState struct {
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
+	lostPings uint64 // bit set per recent ping that got no pong, newest in bit 0
+	numPings  uint8  // number of pings in lostPings, up to 64
+
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
 }
 
@@ -3256,10 +3524,12 @@ func (st *endpointState) shouldDeleteLocked() bool {
 }
 
 func (de *discoEndpoint) deleteEndpointLocked(ep netaddr.IPPort) {
-	delete(de.endpointState, ep)
 	if de.bestAddr.IPPort == ep {
 		de.bestAddr = addrLatency{}
+		de.resetPMTULocked()
+		de.notePathLocked(de.derpAddr, pathReasonEndpointRemoved)
 	}
+	delete(de.endpointState, ep)
 }
 
 // pongHistoryCount is how many pongReply values we keep per endpointState
@@ -3274,9 +3544,11 @@ type pongReply struct {
 
 type sentPing struct {
 	to      netaddr.IPPort
+	sock    int // local socket sent from
 	at      mono.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
+	size    int // for pingPMTU, the path MTU probed for
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -3352,10 +3624,19 @@ func (de *discoEndpoint) heartbeat() {
 	}
 
 	now := mono.Now()
+	reason := pathReasonTimeout
+	if de.lastPath.IsZero() {
+		reason = pathReasonStart
+	}
+	de.notePathLocked(de.curPathLocked(now), reason)
+
 	udpAddr, _ := de.addrForSendLocked(now)
 	if !udpAddr.IsZero() {
 		// We have a preferred path. Ping that every 2 seconds.
-		de.startPingLocked(udpAddr, now, pingHeartbeat)
+		de.startPingLocked(de.bestAddr.sock, udpAddr, now, pingHeartbeat, 0)
+	}
+	if de.wantPMTUProbeLocked(now) {
+		de.startPMTUProbesLocked(now)
 	}
 
 	if de.wantFullPingLocked(now) {
@@ -3403,17 +3684,17 @@ func (de *discoEndpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.Pin
 	now := mono.Now()
 	udpAddr, derpAddr := de.addrForSendLocked(now)
 	if !derpAddr.IsZero() {
-		de.startPingLocked(derpAddr, now, pingCLI)
+		de.startPingLocked(primarySock, derpAddr, now, pingCLI, 0)
 	}
 	if !udpAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
 		// Already have an active session, so just ping the address we're using.
 		// Otherwise "tailscale ping" results to a node on the local network
 		// can look like they're bouncing between, say 10.0.0.0/9 and the peer's
 		// IPv6 address, both 1ms away, and it's random who replies first.
-		de.startPingLocked(udpAddr, now, pingCLI)
+		de.startPingLocked(de.bestAddr.sock, udpAddr, now, pingCLI, 0)
 	} else {
 		for ep := range de.endpointState {
-			de.startPingLocked(ep, now, pingCLI)
+			de.startPingLocked(primarySock, ep, now, pingCLI, 0)
 		}
 	}
 	de.noteActiveLocked()
@@ -3424,6 +3705,7 @@ func (de *discoEndpoint) send(b []byte) error {
 
 	de.mu.Lock()
 	udpAddr, derpAddr := de.addrForSendLocked(now)
+	sock := de.bestAddr.sock
 	if udpAddr.IsZero() || now.After(de.trustBestAddrUntil) {
 		de.sendPingsLocked(now, true)
 	}
@@ -3433,12 +3715,15 @@ func (de *discoEndpoint) send(b []byte) error {
 	if udpAddr.IsZero() && derpAddr.IsZero() {
 		return errors.New("no UDP or DERP addr")
 	}
+	if derpAddr.IsZero() && sock == primarySock && de.c.sendUDPBatched(udpAddr, b) {
+		return nil
+	}
 	var err error
 	if !udpAddr.IsZero() {
-		_, err = de.c.sendAddr(udpAddr, key.Public(de.publicKey), b)
+		_, err = de.c.sendAddr(sock, udpAddr, key.Public(de.publicKey), b)
 	}
 	if !derpAddr.IsZero() {
-		if ok, _ := de.c.sendAddr(derpAddr, key.Public(de.publicKey), b); ok && err != nil {
+		if ok, _ := de.c.sendAddr(primarySock, derpAddr, key.Public(de.publicKey), b); ok && err != nil {
 			// UDP failed but DERP worked, so good enough:
 			return nil
 		}
@@ -3453,7 +3738,14 @@ func (de *discoEndpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
-	if debugDisco || de.bestAddr.IsZero() || mono.Now().After(de.trustBestAddrUntil) {
+	if st, ok := de.endpointState[sp.to]; ok && sp.purpose != pingPMTU && sp.purpose != pingSpray {
+		st.notePingResultLocked(true)
+	}
+	if sp.purpose == pingPMTU {
+		// Not hearing back is the expected way for a probe to
+		// fail, so don't log.
+		de.notePMTUProbeLocked(sp, false)
+	} else if debugDisco || (sp.purpose != pingSpray && (de.bestAddr.IsZero() || mono.Now().After(de.trustBestAddrUntil))) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
 	de.removeSentPingLocked(txid, sp)
@@ -3465,6 +3757,10 @@ func (de *discoEndpoint) forgetPing(txid stun.TxID) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 	if sp, ok := de.sentPing[txid]; ok {
+		if sp.purpose == pingPMTU {
+			// Probes too big for a local link fail to send.
+			de.notePMTUProbeLocked(sp, false)
+		}
 		de.removeSentPingLocked(txid, sp)
 	}
 }
@@ -3476,12 +3772,18 @@ func (de *discoEndpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 	delete(de.sentPing, txid)
 }
 
-// sendDiscoPing sends a ping with the provided txid to ep.
+// sendDiscoPing sends a ping with the provided txid to ep from the
+// local socket sock. If size is non-zero, the ping is padded to probe
+// for that path MTU.
 //
 // The caller (startPingLocked) should've already been recorded the ping in
 // sentPing and set up the timer.
-func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, logLevel discoLogLevel) {
-	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
+func (de *discoEndpoint) sendDiscoPing(sock int, ep netaddr.IPPort, txid stun.TxID, size int, logLevel discoLogLevel) {
+	m := &disco.Ping{TxID: [12]byte(txid)}
+	if size != 0 {
+		m.Padding = pmtuProbePadding(size)
+	}
+	sent, _ := de.sendDiscoMessage(sock, ep, m, logLevel)
 	if !sent {
 		de.forgetPing(txid)
 	}
@@ -3503,10 +3805,21 @@ const (
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingSpray means that the ping was sprayed at a port where
+	// the peer's hard NAT was predicted to have mapped it, which
+	// isn't one of its known endpoints.
+	pingSpray
+
+	// pingPMTU means that the ping was padded to probe whether
+	// the path to the endpoint fits packets of a given size.
+	pingPMTU
 )
 
-func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpose discoPingPurpose) {
-	if purpose != pingCLI {
+// startPingLocked pings ep from the local socket sock. For pingPMTU,
+// size is the path MTU to probe for; otherwise it's zero.
+func (de *discoEndpoint) startPingLocked(sock int, ep netaddr.IPPort, now mono.Time, purpose discoPingPurpose, size int) {
+	if purpose != pingCLI && purpose != pingSpray {
 		st, ok := de.endpointState[ep]
 		if !ok {
 			// Shouldn't happen. But don't ping an endpoint that's
@@ -3520,20 +3833,27 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpo
 	txid := stun.NewTxID()
 	de.sentPing[txid] = sentPing{
 		to:      ep,
+		sock:    sock,
 		at:      now,
 		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
 		purpose: purpose,
+		size:    size,
 	}
 	logLevel := discoLog
-	if purpose == pingHeartbeat {
+	if purpose == pingHeartbeat || purpose == pingSpray || purpose == pingPMTU {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, txid, logLevel)
+	go de.sendDiscoPing(sock, ep, txid, size, logLevel)
 }
 
 func (de *discoEndpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 	de.lastFullPing = now
 	var sentAny bool
+	type sockAddr struct {
+		sock int
+		ep   netaddr.IPPort
+	}
+	var extraPairs []sockAddr
 	for ep, st := range de.endpointState {
 		if st.shouldDeleteLocked() {
 			de.deleteEndpointLocked(ep)
@@ -3550,7 +3870,24 @@ func (de *discoEndpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 			de.c.logf("[v1] magicsock: disco: send, starting discovery for %v (%v)", de.publicKey.ShortString(), de.discoShort)
 		}
 
-		de.startPingLocked(ep, now, pingDiscovery)
+		// Direct paths are also tried from each of our extra
+		// ports, but with N ports on each side that's N*N pairs,
+		// so only a random sample of them per round.
+		de.startPingLocked(primarySock, ep, now, pingDiscovery, 0)
+		if isDirectAddr(ep) {
+			for sock := 1; sock < de.c.numSocks(); sock++ {
+				extraPairs = append(extraPairs, sockAddr{sock, ep})
+			}
+		}
+	}
+	if len(extraPairs) > maxExtraSockPings {
+		rand.Shuffle(len(extraPairs), func(i, j int) {
+			extraPairs[i], extraPairs[j] = extraPairs[j], extraPairs[i]
+		})
+		extraPairs = extraPairs[:maxExtraSockPings]
+	}
+	for _, p := range extraPairs {
+		de.startPingLocked(p.sock, p.ep, now, pingDiscovery, 0)
 	}
 	derpAddr := de.derpAddr
 	if sentAny && sendCallMeMaybe && !derpAddr.IsZero() {
@@ -3563,8 +3900,8 @@ func (de *discoEndpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
 	}
 }
 
-func (de *discoEndpoint) sendDiscoMessage(dst netaddr.IPPort, dm disco.Message, logLevel discoLogLevel) (sent bool, err error) {
-	return de.c.sendDiscoMessage(dst, de.publicKey, de.discoKey, dm, logLevel)
+func (de *discoEndpoint) sendDiscoMessage(sock int, dst netaddr.IPPort, dm disco.Message, logLevel discoLogLevel) (sent bool, err error) {
+	return de.c.sendDiscoMessage(sock, dst, de.publicKey, de.discoKey, dm, logLevel)
 }
 
 func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
@@ -3600,6 +3937,22 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 			de.endpointState[ipp] = &endpointState{index: int16(i)}
 		}
 	}
+	if !n.Hostinfo.PeerRelay {
+		// Every peer relay is a candidate path to peers that
+		// aren't relays themselves. (Relaying to relays would
+		// need relay paths to relays.)
+		for i, ipp := range de.c.relayAddrs {
+			i += len(n.Endpoints)
+			if i > math.MaxInt16 {
+				continue
+			}
+			if st, ok := de.endpointState[ipp]; ok {
+				st.index = int16(i)
+			} else {
+				de.endpointState[ipp] = &endpointState{index: int16(i)}
+			}
+		}
+	}
 
 	// Now delete anything unless it's still in the network map or
 	// was a recently discovered endpoint.
@@ -3674,14 +4027,28 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	now := mono.Now()
 	latency := now.Sub(sp.at)
 
+	if sp.purpose == pingPMTU {
+		de.notePMTUProbeLocked(sp, true)
+	}
+
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
-		if !ok {
+		if !ok && sp.purpose == pingSpray {
+			// A spray ping made it through the peer's NAT.
+			de.c.logf("magicsock: disco: hard NAT spray found %v for %v (%v)", sp.to, de.publicKey.ShortString(), de.discoShort)
+			st = &endpointState{lastGotPing: time.Now()}
+			de.endpointState[sp.to] = st
+		} else if !ok {
 			// This is no longer an endpoint we care about.
 			return
 		}
 
-		de.c.setAddrToDiscoLocked(src, de.discoKey, de)
+		if src.IP() != peerRelayMagicIPAddr {
+			de.c.setAddrToDiscoLocked(src, de.discoKey, de)
+		}
+		if sp.purpose != pingPMTU {
+			st.notePingResultLocked(false)
+		}
 
 		st.addPongReplyLocked(pongReply{
 			latency: latency,
@@ -3691,7 +4058,7 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 		})
 	}
 
-	if sp.purpose != pingHeartbeat {
+	if sp.purpose != pingHeartbeat && sp.purpose != pingPMTU {
 		de.c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got pong tx=%x latency=%v pong.src=%v%v", de.c.discoShort, de.discoShort, de.publicKey.ShortString(), src, m.TxID[:6], latency.Round(time.Millisecond), m.Src, logger.ArgWriter(func(bw *bufio.Writer) {
 			if sp.to != src {
 				fmt.Fprintf(bw, " ping.to=%v", sp.to)
@@ -3708,29 +4075,39 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
-		thisPong := addrLatency{sp.to, latency}
+		thisPong := addrLatency{sp.to, sp.sock, latency}
+		reason := pathReasonPong
 		if betterAddr(thisPong, de.bestAddr) {
-			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+			de.c.logf("magicsock: disco: node %v %v now using %v%v", de.publicKey.ShortString(), de.discoShort, sp.to, de.c.sockSuffix(sp.sock))
+			if !de.bestAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
+				reason = pathReasonBetterPath
+			}
 			de.bestAddr = thisPong
+			de.resetPMTULocked()
 		}
-		if de.bestAddr.IPPort == thisPong.IPPort {
+		if de.bestAddr.IPPort == thisPong.IPPort && de.bestAddr.sock == thisPong.sock {
 			de.bestAddr.latency = latency
 			de.bestAddrAt = now
 			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+			de.notePathLocked(thisPong.IPPort, reason)
 		}
 	}
 }
 
-// addrLatency is an IPPort with an associated latency.
+// addrLatency is an IPPort with an associated latency, when sent to
+// from the local socket sock.
 type addrLatency struct {
 	netaddr.IPPort
+	sock    int
 	latency time.Duration
 }
 
 // betterAddr reports whether a is a better addr to use than b.
 func betterAddr(a, b addrLatency) bool {
 	if a.IPPort == b.IPPort {
-		return false
+		// Only switch local ports for a clear improvement, so we
+		// don't flap between ports that are equally good.
+		return a.sock != b.sock && a.latency < b.latency/10*9
 	}
 	if b.IsZero() {
 		return true
@@ -3738,6 +4115,10 @@ func betterAddr(a, b addrLatency) bool {
 	if a.IsZero() {
 		return false
 	}
+	if aRelay, bRelay := a.IP() == peerRelayMagicIPAddr, b.IP() == peerRelayMagicIPAddr; aRelay != bRelay {
+		// Any direct path beats going through a peer relay.
+		return bRelay
+	}
 	if a.IP().Is6() && b.IP().Is4() {
 		// Prefer IPv6 for being a bit more robust, as long as
 		// the latencies are roughly equivalent.
@@ -3828,10 +4209,86 @@ func (de *discoEndpoint) handleCallMeMaybe(m *disco.CallMeMaybe) {
 	de.sendPingsLocked(mono.Now(), false)
 }
 
+// handlePortPrediction handles a PortPrediction discovery message via
+// DERP from a peer behind a hard NAT, by pinging the ports its NAT
+// is predicted to map its pings to us to. Each of those pings opens
+// a mapping and firewall pinhole on our side for one of the peer's
+// ports: just one if our NAT is easy, one per port if it's also
+// endpoint dependent. The peer, spraying at our predicted ports in
+// turn, gets through the pinhole for the port its NAT actually
+// used, and our ping that hits the peer's pinhole for it gets
+// through the other way.
+func (de *discoEndpoint) handlePortPrediction(m *disco.PortPrediction) {
+	if m.Delta == 0 || !m.Last.IP().Is4() {
+		return
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	now := mono.Now()
+	if !de.bestAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
+		// Already have a working direct path.
+		return
+	}
+	if !de.hasEndpointIPLocked(m.Last.IP()) {
+		// Only spray at the peer's own NAT, not wherever it
+		// likes, such as some third party's host.
+		de.c.logf("[unexpected] magicsock: disco: port prediction from %v (%v) for unknown IP %v", de.publicKey.ShortString(), de.discoShort, m.Last.IP())
+		return
+	}
+	if !de.lastSpray.IsZero() && now.Sub(de.lastSpray) < hardNATSprayInterval {
+		return
+	}
+	de.lastSpray = now
+	de.c.logf("[v1] magicsock: disco: spraying %d pings at %v (%v) from %v%+d", hardNATSprayPorts, de.publicKey.ShortString(), de.discoShort, m.Last, m.Delta)
+	go de.spray(m.Last, int(m.Delta))
+}
+
+// hasEndpointIPLocked reports whether ip is the IP of one of de's
+// endpoints, from the netmap or a CallMeMaybe.
+//
+// de.mu must be held.
+func (de *discoEndpoint) hasEndpointIPLocked(ip netaddr.IP) bool {
+	for ep := range de.endpointState {
+		if ep.IP() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// spray pings up to hardNATSprayPorts ports following last in steps
+// of delta, at the rate allowed by the Conn's spray budget. It stops
+// early once a direct path is found.
+func (de *discoEndpoint) spray(last netaddr.IPPort, delta int) {
+	port := int(last.Port())
+	for i := 0; i < hardNATSprayPorts; i++ {
+		port += delta
+		if port <= 0 || port > math.MaxUint16 {
+			return
+		}
+		if err := de.c.sprayLimit.Wait(de.c.connCtx); err != nil {
+			return
+		}
+		de.mu.Lock()
+		now := mono.Now()
+		if !de.bestAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
+			de.mu.Unlock()
+			return
+		}
+		de.startPingLocked(primarySock, netaddr.IPPortFrom(last.IP(), uint16(port)), now, pingSpray, 0)
+		de.mu.Unlock()
+	}
+}
+
 func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	if !de.bestAddr.IsZero() {
+		ps.Latency = de.bestAddr.latency
+	}
+	ps.PathMTU = de.pathMTU
 	if de.lastSend.IsZero() {
 		return
 	}
@@ -3841,7 +4298,11 @@ func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	ps.Active = now.Sub(de.lastSend) < sessionActiveTimeout
 
 	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
-		ps.CurAddr = udpAddr.String()
+		if name := de.c.peerRelayNameLocked(udpAddr); name != "" {
+			ps.PeerRelay = name
+		} else {
+			ps.CurAddr = udpAddr.String()
+		}
 	}
 }
 
@@ -3859,9 +4320,12 @@ func (de *discoEndpoint) stopAndReset() {
 	// state isn't a mix of before & after two sessions.
 	de.lastSend = 0
 	de.lastFullPing = 0
+	de.lastSpray = 0
 	de.bestAddr = addrLatency{}
 	de.bestAddrAt = 0
 	de.trustBestAddrUntil = 0
+	de.resetPMTULocked()
+	de.notePathLocked(netaddr.IPPort{}, pathReasonReset)
 	for _, es := range de.endpointState {
 		es.lastPing = 0
 	}
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -32,6 +33,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
@@ -121,6 +123,20 @@ func runDERPAndStun(t *testing.T, logf logger.Logf, l nettype.PacketListener, st
 	return m, cleanup
 }
 
+// addSTUNNode runs another STUN server on l, reachable at stunIP, and
+// adds it to the only region of derpMap, which must be from
+// runDERPAndStun.
+func addSTUNNode(t *testing.T, derpMap *tailcfg.DERPMap, l nettype.PacketListener, stunIP netaddr.IP) (cleanup func()) {
+	stunAddr, cleanup := stuntest.ServeWithPacketListener(t, l)
+	reg := derpMap.Regions[1]
+	n := *reg.Nodes[0]
+	n.Name = fmt.Sprintf("t%d", len(reg.Nodes)+1)
+	n.STUNPort = stunAddr.Port
+	n.STUNTestIP = stunIP.String()
+	reg.Nodes = append(reg.Nodes, &n)
+	return cleanup
+}
+
 // magicStack is a magicsock, plus all the stuff around it that's
 // necessary to send and receive packets to test e2e wireguard
 // happiness.
@@ -139,6 +155,14 @@ type magicStack struct {
 // before anything interesting happens.
 func newMagicStack(t testing.TB, logf logger.Logf, l nettype.PacketListener, derpMap *tailcfg.DERPMap, disableLegacy bool) *magicStack {
 	t.Helper()
+	return newMagicStackWithOptions(t, logf, l, derpMap, Options{DisableLegacyNetworking: disableLegacy})
+}
+
+// newMagicStackWithOptions is like newMagicStack, but takes more
+// magicsock options. Their Logf, PacketListener, EndpointsFunc and
+// SimulatedNetwork are set from its other arguments.
+func newMagicStackWithOptions(t testing.TB, logf logger.Logf, l nettype.PacketListener, derpMap *tailcfg.DERPMap, opts Options) *magicStack {
+	t.Helper()
 
 	privateKey, err := wgkey.NewPrivate()
 	if err != nil {
@@ -146,15 +170,13 @@ func newMagicStack(t testing.TB, logf logger.Logf, l nettype.PacketListener, der
 	}
 
 	epCh := make(chan []tailcfg.Endpoint, 100) // arbitrary
-	conn, err := NewConn(Options{
-		Logf:           logf,
-		PacketListener: l,
-		EndpointsFunc: func(eps []tailcfg.Endpoint) {
-			epCh <- eps
-		},
-		SimulatedNetwork:        l != nettype.Std{},
-		DisableLegacyNetworking: disableLegacy,
-	})
+	opts.Logf = logf
+	opts.PacketListener = l
+	opts.EndpointsFunc = func(eps []tailcfg.Endpoint) {
+		epCh <- eps
+	}
+	opts.SimulatedNetwork = l != nettype.Std{}
+	conn, err := NewConn(opts)
 	if err != nil {
 		t.Fatalf("constructing magicsock: %v", err)
 	}
@@ -260,6 +282,9 @@ func meshStacks(logf logger.Logf, ms []*magicStack) (cleanup func()) {
 				continue
 			}
 			addrs := []netaddr.IPPrefix{netaddr.IPPrefixFrom(netaddr.IPv4(1, 0, 0, byte(i+1)), 32)}
+			peer.conn.mu.Lock()
+			peerRelay := peer.conn.peerRelay
+			peer.conn.mu.Unlock()
 			peer := &tailcfg.Node{
 				ID:         tailcfg.NodeID(i + 1),
 				Name:       fmt.Sprintf("node%d", i+1),
@@ -269,6 +294,7 @@ func meshStacks(logf logger.Logf, ms []*magicStack) (cleanup func()) {
 				AllowedIPs: addrs,
 				Endpoints:  epStrings(eps[i]),
 				DERP:       "127.3.3.40:1",
+				Hostinfo:   tailcfg.Hostinfo{PeerRelay: peerRelay},
 			}
 			nm.Peers = append(nm.Peers, peer)
 		}
@@ -727,6 +753,155 @@ func TestActiveDiscovery(t *testing.T) {
 		}
 		testActiveDiscovery(t, n)
 	})
+
+	t.Run("hard_nats_with_port_forward", func(t *testing.T) {
+		// Both machines are behind hard NATs, so they can only
+		// connect directly through m1's manually configured port
+		// forward, which it has to advertise as a static endpoint
+		// since STUN doesn't see it.
+		mstun := &natlab.Machine{Name: "stun"}
+		m1 := &natlab.Machine{Name: "m1"}
+		nat1 := &natlab.Machine{Name: "nat1"}
+		m2 := &natlab.Machine{Name: "m2"}
+		nat2 := &natlab.Machine{Name: "nat2"}
+
+		inet := natlab.NewInternet()
+		lan1 := &natlab.Network{
+			Name:    "lan1",
+			Prefix4: mustPrefix("192.168.0.0/24"),
+		}
+		lan2 := &natlab.Network{
+			Name:    "lan2",
+			Prefix4: mustPrefix("192.168.1.0/24"),
+		}
+
+		sif := mstun.Attach("eth0", inet)
+		nat1WAN := nat1.Attach("wan", inet)
+		nat1LAN := nat1.Attach("lan1", lan1)
+		nat2WAN := nat2.Attach("wan", inet)
+		nat2LAN := nat2.Attach("lan2", lan2)
+		m1if := m1.Attach("eth0", lan1)
+		m2if := m2.Attach("eth0", lan2)
+		lan1.SetDefaultGateway(nat1LAN)
+		lan2.SetDefaultGateway(nat2LAN)
+
+		snat1 := &natlab.SNAT44{
+			Machine:           nat1,
+			ExternalInterface: nat1WAN,
+			Type:              natlab.AddressAndPortDependentNAT,
+			Firewall: &natlab.Firewall{
+				TrustedInterface: nat1LAN,
+			},
+		}
+		nat1.PacketHandler = snat1
+		nat2.PacketHandler = &natlab.SNAT44{
+			Machine:           nat2,
+			ExternalInterface: nat2WAN,
+			Type:              natlab.AddressAndPortDependentNAT,
+			Firewall: &natlab.Firewall{
+				TrustedInterface: nat2LAN,
+			},
+		}
+
+		const fwdPort = 41641
+		n := &devices{
+			m1:     m1,
+			m1IP:   m1if.V4(),
+			m2:     m2,
+			m2IP:   m2if.V4(),
+			stun:   mstun,
+			stunIP: sif.V4(),
+			setup: func(ms1, ms2 *magicStack) {
+				snat1.AddPortForward(fwdPort, netaddr.IPPortFrom(m1if.V4(), ms1.conn.LocalPort()))
+				ms1.conn.SetStaticEndpoints([]netaddr.IPPort{netaddr.IPPortFrom(nat1WAN.V4(), fwdPort)})
+			},
+		}
+		testActiveDiscovery(t, n)
+	})
+
+	// hardNATPortPrediction returns the devices for the
+	// hard_nats_*_port_prediction tests: both machines are behind
+	// NATs whose mappings vary by destination ip:port, but which
+	// allocate ports sequentially. With spray, each side predicts
+	// its NAT's mappings to the other from the two STUN servers'
+	// replies, and the other sprays pings at them.
+	hardNATPortPrediction := func(spray bool) *devices {
+		mstun := &natlab.Machine{Name: "stun"}
+		mstun2 := &natlab.Machine{Name: "stun2"}
+		m1 := &natlab.Machine{Name: "m1"}
+		nat1 := &natlab.Machine{Name: "nat1"}
+		m2 := &natlab.Machine{Name: "m2"}
+		nat2 := &natlab.Machine{Name: "nat2"}
+
+		inet := natlab.NewInternet()
+		lan1 := &natlab.Network{
+			Name:    "lan1",
+			Prefix4: mustPrefix("192.168.0.0/24"),
+		}
+		lan2 := &natlab.Network{
+			Name:    "lan2",
+			Prefix4: mustPrefix("192.168.1.0/24"),
+		}
+
+		sif := mstun.Attach("eth0", inet)
+		sif2 := mstun2.Attach("eth0", inet)
+		nat1WAN := nat1.Attach("wan", inet)
+		nat1LAN := nat1.Attach("lan1", lan1)
+		nat2WAN := nat2.Attach("wan", inet)
+		nat2LAN := nat2.Attach("lan2", lan2)
+		m1if := m1.Attach("eth0", lan1)
+		m2if := m2.Attach("eth0", lan2)
+		lan1.SetDefaultGateway(nat1LAN)
+		lan2.SetDefaultGateway(nat2LAN)
+
+		nat1.PacketHandler = &natlab.SNAT44{
+			Machine:           nat1,
+			ExternalInterface: nat1WAN,
+			Type:              natlab.AddressAndPortDependentNAT,
+			FirstPort:         10000,
+			Firewall: &natlab.Firewall{
+				TrustedInterface: nat1LAN,
+			},
+		}
+		nat2.PacketHandler = &natlab.SNAT44{
+			Machine:           nat2,
+			ExternalInterface: nat2WAN,
+			Type:              natlab.AddressAndPortDependentNAT,
+			FirstPort:         20000,
+			Firewall: &natlab.Firewall{
+				TrustedInterface: nat2LAN,
+			},
+		}
+
+		return &devices{
+			m1:       m1,
+			m1IP:     m1if.V4(),
+			m2:       m2,
+			m2IP:     m2if.V4(),
+			stun:     mstun,
+			stunIP:   sif.V4(),
+			stun2:    mstun2,
+			stun2IP:  sif2.V4(),
+			noDirect: !spray,
+			setup: func(ms1, ms2 *magicStack) {
+				for _, ms := range []*magicStack{ms1, ms2} {
+					ms.conn.mu.Lock()
+					ms.conn.hardNATSpray = spray
+					ms.conn.mu.Unlock()
+				}
+			},
+		}
+	}
+
+	t.Run("hard_nats_with_port_prediction", func(t *testing.T) {
+		testActiveDiscovery(t, hardNATPortPrediction(true))
+	})
+
+	t.Run("hard_nats_without_port_prediction", func(t *testing.T) {
+		// The control for the above: the same NATs without
+		// spraying stay on DERP.
+		testActiveDiscovery(t, hardNATPortPrediction(false))
+	})
 }
 
 func mustPrefix(s string) netaddr.IPPrefix {
@@ -746,6 +921,19 @@ type devices struct {
 
 	stun   nettype.PacketListener
 	stunIP netaddr.IP
+
+	// stun2, if non-nil, runs a second STUN server in the same
+	// DERP region, so netcheck sees two mappings.
+	stun2   nettype.PacketListener
+	stun2IP netaddr.IP
+
+	// setup, if non-nil, is called with the two magicStacks before
+	// they're meshed.
+	setup func(m1, m2 *magicStack)
+
+	// noDirect is whether the machines must not find a direct
+	// path, for control runs of the tests that expect one.
+	noDirect bool
 }
 
 // newPinger starts continuously sending test packets from srcM to
@@ -837,12 +1025,20 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 
 	derpMap, cleanup := runDERPAndStun(t, logf, d.stun, d.stunIP)
 	defer cleanup()
+	if d.stun2 != nil {
+		cleanup = addSTUNNode(t, derpMap, d.stun2, d.stun2IP)
+		defer cleanup()
+	}
 
 	m1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), d.m1, derpMap, true)
 	defer m1.Close()
 	m2 := newMagicStack(t, logger.WithPrefix(logf, "conn2: "), d.m2, derpMap, true)
 	defer m2.Close()
 
+	if d.setup != nil {
+		d.setup(m1, m2)
+	}
+
 	cleanup = meshStacks(logf, []*magicStack{m1, m2})
 	defer cleanup()
 
@@ -873,13 +1069,338 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 		}
 		t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
 	}
+	// mustNotDirect checks that m1 stays on DERP to m2 for as long
+	// as mustDirect would wait for a direct path.
+	mustNotDirect := func(m1, m2 *magicStack) {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if pst := m1.Status().Peer[m2.Public()]; pst.CurAddr != "" {
+				t.Errorf("magicsock found a direct path from %s to %s with addr %s; want none", m1, m2, pst.CurAddr)
+				return
+			}
+		}
+		logf("no direct path %s->%s, as expected", m1, m2)
+	}
+
+	if d.noDirect {
+		mustNotDirect(m1, m2)
+		mustNotDirect(m2, m1)
+	} else {
+		mustDirect(m1, m2)
+		mustDirect(m2, m1)
+	}
+
+	logf("starting cleanup")
+}
+
+// TestPeerRelay verifies that two magicStacks behind hard NATs, which
+// can't connect directly, find a path through a third one on the
+// internet that offers to relay for them.
+func TestPeerRelay(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	mstun := &natlab.Machine{Name: "stun"}
+	m1 := &natlab.Machine{Name: "m1"}
+	nat1 := &natlab.Machine{Name: "nat1"}
+	m2 := &natlab.Machine{Name: "m2"}
+	nat2 := &natlab.Machine{Name: "nat2"}
+	mrelay := &natlab.Machine{Name: "relay"}
+
+	inet := natlab.NewInternet()
+	lan1 := &natlab.Network{
+		Name:    "lan1",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+	lan2 := &natlab.Network{
+		Name:    "lan2",
+		Prefix4: mustPrefix("192.168.1.0/24"),
+	}
+
+	sif := mstun.Attach("eth0", inet)
+	mrelay.Attach("eth0", inet)
+	nat1WAN := nat1.Attach("wan", inet)
+	nat1LAN := nat1.Attach("lan1", lan1)
+	nat2WAN := nat2.Attach("wan", inet)
+	nat2LAN := nat2.Attach("lan2", lan2)
+	m1.Attach("eth0", lan1)
+	m2.Attach("eth0", lan2)
+	lan1.SetDefaultGateway(nat1LAN)
+	lan2.SetDefaultGateway(nat2LAN)
+
+	nat1.PacketHandler = &natlab.SNAT44{
+		Machine:           nat1,
+		ExternalInterface: nat1WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall: &natlab.Firewall{
+			TrustedInterface: nat1LAN,
+		},
+	}
+	nat2.PacketHandler = &natlab.SNAT44{
+		Machine:           nat2,
+		ExternalInterface: nat2WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall: &natlab.Firewall{
+			TrustedInterface: nat2LAN,
+		},
+	}
+
+	tlogf, setT := makeNestable(t)
+	setT(t)
+	logf, closeLogf := logger.LogfCloser(tlogf)
+	defer closeLogf()
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	ms1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), m1, derpMap, true)
+	defer ms1.Close()
+	ms2 := newMagicStack(t, logger.WithPrefix(logf, "conn2: "), m2, derpMap, true)
+	defer ms2.Close()
+	relay := newMagicStack(t, logger.WithPrefix(logf, "relay: "), mrelay, derpMap, true)
+	defer relay.Close()
+	relay.conn.SetPeerRelay(true)
+
+	cleanup = meshStacks(logf, []*magicStack{ms1, ms2, relay})
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	mustRelay := func(m1, m2 *magicStack) {
+		lastLog := time.Now().Add(-time.Minute)
+		for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			pst := m1.Status().Peer[m2.Public()]
+			if pst.CurAddr != "" {
+				t.Errorf("unexpected direct path %s->%s with addr %s", m1, m2, pst.CurAddr)
+				return
+			}
+			if pst.PeerRelay != "" {
+				logf("peer relay path %s->%s found via %s", m1, m2, pst.PeerRelay)
+				return
+			}
+			if now := time.Now(); now.Sub(lastLog) > time.Second {
+				logf("no peer relay path %s->%s yet", m1, m2)
+				lastLog = now
+			}
+		}
+		t.Errorf("magicsock did not find a peer relay path from %s to %s", m1, m2)
+	}
+
+	mustRelay(ms1, ms2)
+	mustRelay(ms2, ms1)
+
+	logf("starting cleanup")
+}
+
+// portFirewall is a natlab.PacketHandler for a machine whose firewall
+// only lets UDP to some local ports in, except from trusted.
+type portFirewall struct {
+	trusted netaddr.IP
+	allowed []uint16
+}
+
+func (f *portFirewall) HandleIn(p *natlab.Packet, iif *natlab.Interface) *natlab.Packet {
+	if p.Src.IP() == f.trusted {
+		return p
+	}
+	for _, port := range f.allowed {
+		if p.Dst.Port() == port {
+			return p
+		}
+	}
+	return nil
+}
+
+func (f *portFirewall) HandleOut(p *natlab.Packet, oif *natlab.Interface) *natlab.Packet {
+	return p
+}
+
+func (f *portFirewall) HandleForward(p *natlab.Packet, iif, oif *natlab.Interface) *natlab.Packet {
+	return nil
+}
+
+// TestExtraPorts verifies that when a firewall only lets peers reach
+// one of a magicStack's extra ports, discovery finds the direct path
+// through it.
+func TestExtraPorts(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	const extraPort = 4242
+
+	mstun := &natlab.Machine{Name: "stun"}
+	m1 := &natlab.Machine{Name: "m1"}
+	m2 := &natlab.Machine{Name: "m2"}
+	inet := natlab.NewInternet()
+	sif := mstun.Attach("eth0", inet)
+	m1.Attach("eth0", inet)
+	m2if := m2.Attach("eth0", inet)
+	m2.PacketHandler = &portFirewall{
+		trusted: sif.V4(), // so m2 can learn its endpoints
+		allowed: []uint16{extraPort},
+	}
+
+	tlogf, setT := makeNestable(t)
+	setT(t)
+	logf, closeLogf := logger.LogfCloser(tlogf)
+	defer closeLogf()
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	ms1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), m1, derpMap, true)
+	defer ms1.Close()
+	ms2 := newMagicStackWithOptions(t, logger.WithPrefix(logf, "conn2: "), m2, derpMap, Options{
+		DisableLegacyNetworking: true,
+		ExtraPorts:              []uint16{extraPort},
+	})
+	defer ms2.Close()
+
+	cleanup = meshStacks(logf, []*magicStack{ms1, ms2})
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	mustDirect := func(m1, m2 *magicStack, want netaddr.IPPort) {
+		lastLog := time.Now().Add(-time.Minute)
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			pst := m1.Status().Peer[m2.Public()]
+			if pst.CurAddr != "" {
+				logf("direct link %s->%s found with addr %s", m1, m2, pst.CurAddr)
+				if !want.IsZero() && pst.CurAddr != want.String() {
+					t.Errorf("direct link %s->%s uses %s; want %s", m1, m2, pst.CurAddr, want)
+				}
+				return
+			}
+			if now := time.Now(); now.Sub(lastLog) > time.Second {
+				logf("no direct path %s->%s yet, addrs %v", m1, m2, pst.Addrs)
+				lastLog = now
+			}
+		}
+		t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
+	}
+
+	mustDirect(ms1, ms2, netaddr.IPPortFrom(m2if.V4(), extraPort))
+	mustDirect(ms2, ms1, netaddr.IPPort{})
+
+	logf("starting cleanup")
+}
+
+// TestExtraPortsBestPair verifies that when both magicStacks have
+// extra ports and their firewalls only let one port each in,
+// discovery finds the one pair of local port and peer endpoint that
+// works, in each direction.
+func TestExtraPortsBestPair(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	mstun := &natlab.Machine{Name: "stun"}
+	m1 := &natlab.Machine{Name: "m1"}
+	m2 := &natlab.Machine{Name: "m2"}
+	inet := natlab.NewInternet()
+	sif := mstun.Attach("eth0", inet)
+	m1if := m1.Attach("eth0", inet)
+	m2if := m2.Attach("eth0", inet)
+	m1.PacketHandler = &portFirewall{trusted: sif.V4(), allowed: []uint16{5152}}
+	m2.PacketHandler = &portFirewall{trusted: sif.V4(), allowed: []uint16{4243}}
+
+	tlogf, setT := makeNestable(t)
+	setT(t)
+	logf, closeLogf := logger.LogfCloser(tlogf)
+	defer closeLogf()
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	ms1 := newMagicStackWithOptions(t, logger.WithPrefix(logf, "conn1: "), m1, derpMap, Options{
+		DisableLegacyNetworking: true,
+		ExtraPorts:              []uint16{5151, 5152},
+	})
+	defer ms1.Close()
+	ms2 := newMagicStackWithOptions(t, logger.WithPrefix(logf, "conn2: "), m2, derpMap, Options{
+		DisableLegacyNetworking: true,
+		ExtraPorts:              []uint16{4242, 4243},
+	})
+	defer ms2.Close()
+
+	cleanup = meshStacks(logf, []*magicStack{ms1, ms2})
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	// bestLocalPort returns the local port that m1 sends to m2's
+	// best direct endpoint from, or zero if it has none.
+	bestLocalPort := func(m1, m2 *magicStack) uint16 {
+		c := m1.conn
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		de := c.endpointOfDisco[m2.conn.DiscoPublicKey()]
+		if de == nil {
+			return 0
+		}
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		if de.bestAddr.IsZero() {
+			return 0
+		}
+		pconn4, _ := c.socketsOf(de.bestAddr.sock)
+		return uint16(pconn4.LocalAddr().Port)
+	}
+
+	mustPair := func(m1, m2 *magicStack, wantLocal uint16, wantRemote netaddr.IPPort) {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			pst := m1.Status().Peer[m2.Public()]
+			if pst.CurAddr == "" {
+				continue
+			}
+			if local := bestLocalPort(m1, m2); pst.CurAddr != wantRemote.String() || local != wantLocal {
+				t.Errorf("direct link %s->%s uses port %d to %s; want port %d to %s", m1, m2, local, pst.CurAddr, wantLocal, wantRemote)
+			}
+			return
+		}
+		t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
+	}
 
-	mustDirect(m1, m2)
-	mustDirect(m2, m1)
+	mustPair(ms1, ms2, 5152, netaddr.IPPortFrom(m2if.V4(), 4243))
+	mustPair(ms2, ms1, 4243, netaddr.IPPortFrom(m1if.V4(), 5152))
 
 	logf("starting cleanup")
 }
 
+func TestNewConnTooManyExtraPorts(t *testing.T) {
+	ports := make([]uint16, MaxExtraPorts+1)
+	for i := range ports {
+		ports[i] = uint16(5000 + i)
+	}
+	c, err := NewConn(Options{ExtraPorts: ports})
+	if err == nil {
+		c.Close()
+		t.Fatal("NewConn succeeded; want error")
+	}
+}
+
+func TestParseRelayFrame(t *testing.T) {
+	k := tailcfg.NodeKey{1, 2, 3}
+	b := appendRelayHeader(nil, relayFrameSend, k)
+	b = append(b, "payload"...)
+	if len(b) != relayHeaderLen+len("payload") {
+		t.Fatalf("frame is %d bytes; want %d", len(b), relayHeaderLen+len("payload"))
+	}
+	typ, gotKey, payload, ok := parseRelayFrame(b)
+	if !ok || typ != relayFrameSend || gotKey != k || string(payload) != "payload" {
+		t.Errorf("parseRelayFrame = %v, %v, %q, %v", typ, gotKey.ShortString(), payload, ok)
+	}
+	if _, _, _, ok := parseRelayFrame(b[:relayHeaderLen-1]); ok {
+		t.Errorf("short frame parsed")
+	}
+	discoMsg := append([]byte(disco.Magic), make([]byte, 64)...)
+	if _, _, _, ok := parseRelayFrame(discoMsg); ok {
+		t.Errorf("disco message parsed as relay frame")
+	}
+}
+
 func testTwoDevicePing(t *testing.T, d *devices) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -1202,7 +1723,7 @@ func TestDiscoMessage(t *testing.T) {
 	pkt = append(pkt, nonce[:]...)
 
 	pkt = box.Seal(pkt, []byte(payload), &nonce, c.discoPrivate.Public().B32(), peer1Priv.B32())
-	got := c.handleDiscoMessage(pkt, netaddr.IPPort{})
+	got := c.handleDiscoMessage(pkt, netaddr.IPPort{}, primarySock)
 	if !got {
 		t.Error("failed to open it")
 	}
@@ -1401,6 +1922,142 @@ func BenchmarkReceiveFrom(b *testing.B) {
 	}
 }
 
+func TestBatchReader(t *testing.T) {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruc := &RebindingUDPConn{pconn: pconn}
+	defer ruc.Close()
+	sendConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sendConn.Close()
+	wantSrc := netaddr.MustParseIPPort(sendConn.LocalAddr().String())
+
+	want := []string{"one", "two", "three"}
+	for _, s := range want {
+		if _, err := sendConn.WriteTo([]byte(s), ruc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var br batchReader
+	buf := make([]byte, 100)
+	for _, s := range want {
+		n, src, err := br.readFromNetaddr(ruc, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != s || src != wantSrc {
+			t.Errorf("read %q from %v; want %q from %v", got, src, s, wantSrc)
+		}
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	if !batchIOSupported {
+		t.Skip("batched I/O not supported")
+	}
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruc := &RebindingUDPConn{pconn: pconn}
+	defer ruc.Close()
+	recvConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recvConn.Close()
+	dst := netaddr.MustParseIPPort(recvConn.LocalAddr().String())
+	wantSrc := ruc.LocalAddr().String()
+
+	done := make(chan struct{})
+	defer close(done)
+	w := newBatchWriter(ruc, t.Logf, done)
+
+	want := []string{"one", "two", "three"}
+	for _, s := range want {
+		if !w.enqueue([]byte(s), dst) {
+			t.Fatalf("enqueue(%q) = false", s)
+		}
+	}
+	recvConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	for _, s := range want {
+		n, src, err := recvConn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != s || src.String() != wantSrc {
+			t.Errorf("read %q from %v; want %q from %v", got, src, s, wantSrc)
+		}
+	}
+
+	// After a failed batch write, here of an IPv6 packet to the
+	// IPv4 socket, packets are refused so that they're written
+	// directly and their errors returned.
+	if !w.enqueue([]byte("bad"), netaddr.MustParseIPPort("[2001:db8::1]:1")) {
+		t.Fatal("enqueue of IPv6 packet = false")
+	}
+	for deadline := time.Now().Add(5 * time.Second); w.failedAt.LoadAtomic().IsZero(); {
+		if time.Now().After(deadline) {
+			t.Fatal("batch write of IPv6 packet didn't fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w.enqueue([]byte("four"), dst) {
+		t.Error("enqueue after failed batch write = true")
+	}
+}
+
+// BenchmarkReceiveBurst measures receiving bursts of packets, with and
+// without batched reads.
+func BenchmarkReceiveBurst(b *testing.B) {
+	for _, batch := range []bool{true, false} {
+		name := "batch"
+		if !batch {
+			name = "nobatch"
+		}
+		b.Run(name, func(b *testing.B) {
+			defer func(old bool) { debugDisableBatchIO = old }(debugDisableBatchIO)
+			debugDisableBatchIO = !batch
+
+			conn := newNonLegacyTestConn(b)
+			b.Cleanup(func() { conn.Close() })
+			conn.logf = logger.Discard
+
+			sendConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { sendConn.Close() })
+			addTestEndpoint(b, conn, sendConn)
+
+			const burst = udpBatchSize
+			var dstAddr net.Addr = conn.pconn4.LocalAddr()
+			sendBuf := make([]byte, 1<<10)
+			buf := make([]byte, 2<<10)
+			b.SetBytes(int64(len(sendBuf) * burst))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < burst; j++ {
+					if _, err := sendConn.WriteTo(sendBuf, dstAddr); err != nil {
+						b.Fatalf("WriteTo: %v", err)
+					}
+				}
+				for j := 0; j < burst; j++ {
+					if _, _, err := conn.receiveIPv4(buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
 func BenchmarkReceiveFrom_Native(b *testing.B) {
 	recvConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	if err != nil {
@@ -1632,7 +2289,12 @@ func TestEndpointSetsEqual(t *testing.T) {
 func TestBetterAddr(t *testing.T) {
 	const ms = time.Millisecond
 	al := func(ipps string, d time.Duration) addrLatency {
-		return addrLatency{netaddr.MustParseIPPort(ipps), d}
+		return addrLatency{IPPort: netaddr.MustParseIPPort(ipps), latency: d}
+	}
+	alSock := func(ipps string, sock int, d time.Duration) addrLatency {
+		a := al(ipps, d)
+		a.sock = sock
+		return a
 	}
 	zero := addrLatency{}
 	tests := []struct {
@@ -1667,6 +2329,28 @@ func TestBetterAddr(t *testing.T) {
 			b:    al("[2001::5]:123", 100*ms),
 			want: true,
 		},
+		// Prefer any direct path over a peer relay:
+		{
+			a:    al("1.2.3.4:555", 100*ms),
+			b:    al("127.3.3.41:1", 10*ms),
+			want: true,
+		},
+		{
+			a:    al("127.3.3.41:1", 10*ms),
+			b:    al("127.3.3.41:2", 20*ms),
+			want: true,
+		},
+		// Only switch local ports if it's clearly faster:
+		{
+			a:    alSock("1.2.3.4:555", 1, 10*ms),
+			b:    al("1.2.3.4:555", 20*ms),
+			want: true,
+		},
+		{
+			a:    alSock("1.2.3.4:555", 1, 19*ms),
+			b:    al("1.2.3.4:555", 20*ms),
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		got := betterAddr(tt.a, tt.b)
@@ -1688,3 +2372,161 @@ func epStrings(eps []tailcfg.Endpoint) (ret []string) {
 	}
 	return
 }
+
+func TestPMTUProbePadding(t *testing.T) {
+	// A probe must be exactly as big on the wire as a WireGuard
+	// packet carrying an inner packet of the size probed for.
+	var nonce [disco.NonceLen]byte
+	var sharedKey [32]byte
+	for _, mtu := range pmtuProbeSizes {
+		m := &disco.Ping{Padding: pmtuProbePadding(mtu)}
+		pkt := []byte(disco.Magic)
+		pkt = append(pkt, make([]byte, len(tailcfg.DiscoKey{}))...)
+		pkt = append(pkt, nonce[:]...)
+		pkt = box.SealAfterPrecomputation(pkt, m.AppendMarshal(nil), &nonce, &sharedKey)
+		if got, want := len(pkt), mtu+wgDataOverhead; got != want {
+			t.Errorf("probe for %d is %d bytes; want %d", mtu, got, want)
+		}
+	}
+}
+
+func TestNotePMTUProbe(t *testing.T) {
+	ep := netaddr.MustParseIPPort("1.2.3.4:567")
+	other := netaddr.MustParseIPPort("5.6.7.8:9")
+	c := &Conn{logf: t.Logf}
+	de := &discoEndpoint{
+		c:        c,
+		bestAddr: addrLatency{IPPort: ep},
+	}
+	startRound := func(at mono.Time, probes int) {
+		// As startPMTUProbesLocked does, without sending.
+		de.lastPMTUProbe = at
+		de.pmtuPending = probes
+		de.pmtuRoundMax = 0
+	}
+
+	type step struct {
+		to   netaddr.IPPort
+		at   mono.Time // round of the probe
+		size int
+		ok   bool
+		want int
+	}
+	check := func(steps []step) {
+		t.Helper()
+		for i, st := range steps {
+			de.notePMTUProbeLocked(sentPing{to: st.to, at: st.at, purpose: pingPMTU, size: st.size}, st.ok)
+			if de.pathMTU != st.want {
+				t.Fatalf("round %v step %d: pathMTU = %d; want %d", de.lastPMTUProbe, i, de.pathMTU, st.want)
+			}
+		}
+	}
+
+	startRound(1, 4)
+	check([]step{
+		{ep, 1, 1400, true, 1400}, // raised right away
+		{ep, 1, 1200, true, 1400},
+		{ep, 1, 1280, false, 1400},   // a bigger probe made it
+		{other, 1, 1440, true, 1400}, // not bestAddr
+		{ep, 1, 1360, false, 1400},   // end of round
+	})
+	if got := c.MinPathMTU(); got != 1400 {
+		t.Errorf("MinPathMTU = %d; want 1400", got)
+	}
+
+	// The path shrinks below tstun's MTU.
+	startRound(2, 3)
+	check([]step{
+		{ep, 2, 1024, true, 1400},
+		{ep, 1, 1440, true, 1400}, // from the previous round
+		{ep, 2, 1200, true, 1400},
+		{ep, 2, 1280, false, 1200}, // end of round: lowered
+	})
+	if got := c.MinPathMTU(); got != 1200 {
+		t.Errorf("MinPathMTU = %d; want 1200", got)
+	}
+
+	// Nothing gets through; the heartbeats deal with that.
+	startRound(3, 2)
+	check([]step{
+		{ep, 3, 1024, false, 1200},
+		{ep, 3, 1200, false, 1200},
+	})
+
+	de.resetPMTULocked()
+	if got := c.MinPathMTU(); got != 0 {
+		t.Errorf("MinPathMTU after reset = %d; want 0", got)
+	}
+}
+
+func TestPortPredictionForeignIP(t *testing.T) {
+	ep := netaddr.MustParseIPPort("1.2.3.4:567")
+	de := &discoEndpoint{
+		c:             &Conn{logf: t.Logf},
+		endpointState: map[netaddr.IPPort]*endpointState{ep: {}},
+	}
+	if !de.hasEndpointIPLocked(ep.IP()) {
+		t.Fatalf("endpoint IP %v not known", ep.IP())
+	}
+
+	// A prediction naming some other host, which the peer could
+	// use to have us spray pings at it, is ignored.
+	de.handlePortPrediction(&disco.PortPrediction{
+		Last:  netaddr.MustParseIPPort("5.6.7.8:1000"),
+		Delta: 1,
+	})
+	if !de.lastSpray.IsZero() {
+		t.Error("sprayed at a foreign IP")
+	}
+}
+
+func TestPathHistory(t *testing.T) {
+	derpAddr := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	udpAddr := netaddr.MustParseIPPort("1.2.3.4:567")
+	st := &endpointState{}
+	de := &discoEndpoint{
+		c:             &Conn{logf: t.Logf},
+		derpAddr:      derpAddr,
+		endpointState: map[netaddr.IPPort]*endpointState{udpAddr: st},
+	}
+
+	de.notePathLocked(derpAddr, pathReasonStart)
+	de.bestAddr = addrLatency{IPPort: udpAddr, latency: 5 * time.Millisecond}
+	de.notePathLocked(udpAddr, pathReasonPong)
+	de.notePathLocked(udpAddr, pathReasonPong) // not a change
+	for i := 0; i < 4; i++ {
+		st.notePingResultLocked(i >= 1)
+	}
+	de.notePathLocked(derpAddr, pathReasonTimeout)
+
+	type change struct {
+		from, to netaddr.IPPort
+		reason   string
+		latency  time.Duration
+		loss     float64
+	}
+	var got []change
+	for _, pc := range de.pathHistory {
+		got = append(got, change{pc.from, pc.to, pc.reason, pc.latency, pc.loss})
+	}
+	want := []change{
+		{netaddr.IPPort{}, derpAddr, pathReasonStart, 0, 0},
+		{derpAddr, udpAddr, pathReasonPong, 5 * time.Millisecond, 0},
+		{udpAddr, derpAddr, pathReasonTimeout, 0, 0.75},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("history:\n got %+v\nwant %+v", got, want)
+	}
+
+	// The history is bounded, keeping the most recent changes.
+	for i := 0; i < pathHistoryLen; i++ {
+		de.notePathLocked(udpAddr, pathReasonPong)
+		de.notePathLocked(derpAddr, pathReasonTimeout)
+	}
+	if len(de.pathHistory) != pathHistoryLen {
+		t.Errorf("history has %d entries; want %d", len(de.pathHistory), pathHistoryLen)
+	}
+	if last := de.pathHistory[len(de.pathHistory)-1]; last.to != derpAddr {
+		t.Errorf("last change is to %v; want %v", last.to, derpAddr)
+	}
+}
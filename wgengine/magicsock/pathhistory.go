@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"math/bits"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+// pathHistoryLen is how many path changes we remember per peer.
+const pathHistoryLen = 32
+
+// Reasons for path changes, as reported in ipnstate.PathChange.
+const (
+	pathReasonStart           = "start"            // first path used
+	pathReasonPong            = "pong"             // a direct path was confirmed by a pong
+	pathReasonBetterPath      = "better-path"      // switched to a better direct path
+	pathReasonTimeout         = "timeout"          // no pong on the direct path in time
+	pathReasonEndpointRemoved = "endpoint-removed" // the direct path's endpoint went away
+	pathReasonReset           = "reset"            // the peer was removed or we stopped
+)
+
+// pathChange is a change of the path that packets to a peer take.
+type pathChange struct {
+	at       time.Time
+	from, to netaddr.IPPort // zero for none
+	reason   string
+	latency  time.Duration // of to, if measured
+	loss     float64       // recent ping loss on from
+}
+
+// curPathLocked returns the path that packets to de currently take:
+// its best UDP address if that's trusted, otherwise DERP, or zero if
+// neither.
+//
+// de.mu must be held.
+func (de *discoEndpoint) curPathLocked(now mono.Time) netaddr.IPPort {
+	udpAddr, derpAddr := de.addrForSendLocked(now)
+	if !derpAddr.IsZero() {
+		return derpAddr
+	}
+	return udpAddr
+}
+
+// notePathLocked records that packets to de now take path to, for the
+// given reason, if that's a change.
+//
+// de.mu must be held.
+func (de *discoEndpoint) notePathLocked(to netaddr.IPPort, reason string) {
+	if to == de.lastPath {
+		return
+	}
+	pc := pathChange{
+		at:     time.Now(),
+		from:   de.lastPath,
+		to:     to,
+		reason: reason,
+	}
+	if to == de.bestAddr.IPPort {
+		pc.latency = de.bestAddr.latency
+	}
+	if st, ok := de.endpointState[de.lastPath]; ok {
+		pc.loss = st.lossLocked()
+	}
+	de.lastPath = to
+	if len(de.pathHistory) == pathHistoryLen {
+		copy(de.pathHistory, de.pathHistory[1:])
+		de.pathHistory = de.pathHistory[:pathHistoryLen-1]
+	}
+	de.pathHistory = append(de.pathHistory, pc)
+}
+
+// notePingResultLocked records whether a ping to st's endpoint got a
+// pong back.
+//
+// de.mu must be held.
+func (st *endpointState) notePingResultLocked(lost bool) {
+	st.lostPings <<= 1
+	if lost {
+		st.lostPings |= 1
+	}
+	if st.numPings < 64 {
+		st.numPings++
+	}
+}
+
+// lossLocked returns the fraction of the recent pings to st's endpoint
+// that got no pong, or zero if there were none.
+//
+// de.mu must be held.
+func (st *endpointState) lossLocked() float64 {
+	if st.numPings == 0 {
+		return 0
+	}
+	return float64(bits.OnesCount64(st.lostPings)) / float64(st.numPings)
+}
+
+// PathHistory returns the recent changes of the path that packets to
+// the peer with public key k take, oldest first.
+func (c *Conn) PathHistory(k tailcfg.NodeKey) []ipnstate.PathChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	de, ok := c.endpointOfDisco[c.discoOfNode[k]]
+	if !ok {
+		return nil
+	}
+	de.mu.Lock()
+	hist := append([]pathChange(nil), de.pathHistory...)
+	de.mu.Unlock()
+
+	ret := make([]ipnstate.PathChange, 0, len(hist))
+	for _, pc := range hist {
+		ret = append(ret, ipnstate.PathChange{
+			Time:    pc.at,
+			From:    c.pathStringLocked(pc.from),
+			To:      c.pathStringLocked(pc.to),
+			Reason:  pc.reason,
+			Latency: pc.latency,
+			Loss:    pc.loss,
+		})
+	}
+	return ret
+}
+
+// pathStringLocked describes path addr for ipnstate.PathChange.
+//
+// c.mu must be held.
+func (c *Conn) pathStringLocked(addr netaddr.IPPort) string {
+	switch {
+	case addr.IsZero():
+		return ""
+	case addr.IP() == derpMagicIPAddr:
+		return derpStr(addr.String())
+	case addr.IP() == peerRelayMagicIPAddr:
+		return "peer-relay-" + c.peerRelayNameLocked(addr)
+	default:
+		return addr.String()
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+// Peer relays are tailnet nodes that offer (with Hostinfo.PeerRelay)
+// to forward UDP between other nodes that can't reach each other
+// directly, as a closer or faster alternative to DERP.
+//
+// Each peer relay is a candidate path to every other peer, at a fake
+// peerRelayMagicIP endpoint, and disco picks between it, DERP and
+// direct paths as usual, except that direct paths always win. The
+// relayed packets are WireGuard or disco packets, so the relay can't
+// read them.
+//
+// A relay frame, sent over UDP to or from the relay, is:
+//
+//  * magic   [6]byte ("TS🔁")
+//  * type    byte (relayFrameSend or relayFrameRecv)
+//  * nodeKey [32]byte, the destination for relayFrameSend or the
+//    source for relayFrameRecv
+//  * the relayed packet
+
+// relayMagic is the start of relay frames. Like disco.Magic, it can't
+// be the start of a WireGuard packet.
+const relayMagic = "TS🔁" // 6 bytes: 0x54 53 f0 9f 94 81
+
+// Relay frame types.
+const (
+	relayFrameSend = 1 // to a relay, to be forwarded
+	relayFrameRecv = 2 // from a relay, forwarded
+)
+
+const relayHeaderLen = len(relayMagic) + 1 + len(tailcfg.NodeKey{})
+
+// peerRelayMagicIP is a fake WireGuard endpoint IP address that means
+// to send through a peer relay. The port number of the endpoint
+// identifies the relay; see Conn.relayByPort.
+//
+// Mnemonic: it's one past DerpMagicIP.
+const peerRelayMagicIP = "127.3.3.41"
+
+var peerRelayMagicIPAddr = netaddr.MustParseIP(peerRelayMagicIP)
+
+// peerRelay is a peer that offers to relay for us.
+type peerRelay struct {
+	key  tailcfg.NodeKey
+	name string // for status and "tailscale ping"
+}
+
+// isDirectAddr reports whether ipp is a real UDP address, rather than
+// a fake DERP or peer relay one.
+func isDirectAddr(ipp netaddr.IPPort) bool {
+	ip := ipp.IP()
+	return !ipp.IsZero() && ip != derpMagicIPAddr && ip != peerRelayMagicIPAddr
+}
+
+func appendRelayHeader(b []byte, typ byte, k tailcfg.NodeKey) []byte {
+	b = append(b, relayMagic...)
+	b = append(b, typ)
+	return append(b, k[:]...)
+}
+
+// parseRelayFrame parses b as a relay frame, reporting whether it is
+// one.
+func parseRelayFrame(b []byte) (typ byte, k tailcfg.NodeKey, payload []byte, ok bool) {
+	if len(b) < relayHeaderLen || string(b[:len(relayMagic)]) != relayMagic {
+		return 0, k, nil, false
+	}
+	typ = b[len(relayMagic)]
+	copy(k[:], b[len(relayMagic)+1:])
+	return typ, k, b[relayHeaderLen:], true
+}
+
+// SetPeerRelay sets whether c relays UDP for other tailnet nodes that
+// send it relay frames. Whether peers do so is up to the
+// Hostinfo.PeerRelay that the caller advertises.
+func (c *Conn) SetPeerRelay(v bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerRelay == v {
+		return
+	}
+	c.peerRelay = v
+	c.logf("magicsock: peer relay enabled=%v", v)
+}
+
+// updatePeerRelaysLocked updates the set of peer relays from peers. A
+// relay keeps its fake address for as long as it's in the network
+// map; fake addresses aren't reused.
+//
+// c.mu must be held.
+func (c *Conn) updatePeerRelaysLocked(peers []*tailcfg.Node) {
+	if c.relayPort == nil {
+		c.relayPort = map[tailcfg.NodeKey]uint16{}
+		c.relayByPort = map[uint16]peerRelay{}
+	}
+	var addrs []netaddr.IPPort
+	seen := map[tailcfg.NodeKey]bool{}
+	for _, n := range peers {
+		if !n.Hostinfo.PeerRelay || n.DiscoKey.IsZero() {
+			continue
+		}
+		port, ok := c.relayPort[n.Key]
+		if !ok {
+			c.lastRelayPort++
+			port = c.lastRelayPort
+			c.relayPort[n.Key] = port
+		}
+		name := n.ComputedName
+		if name == "" {
+			name = n.Key.ShortString()
+		}
+		if !ok {
+			c.logf("[v1] magicsock: peer relay %v (%v) at %v:%d", name, n.Key.ShortString(), peerRelayMagicIP, port)
+		}
+		c.relayByPort[port] = peerRelay{key: n.Key, name: name}
+		seen[n.Key] = true
+		addrs = append(addrs, netaddr.IPPortFrom(peerRelayMagicIPAddr, port))
+	}
+	for k, port := range c.relayPort {
+		if !seen[k] {
+			delete(c.relayPort, k)
+			delete(c.relayByPort, port)
+		}
+	}
+	c.relayAddrs = addrs
+}
+
+// peerRelayNameLocked returns the name of the peer relay at fake
+// address addr, or the empty string if it's not one.
+//
+// c.mu must be held.
+func (c *Conn) peerRelayNameLocked(addr netaddr.IPPort) string {
+	if addr.IP() != peerRelayMagicIPAddr {
+		return ""
+	}
+	if r, ok := c.relayByPort[addr.Port()]; ok {
+		return r.name
+	}
+	return "unknown"
+}
+
+// sendPeerRelay sends packet b for the peer with public key dst
+// through the peer relay at fake address addr, over our direct path
+// to the relay. The return values are as for sendAddr.
+//
+// Using the relay keeps our session with it active, so disco finds
+// and maintains a direct path to it.
+func (c *Conn) sendPeerRelay(addr netaddr.IPPort, dst key.Public, b []byte) (sent bool, err error) {
+	c.mu.Lock()
+	r, ok := c.relayByPort[addr.Port()]
+	dk := c.discoOfNode[r.key]
+	de := c.endpointOfDisco[dk]
+	c.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if de == nil {
+		// The relay is an idle peer that isn't in the WireGuard
+		// config yet. Have it configured so we can disco with it,
+		// but not from here, as we may be called with wireguard-go
+		// locks held. Retransmits will make it through.
+		if c.noteRecvActivity != nil {
+			go c.noteRecvActivity(dk)
+		}
+		return false, nil
+	}
+
+	now := mono.Now()
+	de.mu.Lock()
+	relayAddr := de.bestAddr.IPPort
+	if relayAddr.IsZero() || now.After(de.trustBestAddrUntil) {
+		de.sendPingsLocked(now, true)
+	}
+	de.noteActiveLocked()
+	de.mu.Unlock()
+
+	if !isDirectAddr(relayAddr) {
+		// No direct path to the relay (yet).
+		return false, nil
+	}
+	pkt := make([]byte, 0, relayHeaderLen+len(b))
+	pkt = appendRelayHeader(pkt, relayFrameSend, tailcfg.NodeKey(dst))
+	pkt = append(pkt, b...)
+	return c.sendUDP(relayAddr, pkt)
+}
+
+// receivePeerRelay handles relay frame b, received from src. If it
+// holds a WireGuard packet relayed to us, the packet is moved to the
+// front of b, and its length and endpoint are returned. Otherwise n
+// is zero.
+func (c *Conn) receivePeerRelay(b []byte, src netaddr.IPPort) (n int, ep conn.Endpoint) {
+	typ, k, payload, _ := parseRelayFrame(b)
+	switch typ {
+	case relayFrameSend:
+		c.forwardPeerRelay(src, k, payload)
+		return 0, nil
+	case relayFrameRecv:
+	default:
+		return 0, nil
+	}
+
+	// Only accept frames from the direct path to a relay, and
+	// hand them up as coming from the relay's fake address.
+	c.mu.Lock()
+	relayNode := c.nodeOfDisco[c.discoOfAddr[src]]
+	var port uint16
+	var ok bool
+	if relayNode != nil {
+		port, ok = c.relayPort[relayNode.Key]
+	}
+	de := c.endpointOfDisco[c.discoOfNode[k]]
+	c.mu.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	if c.handleDiscoMessage(payload, netaddr.IPPortFrom(peerRelayMagicIPAddr, port), primarySock) {
+		return 0, nil
+	}
+	if de == nil || !c.havePrivateKey.Get() {
+		return 0, nil
+	}
+	n = copy(b, payload)
+	c.noteRecvActivityFromEndpoint(de)
+	return n, de
+}
+
+// forwardPeerRelay relays packet b from the peer at src to the peer
+// with node key dst, if we're a peer relay and have direct paths to
+// both of them.
+func (c *Conn) forwardPeerRelay(src netaddr.IPPort, dst tailcfg.NodeKey, b []byte) {
+	c.mu.Lock()
+	if !c.peerRelay || c.privateKey.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	srcNode := c.nodeOfDisco[c.discoOfAddr[src]]
+	var to netaddr.IPPort
+	if de, ok := c.endpointOfDisco[c.discoOfNode[dst]]; ok {
+		// The peer may not have answered any of our pings, but
+		// it's been pinging us from somewhere recently if it's
+		// using us as a relay.
+		if isDirectAddr(de.lastPingFrom) && time.Since(de.lastPingTime) < sessionActiveTimeout {
+			to = de.lastPingFrom
+		}
+		de.mu.Lock()
+		if isDirectAddr(de.bestAddr.IPPort) && mono.Now().Before(de.trustBestAddrUntil) {
+			to = de.bestAddr.IPPort
+		}
+		de.mu.Unlock()
+	}
+	c.mu.Unlock()
+	if srcNode == nil || to.IsZero() || to == src {
+		return
+	}
+
+	pkt := make([]byte, 0, relayHeaderLen+len(b))
+	pkt = appendRelayHeader(pkt, relayFrameRecv, srcNode.Key)
+	pkt = append(pkt, b...)
+	c.sendUDP(to, pkt)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+// Path MTU discovery.
+//
+// While a peer is active, we periodically probe its best UDP path
+// with disco pings padded to be as big on the wire as WireGuard
+// packets carrying inner packets of each of pmtuProbeSizes. The
+// biggest size that gets a pong back in a round of probes is the
+// path MTU. Sizes below tstun's MTU of 1280 catch paths that can't
+// even carry that, like PPPoE links inside other tunnels. tstun
+// clamps the MSS of TCP connections to peers with a smaller path MTU
+// than its own, and answers other packets that don't fit with ICMP
+// errors, so the sender's stack lowers its path MTU, rather than the
+// packets vanishing on the way.
+
+const (
+	// pmtuProbeInterval is how often we re-probe a path's MTU.
+	pmtuProbeInterval = 5 * time.Minute
+
+	// maxOuterMTU is the MTU of the links we expect to send over
+	// (Ethernet). We don't send probes bigger than it.
+	maxOuterMTU = 1500
+
+	// wgDataOverhead is how many bytes WireGuard adds to an inner
+	// packet: a 16 byte data message header and a 16 byte
+	// authentication tag.
+	wgDataOverhead = 32
+
+	// discoPingOverhead is the size of an unpadded disco ping in
+	// a UDP packet: magic, sender key, nonce, box overhead, message
+	// header and TxID.
+	discoPingOverhead = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen + box.Overhead + 2 + 12
+)
+
+// pmtuProbeSizes are the path MTUs we probe for, in increasing order.
+var pmtuProbeSizes = []int{1024, 1200, 1280, 1360, 1400, 1420, 1440}
+
+// pmtuProbePadding returns the disco ping padding needed to probe for
+// path MTU mtu.
+func pmtuProbePadding(mtu int) int {
+	return mtu + wgDataOverhead - discoPingOverhead
+}
+
+// pmtuOuterLen returns the size of the IP packet that probes for path
+// MTU mtu to ep.
+func pmtuOuterLen(ep netaddr.IPPort, mtu int) int {
+	const udpHeader = 8
+	ipHeader := 20
+	if ep.IP().Is6() {
+		ipHeader = 40
+	}
+	return ipHeader + udpHeader + wgDataOverhead + mtu
+}
+
+// wantPMTUProbeLocked reports whether it's time to probe the path MTU
+// of de's best UDP path.
+//
+// de.mu must be held.
+func (de *discoEndpoint) wantPMTUProbeLocked(now mono.Time) bool {
+	if debugDisablePMTU || !isDirectAddr(de.bestAddr.IPPort) || now.After(de.trustBestAddrUntil) {
+		return false
+	}
+	return de.lastPMTUProbe.IsZero() || now.Sub(de.lastPMTUProbe) >= pmtuProbeInterval
+}
+
+// startPMTUProbesLocked sends a round of path MTU probes to de's best
+// UDP path.
+//
+// de.mu must be held.
+func (de *discoEndpoint) startPMTUProbesLocked(now mono.Time) {
+	de.lastPMTUProbe = now
+	de.pmtuPending = 0
+	de.pmtuRoundMax = 0
+	ep := de.bestAddr.IPPort
+	if _, ok := de.endpointState[ep]; !ok {
+		return
+	}
+	for _, mtu := range pmtuProbeSizes {
+		if pmtuOuterLen(ep, mtu) > maxOuterMTU {
+			break
+		}
+		de.pmtuPending++
+		de.startPingLocked(de.bestAddr.sock, ep, now, pingPMTU, mtu)
+	}
+}
+
+// notePMTUProbeLocked updates de's path MTU with the outcome of probe
+// sp: whether we got a pong for it.
+//
+// A pong for a size bigger than the path MTU raises it right away.
+// Lost probes only lower it once all of the round's probes are
+// done, to the biggest size that got through, so one probe lost
+// along the way doesn't lower it if a bigger one made it.
+//
+// de.mu must be held.
+func (de *discoEndpoint) notePMTUProbeLocked(sp sentPing, ok bool) {
+	if sp.to != de.bestAddr.IPPort || sp.at != de.lastPMTUProbe || de.pmtuPending == 0 {
+		// A probe of a path we've since moved away from, or of
+		// an earlier round.
+		return
+	}
+	old := de.pathMTU
+	de.pmtuPending--
+	if ok {
+		if sp.size > de.pmtuRoundMax {
+			de.pmtuRoundMax = sp.size
+		}
+		if sp.size > de.pathMTU {
+			de.pathMTU = sp.size
+		}
+	}
+	if de.pmtuPending == 0 && de.pmtuRoundMax != 0 {
+		// If no probe at all made it, the path is likely down,
+		// which the heartbeats deal with; keep what we had.
+		de.pathMTU = de.pmtuRoundMax
+	}
+	if de.pathMTU != old {
+		de.c.logf("[v1] magicsock: disco: path MTU to %v (%v) via %v now %d", de.publicKey.ShortString(), de.discoShort, sp.to, de.pathMTU)
+		de.c.notePathMTU(de, de.pathMTU)
+	}
+}
+
+// resetPMTULocked forgets de's path MTU, when its best path changes.
+//
+// de.mu must be held.
+func (de *discoEndpoint) resetPMTULocked() {
+	if de.pathMTU != 0 {
+		de.c.notePathMTU(de, 0)
+	}
+	de.pathMTU = 0
+	de.lastPMTUProbe = 0
+	de.pmtuPending = 0
+	de.pmtuRoundMax = 0
+}
+
+// notePathMTU records that the path MTU to de is now mtu, or unknown
+// if zero.
+func (c *Conn) notePathMTU(de *discoEndpoint, mtu int) {
+	c.pmtuMu.Lock()
+	defer c.pmtuMu.Unlock()
+	if mtu == 0 {
+		delete(c.pathMTUs, de)
+	} else {
+		if c.pathMTUs == nil {
+			c.pathMTUs = map[*discoEndpoint]int{}
+		}
+		c.pathMTUs[de] = mtu
+	}
+	min := 0
+	for _, mtu := range c.pathMTUs {
+		if min == 0 || mtu < min {
+			min = mtu
+		}
+	}
+	c.minPathMTU.Set(uint32(min))
+}
+
+// MinPathMTU returns the smallest path MTU discovered for the direct
+// path to any peer, or zero if none is known. Packets no bigger than
+// it fit through any path, so callers can skip looking up the peer's.
+func (c *Conn) MinPathMTU() int {
+	return int(c.minPathMTU.Get())
+}
+
+// PathMTU returns the path MTU discovered for the direct path to the
+// peer with public key k, or zero if it's not known.
+func (c *Conn) PathMTU(k tailcfg.NodeKey) int {
+	c.mu.Lock()
+	de, ok := c.endpointOfDisco[c.discoOfNode[k]]
+	c.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	return de.pathMTU
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"inet.af/netaddr"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+// Extra local ports.
+//
+// Besides its primary port (Options.Port), a Conn can listen on
+// Options.ExtraPorts, for networks whose firewalls only let certain
+// ports through, or whose NATs rate-limit any one mapping. We
+// advertise endpoints on each port and send discovery pings to a
+// peer's direct endpoints from each, so the path to a peer is a pair
+// of a local socket and one of its endpoints. Packets from a peer are
+// accepted on any of them.
+//
+// Each extra port costs sockets, receive goroutines and discovery
+// pings, so there are at most MaxExtraPorts of them, and each round
+// of discovery pings from them is capped at maxExtraSockPings. We
+// only advertise an extra port's public endpoint once a STUN server
+// has seen it; ports forwarded where STUN can't see them can be
+// configured as static endpoints.
+//
+// Local sockets are identified by an index: primarySock is the
+// primary port, and sock i > 0 is c.extraSocks[i-1].
+
+// MaxExtraPorts is the most Options.ExtraPorts a Conn accepts.
+const MaxExtraPorts = 16
+
+// maxExtraSockPings is the most discovery pings a round sends to a
+// peer from the extra ports, on top of those from the primary port.
+const maxExtraSockPings = 16
+
+// primarySock is the index of the primary port's sockets.
+const primarySock = 0
+
+// extraSock is the IPv4 and IPv6 sockets of an extra port.
+type extraSock struct {
+	port           uint16
+	pconn4, pconn6 *RebindingUDPConn
+
+	// ippEndpoint4 and ippEndpoint6 are owned by the receive funcs
+	// of pconn4 and pconn6, like Conn.ippEndpoint4 and
+	// Conn.ippEndpoint6.
+	ippEndpoint4, ippEndpoint6 ippEndpointCache
+
+	// stunTxID is the transaction ID of the latest STUN request
+	// sent from pconn4, and mapped is the public endpoint that a
+	// STUN server last saw pconn4 as, if any. Both are guarded by
+	// Conn.mu.
+	stunTxID stun.TxID
+	mapped   netaddr.IPPort
+}
+
+// newExtraSocks returns the unbound extraSocks of ports, skipping
+// the primary port, zero and duplicates.
+func newExtraSocks(primary uint16, ports []uint16) []*extraSock {
+	seen := map[uint16]bool{0: true}
+	if primary != 0 {
+		seen[primary] = true
+	}
+	var socks []*extraSock
+	for _, port := range ports {
+		if seen[port] {
+			continue
+		}
+		seen[port] = true
+		socks = append(socks, &extraSock{
+			port:   port,
+			pconn4: new(RebindingUDPConn),
+			pconn6: new(RebindingUDPConn),
+		})
+	}
+	return socks
+}
+
+// numSocks returns how many local sockets (per address family) c has.
+func (c *Conn) numSocks() int {
+	return 1 + len(c.extraSocks)
+}
+
+// socketsOf returns the IPv4 and IPv6 sockets of the local socket sock.
+func (c *Conn) socketsOf(sock int) (pconn4, pconn6 *RebindingUDPConn) {
+	if sock == primarySock || sock > len(c.extraSocks) {
+		return c.pconn4, c.pconn6
+	}
+	es := c.extraSocks[sock-1]
+	return es.pconn4, es.pconn6
+}
+
+// sockSuffix returns a suffix for log messages about paths from the
+// local socket sock, naming its port if it's not the primary one.
+func (c *Conn) sockSuffix(sock int) string {
+	if sock == primarySock || sock > len(c.extraSocks) {
+		return ""
+	}
+	return fmt.Sprintf(" from port %d", c.extraSocks[sock-1].port)
+}
+
+// boundExtraPorts returns the extra ports that c's IPv4 sockets are
+// currently bound to.
+func (c *Conn) boundExtraPorts() []uint16 {
+	var ports []uint16
+	for _, es := range c.extraSocks {
+		if es.pconn4.LocalAddr().Port == int(es.port) {
+			ports = append(ports, es.port)
+		}
+	}
+	return ports
+}
+
+// extraSTUNEndpoints returns the public endpoints that STUN servers
+// have seen c's extra ports as.
+func (c *Conn) extraSTUNEndpoints() []netaddr.IPPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var eps []netaddr.IPPort
+	for _, es := range c.extraSocks {
+		if !es.mapped.IsZero() {
+			eps = append(eps, es.mapped)
+		}
+	}
+	return eps
+}
+
+// stunExtraSockets sends a STUN request from the IPv4 socket of each
+// of c's extra ports to a STUN server of the DERP region regionID.
+// The responses are handled by handleExtraSTUN.
+func (c *Conn) stunExtraSockets(regionID int) {
+	c.mu.Lock()
+	if len(c.extraSocks) == 0 || c.derpMap == nil {
+		c.mu.Unlock()
+		return
+	}
+	dst, ok := stunServer4(c.derpMap.Regions[regionID])
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	reqs := make([][]byte, len(c.extraSocks))
+	for i, es := range c.extraSocks {
+		es.stunTxID = stun.NewTxID()
+		reqs[i] = stun.Request(es.stunTxID)
+	}
+	c.mu.Unlock()
+
+	for i, es := range c.extraSocks {
+		if _, err := es.pconn4.WriteTo(reqs[i], dst.UDPAddr()); err != nil {
+			c.logf("[v1] magicsock: STUN from extra port %d: %v", es.port, err)
+		}
+	}
+}
+
+// stunServer4 returns the IPv4 STUN endpoint of the first node of r
+// that has one.
+func stunServer4(r *tailcfg.DERPRegion) (ipp netaddr.IPPort, ok bool) {
+	if r == nil {
+		return ipp, false
+	}
+	for _, n := range r.Nodes {
+		if n.STUNPort < 0 {
+			continue
+		}
+		addr := n.IPv4
+		if n.STUNTestIP != "" {
+			addr = n.STUNTestIP
+		}
+		ip, err := netaddr.ParseIP(addr)
+		if err != nil || !ip.Is4() {
+			continue
+		}
+		port := n.STUNPort
+		if port == 0 {
+			port = 3478
+		}
+		return netaddr.IPPortFrom(ip, uint16(port)), true
+	}
+	return ipp, false
+}
+
+// handleExtraSTUN handles the STUN packet b, which arrived on the
+// extra port sock. If it answers the latest request from the port
+// and shows a new mapping, it records it and redetermines c's
+// endpoints to advertise it.
+func (c *Conn) handleExtraSTUN(b []byte, sock int) {
+	txid, addr, port, err := stun.ParseResponse(b)
+	if err != nil {
+		return
+	}
+	ip, ok := netaddr.FromStdIP(net.IP(addr))
+	if !ok {
+		return
+	}
+	mapped := netaddr.IPPortFrom(ip, port)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sock == primarySock || sock > len(c.extraSocks) {
+		return
+	}
+	es := c.extraSocks[sock-1]
+	if txid != es.stunTxID || mapped == es.mapped {
+		return
+	}
+	c.logf("[v1] magicsock: extra port %d is mapped to %v", es.port, mapped)
+	es.mapped = mapped
+	go c.ReSTUN("extra-port-mapped")
+}
+
+// bindExtraSockets binds (or rebinds) the sockets of c's extra ports.
+// Failures are logged, but otherwise ignored: the extra ports are
+// only extra paths.
+func (c *Conn) bindExtraSockets() {
+	for _, es := range c.extraSocks {
+		if err := c.bindExtraSocket(es.pconn4, "udp4", es.port); err != nil {
+			c.logf("magicsock: %v", err)
+		}
+		if err := c.bindExtraSocket(es.pconn6, "udp6", es.port); err != nil {
+			c.logf("[v1] magicsock: ignoring extra port IPv6 bind failure: %v", err)
+		}
+	}
+}
+
+// bindExtraSocket binds ruc to port, closing any socket it had.
+// Unlike bindSocket, it doesn't fall back to other ports: an extra
+// port is only useful as configured.
+func (c *Conn) bindExtraSocket(ruc *RebindingUDPConn, network string, port uint16) error {
+	// Hold the ruc lock the entire time, so that the close+bind is atomic
+	// from the perspective of ruc receive functions.
+	ruc.mu.Lock()
+	defer ruc.mu.Unlock()
+
+	if err := ruc.closeLocked(); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, errNilPConn) {
+		c.logf("magicsock: bindExtraSocket %v close failed: %v", network, err)
+	}
+	if debugAlwaysDERP {
+		ruc.pconn = newBlockForeverConn()
+		return nil
+	}
+	pconn, err := c.listenPacket(network, c.bindHost(network), port)
+	if err != nil {
+		// As in bindSocket, keep the receive func alive until a
+		// later rebind.
+		ruc.pconn = newBlockForeverConn()
+		return fmt.Errorf("unable to bind extra %v port %d: %w", network, port, err)
+	}
+	ruc.pconn = pconn
+	return nil
+}
+
+// closeExtraSockets closes the sockets of c's extra ports,
+// unblocking their receive funcs.
+func (c *Conn) closeExtraSockets() {
+	for _, es := range c.extraSocks {
+		es.pconn4.Close()
+		es.pconn6.Close()
+	}
+}
+
+// extraReceiveFuncs returns the wireguard-go receive funcs of c's
+// extra ports.
+func (c *Conn) extraReceiveFuncs() []conn.ReceiveFunc {
+	var fns []conn.ReceiveFunc
+	for i, es := range c.extraSocks {
+		sock, es := i+1, es
+		fns = append(fns,
+			func(b []byte) (int, conn.Endpoint, error) {
+				return c.receiveExtra(b, sock, es.pconn4, &es.ippEndpoint4)
+			},
+			func(b []byte) (int, conn.Endpoint, error) {
+				return c.receiveExtra(b, sock, es.pconn6, &es.ippEndpoint6)
+			},
+		)
+	}
+	return fns
+}
+
+// receiveExtra receives a UDP packet on ruc, one of the sockets of
+// the extra port sock.
+func (c *Conn) receiveExtra(b []byte, sock int, ruc *RebindingUDPConn, cache *ippEndpointCache) (int, conn.Endpoint, error) {
+	for {
+		n, ipp, err := ruc.ReadFromNetaddr(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n, ep, ok := c.receiveIP(b[:n], ipp, sock, cache); ok {
+			return n, ep, nil
+		}
+	}
+}
@@ -41,6 +41,7 @@ import (
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/preftype"
 	"tailscale.com/types/wgkey"
 	"tailscale.com/util/deephash"
 	"tailscale.com/version"
@@ -142,6 +143,10 @@ func (e *userspaceEngine) GetInternals() (_ *tstun.Wrapper, _ *magicsock.Conn, o
 	return e.tundev, e.magicConn, true
 }
 
+// MaxExtraListenPorts is the most ports Config.ExtraListenPorts may
+// have.
+const MaxExtraListenPorts = magicsock.MaxExtraPorts
+
 // Config is the engine configuration.
 type Config struct {
 	// Tun is the device used by the Engine to exchange packets with
@@ -169,10 +174,19 @@ type Config struct {
 	// If zero, a port is automatically selected.
 	ListenPort uint16
 
+	// ExtraListenPorts are more ports on which the engine will
+	// listen, for peers that can't reach ListenPort. There may be
+	// at most MaxExtraListenPorts.
+	ExtraListenPorts []uint16
+
 	// RespondToPing determines whether this engine should internally
 	// reply to ICMP pings, without involving the OS.
 	// Used in "fake" mode for development.
 	RespondToPing bool
+
+	// DisableBatchIO disables reading and writing UDP packets in
+	// batches. It's meant for benchmarks.
+	DisableBatchIO bool
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -293,11 +307,13 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	magicsockOpts := magicsock.Options{
 		Logf:             logf,
 		Port:             conf.ListenPort,
+		ExtraPorts:       conf.ExtraListenPorts,
 		EndpointsFunc:    endpointsFn,
 		DERPActiveFunc:   e.RequestStatus,
 		IdleFunc:         e.tundev.IdleDuration,
 		NoteRecvActivity: e.noteReceiveActivity,
 		LinkMonitor:      e.linkMon,
+		DisableBatchIO:   conf.DisableBatchIO,
 	}
 
 	var err error
@@ -324,6 +340,13 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		e.tundev.PostFilterOut = e.trackOpenPostFilterOut
 	}
 
+	e.tundev.PeerMTU = e.peerMTU
+	e.tundev.MinPeerMTU = e.magicConn.MinPathMTU
+	e.tundev.IsLocalIP = func(ip netaddr.IP) bool {
+		isLocalAddr, ok := e.isLocalAddr.Load().(func(netaddr.IP) bool)
+		return ok && isLocalAddr(ip)
+	}
+
 	e.wgLogger = wglog.NewLogger(logf)
 	e.tundev.OnTSMPPongReceived = func(pong packet.TSMPPongReply) {
 		e.mu.Lock()
@@ -754,6 +777,33 @@ func (e *userspaceEngine) updateActivityMapsLocked(trackDisco []tailcfg.DiscoKey
 	e.tundev.SetDestIPActivityFuncs(e.destIPActivityFuncs)
 }
 
+// nat64PeerAddrs returns a map from the Tailscale IPv6 address of each
+// peer in nm with both kinds of Tailscale address to its Tailscale
+// IPv4 address, for tstun.Wrapper.SetNAT64. It's never nil.
+func nat64PeerAddrs(nm *netmap.NetworkMap) map[netaddr.IP]netaddr.IP {
+	ret := map[netaddr.IP]netaddr.IP{}
+	if nm == nil {
+		return ret
+	}
+	for _, p := range nm.Peers {
+		var ip4, ip6 netaddr.IP
+		for _, a := range p.Addresses {
+			if !a.IsSingleIP() || !tsaddr.IsTailscaleIP(a.IP()) {
+				continue
+			}
+			if a.IP().Is4() {
+				ip4 = a.IP()
+			} else {
+				ip6 = a.IP()
+			}
+		}
+		if !ip4.IsZero() && !ip6.IsZero() {
+			ret[ip6] = ip4
+		}
+	}
+	return ret
+}
+
 func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug) error {
 	if routerCfg == nil {
 		panic("routerCfg must not be nil")
@@ -764,6 +814,19 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(routerCfg.LocalAddrs))
 
+	// Subnet routers advertising the NAT64 range translate traffic
+	// to it themselves, rather than routing it.
+	var nat64Peers map[netaddr.IP]netaddr.IP
+	for _, r := range routerCfg.SubnetRoutes {
+		if r == tsaddr.TailscaleNAT64Range() {
+			e.mu.Lock()
+			nat64Peers = nat64PeerAddrs(e.netMap)
+			e.mu.Unlock()
+			break
+		}
+	}
+	e.tundev.SetNAT64(nat64Peers)
+
 	e.wgLock.Lock()
 	defer e.wgLock.Unlock()
 	e.lastDNSConfig = dnsCfg
@@ -1139,8 +1202,25 @@ func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
 	e.magicConn.SetDERPMap(dm)
 }
 
+func (e *userspaceEngine) SetStaticEndpoints(eps []netaddr.IPPort) {
+	e.magicConn.SetStaticEndpoints(eps)
+}
+
+func (e *userspaceEngine) SetPeerRelay(v bool) {
+	e.magicConn.SetPeerRelay(v)
+}
+
+func (e *userspaceEngine) SetQoS(enable bool, classes []preftype.QoSClass) {
+	e.tundev.SetQoS(enable, classes)
+}
+
+func (e *userspaceEngine) SetForwardRateLimit(bytesPerSec int64) {
+	e.tundev.SetForwardRateLimit(bytesPerSec)
+}
+
 func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	e.magicConn.SetNetworkMap(nm)
+	e.pruneForwardPeers(nm)
 	e.mu.Lock()
 	e.netMap = nm
 	callbacks := make([]NetworkMapCallback, 0, 4)
@@ -1153,6 +1233,10 @@ func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	}
 }
 
+func (e *userspaceEngine) GetResolver() (r *resolver.Resolver, ok bool) {
+	return e.dns.Resolver(), true
+}
+
 func (e *userspaceEngine) DiscoPublicKey() tailcfg.DiscoKey {
 	return e.magicConn.DiscoPublicKey()
 }
@@ -1171,10 +1255,80 @@ func (e *userspaceEngine) UpdateStatus(sb *ipnstate.StatusBuilder) {
 			InEngine:      true,
 		})
 	}
+	e.updateForwardStatus(sb)
+	e.updateQoSStatus(sb)
 
 	e.magicConn.UpdateStatus(sb)
 }
 
+// updateQoSStatus adds the stats of the QoS classes, if any, to sb.
+func (e *userspaceEngine) updateQoSStatus(sb *ipnstate.StatusBuilder) {
+	stats := e.tundev.QoSStats()
+	if len(stats) == 0 {
+		return
+	}
+	sb.MutateStatus(func(st *ipnstate.Status) {
+		for _, s := range stats {
+			st.QoS = append(st.QoS, ipnstate.QoSClassStatus{
+				Name:    s.Class,
+				Queued:  s.Queued,
+				Sent:    s.Sent,
+				Dropped: s.Dropped,
+			})
+		}
+	})
+}
+
+// updateForwardStatus adds the forwarding rate limit stats of each
+// peer, by its Tailscale IPs, to sb.
+func (e *userspaceEngine) updateForwardStatus(sb *ipnstate.StatusBuilder) {
+	stats := e.tundev.ForwardStats()
+	if len(stats) == 0 {
+		return
+	}
+	e.mu.Lock()
+	nm := e.netMap
+	e.mu.Unlock()
+	if nm == nil {
+		return
+	}
+	for _, p := range nm.Peers {
+		var ps ipnstate.PeerStatus
+		for _, a := range p.Addresses {
+			if !a.IsSingleIP() {
+				continue
+			}
+			st := stats[a.IP()]
+			ps.ForwardedBytes += st.Bytes
+			ps.ForwardDropped += st.Dropped
+		}
+		if ps.ForwardedBytes != 0 || ps.ForwardDropped != 0 {
+			sb.AddPeer(key.Public(p.Key), &ps)
+		}
+	}
+}
+
+// pruneForwardPeers forgets the forwarding rate limit state and stats
+// of Tailscale IPs that aren't those of a peer in nm.
+func (e *userspaceEngine) pruneForwardPeers(nm *netmap.NetworkMap) {
+	var peerIPs map[netaddr.IP]bool // built on first use
+	e.tundev.PruneForwardPeers(func(ip netaddr.IP) bool {
+		if peerIPs == nil {
+			peerIPs = map[netaddr.IP]bool{}
+			if nm != nil {
+				for _, p := range nm.Peers {
+					for _, a := range p.Addresses {
+						if a.IsSingleIP() {
+							peerIPs[a.IP()] = true
+						}
+					}
+				}
+			}
+		}
+		return peerIPs[ip]
+	})
+}
+
 func (e *userspaceEngine) Ping(ip netaddr.IP, useTSMP bool, cb func(*ipnstate.PingResult)) {
 	res := &ipnstate.PingResult{IP: ip.String()}
 	peer, err := e.peerForIP(ip)
@@ -1202,6 +1356,17 @@ func (e *userspaceEngine) Ping(ip netaddr.IP, useTSMP bool, cb func(*ipnstate.Pi
 	}
 }
 
+func (e *userspaceEngine) PathHistory(ip netaddr.IP) ([]ipnstate.PathChange, error) {
+	peer, err := e.peerForIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	if peer == nil {
+		return nil, errors.New("no matching peer")
+	}
+	return e.magicConn.PathHistory(peer.Key), nil
+}
+
 func (e *userspaceEngine) mySelfIPMatchingFamily(dst netaddr.IP) (src netaddr.IP, err error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -1323,6 +1488,16 @@ func (e *userspaceEngine) WhoIsIPPort(ipport netaddr.IPPort) (tsIP netaddr.IP, o
 	return tsIP, false
 }
 
+// peerMTU returns the path MTU that magicsock discovered to the peer
+// that packets to ip go to, or zero if it's unknown.
+func (e *userspaceEngine) peerMTU(ip netaddr.IP) int {
+	n, err := e.peerForIP(ip)
+	if n == nil || err != nil {
+		return 0
+	}
+	return e.magicConn.PathMTU(n.Key)
+}
+
 // peerForIP returns the Node in the wireguard config
 // that's responsible for handling the given IP address.
 //
@@ -15,9 +15,11 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
@@ -104,6 +106,18 @@ func (e *watchdogEngine) LinkChange(isExpensive bool) {
 func (e *watchdogEngine) SetDERPMap(m *tailcfg.DERPMap) {
 	e.watchdog("SetDERPMap", func() { e.wrap.SetDERPMap(m) })
 }
+func (e *watchdogEngine) SetStaticEndpoints(eps []netaddr.IPPort) {
+	e.watchdog("SetStaticEndpoints", func() { e.wrap.SetStaticEndpoints(eps) })
+}
+func (e *watchdogEngine) SetPeerRelay(v bool) {
+	e.watchdog("SetPeerRelay", func() { e.wrap.SetPeerRelay(v) })
+}
+func (e *watchdogEngine) SetQoS(enable bool, classes []preftype.QoSClass) {
+	e.watchdog("SetQoS", func() { e.wrap.SetQoS(enable, classes) })
+}
+func (e *watchdogEngine) SetForwardRateLimit(bytesPerSec int64) {
+	e.watchdog("SetForwardRateLimit", func() { e.wrap.SetForwardRateLimit(bytesPerSec) })
+}
 func (e *watchdogEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	e.watchdog("SetNetworkMap", func() { e.wrap.SetNetworkMap(nm) })
 }
@@ -119,6 +133,10 @@ func (e *watchdogEngine) DiscoPublicKey() (k tailcfg.DiscoKey) {
 func (e *watchdogEngine) Ping(ip netaddr.IP, useTSMP bool, cb func(*ipnstate.PingResult)) {
 	e.watchdog("Ping", func() { e.wrap.Ping(ip, useTSMP, cb) })
 }
+func (e *watchdogEngine) PathHistory(ip netaddr.IP) (hist []ipnstate.PathChange, err error) {
+	e.watchdog("PathHistory", func() { hist, err = e.wrap.PathHistory(ip) })
+	return hist, err
+}
 func (e *watchdogEngine) RegisterIPPortIdentity(ipp netaddr.IPPort, tsIP netaddr.IP) {
 	e.watchdog("RegisterIPPortIdentity", func() { e.wrap.RegisterIPPortIdentity(ipp, tsIP) })
 }
@@ -129,6 +147,9 @@ func (e *watchdogEngine) WhoIsIPPort(ipp netaddr.IPPort) (tsIP netaddr.IP, ok bo
 	e.watchdog("UnregisterIPPortIdentity", func() { tsIP, ok = e.wrap.WhoIsIPPort(ipp) })
 	return tsIP, ok
 }
+func (e *watchdogEngine) GetResolver() (r *resolver.Resolver, ok bool) {
+	return e.wrap.GetResolver()
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
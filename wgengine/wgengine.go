@@ -10,8 +10,10 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/dns/resolver"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/router"
@@ -115,6 +117,24 @@ type Engine interface {
 	// The network map should only be read from.
 	SetNetworkMap(*netmap.NetworkMap)
 
+	// SetStaticEndpoints sets ip:ports to advertise as this node's
+	// endpoints in addition to the discovered ones.
+	SetStaticEndpoints([]netaddr.IPPort)
+
+	// SetPeerRelay sets whether this node relays UDP traffic
+	// between peers that can't reach each other directly.
+	SetPeerRelay(bool)
+
+	// SetQoS sets whether to prioritize outbound traffic by class,
+	// and the classes that take priority over all other traffic, in
+	// order.
+	SetQoS(enable bool, classes []preftype.QoSClass)
+
+	// SetForwardRateLimit sets the rate, in bytes per second, at
+	// which this node forwards each peer's traffic as a subnet
+	// router or exit node. Zero means no limit.
+	SetForwardRateLimit(bytesPerSec int64)
+
 	// AddNetworkMapCallback adds a function to a list of callbacks
 	// that are called when the network map updates. It returns a
 	// function that when called would remove the function from the
@@ -137,6 +157,10 @@ type Engine interface {
 	// the given IP and then call cb with its ping latency & method.
 	Ping(ip netaddr.IP, useTSMP bool, cb func(*ipnstate.PingResult))
 
+	// PathHistory returns the recent changes of the network path
+	// to the peer handling the given IP, oldest first.
+	PathHistory(ip netaddr.IP) ([]ipnstate.PathChange, error)
+
 	// RegisterIPPortIdentity registers a given node (identified by its
 	// Tailscale IP) as temporarily having the given IP:port for whois lookups.
 	// The IP:port is generally a localhost IP and an ephemeral port, used
@@ -149,4 +173,8 @@ type Engine interface {
 	// WhoIsIPPort looks up an IP:port in the temporary registrations,
 	// and returns a matching Tailscale IP, if it exists.
 	WhoIsIPPort(netaddr.IPPort) (netaddr.IP, bool)
+
+	// GetResolver returns the engine's internal DNS resolver
+	// (the one listening on 100.100.100.100), if it has one.
+	GetResolver() (r *resolver.Resolver, ok bool)
 }